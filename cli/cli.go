@@ -0,0 +1,543 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cli implements the subcommands of the provisioner binary for
+// inspecting and repairing the exports of provisioned volumes offline, i.e.
+// against the export directories and the exporters' config files rather than a
+// running controller, optionally together with the API server.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	vol "github.com/wongma7/nfs-provisioner/volume"
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// The annotation the controller sets on the PVs it provisions to the name of
+// the provisioner.
+const annDynamicallyProvisioned = "pv.kubernetes.io/provisioned-by"
+
+// Env is what the subcommands work against.
+type Env struct {
+	// Managers are the export managers of the provisioners by name.
+	Managers map[string]*vol.ExportManager
+	// Client is a client of the API server, or nil to work offline, in which
+	// case the subcommands can't tell which exports belong to PVs.
+	Client kubernetes.Interface
+	// Server is how the provisioners choose the NFS server address to put in
+	// PVs.
+	Server vol.ServerAddress
+	// AllowEphemeral is whether the provisioners may serve export directories
+	// on storage that doesn't outlive the pod.
+	AllowEphemeral bool
+	// Out is where the subcommands write their output.
+	Out io.Writer
+}
+
+type command struct {
+	name  string
+	usage string
+	help  string
+	// needsClient is whether the command can't work offline.
+	needsClient bool
+	run         func(env *Env, flags *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{
+		name:  "preflight",
+		usage: "preflight",
+		help:  "Check the export directories, exporters and NFS server address the way the provisioner does before it starts. Exits non-zero if any problem is fatal.",
+		run:   preflight,
+	},
+	{
+		name:  "list-exports",
+		usage: "list-exports",
+		help:  "List the exports in the exporters' config files with their directories, live state and PVs.",
+		run:   listExports,
+	},
+	{
+		name:  "describe",
+		usage: "describe <pv> | describe <namespace>/<claim>",
+		help:  "Show a volume's PV, claim, export block, directory and live export. Offline, <pv> is the last element of the volume's path.",
+		run:   describe,
+	},
+	{
+		name:  "verify",
+		usage: "verify",
+		help:  "Check that the config files, export directories, live exports and PVs agree. Exits non-zero if they don't.",
+		run:   verify,
+	},
+	{
+		name:        "gc",
+		usage:       "gc [-confirm] [-delete-data]",
+		help:        "Remove the exports that have no PV. Only lists them unless -confirm is given. With -delete-data, removes their directories too.",
+		needsClient: true,
+		run:         gc,
+	},
+	{
+		name:        "rebuild-config",
+		usage:       "rebuild-config [-write]",
+		help:        "Rebuild the exporters' config files from the export blocks recorded on the PVs. Prints them unless -write is given, which replaces them, keeping a .bak copy.",
+		needsClient: true,
+		run:         rebuildConfig,
+	},
+}
+
+// IsCommand returns whether there is a subcommand of the given name.
+func IsCommand(name string) bool {
+	for _, c := range commands {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Usage writes the usage of the subcommands to the given writer.
+func Usage(w io.Writer) {
+	fmt.Fprintf(w, "Commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s\n    \t%s\n", c.usage, c.help)
+	}
+}
+
+// Run runs the subcommand named by the first of the given arguments with the
+// rest.
+func Run(env *Env, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command given")
+	}
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		if c.needsClient && env.Client == nil {
+			return fmt.Errorf("%s needs the API server, see the master and kubeconfig flags", c.name)
+		}
+		flags := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		flags.SetOutput(env.Out)
+		return c.run(env, flags, args[1:])
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// names returns the names of the provisioners in the given environment, sorted.
+func (env *Env) names() []string {
+	names := []string{}
+	for name := range env.Managers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// volumes returns the PVs of the provisioner of the given name by path, or nil
+// if offline.
+func (env *Env) volumes(name string) (map[string]*v1.PersistentVolume, error) {
+	if env.Client == nil {
+		return nil, nil
+	}
+	list, err := env.Client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing PVs: %v", err)
+	}
+	volumes := make(map[string]*v1.PersistentVolume)
+	for i := range list.Items {
+		volume := &list.Items[i]
+		if volume.Annotations[annDynamicallyProvisioned] != name || volume.Spec.NFS == nil {
+			continue
+		}
+		volumes[volume.Spec.NFS.Path] = volume
+	}
+	return volumes, nil
+}
+
+// liveExports returns the paths the NFS server is exporting by exportId, or
+// nil if the exporter can't tell. An error getting them is written to the
+// output rather than returned, since the NFS server may just not be running.
+func (env *Env) liveExports(manager *vol.ExportManager) map[uint16]string {
+	live, ok, err := manager.LiveExports()
+	if !ok {
+		return nil
+	}
+	if err != nil {
+		fmt.Fprintf(env.Out, "warning: can't get live exports of %s: %v\n", manager.Config(), err)
+		return nil
+	}
+	return live
+}
+
+func preflight(env *Env, flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	fatal := false
+	for _, name := range env.names() {
+		checks := env.Managers[name].Preflight(env.Client, env.Server, env.AllowEphemeral)
+		if err := WritePreflightReport(env.Out, name, checks); err != nil {
+			return err
+		}
+		fatal = fatal || vol.Fatal(checks)
+	}
+	if fatal {
+		return fmt.Errorf("fatal problems found")
+	}
+	return nil
+}
+
+// WritePreflightReport writes the results of the preflight checks of the
+// provisioner of the given name to the given writer.
+func WritePreflightReport(w io.Writer, name string, checks []vol.Check) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s:\n", name)
+	for _, check := range checks {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", check.Status, check.Name, check.Message)
+	}
+	return tw.Flush()
+}
+
+func listExports(env *Env, flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(env.Out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "PROVISIONER\tEXPORT ID\tPATH\tDIRECTORY\tLIVE\tPV\n")
+	for _, name := range env.names() {
+		manager := env.Managers[name]
+		exports, err := manager.Exports()
+		if err != nil {
+			return fmt.Errorf("error reading exports of %s: %v", name, err)
+		}
+		volumes, err := env.volumes(name)
+		if err != nil {
+			return err
+		}
+		live := env.liveExports(manager)
+		for _, export := range exports {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", name, export.ExportId, export.Path, directoryState(manager, export.Path), liveState(live, export), pvName(env, volumes, export.Path))
+		}
+	}
+	return w.Flush()
+}
+
+func directoryState(manager *vol.ExportManager, path string) string {
+	if !manager.DirectoryExists(path) {
+		return "missing"
+	}
+	return "exists"
+}
+
+func liveState(live map[uint16]string, export vol.Export) string {
+	if live == nil {
+		return "unknown"
+	}
+	if live[export.ExportId] == export.Path {
+		return "yes"
+	}
+	return "no"
+}
+
+func pvName(env *Env, volumes map[string]*v1.PersistentVolume, path string) string {
+	if env.Client == nil {
+		return "unknown"
+	}
+	if volume, ok := volumes[path]; ok {
+		return volume.Name
+	}
+	return "none"
+}
+
+func describe(env *Env, flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: describe <pv> | describe <namespace>/<claim>")
+	}
+	arg := flags.Arg(0)
+
+	var volume *v1.PersistentVolume
+	claim := ""
+	if env.Client != nil {
+		name := arg
+		if parts := strings.SplitN(arg, "/", 2); len(parts) == 2 {
+			c, err := env.Client.Core().PersistentVolumeClaims(parts[0]).Get(parts[1])
+			if err != nil {
+				return fmt.Errorf("error getting claim %s: %v", arg, err)
+			}
+			if c.Spec.VolumeName == "" {
+				return fmt.Errorf("claim %s is not bound to a PV", arg)
+			}
+			name = c.Spec.VolumeName
+		}
+		v, err := env.Client.Core().PersistentVolumes().Get(name)
+		if err != nil {
+			return fmt.Errorf("error getting PV %s: %v", name, err)
+		}
+		volume = v
+		if ref := volume.Spec.ClaimRef; ref != nil {
+			claim = ref.Namespace + "/" + ref.Name
+		}
+	}
+
+	// Find the volume's export and provisioner, by its PV's path if online or
+	// else by the last element of the path
+	for _, name := range env.names() {
+		manager := env.Managers[name]
+		exports, err := manager.Exports()
+		if err != nil {
+			return fmt.Errorf("error reading exports of %s: %v", name, err)
+		}
+		var export *vol.Export
+		if volume != nil {
+			if volume.Annotations[annDynamicallyProvisioned] != name {
+				continue
+			}
+			if recorded, ok := vol.ExportOf(volume); ok {
+				export = &recorded
+			}
+		} else {
+			for i := range exports {
+				if path.Base(exports[i].Path) == arg && manager.InExportDir(exports[i].Path) {
+					export = &exports[i]
+					break
+				}
+			}
+			if export == nil {
+				continue
+			}
+		}
+		return writeDescription(env, name, manager, volume, claim, export, exports)
+	}
+	if volume != nil {
+		return fmt.Errorf("PV %s was not provisioned by any of %s", volume.Name, strings.Join(env.names(), ", "))
+	}
+	return fmt.Errorf("no export with path ending in %s found", arg)
+}
+
+// writeDescription writes what is known about the given volume: its PV and
+// claim, if online, the export recorded on the PV or found in the config file,
+// and whether the export is in the config file and live.
+func writeDescription(env *Env, name string, manager *vol.ExportManager, volume *v1.PersistentVolume, claim string, export *vol.Export, exports []vol.Export) error {
+	w := tabwriter.NewWriter(env.Out, 0, 8, 1, ' ', 0)
+	if volume != nil {
+		fmt.Fprintf(w, "PV:\t%s\n", volume.Name)
+		fmt.Fprintf(w, "Claim:\t%s\n", claim)
+		fmt.Fprintf(w, "Phase:\t%s\n", volume.Status.Phase)
+	}
+	fmt.Fprintf(w, "Provisioner:\t%s\n", name)
+	if export == nil {
+		fmt.Fprintf(w, "Export:\tnone recorded on the PV\n")
+		return w.Flush()
+	}
+	fmt.Fprintf(w, "Export ID:\t%d\n", export.ExportId)
+	directory := directoryState(manager, export.Path)
+	if usage, err := directoryUsage(manager, export.Path); err == nil {
+		directory = fmt.Sprintf("%s, %d bytes used", directory, usage)
+	}
+	fmt.Fprintf(w, "Directory:\t%s (%s)\n", export.Path, directory)
+	inConfig := "no"
+	for _, e := range exports {
+		if e.Block == export.Block {
+			inConfig = "yes"
+		}
+	}
+	fmt.Fprintf(w, "In config:\t%s (%s)\n", inConfig, manager.Config())
+	fmt.Fprintf(w, "Live:\t%s\n", liveState(env.liveExports(manager), *export))
+	fmt.Fprintf(w, "Export block:\n%s\n", export.Block)
+	return w.Flush()
+}
+
+// directoryUsage returns the size of the files in the directory at the given
+// path.
+func directoryUsage(manager *vol.ExportManager, path string) (int64, error) {
+	info, err := manager.Inspect(&v1.PersistentVolume{
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{Path: path},
+			},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.UsedBytes, nil
+}
+
+func verify(env *Env, flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	problems := 0
+	report := func(format string, a ...interface{}) {
+		problems++
+		fmt.Fprintf(env.Out, format+"\n", a...)
+	}
+	for _, name := range env.names() {
+		manager := env.Managers[name]
+		exports, err := manager.Exports()
+		if err != nil {
+			return fmt.Errorf("error reading exports of %s: %v", name, err)
+		}
+		volumes, err := env.volumes(name)
+		if err != nil {
+			return err
+		}
+		live := env.liveExports(manager)
+
+		paths := make(map[string]bool)
+		ids := make(map[uint16]string)
+		for _, export := range exports {
+			paths[export.Path] = true
+			if other, ok := ids[export.ExportId]; ok {
+				report("%s: export ID %d of %s is also used by %s", name, export.ExportId, export.Path, other)
+			}
+			ids[export.ExportId] = export.Path
+			if directoryState(manager, export.Path) == "missing" {
+				report("%s: directory %s of export %d is missing", name, export.Path, export.ExportId)
+			}
+			if live != nil && live[export.ExportId] != export.Path {
+				report("%s: export %d of %s is in %s but not live", name, export.ExportId, export.Path, manager.Config())
+			}
+			if volumes != nil && volumes[export.Path] == nil {
+				report("%s: export %d of %s has no PV", name, export.ExportId, export.Path)
+			}
+		}
+		for id, path := range live {
+			if manager.InExportDir(path) && !paths[path] {
+				report("%s: live export %d of %s is not in %s", name, id, path, manager.Config())
+			}
+		}
+		for path, volume := range volumes {
+			if !paths[path] {
+				report("%s: PV %s's export of %s is not in %s", name, volume.Name, path, manager.Config())
+			}
+			if directoryState(manager, path) == "missing" {
+				report("%s: PV %s's directory %s is missing", name, volume.Name, path)
+			}
+		}
+	}
+	if problems != 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	fmt.Fprintf(env.Out, "no problems found\n")
+	return nil
+}
+
+func gc(env *Env, flags *flag.FlagSet, args []string) error {
+	confirm := flags.Bool("confirm", false, "Remove the exports rather than only list them.")
+	deleteData := flags.Bool("delete-data", false, "Remove the directories of the exports too.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	for _, name := range env.names() {
+		manager := env.Managers[name]
+		exports, err := manager.Exports()
+		if err != nil {
+			return fmt.Errorf("error reading exports of %s: %v", name, err)
+		}
+		volumes, err := env.volumes(name)
+		if err != nil {
+			return err
+		}
+		for _, export := range exports {
+			if volumes[export.Path] != nil {
+				continue
+			}
+			if !*confirm {
+				fmt.Fprintf(env.Out, "%s: would remove export %d of %s\n", name, export.ExportId, export.Path)
+				continue
+			}
+			fmt.Fprintf(env.Out, "%s: removing export %d of %s\n", name, export.ExportId, export.Path)
+			if err := manager.RemoveExport(export); err != nil {
+				return err
+			}
+			if *deleteData {
+				fmt.Fprintf(env.Out, "%s: removing directory %s\n", name, export.Path)
+				if err := manager.RemoveDirectory(export.Path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func rebuildConfig(env *Env, flags *flag.FlagSet, args []string) error {
+	write := flags.Bool("write", false, "Replace the config files rather than print them.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// Provisioners may share a config file, so rebuild each file once with
+	// the PVs of all of them
+	configs := []string{}
+	managers := make(map[string][]string)
+	for _, name := range env.names() {
+		config := env.Managers[name].Config()
+		if _, ok := managers[config]; !ok {
+			configs = append(configs, config)
+		}
+		managers[config] = append(managers[config], name)
+	}
+	for _, config := range configs {
+		read, err := ioutil.ReadFile(config)
+		if err != nil {
+			return err
+		}
+		rebuilt := string(read)
+		for _, name := range managers[config] {
+			volumes, err := env.volumes(name)
+			if err != nil {
+				return err
+			}
+			list := []*v1.PersistentVolume{}
+			for _, volume := range volumes {
+				list = append(list, volume)
+			}
+			if rebuilt, err = env.Managers[name].RebuildConfig(rebuilt, list); err != nil {
+				return err
+			}
+		}
+		if !*write {
+			fmt.Fprintf(env.Out, "# %s\n%s\n", config, rebuilt)
+			continue
+		}
+		if rebuilt == string(read) {
+			fmt.Fprintf(env.Out, "%s is up to date\n", config)
+			continue
+		}
+		if err := ioutil.WriteFile(config+".bak", read, 0600); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(config, []byte(rebuilt), 0600); err != nil {
+			return err
+		}
+		fmt.Fprintf(env.Out, "rebuilt %s, the previous contents are in %s.bak. Restart or reload the NFS server for it to take effect.\n", config, config)
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	vol "github.com/wongma7/nfs-provisioner/volume"
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+const provisionerName = "example.com/nfs"
+
+// testExporter is a kernel exporter that doesn't run exportfs.
+type testExporter struct {
+	vol.Exporter
+}
+
+func (e *testExporter) Export(_ string) error {
+	return nil
+}
+
+func (e *testExporter) Unexport(_ *v1.PersistentVolume) error {
+	return nil
+}
+
+func (e *testExporter) ParseExports(config string) []vol.Export {
+	return e.Exporter.(vol.ExportParser).ParseExports(config)
+}
+
+// setup creates an export directory with a config file exporting:
+// pvc-1, whose directory and PV exist; pvc-2, whose directory exists but PV
+// doesn't; and pvc-3, whose PV exists but directory doesn't. The PV of pvc-4
+// and its directory exist but its export isn't in the config file.
+func setup(t *testing.T) (tmpDir, config string, volumes []runtime.Object) {
+	tmpDir = utiltesting.MkTmpdirOrDie("cliTest")
+	exporter, _ := vol.NewExporter("kernel", "")
+	config = path.Join(tmpDir, "exports")
+	contents := "/srv *(rw)\n"
+	for i, name := range []string{"pvc-1", "pvc-2", "pvc-3", "pvc-4"} {
+		id := strconv.Itoa(i + 1)
+		p := path.Join(tmpDir, "export", name)
+		block := exporter.CreateBlock(id, p, false, nil)
+		if name != "pvc-3" {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatalf("error creating directory %s: %v", p, err)
+			}
+		}
+		if name != "pvc-4" {
+			contents += block
+		}
+		if name != "pvc-2" {
+			volumes = append(volumes, newVolume(name, p, id, block))
+		}
+	}
+	if err := ioutil.WriteFile(config, []byte(contents), 0600); err != nil {
+		t.Fatalf("error writing config file: %v", err)
+	}
+	return tmpDir, config, volumes
+}
+
+func newVolume(name, path, exportId, block string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				annDynamicallyProvisioned: provisionerName,
+				"Export_Id":               exportId,
+				"EXPORT_block":            block,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{Path: path},
+			},
+			ClaimRef: &v1.ObjectReference{Namespace: "default", Name: "claim-" + name},
+		},
+	}
+}
+
+func newClaim(name, volumeName string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: volumeName},
+	}
+}
+
+func newEnv(tmpDir, config string, client kubernetes.Interface) (*Env, *bytes.Buffer) {
+	exporter, _ := vol.NewExporter("kernel", config)
+	out := &bytes.Buffer{}
+	return &Env{
+		Managers: map[string]*vol.ExportManager{
+			provisionerName: vol.NewExportManager(path.Join(tmpDir, "export")+"/", &testExporter{exporter}),
+		},
+		Client: client,
+		Server: vol.ServerAddress{Address: "nfs.example.com"},
+		// Whether tmpDir is ephemeral depends on where the tests run
+		AllowEphemeral: true,
+		Out:            out,
+	}, out
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name             string
+		args             []string
+		offline          bool
+		expectedOutput   []string
+		unexpectedOutput []string
+		expectError      bool
+	}{
+		{
+			name:           "preflight",
+			args:           []string{"preflight"},
+			expectedOutput: []string{"example.com/nfs:", "ok  export directory", "ok  server address    using nfs.example.com"},
+			expectError:    false,
+		},
+		{
+			name:             "list-exports",
+			args:             []string{"list-exports"},
+			expectedOutput:   []string{"pvc-1  exists     unknown  pvc-1", "pvc-2  exists     unknown  none", "pvc-3  missing    unknown  pvc-3"},
+			unexpectedOutput: []string{"/srv", "pvc-4"},
+			expectError:      false,
+		},
+		{
+			name:           "list-exports offline",
+			args:           []string{"list-exports"},
+			offline:        true,
+			expectedOutput: []string{"pvc-2  exists     unknown  unknown"},
+			expectError:    false,
+		},
+		{
+			name:           "describe pv",
+			args:           []string{"describe", "pvc-1"},
+			expectedOutput: []string{"PV:          pvc-1", "Claim:       default/claim-pvc-1", "Export ID:   1", "In config:   yes"},
+			expectError:    false,
+		},
+		{
+			name:           "describe claim",
+			args:           []string{"describe", "default/claim-pvc-4"},
+			expectedOutput: []string{"PV:          pvc-4", "Export ID:   4", "In config:   no"},
+			expectError:    false,
+		},
+		{
+			name:           "describe unbound claim",
+			args:           []string{"describe", "default/unbound"},
+			expectedOutput: []string{},
+			expectError:    true,
+		},
+		{
+			name:             "describe offline",
+			args:             []string{"describe", "pvc-2"},
+			offline:          true,
+			expectedOutput:   []string{"Export ID:   2", "exists, 0 bytes used"},
+			unexpectedOutput: []string{"PV:"},
+			expectError:      false,
+		},
+		{
+			name:           "describe offline unknown",
+			args:           []string{"describe", "pvc-4"},
+			offline:        true,
+			expectedOutput: []string{},
+			expectError:    true,
+		},
+		{
+			name: "verify",
+			args: []string{"verify"},
+			expectedOutput: []string{
+				"/export/pvc-2 has no PV",
+				"/export/pvc-3 of export 3 is missing",
+				"PV pvc-4's export of ",
+				"PV pvc-3's directory ",
+			},
+			expectError: true,
+		},
+		{
+			name:             "verify offline",
+			args:             []string{"verify"},
+			offline:          true,
+			expectedOutput:   []string{"/export/pvc-3 of export 3 is missing"},
+			unexpectedOutput: []string{"has no PV", "pvc-4"},
+			expectError:      true,
+		},
+		{
+			name:             "gc without confirm",
+			args:             []string{"gc"},
+			expectedOutput:   []string{"would remove export 2 of "},
+			unexpectedOutput: []string{"pvc-1", "pvc-3"},
+			expectError:      false,
+		},
+		{
+			name:           "gc offline",
+			args:           []string{"gc"},
+			offline:        true,
+			expectedOutput: []string{},
+			expectError:    true,
+		},
+		{
+			name:           "unknown command",
+			args:           []string{"foo"},
+			expectedOutput: []string{},
+			expectError:    true,
+		},
+		{
+			name:           "bad flag",
+			args:           []string{"gc", "-foo"},
+			expectedOutput: []string{},
+			expectError:    true,
+		},
+	}
+	for _, test := range tests {
+		tmpDir, config, volumes := setup(t)
+		objects := append(volumes, newClaim("claim-pvc-4", "pvc-4"), newClaim("unbound", ""))
+		var client kubernetes.Interface = fake.NewSimpleClientset(objects...)
+		if test.offline {
+			client = nil
+		}
+		env, out := newEnv(tmpDir, config, client)
+
+		err := Run(env, test.args)
+		if !test.expectError && err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error running %v: %v", test.args, err)
+		} else if test.expectError && err == nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error running %v but got none", test.args)
+		}
+		for _, s := range test.expectedOutput {
+			if !strings.Contains(out.String(), s) {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected output to contain %q but got:\n%s", s, out.String())
+			}
+		}
+		for _, s := range test.unexpectedOutput {
+			if strings.Contains(out.String(), s) {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected output not to contain %q but got:\n%s", s, out.String())
+			}
+		}
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestGC(t *testing.T) {
+	tests := []struct {
+		name            string
+		args            []string
+		expectedRemoved bool
+	}{
+		{
+			name:            "keep data",
+			args:            []string{"gc", "-confirm"},
+			expectedRemoved: false,
+		},
+		{
+			name:            "delete data",
+			args:            []string{"gc", "-confirm", "-delete-data"},
+			expectedRemoved: true,
+		},
+	}
+	for _, test := range tests {
+		tmpDir, config, volumes := setup(t)
+		env, _ := newEnv(tmpDir, config, fake.NewSimpleClientset(volumes...))
+		manager := env.Managers[provisionerName]
+
+		if err := Run(env, test.args); err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error running %v: %v", test.args, err)
+		}
+		exports, _ := manager.Exports()
+		paths := []string{}
+		for _, export := range exports {
+			paths = append(paths, path.Base(export.Path))
+		}
+		if strings.Join(paths, ",") != "pvc-1,pvc-3" {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected exports of pvc-1,pvc-3 but got %v", paths)
+		}
+		read, _ := ioutil.ReadFile(config)
+		if !strings.HasPrefix(string(read), "/srv *(rw)\n") {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected config file to keep other exports but got:\n%s", read)
+		}
+		_, err := os.Stat(path.Join(tmpDir, "export", "pvc-2"))
+		if removed := os.IsNotExist(err); removed != test.expectedRemoved {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected directory removed %v but got %v", test.expectedRemoved, removed)
+		}
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestRebuildConfig(t *testing.T) {
+	tmpDir, config, volumes := setup(t)
+	defer os.RemoveAll(tmpDir)
+	env, out := newEnv(tmpDir, config, fake.NewSimpleClientset(volumes...))
+	original, _ := ioutil.ReadFile(config)
+
+	if err := Run(env, []string{"rebuild-config"}); err != nil {
+		t.Fatalf("unexpected error rebuilding config: %v", err)
+	}
+	printed := out.String()
+	if read, _ := ioutil.ReadFile(config); !bytes.Equal(original, read) {
+		t.Errorf("expected config file unchanged without -write but got:\n%s", read)
+	}
+
+	if err := Run(env, []string{"rebuild-config", "-write"}); err != nil {
+		t.Fatalf("unexpected error rebuilding config: %v", err)
+	}
+	read, _ := ioutil.ReadFile(config)
+	if !strings.Contains(printed, string(read)) {
+		t.Errorf("expected written config file to be the printed one %q but got %q", printed, read)
+	}
+	exports, _ := env.Managers[provisionerName].Exports()
+	paths := []string{}
+	for _, export := range exports {
+		paths = append(paths, path.Base(export.Path))
+	}
+	if strings.Join(paths, ",") != "pvc-1,pvc-3,pvc-4" {
+		t.Errorf("expected exports of pvc-1,pvc-3,pvc-4 but got %v", paths)
+	}
+	if backup, _ := ioutil.ReadFile(config + ".bak"); !bytes.Equal(original, backup) {
+		t.Errorf("expected backup %q but got %q", original, backup)
+	}
+}
@@ -0,0 +1,335 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	vol "github.com/wongma7/nfs-provisioner/volume"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/labels"
+	"k8s.io/client-go/1.4/pkg/util/validation"
+	"k8s.io/client-go/1.4/pkg/util/wait"
+)
+
+// Config is the configuration of the provisioner. It is built from the flags
+// and, if one is given, a YAML config file whose settings take precedence.
+type Config struct {
+	// Provisioners are the provisioner names to serve, each with its own
+	// export directory. The first is the one named by the provisioner flag.
+	Provisioners []Provisioner `json:"provisioners"`
+	// Exporter is the name of the exporter of the provisioners that don't
+	// name their own.
+	Exporter string `json:"exporter"`
+	// Server is how the NFS server is run and addressed.
+	Server Server `json:"server"`
+	// Workers are the sizes of the worker pools.
+	Workers Workers `json:"workers"`
+	// Limits are the limits on operations. They can change without a
+	// restart.
+	Limits Limits `json:"limits"`
+	// LeaseDuration is the duration of the lease on a claim, or 0 for none.
+	LeaseDuration unversioned.Duration `json:"claimLeaseDuration"`
+	// Namespaces are the namespaces of the claims to provision volumes for, or
+	// empty for all.
+	Namespaces []string `json:"namespaces"`
+	// ClaimSelector is the label selector of the claims to provision volumes
+	// for, or empty for all.
+	ClaimSelector string `json:"claimSelector"`
+	// MetricsAddress is the address to serve metrics on, or empty for none.
+	MetricsAddress string `json:"metricsAddress"`
+	// HealthAddress is the address to serve /healthz on, or empty for none.
+	HealthAddress string `json:"healthAddress"`
+	// AdminAddress is the address to serve the admin API on, or empty for
+	// none. AdminTokenFile is the path of the file holding the token requests
+	// to the admin API must carry, required if AdminAddress is set.
+	AdminAddress   string `json:"adminAddress"`
+	AdminTokenFile string `json:"adminTokenFile"`
+	// LogLevel is the verbosity of the logs, like the v flag. It can change
+	// without a restart.
+	LogLevel int `json:"logLevel"`
+	// DryRun is whether to only report what the provisioner would do.
+	DryRun bool `json:"dryRun"`
+	// AllowEphemeral is whether the provisioners may serve export directories
+	// on storage that doesn't outlive the pod, like an emptyDir.
+	AllowEphemeral bool `json:"allowEphemeral"`
+}
+
+// Provisioner is a provisioner name to serve.
+type Provisioner struct {
+	Name      string `json:"name"`
+	ExportDir string `json:"exportDir"`
+	// Exporter is the name of the provisioner's exporter, or empty for the
+	// Config's.
+	Exporter string `json:"exporter,omitempty"`
+	// DefaultParameters are the default values of the StorageClass parameters
+	// of the provisioner's volumes, i.e. the default export options. They can
+	// change without a restart.
+	DefaultParameters map[string]string `json:"defaultParameters,omitempty"`
+}
+
+// Server is how the NFS server is run and addressed.
+type Server struct {
+	// Run is whether the provisioner runs NFS Ganesha itself.
+	Run bool `json:"run"`
+	// GaneshaConfig is the path of the NFS Ganesha config file.
+	GaneshaConfig string `json:"ganeshaConfig"`
+	// Address, if set, is the NFS server put in provisioned PVs instead of
+	// one looked up from the environment, if AddressStrategy is auto or fixed.
+	Address string `json:"address"`
+	// AddressStrategy is how to choose the NFS server put in the PVs of
+	// StorageClasses that don't choose one, one of vol.ServerStrategies.
+	AddressStrategy string `json:"addressStrategy"`
+	// ClusterDomain is the DNS domain of the cluster, for the DNS name
+	// strategies.
+	ClusterDomain string `json:"clusterDomain"`
+	// IPFamily is the family of the IPs to put in PVs and the managed
+	// service's endpoints in a dual-stack cluster, vol.IPv4 or vol.IPv6, or
+	// empty for the first IP found.
+	IPFamily string `json:"ipFamily"`
+	// ManageService is whether the provisioner creates or adopts the service
+	// named by the SERVICE_NAME env and keeps its endpoints pointing at the
+	// pod, so that PVs get its cluster IP.
+	ManageService bool `json:"manageService"`
+}
+
+// Workers are the sizes of the worker pools.
+type Workers struct {
+	Provision int `json:"provision"`
+	Delete    int `json:"delete"`
+}
+
+// Limits are the limits on operations.
+type Limits struct {
+	MaxRetries       int                  `json:"maxRetries"`
+	OperationTimeout unversioned.Duration `json:"operationTimeout"`
+}
+
+// Load returns the given base configuration, e.g. from the flags, overridden
+// by the settings in the YAML config file at the given path. Lists in the file
+// replace the base's rather than add to them. It doesn't validate the result.
+func Load(path string, base Config) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %s: %v", path, err)
+	}
+	return parse(data, base)
+}
+
+func parse(data []byte, base Config) (*Config, error) {
+	config := base
+	// Decode lists from scratch instead of into the base's elements
+	config.Provisioners = nil
+	config.Namespaces = nil
+	// An empty file, e.g. a ConfigMap key with no settings yet, overrides none
+	if len(bytes.TrimSpace(data)) != 0 {
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("error parsing config file: %v", err)
+		}
+	}
+	if config.Provisioners == nil {
+		config.Provisioners = base.Provisioners
+	}
+	if config.Namespaces == nil {
+		config.Namespaces = base.Namespaces
+	}
+	for i := range config.Provisioners {
+		if exportDir := config.Provisioners[i].ExportDir; exportDir != "" && !strings.HasSuffix(exportDir, "/") {
+			config.Provisioners[i].ExportDir = exportDir + "/"
+		}
+	}
+	return &config, nil
+}
+
+// ExporterOf returns the name of the exporter of the given provisioner.
+func (c *Config) ExporterOf(provisioner Provisioner) string {
+	if provisioner.Exporter != "" {
+		return provisioner.Exporter
+	}
+	return c.Exporter
+}
+
+// Validate returns an error if any of the settings is invalid.
+func (c *Config) Validate() error {
+	if len(c.Provisioners) == 0 {
+		return fmt.Errorf("provisioners: at least one provisioner is required")
+	}
+	names := make(map[string]bool)
+	exportDirs := []string{}
+	for i, provisioner := range c.Provisioners {
+		if provisioner.Name == "" {
+			return fmt.Errorf("provisioners[%d].name: required", i)
+		}
+		if errs := validation.IsQualifiedName(strings.ToLower(provisioner.Name)); len(errs) != 0 {
+			return fmt.Errorf("provisioners[%d].name: %q is invalid: %s", i, provisioner.Name, strings.Join(errs, "; "))
+		}
+		if names[provisioner.Name] {
+			return fmt.Errorf("provisioners[%d].name: %s is given more than once", i, provisioner.Name)
+		}
+		names[provisioner.Name] = true
+		if provisioner.ExportDir == "" {
+			return fmt.Errorf("provisioners[%d].exportDir: required", i)
+		}
+		for _, exportDir := range exportDirs {
+			if strings.HasPrefix(provisioner.ExportDir, exportDir) || strings.HasPrefix(exportDir, provisioner.ExportDir) {
+				return fmt.Errorf("provisioners[%d].exportDir: %s overlaps %s", i, provisioner.ExportDir, exportDir)
+			}
+		}
+		exportDirs = append(exportDirs, provisioner.ExportDir)
+		exporter := c.ExporterOf(provisioner)
+		if !IsExporter(exporter) {
+			return fmt.Errorf("provisioners[%d].exporter: unknown exporter %q. valid values are: %s", i, exporter, strings.Join(vol.ExporterNames(), ", "))
+		}
+		if c.Server.Run && exporter != "ganesha" {
+			return fmt.Errorf("provisioners[%d].exporter: if server.run is true, the exporter must be ganesha", i)
+		}
+	}
+	if c.Server.Run && c.Server.GaneshaConfig == "" {
+		return fmt.Errorf("server.ganeshaConfig: required if server.run is true")
+	}
+	if !isServerStrategy(c.Server.AddressStrategy) {
+		return fmt.Errorf("server.addressStrategy: unknown strategy %q. valid values are: %s", c.Server.AddressStrategy, strings.Join(vol.ServerStrategies(), ", "))
+	}
+	if c.Server.AddressStrategy == vol.ServerFixed && c.Server.Address == "" {
+		return fmt.Errorf("server.address: required if server.addressStrategy is %s", vol.ServerFixed)
+	}
+	if c.Server.IPFamily != "" && c.Server.IPFamily != vol.IPv4 && c.Server.IPFamily != vol.IPv6 {
+		return fmt.Errorf("server.ipFamily: unknown family %q. valid values are: %s, %s", c.Server.IPFamily, vol.IPv4, vol.IPv6)
+	}
+	if errs := validation.IsDNS1123Subdomain(c.Server.ClusterDomain); c.Server.ClusterDomain != "" && len(errs) != 0 {
+		return fmt.Errorf("server.clusterDomain: %q is invalid: %s", c.Server.ClusterDomain, strings.Join(errs, "; "))
+	}
+	if c.Workers.Provision < 1 || c.Workers.Delete < 1 {
+		return fmt.Errorf("workers: provision and delete must be at least 1")
+	}
+	if c.Limits.MaxRetries < 0 {
+		return fmt.Errorf("limits.maxRetries: must be at least 0")
+	}
+	if c.Limits.OperationTimeout.Duration < 0 {
+		return fmt.Errorf("limits.operationTimeout: must be at least 0")
+	}
+	if c.LeaseDuration.Duration != 0 && c.LeaseDuration.Duration < time.Second {
+		return fmt.Errorf("claimLeaseDuration: must be 0 or at least 1s")
+	}
+	for _, namespace := range c.Namespaces {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) != 0 {
+			return fmt.Errorf("namespaces: namespace %q is invalid: %s", namespace, strings.Join(errs, "; "))
+		}
+	}
+	if _, err := labels.Parse(c.ClaimSelector); err != nil {
+		return fmt.Errorf("claimSelector: %v", err)
+	}
+	if c.AdminAddress != "" && c.AdminTokenFile == "" {
+		return fmt.Errorf("adminTokenFile: required if adminAddress is set")
+	}
+	if c.LogLevel < 0 {
+		return fmt.Errorf("logLevel: must be at least 0")
+	}
+	return nil
+}
+
+// IsExporter returns whether an exporter of the given name is registered.
+func IsExporter(name string) bool {
+	for _, registered := range vol.ExporterNames() {
+		if registered == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isServerStrategy(strategy string) bool {
+	if strategy == "" {
+		return true
+	}
+	for _, s := range vol.ServerStrategies() {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// RestartRequired returns the names of the settings that differ between the
+// given configurations and only take effect on a restart, i.e. all but the
+// limits, the log level and the default parameters of the provisioners.
+func RestartRequired(old, new *Config) []string {
+	old, new = withoutReloadable(old), withoutReloadable(new)
+	changed := []string{}
+	oldValue, newValue := reflect.ValueOf(*old), reflect.ValueOf(*new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			name := strings.Split(oldValue.Type().Field(i).Tag.Get("json"), ",")[0]
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// withoutReloadable returns a copy of the given configuration with the settings
+// that can change without a restart zeroed.
+func withoutReloadable(config *Config) *Config {
+	c := *config
+	c.Limits = Limits{}
+	c.LogLevel = 0
+	c.Provisioners = make([]Provisioner, len(config.Provisioners))
+	for i, provisioner := range config.Provisioners {
+		provisioner.DefaultParameters = nil
+		c.Provisioners[i] = provisioner
+	}
+	return &c
+}
+
+// Watch checks the YAML config file at the given path for changes every
+// period until stopCh is closed. When its contents change, it loads it over
+// the given base configuration, validates it and calls onChange with it. If
+// the file can't be loaded or is invalid, it logs the error and waits for the
+// next change.
+func Watch(path string, base Config, period time.Duration, stopCh <-chan struct{}, onChange func(*Config)) {
+	last, err := ioutil.ReadFile(path)
+	if err != nil {
+		glog.Errorf("Error reading config file %s: %v", path, err)
+	}
+	wait.Until(func() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			glog.Errorf("Error reading config file %s: %v", path, err)
+			return
+		}
+		if bytes.Equal(data, last) {
+			return
+		}
+		last = data
+		config, err := parse(data, base)
+		if err == nil {
+			err = config.Validate()
+		}
+		if err != nil {
+			glog.Errorf("Error reloading config file %s, keeping the previous configuration: %v", path, err)
+			return
+		}
+		glog.Infof("Config file %s changed, reloading", path)
+		onChange(config)
+	}, period, stopCh)
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+func newBase() Config {
+	return Config{
+		Provisioners: []Provisioner{{Name: "example.com/nfs", ExportDir: "/export/"}},
+		Exporter:     "ganesha",
+		Server:       Server{Run: true, GaneshaConfig: "/export/vfs.conf"},
+		Workers:      Workers{Provision: 4, Delete: 4},
+		Limits:       Limits{MaxRetries: 15, OperationTimeout: unversioned.Duration{Duration: 5 * time.Minute}},
+		Namespaces:   []string{"foo"},
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		expected    func(*Config)
+		expectError bool
+	}{
+		{
+			name:        "empty",
+			file:        "",
+			expected:    func(c *Config) {},
+			expectError: false,
+		},
+		{
+			name: "override",
+			file: `
+exporter: kernel
+server:
+  run: false
+  address: nfs.example.com
+limits:
+  operationTimeout: 1m
+claimLeaseDuration: 30s
+logLevel: 4
+allowEphemeral: true
+`,
+			expected: func(c *Config) {
+				c.Exporter = "kernel"
+				c.Server = Server{Run: false, GaneshaConfig: "/export/vfs.conf", Address: "nfs.example.com"}
+				c.Limits.OperationTimeout = unversioned.Duration{Duration: time.Minute}
+				c.LeaseDuration = unversioned.Duration{Duration: 30 * time.Second}
+				c.LogLevel = 4
+				c.AllowEphemeral = true
+			},
+			expectError: false,
+		},
+		{
+			name: "no operation timeout",
+			file: `
+limits:
+  operationTimeout: 0s
+`,
+			expected: func(c *Config) {
+				c.Limits.OperationTimeout = unversioned.Duration{}
+			},
+			expectError: false,
+		},
+		{
+			name: "lists replaced",
+			file: `
+provisioners:
+- name: example.com/nfs-b
+  exportDir: /export-b
+  defaultParameters:
+    gid: "1000"
+namespaces: []
+`,
+			expected: func(c *Config) {
+				c.Provisioners = []Provisioner{{Name: "example.com/nfs-b", ExportDir: "/export-b/", DefaultParameters: map[string]string{"gid": "1000"}}}
+				c.Namespaces = []string{}
+			},
+			expectError: false,
+		},
+		{
+			name:        "unparseable",
+			file:        "workers: [",
+			expectError: true,
+		},
+		{
+			name:        "wrong type",
+			file:        "workers: 4",
+			expectError: true,
+		},
+	}
+
+	tmpDir := utiltesting.MkTmpdirOrDie("configTest")
+	defer os.RemoveAll(tmpDir)
+	file := path.Join(tmpDir, "config.yaml")
+
+	for _, test := range tests {
+		if err := ioutil.WriteFile(file, []byte(test.file), 0600); err != nil {
+			t.Fatalf("error writing config file: %v", err)
+		}
+		base := newBase()
+
+		config, err := Load(file, base)
+		if test.expectError {
+			if err == nil {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected error but got none")
+			}
+			continue
+		}
+		if err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error loading config: %v", err)
+			continue
+		}
+		expected := newBase()
+		test.expected(&expected)
+		if !reflect.DeepEqual(&expected, config) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected config %+v but got %+v", expected, *config)
+		}
+		if !reflect.DeepEqual(newBase(), base) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected base config unchanged but got %+v", base)
+		}
+	}
+
+	if _, err := Load(path.Join(tmpDir, "missing.yaml"), newBase()); err == nil {
+		t.Errorf("expected error loading missing config file but got none")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		modify      func(*Config)
+		expectError bool
+	}{
+		{
+			name:        "valid",
+			modify:      func(c *Config) {},
+			expectError: false,
+		},
+		{
+			name: "multiple provisioners",
+			modify: func(c *Config) {
+				c.Provisioners = append(c.Provisioners, Provisioner{Name: "example.com/nfs-b", ExportDir: "/export-b/"})
+			},
+			expectError: false,
+		},
+		{
+			name:        "no provisioners",
+			modify:      func(c *Config) { c.Provisioners = nil },
+			expectError: true,
+		},
+		{
+			name:        "invalid name",
+			modify:      func(c *Config) { c.Provisioners[0].Name = "example.com/nfs/foo" },
+			expectError: true,
+		},
+		{
+			name: "duplicate name",
+			modify: func(c *Config) {
+				c.Provisioners = append(c.Provisioners, Provisioner{Name: "example.com/nfs", ExportDir: "/export-b/"})
+			},
+			expectError: true,
+		},
+		{
+			name: "overlapping export dirs",
+			modify: func(c *Config) {
+				c.Provisioners = append(c.Provisioners, Provisioner{Name: "example.com/nfs-b", ExportDir: "/export/b/"})
+			},
+			expectError: true,
+		},
+		{
+			name:        "unknown exporter",
+			modify:      func(c *Config) { c.Exporter = "foo" },
+			expectError: true,
+		},
+		{
+			name:        "kernel exporter with server",
+			modify:      func(c *Config) { c.Provisioners[0].Exporter = "kernel" },
+			expectError: true,
+		},
+		{
+			name: "kernel exporter without server",
+			modify: func(c *Config) {
+				c.Provisioners[0].Exporter = "kernel"
+				c.Server.Run = false
+			},
+			expectError: false,
+		},
+		{
+			name:        "unknown server address strategy",
+			modify:      func(c *Config) { c.Server.AddressStrategy = "foo" },
+			expectError: true,
+		},
+		{
+			name:        "fixed server address strategy without address",
+			modify:      func(c *Config) { c.Server.AddressStrategy = "fixed" },
+			expectError: true,
+		},
+		{
+			name: "fixed server address strategy with address",
+			modify: func(c *Config) {
+				c.Server.AddressStrategy = "fixed"
+				c.Server.Address = "nfs.example.com"
+			},
+			expectError: false,
+		},
+		{
+			name:        "IP family",
+			modify:      func(c *Config) { c.Server.IPFamily = "ipv6" },
+			expectError: false,
+		},
+		{
+			name:        "unknown IP family",
+			modify:      func(c *Config) { c.Server.IPFamily = "ipv5" },
+			expectError: true,
+		},
+		{
+			name:        "invalid cluster domain",
+			modify:      func(c *Config) { c.Server.ClusterDomain = "Cluster_Local" },
+			expectError: true,
+		},
+		{
+			name:        "no workers",
+			modify:      func(c *Config) { c.Workers.Delete = 0 },
+			expectError: true,
+		},
+		{
+			name:        "negative retries",
+			modify:      func(c *Config) { c.Limits.MaxRetries = -1 },
+			expectError: true,
+		},
+		{
+			name:        "no operation timeout",
+			modify:      func(c *Config) { c.Limits.OperationTimeout = unversioned.Duration{} },
+			expectError: false,
+		},
+		{
+			name:        "negative operation timeout",
+			modify:      func(c *Config) { c.Limits.OperationTimeout = unversioned.Duration{Duration: -time.Minute} },
+			expectError: true,
+		},
+		{
+			name:        "short lease",
+			modify:      func(c *Config) { c.LeaseDuration = unversioned.Duration{Duration: time.Millisecond} },
+			expectError: true,
+		},
+		{
+			name:        "invalid namespace",
+			modify:      func(c *Config) { c.Namespaces = []string{"Foo"} },
+			expectError: true,
+		},
+		{
+			name:        "invalid claim selector",
+			modify:      func(c *Config) { c.ClaimSelector = "tenant in (a" },
+			expectError: true,
+		},
+		{
+			name:        "admin address without token file",
+			modify:      func(c *Config) { c.AdminAddress = "127.0.0.1:8081" },
+			expectError: true,
+		},
+		{
+			name: "admin address with token file",
+			modify: func(c *Config) {
+				c.AdminAddress = "127.0.0.1:8081"
+				c.AdminTokenFile = "/etc/nfs-provisioner/admin-token"
+			},
+			expectError: false,
+		},
+		{
+			name:        "negative log level",
+			modify:      func(c *Config) { c.LogLevel = -1 },
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		config := newBase()
+		test.modify(&config)
+
+		err := config.Validate()
+		if test.expectError && err == nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error but got none")
+		} else if !test.expectError && err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error validating config: %v", err)
+		}
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*Config)
+		expected []string
+	}{
+		{
+			name:     "unchanged",
+			modify:   func(c *Config) {},
+			expected: []string{},
+		},
+		{
+			name: "reloadable",
+			modify: func(c *Config) {
+				c.LogLevel = 4
+				c.Limits.MaxRetries = 0
+				c.Provisioners[0].DefaultParameters = map[string]string{"gid": "1000"}
+			},
+			expected: []string{},
+		},
+		{
+			name: "restart required",
+			modify: func(c *Config) {
+				c.Provisioners[0].ExportDir = "/export-b/"
+				c.Server.Address = "nfs.example.com"
+				c.MetricsAddress = ":9090"
+				c.LogLevel = 4
+			},
+			expected: []string{"provisioners", "server", "metricsAddress"},
+		},
+	}
+	for _, test := range tests {
+		old, new := newBase(), newBase()
+		test.modify(&new)
+
+		changed := RestartRequired(&old, &new)
+		if !reflect.DeepEqual(test.expected, changed) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected settings %v to require a restart but got %v", test.expected, changed)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// AdminHandler returns a handler that serves the controller's admin API, for
+// inspecting what it holds in memory and operating it. Every request must carry
+// the given token as a bearer token, e.g. "Authorization: Bearer <token>". The
+// API is:
+//
+//	GET  /status                            operations in progress, pending volumes, cache sizes
+//	GET  /volumes                           the volumes the provisioners provisioned
+//	GET  /volumes/<name>                    one of them, including its export block
+//	GET  /volumes/<name>/export-block       its export block as text
+//	POST /reconcile                         work on every claim and volume that needs it now
+//	POST /claims/<namespace>/<name>/retry   retry a claim the controller gave up on
+//	GET  /provisioning                      whether provisioning is paused
+//	POST /provisioning/pause                stop provisioning volumes
+//	POST /provisioning/resume               start again
+//	GET  /deletions                         whether deletions are paused
+//	POST /deletions/pause                   stop deleting and recycling volumes
+//	POST /deletions/resume                  start again
+func (ctrl *ProvisionController) AdminHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ctrl.serveAdmin(w, r)
+	})
+}
+
+// authorized returns whether the given request carries the given token, which
+// must not be empty, as a bearer token.
+func authorized(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header[len(prefix):]), []byte(token)) == 1
+}
+
+func (ctrl *ProvisionController) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && len(path) == 1 && path[0] == "status":
+		writeJSON(w, ctrl.adminStatus())
+	case r.Method == "GET" && len(path) == 1 && path[0] == "volumes":
+		writeJSON(w, ctrl.listVolumes())
+	case r.Method == "GET" && len(path) == 2 && path[0] == "volumes":
+		info, err := ctrl.getVolume(path[1])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, info)
+	case r.Method == "GET" && len(path) == 3 && path[0] == "volumes" && path[2] == "export-block":
+		info, err := ctrl.getVolume(path[1])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if info.VolumeInfo == nil {
+			http.Error(w, fmt.Sprintf("volume %q can't be inspected: %s", info.Name, info.Error), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, info.ExportBlock)
+	case r.Method == "POST" && len(path) == 1 && path[0] == "reconcile":
+		claims, volumes := ctrl.Reconcile()
+		writeJSON(w, map[string]int{"claims": claims, "volumes": volumes})
+	case r.Method == "POST" && len(path) == 4 && path[0] == "claims" && path[3] == "retry":
+		if err := ctrl.RetryClaim(path[1] + "/" + path[2]); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, map[string]string{"claim": path[1] + "/" + path[2]})
+	case r.Method == "GET" && len(path) == 1 && path[0] == "provisioning":
+		writeJSON(w, map[string]bool{"paused": ctrl.ProvisioningPaused()})
+	case r.Method == "POST" && len(path) == 2 && path[0] == "provisioning" && (path[1] == "pause" || path[1] == "resume"):
+		ctrl.PauseProvisioning(path[1] == "pause")
+		writeJSON(w, map[string]bool{"paused": ctrl.ProvisioningPaused()})
+	case r.Method == "GET" && len(path) == 1 && path[0] == "deletions":
+		writeJSON(w, map[string]bool{"paused": ctrl.DeletionsPaused()})
+	case r.Method == "POST" && len(path) == 2 && path[0] == "deletions" && (path[1] == "pause" || path[1] == "resume"):
+		ctrl.PauseDeletions(path[1] == "pause")
+		writeJSON(w, map[string]bool{"paused": ctrl.DeletionsPaused()})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// adminError is an error of an admin API request with the HTTP status to
+// answer it with.
+type adminError struct {
+	status  int
+	message string
+}
+
+func (e *adminError) Error() string {
+	return e.message
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*adminError); ok {
+		status = e.status
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("Error writing admin API response: %v", err)
+	}
+}
+
+// AdminStatus is what the controller holds in memory, as served by the admin
+// API.
+type AdminStatus struct {
+	// Operations are the keys of the claims being provisioned for.
+	Operations []string `json:"operations"`
+	// PendingVolumes are the keys of the claims whose volumes have been
+	// provisioned but whose PV objects have yet to be created.
+	PendingVolumes []string `json:"pendingVolumes"`
+	// ProvisioningPaused is whether provisioning volumes is paused.
+	ProvisioningPaused bool `json:"provisioningPaused"`
+	// DeletionsPaused is whether deleting and recycling volumes is paused.
+	DeletionsPaused bool `json:"deletionsPaused"`
+	// The numbers of objects in the informer caches.
+	CachedClaims  int `json:"cachedClaims"`
+	CachedVolumes int `json:"cachedVolumes"`
+	CachedClasses int `json:"cachedClasses"`
+}
+
+func (ctrl *ProvisionController) adminStatus() AdminStatus {
+	status := AdminStatus{
+		Operations:         []string{},
+		PendingVolumes:     []string{},
+		ProvisioningPaused: ctrl.ProvisioningPaused(),
+		DeletionsPaused:    ctrl.DeletionsPaused(),
+		CachedClaims:       len(ctrl.claims.ListKeys()),
+		CachedVolumes:      len(ctrl.volumes.ListKeys()),
+		CachedClasses:      len(ctrl.classes.ListKeys()),
+	}
+	ctrl.operationsLock.Lock()
+	for key := range ctrl.operations {
+		status.Operations = append(status.Operations, key)
+	}
+	ctrl.operationsLock.Unlock()
+	ctrl.pendingVolumesLock.Lock()
+	for key := range ctrl.pendingVolumes {
+		status.PendingVolumes = append(status.PendingVolumes, key)
+	}
+	ctrl.pendingVolumesLock.Unlock()
+	sort.Strings(status.Operations)
+	sort.Strings(status.PendingVolumes)
+	return status
+}
+
+// ManagedVolume is a volume one of the controller's provisioners provisioned,
+// as served by the admin API.
+type ManagedVolume struct {
+	Name string `json:"name"`
+	// Provisioner is the name of the provisioner, i.e. the pool, that
+	// provisioned the volume.
+	Provisioner string `json:"provisioner"`
+	Phase       string `json:"phase"`
+	// Claim is the key of the volume's claim, if any.
+	Claim string `json:"claim,omitempty"`
+	// VolumeInfo is what the provisioner knows about the volume, if it is an
+	// Inspector.
+	*VolumeInfo
+	// Error is why the provisioner couldn't inspect the volume, if it
+	// couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// listVolumes returns the volumes in the cache that the controller's
+// provisioners provisioned, sorted by name, without their export blocks.
+func (ctrl *ProvisionController) listVolumes() []ManagedVolume {
+	volumes := []ManagedVolume{}
+	for _, obj := range ctrl.volumes.List() {
+		volume, ok := obj.(*v1.PersistentVolume)
+		if !ok {
+			continue
+		}
+		managed, ok := ctrl.inspectVolume(volume)
+		if !ok {
+			continue
+		}
+		if managed.VolumeInfo != nil {
+			managed.VolumeInfo.ExportBlock = ""
+		}
+		volumes = append(volumes, managed)
+	}
+	sort.Sort(byName(volumes))
+	return volumes
+}
+
+type byName []ManagedVolume
+
+func (v byName) Len() int           { return len(v) }
+func (v byName) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v byName) Less(i, j int) bool { return v[i].Name < v[j].Name }
+
+// getVolume returns the volume in the cache with the given name if one of the
+// controller's provisioners provisioned it.
+func (ctrl *ProvisionController) getVolume(name string) (ManagedVolume, error) {
+	obj, exists, err := ctrl.volumes.GetByKey(name)
+	if err != nil {
+		return ManagedVolume{}, err
+	}
+	if exists {
+		if volume, ok := obj.(*v1.PersistentVolume); ok {
+			if managed, ok := ctrl.inspectVolume(volume); ok {
+				return managed, nil
+			}
+		}
+	}
+	return ManagedVolume{}, &adminError{http.StatusNotFound, fmt.Sprintf("volume %q not found", name)}
+}
+
+// inspectVolume describes the given volume if one of the controller's
+// provisioners provisioned it and returns false otherwise.
+func (ctrl *ProvisionController) inspectVolume(volume *v1.PersistentVolume) (ManagedVolume, bool) {
+	provisionerName := volume.Annotations[annDynamicallyProvisioned]
+	provisioner, ok := ctrl.provisioners[provisionerName]
+	if !ok || !ctrl.watchesNamespaceOf(volume) {
+		return ManagedVolume{}, false
+	}
+	managed := ManagedVolume{
+		Name:        volume.Name,
+		Provisioner: provisionerName,
+		Phase:       string(volume.Status.Phase),
+	}
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		managed.Claim = ref.Namespace + "/" + ref.Name
+	}
+	if inspector, ok := provisioner.(Inspector); ok {
+		info, err := inspector.Inspect(volume)
+		if err != nil {
+			managed.Error = err.Error()
+		} else {
+			managed.VolumeInfo = info
+		}
+	}
+	return managed, true
+}
+
+// Reconcile makes the controller work right away on every claim and volume in
+// its caches that needs it, cutting short any backoff, except those it has
+// given up on and, while provisioning or deletions are paused, claims or
+// volumes. It returns the numbers of claims and volumes queued.
+func (ctrl *ProvisionController) Reconcile() (claims, volumes int) {
+	if !ctrl.ProvisioningPaused() {
+		for _, obj := range ctrl.claims.List() {
+			claim, ok := obj.(*v1.PersistentVolumeClaim)
+			if !ok || !ctrl.shouldProvision(claim) || claim.Annotations[annNextAttempt] == nextAttemptNever {
+				continue
+			}
+			ctrl.claimQueue.AddAfter(claimToClaimKey(claim), 0)
+			claims++
+		}
+	}
+	if ctrl.DeletionsPaused() {
+		return claims, 0
+	}
+	for _, obj := range ctrl.volumes.List() {
+		volume, ok := obj.(*v1.PersistentVolume)
+		if !ok || !ctrl.watchesNamespaceOf(volume) || volume.Annotations[annNextAttempt] == nextAttemptNever {
+			continue
+		}
+		if ctrl.shouldDelete(volume) || ctrl.shouldRecycle(volume) {
+			ctrl.volumeQueue.AddAfter(volume.Name, 0)
+			volumes++
+		}
+	}
+	glog.Infof("reconciling %d claims and %d volumes", claims, volumes)
+	return claims, volumes
+}
+
+// RetryClaim makes the controller retry provisioning a volume for the claim
+// with the given key right away, with its retries reset, even if it has given
+// up on it.
+func (ctrl *ProvisionController) RetryClaim(key string) error {
+	obj, exists, err := ctrl.claims.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return &adminError{http.StatusNotFound, fmt.Sprintf("claim %q not found", key)}
+	}
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return fmt.Errorf("expected PersistentVolumeClaim but claim store contained %+v", obj)
+	}
+	if !ctrl.shouldProvision(claim) {
+		return &adminError{http.StatusConflict, fmt.Sprintf("claim %q doesn't need a volume from this provisioner", key)}
+	}
+	glog.Infof("retrying claim %q", key)
+	ctrl.updateRetryAnnotations(claim, 0, "")
+	ctrl.claimQueue.Forget(key)
+	ctrl.claimQueue.AddAfter(key, 0)
+	return nil
+}
+
+// PauseProvisioning stops the controller from provisioning volumes if paused
+// is true, letting operations in progress finish and leaving existing volumes
+// and their exports alone, and starts it again if false. Claims that need
+// volumes meanwhile get an event saying provisioning is paused.
+func (ctrl *ProvisionController) PauseProvisioning(paused bool) {
+	ctrl.provisioningPausedLock.Lock()
+	changed := ctrl.provisioningPaused != paused
+	ctrl.provisioningPaused = paused
+	ctrl.provisioningPausedLock.Unlock()
+	if !changed {
+		return
+	}
+	if paused {
+		glog.Infof("provisioning paused")
+		return
+	}
+	glog.Infof("provisioning resumed")
+	ctrl.Reconcile()
+}
+
+// ProvisioningPaused returns whether provisioning volumes is paused.
+func (ctrl *ProvisionController) ProvisioningPaused() bool {
+	ctrl.provisioningPausedLock.Lock()
+	defer ctrl.provisioningPausedLock.Unlock()
+	return ctrl.provisioningPaused
+}
+
+// PauseDeletions stops the controller from deleting and recycling volumes if
+// paused is true, letting operations in progress finish, and starts it again
+// if false.
+func (ctrl *ProvisionController) PauseDeletions(paused bool) {
+	ctrl.deletionsPausedLock.Lock()
+	changed := ctrl.deletionsPaused != paused
+	ctrl.deletionsPaused = paused
+	ctrl.deletionsPausedLock.Unlock()
+	if !changed {
+		return
+	}
+	if paused {
+		glog.Infof("deletions paused")
+		return
+	}
+	glog.Infof("deletions resumed")
+	ctrl.Reconcile()
+}
+
+// DeletionsPaused returns whether deleting and recycling volumes is paused.
+func (ctrl *ProvisionController) DeletionsPaused() bool {
+	ctrl.deletionsPausedLock.Lock()
+	defer ctrl.deletionsPausedLock.Unlock()
+	return ctrl.deletionsPaused
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func TestAdminHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		token          string
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{
+			name:           "no token",
+			method:         "GET",
+			path:           "/status",
+			token:          "",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "wrong token",
+			method:         "GET",
+			path:           "/status",
+			token:          "wrong",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "status",
+			method:         "GET",
+			path:           "/status",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`"operations":[]`, `"provisioningPaused":false`, `"deletionsPaused":false`, `"cachedClaims":2`, `"cachedVolumes":4`, `"cachedClasses":1`},
+		},
+		{
+			name:           "list volumes",
+			method:         "GET",
+			path:           "/volumes",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expectedBody: []string{
+				`[{"name":"volume-1","provisioner":"foo.bar/baz","phase":"Bound","exportId":"1","path":"/export/volume-1","usedBytes":10},` +
+					`{"name":"volume-2","provisioner":"foo.bar/baz","phase":"Released","claim":"default/claim-1","exportId":"1","path":"/export/volume-2","usedBytes":10},` +
+					`{"name":"volume-3","provisioner":"foo.bar/baz","phase":"Bound","error":"fake error"}]`,
+			},
+		},
+		{
+			name:           "get volume",
+			method:         "GET",
+			path:           "/volumes/volume-1",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`"exportBlock":"block of volume-1"`},
+		},
+		{
+			name:           "get volume of other provisioner",
+			method:         "GET",
+			path:           "/volumes/volume-4",
+			token:          "secret",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "get export block",
+			method:         "GET",
+			path:           "/volumes/volume-1/export-block",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{"block of volume-1"},
+		},
+		{
+			name:           "get export block of uninspectable volume",
+			method:         "GET",
+			path:           "/volumes/volume-3/export-block",
+			token:          "secret",
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   []string{"fake error"},
+		},
+		{
+			name:           "reconcile",
+			method:         "POST",
+			path:           "/reconcile",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`{"claims":0,"volumes":1}`},
+		},
+		{
+			name:           "retry claim",
+			method:         "POST",
+			path:           "/claims/default/claim-1/retry",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "retry bound claim",
+			method:         "POST",
+			path:           "/claims/default/claim-2/retry",
+			token:          "secret",
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "retry missing claim",
+			method:         "POST",
+			path:           "/claims/default/claim-3/retry",
+			token:          "secret",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "pause deletions",
+			method:         "POST",
+			path:           "/deletions/pause",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`{"paused":true}`},
+		},
+		{
+			name:           "pause provisioning",
+			method:         "POST",
+			path:           "/provisioning/pause",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expectedBody:   []string{`{"paused":true}`},
+		},
+		{
+			name:           "wrong method",
+			method:         "GET",
+			path:           "/reconcile",
+			token:          "secret",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		ctrl := newAdminTestController(t)
+		handler := ctrl.AdminHandler("secret")
+
+		r, _ := http.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if test.expectedStatus != w.Code {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected status %d but got %d: %s", test.expectedStatus, w.Code, w.Body.String())
+		}
+		for _, expected := range test.expectedBody {
+			if !strings.Contains(w.Body.String(), expected) {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected %s in body but got %s", expected, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestRetryClaim(t *testing.T) {
+	ctrl := newAdminTestController(t)
+	ctrl.claimQueue.SetRequeues("default/claim-1", 15)
+
+	if err := ctrl.RetryClaim("default/claim-1"); err != nil {
+		t.Fatalf("unexpected error retrying claim: %v", err)
+	}
+
+	claim, _ := ctrl.client.Core().PersistentVolumeClaims("default").Get("claim-1")
+	if hasAnnotation(claim.ObjectMeta, annRetries) || hasAnnotation(claim.ObjectMeta, annNextAttempt) {
+		t.Errorf("expected retry annotations removed but got %v", claim.Annotations)
+	}
+	if n := ctrl.claimQueue.NumRequeues("default/claim-1"); n != 0 {
+		t.Errorf("expected retries reset but got %d", n)
+	}
+	if key, _ := ctrl.claimQueue.Get(); key != "default/claim-1" {
+		t.Errorf("expected claim queued but got %q", key)
+	}
+}
+
+func TestPauseDeletions(t *testing.T) {
+	ctrl := newAdminTestController(t)
+
+	ctrl.PauseDeletions(true)
+	ctrl.volumeQueue.Add("volume-2")
+	ctrl.processNextVolumeWorkItem()
+	if _, err := ctrl.client.Core().PersistentVolumes().Get("volume-2"); err != nil {
+		t.Errorf("expected volume kept while deletions are paused but got error: %v", err)
+	}
+	if n := ctrl.volumeQueue.Len(); n != 0 {
+		t.Errorf("expected volume dropped from the queue but the queue has %d keys", n)
+	}
+
+	ctrl.PauseDeletions(false)
+	if key, _ := ctrl.volumeQueue.Get(); key != "volume-2" {
+		t.Errorf("expected volume queued again on resume but got %q", key)
+	}
+}
+
+// newAdminTestController returns a controller whose caches hold a class, a
+// claim that was given up on, a bound claim and volumes: bound, released,
+// uninspectable and another provisioner's.
+func newAdminTestController(t *testing.T) *ProvisionController {
+	class := newStorageClass("class-1", "foo.bar/baz")
+	claims := []*v1.PersistentVolumeClaim{
+		newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annRetries: "15", annNextAttempt: nextAttemptNever}),
+		newClaim("claim-2", "uid-1-2", "class-1", "volume-1", nil),
+	}
+	volumes := []*v1.PersistentVolume{
+		newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}),
+		newVolumeWithClaimRef(newVolume("volume-2", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"})),
+		newVolume("volume-3", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}),
+		newVolume("volume-4", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "other.bar/baz"}),
+	}
+	client := fake.NewSimpleClientset(claims[0], claims[1], volumes[0], volumes[1], volumes[2], volumes[3])
+	ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": &inspectTestProvisioner{badVolume: "volume-3"}}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: 100 * time.Millisecond})
+	ctrl.classes.Add(class)
+	for _, claim := range claims {
+		ctrl.claims.Add(claim)
+	}
+	for _, volume := range volumes {
+		ctrl.volumes.Add(volume)
+	}
+	return ctrl
+}
@@ -22,25 +22,34 @@ kubernetes, copyright 2016 The Kubernetes Authors.
 package controller
 
 import (
+	"encoding/json"
 	"fmt"
-	"os/exec"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	// TODO get rid of this and use https://github.com/kubernetes/kubernetes/pull/32718
 	"github.com/wongma7/nfs-provisioner/framework"
+	"golang.org/x/net/context"
 	"k8s.io/client-go/1.4/kubernetes"
 	core_v1 "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
 	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/errors"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/pkg/apis/storage/v1beta1"
+	"k8s.io/client-go/1.4/pkg/labels"
 	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/pkg/types"
+	"k8s.io/client-go/1.4/pkg/util/sets"
+	"k8s.io/client-go/1.4/pkg/util/uuid"
 	"k8s.io/client-go/1.4/pkg/version"
 	"k8s.io/client-go/1.4/pkg/watch"
 	"k8s.io/client-go/1.4/tools/cache"
 	"k8s.io/client-go/1.4/tools/record"
-	"k8s.io/kubernetes/pkg/util/goroutinemap"
 )
 
 // annClass annotation represents the storage class associated with a resource:
@@ -61,38 +70,79 @@ const annDynamicallyProvisioned = "pv.kubernetes.io/provisioned-by"
 
 const annStorageProvisioner = "volume.beta.kubernetes.io/storage-provisioner"
 
-// Number of retries when we create a PV object for a provisioned volume.
-const createProvisionedPVRetryCount = 5
-
-// Interval between retries when we create a PV object for a provisioned volume.
-const createProvisionedPVInterval = 10 * time.Second
+// annMountOptions annotation is where provisioners put the options the kubelet
+// should mount a PV with, since the vendored API types have no
+// PV.Spec.MountOptions. On servers that have the field, the controller moves
+// the options there once the PV is created.
+const annMountOptions = "volume.beta.kubernetes.io/mount-options"
+
+// A claim annotation with this prefix followed by the name of a StorageClass
+// parameter overrides the value of that parameter for the claim. The class
+// must allow the override by listing the parameter in
+// paramOverridableParameters.
+const annParameterOverridePrefix = "parameters.provisioner.alpha.kubernetes.io/"
+
+// A StorageClass parameter interpreted by the controller rather than passed on
+// to the provisioner: a comma-separated list of the names of the parameters
+// that claims of the class may override.
+const paramOverridableParameters = "overridableParameters"
+
+// A StorageClass parameter interpreted by the controller rather than passed on
+// to the provisioner: the reclaim policy of the class's PVs, one of Delete,
+// Retain or Recycle. Default Delete.
+const paramReclaimPolicy = "reclaimPolicy"
+
+// This annotation is added to a PV whose class asked for the Recycle reclaim
+// policy. The PV's actual reclaim policy is Retain so that the PV controller
+// leaves it alone and this controller can recycle it using the provisioner.
+const annReclaimPolicy = "provisioner.alpha.kubernetes.io/reclaim-policy"
+
+// These annotations are added to a claim or volume the controller failed to
+// provision a volume for, delete or recycle: the number of times it has
+// retried so far and when it will try next, in RFC 3339 format. Once the
+// controller gives up retrying, the latter is "never" and the controller
+// leaves the object alone until the annotation is removed.
+const annRetries = "provisioner.alpha.kubernetes.io/retries"
+const annNextAttempt = "provisioner.alpha.kubernetes.io/next-attempt"
+const nextAttemptNever = "never"
+
+// Number of workers processing the changes to claims and volumes seen by each
+// informer in parallel. The work they do is only deciding which keys to add to
+// claimQueue and volumeQueue, so it needn't be configurable.
+const informerWorkers = 4
 
 // ProvisionController is a controller that provisions PersistentVolumes for
 // PersistentVolumeClaims.
 type ProvisionController struct {
 	client kubernetes.Interface
 
-	// The name of the provisioner for which this controller dynamically
-	// provisions volumes. The value of annDynamicallyProvisioned and
-	// annStorageProvisioner to set & watch for, respectively
-	provisionerName string
-
-	// The provisioner the controller will use to provision and delete volumes.
-	// Presumably this implementer of Provisioner carries its own
-	// volume-specific options and such that it needs in order to provision
-	// volumes.
-	provisioner Provisioner
+	// The provisioners the controller will use to provision and delete
+	// volumes, by the names for which this controller dynamically provisions
+	// volumes: the values of annDynamicallyProvisioned and
+	// annStorageProvisioner to set & watch for, respectively. Presumably each
+	// implementer of Provisioner carries its own volume-specific options and
+	// such that it needs in order to provision volumes.
+	provisioners map[string]Provisioner
 
 	// Whether we are running in a 1.4 cluster before out-of-tree dynamic
 	// provisioning is officially supported
 	is1dot4 bool
 
-	claimSource      cache.ListerWatcher
-	claimController  *framework.Controller
+	// Whether PVs have a spec.mountOptions field, i.e. the cluster is 1.8 or
+	// later
+	hasMountOptionsField bool
+
+	// The namespaces of the claims to provision volumes for, and of the claims
+	// of the volumes to delete, or empty for all namespaces.
+	namespaces sets.String
+	// The selector of the labels of the claims to provision volumes for.
+	claimSelector labels.Selector
+
+	claimControllers []*framework.Controller
 	volumeSource     cache.ListerWatcher
 	volumeController *framework.Controller
 	classSource      cache.ListerWatcher
-	classReflector   *cache.Reflector
+	classController  *framework.Controller
 
 	volumes cache.Store
 	claims  cache.Store
@@ -100,64 +150,160 @@ type ProvisionController struct {
 
 	eventRecorder record.EventRecorder
 
-	// Map of scheduled/running operations.
-	runningOperations goroutinemap.GoRoutineMap
-
-	createProvisionedPVRetryCount int
-	createProvisionedPVInterval   time.Duration
+	// Identity of this instance of the provisioner among those with the same
+	// name, for holding leases on claims.
+	identity string
+
+	// Duration of leases on claims. If zero, instances don't take leases and
+	// race to provision volumes for the same claims.
+	leaseDuration time.Duration
+
+	// Queues of the keys of claims to provision volumes for and of the names
+	// of volumes to delete or recycle. Failed operations are retried with
+	// exponential backoff, up to maxRetries times or forever if it's zero.
+	claimQueue  *rateLimitingQueue
+	volumeQueue *rateLimitingQueue
+	maxRetries  int
+
+	// Number of workers provisioning volumes for claims from claimQueue and
+	// deleting or recycling volumes from volumeQueue, respectively.
+	provisionWorkers int
+	deleteWorkers    int
+
+	// Maximum duration of an operation. If zero, operations have no deadline.
+	operationTimeout time.Duration
+
+	// Lock for maxRetries and operationTimeout, which SetLimits may change
+	// while workers read them
+	limitsLock sync.RWMutex
+
+	// Feature toggles, see ProvisionControllerOptions
+	disableRecycle            bool
+	disableParameterOverrides bool
+
+	// Whether to only report what the controller would do, see
+	// ProvisionControllerOptions.DryRun. The UIDs of the claims and volumes
+	// already reported, so that resyncs don't report them again.
+	dryRun            bool
+	dryRunPlanned     sets.String
+	dryRunPlannedLock sync.Mutex
+
+	// Whether provisioning volumes and deleting and recycling volumes are
+	// paused, see PauseProvisioning and PauseDeletions
+	provisioningPaused     bool
+	provisioningPausedLock sync.Mutex
+	deletionsPaused        bool
+	deletionsPausedLock    sync.Mutex
+
+	// The UIDs of the claims notified that provisioning for them is paused, so
+	// that resyncs don't notify them again.
+	pausedClaims     sets.String
+	pausedClaimsLock sync.Mutex
+
+	// Functions to cancel the operations in progress on claims, by claim key,
+	// for when the claims are deleted.
+	operations     map[string]context.CancelFunc
+	operationsLock sync.Mutex
+
+	// Volumes provisioned for claims, by claim key, whose PV objects could not
+	// be created yet. Retries create the PV objects for them rather than
+	// provision more volumes.
+	pendingVolumes     map[string]*v1.PersistentVolume
+	pendingVolumesLock sync.Mutex
 }
 
+// NewProvisionController creates a controller that provisions volumes for
+// claims, and deletes or recycles them, using the given provisioners by name.
 func NewProvisionController(
 	client kubernetes.Interface,
-	serverGitVersion string,
-	resyncPeriod time.Duration,
-	provisionerName string,
-	provisioner Provisioner,
-) *ProvisionController {
-	broadcaster := record.NewBroadcaster()
-	broadcaster.StartRecordingToSink(&core_v1.EventSinkImpl{Interface: client.Core().Events(v1.NamespaceAll)})
-	var eventRecorder record.EventRecorder
-	out, err := exec.Command("hostname").Output()
-	if err != nil {
-		glog.Errorf("Error getting hostname for specifying it as source of events: %v", err)
-		eventRecorder = broadcaster.NewRecorder(v1.EventSource{Component: provisionerName})
-	} else {
-		eventRecorder = broadcaster.NewRecorder(v1.EventSource{Component: fmt.Sprintf("%s-%s", provisionerName, strings.TrimSpace(string(out)))})
+	provisioners map[string]Provisioner,
+	options ProvisionControllerOptions,
+) (*ProvisionController, error) {
+	options.setDefaults()
+	if err := options.validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %v", err)
 	}
 
-	gitVersion := version.MustParse(serverGitVersion)
+	serverGitVersion := options.ServerGitVersion
+	if serverGitVersion == "" {
+		serverVersion, err := client.Discovery().ServerVersion()
+		if err != nil {
+			return nil, fmt.Errorf("error getting server version: %v", err)
+		}
+		serverGitVersion = serverVersion.GitVersion
+	}
+	gitVersion, err := version.Parse(serverGitVersion)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing server version %q: %v", serverGitVersion, err)
+	}
 	gitVersion1dot5 := version.MustParse("1.5.0")
 	is1dot4 := gitVersion.LT(gitVersion1dot5)
+	hasMountOptionsField := !gitVersion.LT(version.MustParse("1.8.0"))
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		glog.Errorf("Error getting hostname for specifying it as source of events: %v", err)
+	}
+	identity := options.Identity
+	if identity == "" {
+		identity = hostname
+		if identity == "" {
+			identity = string(uuid.NewUUID())
+		}
+	}
+	eventSource := options.EventSource
+	if eventSource == "" {
+		provisionerNames := make([]string, 0, len(provisioners))
+		for name := range provisioners {
+			provisionerNames = append(provisionerNames, name)
+		}
+		sort.Strings(provisionerNames)
+		eventSource = strings.Join(provisionerNames, ",")
+		if hostname != "" {
+			eventSource = fmt.Sprintf("%s-%s", eventSource, hostname)
+		}
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&core_v1.EventSinkImpl{Interface: client.Core().Events(v1.NamespaceAll)})
+	eventRecorder := broadcaster.NewRecorder(v1.EventSource{Component: eventSource})
 
 	controller := &ProvisionController{
-		client:                        client,
-		provisionerName:               provisionerName,
-		provisioner:                   provisioner,
-		is1dot4:                       is1dot4,
-		eventRecorder:                 eventRecorder,
-		runningOperations:             goroutinemap.NewGoRoutineMap(false /* exponentialBackOffOnError */),
-		createProvisionedPVRetryCount: createProvisionedPVRetryCount,
-		createProvisionedPVInterval:   createProvisionedPVInterval,
+		client:                    client,
+		provisioners:              provisioners,
+		is1dot4:                   is1dot4,
+		hasMountOptionsField:      hasMountOptionsField,
+		namespaces:                sets.NewString(options.Namespaces...),
+		claimSelector:             options.ClaimSelector,
+		eventRecorder:             eventRecorder,
+		identity:                  identity,
+		leaseDuration:             options.LeaseDuration,
+		claimQueue:                newRateLimitingQueue(options.RetryBaseDelay, options.RetryMaxDelay),
+		volumeQueue:               newRateLimitingQueue(options.RetryBaseDelay, options.RetryMaxDelay),
+		maxRetries:                options.MaxRetries,
+		provisionWorkers:          options.ProvisionWorkers,
+		deleteWorkers:             options.DeleteWorkers,
+		operationTimeout:          options.OperationTimeout,
+		disableRecycle:            options.DisableRecycle,
+		disableParameterOverrides: options.DisableParameterOverrides,
+		dryRun:                    options.DryRun,
+		dryRunPlanned:             sets.NewString(),
+		pausedClaims:              sets.NewString(),
+		operations:                make(map[string]context.CancelFunc),
+		pendingVolumes:            make(map[string]*v1.PersistentVolume),
 	}
 
-	controller.claimSource = &cache.ListWatch{
-		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
-			return client.Core().PersistentVolumeClaims(v1.NamespaceAll).List(options)
-		},
-		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
-			return client.Core().PersistentVolumeClaims(v1.NamespaceAll).Watch(options)
-		},
+	// Watch the claims of each namespace separately, so that the controller
+	// only needs permission to watch claims in those namespaces
+	resyncPeriod := options.ResyncPeriod
+	if controller.namespaces.Len() == 0 {
+		controller.claims = controller.newClaimInformer(v1.NamespaceAll, resyncPeriod)
+	} else {
+		stores := make(map[string]cache.Store)
+		for _, namespace := range controller.namespaces.List() {
+			stores[namespace] = controller.newClaimInformer(namespace, resyncPeriod)
+		}
+		controller.claims = newNamespacedStore(stores)
 	}
-	controller.claims, controller.claimController = framework.NewInformer(
-		controller.claimSource,
-		&v1.PersistentVolumeClaim{},
-		resyncPeriod,
-		framework.ResourceEventHandlerFuncs{
-			AddFunc:    controller.addClaim,
-			UpdateFunc: controller.updateClaim,
-			DeleteFunc: nil,
-		},
-	)
 
 	controller.volumeSource = &cache.ListWatch{
 		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
@@ -167,7 +313,7 @@ func NewProvisionController(
 			return client.Core().PersistentVolumes().Watch(options)
 		},
 	}
-	controller.volumes, controller.volumeController = framework.NewInformer(
+	controller.volumes, controller.volumeController = framework.NewParallelInformer(
 		controller.volumeSource,
 		&v1.PersistentVolume{},
 		resyncPeriod,
@@ -176,6 +322,7 @@ func NewProvisionController(
 			UpdateFunc: controller.updateVolume,
 			DeleteFunc: nil,
 		},
+		informerWorkers,
 	)
 
 	controller.classSource = &cache.ListWatch{
@@ -186,23 +333,76 @@ func NewProvisionController(
 			return client.Storage().StorageClasses().Watch(options)
 		},
 	}
-	controller.classes = cache.NewStore(framework.DeletionHandlingMetaNamespaceKeyFunc)
-	controller.classReflector = cache.NewReflector(
+	controller.classes, controller.classController = framework.NewInformer(
 		controller.classSource,
 		&v1beta1.StorageClass{},
-		controller.classes,
 		resyncPeriod,
+		framework.ResourceEventHandlerFuncs{
+			AddFunc:    controller.addClass,
+			UpdateFunc: controller.updateClass,
+			DeleteFunc: nil,
+		},
 	)
 
-	return controller
+	return controller, nil
+}
+
+// newClaimInformer adds an informer of the claims in the given namespace that
+// match claimSelector to claimControllers and returns its store.
+func (ctrl *ProvisionController) newClaimInformer(namespace string, resyncPeriod time.Duration) cache.Store {
+	source := &cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = ctrl.claimSelector
+			return ctrl.client.Core().PersistentVolumeClaims(namespace).List(options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = ctrl.claimSelector
+			return ctrl.client.Core().PersistentVolumeClaims(namespace).Watch(options)
+		},
+	}
+	store, controller := framework.NewParallelInformer(
+		source,
+		&v1.PersistentVolumeClaim{},
+		resyncPeriod,
+		framework.ResourceEventHandlerFuncs{
+			AddFunc:    ctrl.addClaim,
+			UpdateFunc: ctrl.updateClaim,
+			DeleteFunc: ctrl.deleteClaim,
+		},
+		informerWorkers,
+	)
+	ctrl.claimControllers = append(ctrl.claimControllers, controller)
+	return store
 }
 
 func (ctrl *ProvisionController) Run(stopCh <-chan struct{}) {
 	glog.Info("Starting nfs provisioner controller!")
-	go ctrl.claimController.Run(stopCh)
+	for _, claimController := range ctrl.claimControllers {
+		go claimController.Run(stopCh)
+	}
 	go ctrl.volumeController.Run(stopCh)
-	go ctrl.classReflector.RunUntil(stopCh)
+	go ctrl.classController.Run(stopCh)
+
+	var wg sync.WaitGroup
+	wg.Add(ctrl.provisionWorkers + ctrl.deleteWorkers)
+	for i := 0; i < ctrl.provisionWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			ctrl.runClaimWorker()
+		}()
+	}
+	for i := 0; i < ctrl.deleteWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			ctrl.runVolumeWorker()
+		}()
+	}
+
 	<-stopCh
+	ctrl.claimQueue.ShutDown()
+	ctrl.volumeQueue.ShutDown()
+	// Let operations in progress finish
+	wg.Wait()
 }
 
 // On add claim, check if the added claim should have a volume provisioned for
@@ -215,11 +415,7 @@ func (ctrl *ProvisionController) addClaim(obj interface{}) {
 	}
 
 	if ctrl.shouldProvision(claim) {
-		opName := fmt.Sprintf("provision-%s[%s]", claimToClaimKey(claim), string(claim.UID))
-		ctrl.scheduleOperation(opName, func() error {
-			ctrl.provisionClaimOperation(claim)
-			return nil
-		})
+		ctrl.enqueue(ctrl.claimQueue, claimToClaimKey(claim), claim, claim.ObjectMeta)
 	}
 }
 
@@ -229,6 +425,69 @@ func (ctrl *ProvisionController) updateClaim(oldObj, newObj interface{}) {
 	ctrl.addClaim(newObj)
 }
 
+// On delete claim, cancel any operation in progress on the claim and process it
+// right away, without waiting out any backoff, so that any volume provisioned
+// for it in vain is deleted.
+func (ctrl *ProvisionController) deleteClaim(obj interface{}) {
+	key, err := framework.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Error getting key of deleted claim %+v: %v", obj, err)
+		return
+	}
+	ctrl.cancelOperation(key)
+	ctrl.claimQueue.AddAfter(key, 0)
+}
+
+// On add class, provision volumes right away for the claims of the class that
+// should have them, e.g. claims created before the class, instead of waiting
+// for the next resync or retry.
+func (ctrl *ProvisionController) addClass(obj interface{}) {
+	class, ok := obj.(*v1beta1.StorageClass)
+	if !ok {
+		glog.Errorf("Expected StorageClass but addClass received %+v", obj)
+		return
+	}
+	if _, ok := ctrl.provisioners[class.Provisioner]; !ok {
+		return
+	}
+
+	for _, claimObj := range ctrl.claims.List() {
+		claim, ok := claimObj.(*v1.PersistentVolumeClaim)
+		if !ok || getClaimClass(claim) != class.Name || !ctrl.shouldProvision(claim) {
+			continue
+		}
+		if claim.Annotations[annNextAttempt] == nextAttemptNever {
+			continue
+		}
+		// Cut short any backoff, e.g. after failing because the class was
+		// missing
+		ctrl.claimQueue.AddAfter(claimToClaimKey(claim), 0)
+	}
+}
+
+// On update class, pass the new class to addClass if it has really changed, as
+// opposed to merely been resynced. If the change lifts a pause of deletion,
+// queue the class's volumes too.
+func (ctrl *ProvisionController) updateClass(oldObj, newObj interface{}) {
+	oldClass, ok := oldObj.(*v1beta1.StorageClass)
+	if ok {
+		newClass, ok := newObj.(*v1beta1.StorageClass)
+		if ok && oldClass.ResourceVersion == newClass.ResourceVersion {
+			return
+		}
+		if ok {
+			_, wasPaused := getPausedOperations(oldClass)
+			_, isPaused := getPausedOperations(newClass)
+			if wasPaused && !isPaused {
+				if _, ours := ctrl.provisioners[newClass.Provisioner]; ours {
+					ctrl.queueClassVolumes(newClass.Name)
+				}
+			}
+		}
+	}
+	ctrl.addClass(newObj)
+}
+
 // On update volume, check if the updated volume should be deleted and delete if
 // so. Updates occur at least every resyncPeriod.
 func (ctrl *ProvisionController) updateVolume(oldObj, newObj interface{}) {
@@ -237,13 +496,322 @@ func (ctrl *ProvisionController) updateVolume(oldObj, newObj interface{}) {
 		glog.Errorf("Expected PersistentVolume but handler received %#v", newObj)
 		return
 	}
+	if !ctrl.watchesNamespaceOf(volume) {
+		return
+	}
+
+	if ctrl.shouldDelete(volume) || ctrl.shouldRecycle(volume) {
+		ctrl.enqueue(ctrl.volumeQueue, volume.Name, volume, volume.ObjectMeta)
+	}
+}
+
+// watchesNamespaceOf returns whether the claim of the given volume is, or was,
+// in one of the namespaces the controller watches.
+func (ctrl *ProvisionController) watchesNamespaceOf(volume *v1.PersistentVolume) bool {
+	if ctrl.namespaces.Len() == 0 {
+		return true
+	}
+	return volume.Spec.ClaimRef != nil && ctrl.namespaces.Has(volume.Spec.ClaimRef.Namespace)
+}
 
+// enqueue adds the given key of the given claim or volume to the given queue,
+// unless the controller has given up retrying work on the object. If this
+// instance of the controller hasn't tried to work on the object yet, the
+// annotations on it carry the backoff over from previous instances.
+func (ctrl *ProvisionController) enqueue(queue *rateLimitingQueue, key string, obj runtime.Object, meta v1.ObjectMeta) {
+	nextAttempt, found := meta.Annotations[annNextAttempt]
+	if !found {
+		if maxRetries := ctrl.getMaxRetries(); maxRetries != 0 && queue.NumRequeues(key) >= maxRetries {
+			// Either a user removed the annotation so that the controller
+			// retries after it has given up, or the cache has yet to see it
+			if ctrl.hasGivenUp(obj) {
+				return
+			}
+			queue.Forget(key)
+		}
+		queue.Add(key)
+		return
+	}
+	if nextAttempt == nextAttemptNever {
+		glog.V(4).Infof("gave up retrying %q, skipping", key)
+		return
+	}
+	if queue.NumRequeues(key) != 0 {
+		queue.Add(key)
+		return
+	}
+
+	if retries, err := strconv.Atoi(meta.Annotations[annRetries]); err == nil {
+		queue.SetRequeues(key, retries)
+	}
+	if t, err := time.Parse(time.RFC3339, nextAttempt); err == nil {
+		queue.AddAfter(key, t.Sub(time.Now()))
+		return
+	}
+	queue.Add(key)
+}
+
+func (ctrl *ProvisionController) runClaimWorker() {
+	for ctrl.processNextClaimWorkItem() {
+	}
+}
+
+// processNextClaimWorkItem provisions a volume for the next claim in
+// claimQueue if it still needs one. It returns false once the queue is shut
+// down.
+func (ctrl *ProvisionController) processNextClaimWorkItem() bool {
+	key, quit := ctrl.claimQueue.Get()
+	if quit {
+		return false
+	}
+	defer ctrl.claimQueue.Done(key)
+
+	obj, exists, err := ctrl.claims.GetByKey(key)
+	if err != nil {
+		glog.Errorf("Error getting claim %q: %v", key, err)
+		ctrl.claimQueue.Forget(key)
+		return true
+	}
+	if !exists {
+		// The claim was deleted, so delete any volume provisioned for it
+		// whose PV object could not be created
+		ctrl.claimQueue.Forget(key)
+		ctrl.cleanupPendingVolume(key)
+		return true
+	}
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		glog.Errorf("Expected PersistentVolumeClaim but claim store contained %+v", obj)
+		ctrl.claimQueue.Forget(key)
+		return true
+	}
+	if !ctrl.shouldProvision(claim) {
+		ctrl.claimQueue.Forget(key)
+		ctrl.cleanupPendingVolume(key)
+		return true
+	}
+
+	if reason := ctrl.provisioningPausedReason(claim); reason != "" {
+		// Lifting the pause queues the claim again
+		ctrl.notifyPaused(claim, reason)
+		ctrl.claimQueue.Forget(key)
+		return true
+	}
+	ctrl.clearPaused(claim.UID)
+
+	ctx, cancel := ctrl.newOperationContext()
+	ctrl.setOperation(key, cancel)
+	err = ctrl.provisionClaimOperation(ctx, claim)
+	canceled := err != nil && ctx.Err() == context.Canceled
+	ctrl.removeOperation(key)
+	cancel()
+	if canceled {
+		// The claim was deleted, there's no point retrying
+		glog.Infof("provisioning for claim %q canceled: %v", key, err)
+		ctrl.claimQueue.Forget(key)
+		ctrl.cleanupPendingVolume(key)
+		return true
+	}
+	if gaveUp := ctrl.handleErr(ctrl.claimQueue, key, claim, claim.ObjectMeta, err, "ProvisioningFailed"); gaveUp {
+		ctrl.cleanupPendingVolume(key)
+	}
+	return true
+}
+
+func (ctrl *ProvisionController) runVolumeWorker() {
+	for ctrl.processNextVolumeWorkItem() {
+	}
+}
+
+// processNextVolumeWorkItem deletes or recycles the next volume in volumeQueue
+// if it still needs it. It returns false once the queue is shut down.
+func (ctrl *ProvisionController) processNextVolumeWorkItem() bool {
+	key, quit := ctrl.volumeQueue.Get()
+	if quit {
+		return false
+	}
+	defer ctrl.volumeQueue.Done(key)
+
+	obj, exists, err := ctrl.volumes.GetByKey(key)
+	if err != nil {
+		glog.Errorf("Error getting volume %q: %v", key, err)
+		ctrl.volumeQueue.Forget(key)
+		return true
+	}
+	if !exists {
+		ctrl.volumeQueue.Forget(key)
+		return true
+	}
+	volume, ok := obj.(*v1.PersistentVolume)
+	if !ok {
+		glog.Errorf("Expected PersistentVolume but volume store contained %+v", obj)
+		ctrl.volumeQueue.Forget(key)
+		return true
+	}
+
+	if ctrl.deletionPaused(volume) {
+		// Lifting the pause queues the volume again
+		glog.V(4).Infof("deletions paused, skipping volume %q", key)
+		ctrl.volumeQueue.Forget(key)
+		return true
+	}
+
+	ctx, cancel := ctrl.newOperationContext()
+	defer cancel()
 	if ctrl.shouldDelete(volume) {
-		opName := fmt.Sprintf("delete-%s[%s]", volume.Name, string(volume.UID))
-		ctrl.scheduleOperation(opName, func() error {
-			ctrl.deleteVolumeOperation(volume)
-			return nil
-		})
+		err = ctrl.deleteVolumeOperation(ctx, volume)
+		ctrl.handleErr(ctrl.volumeQueue, key, volume, volume.ObjectMeta, err, "VolumeFailedDelete")
+	} else if ctrl.shouldRecycle(volume) {
+		err = ctrl.recycleVolumeOperation(ctx, volume)
+		ctrl.handleErr(ctrl.volumeQueue, key, volume, volume.ObjectMeta, err, "VolumeFailedRecycle")
+	} else {
+		ctrl.volumeQueue.Forget(key)
+	}
+	return true
+}
+
+// newOperationContext returns a context for a new operation, done when the
+// operation's deadline passes if it has one.
+func (ctrl *ProvisionController) newOperationContext() (context.Context, context.CancelFunc) {
+	ctrl.limitsLock.RLock()
+	operationTimeout := ctrl.operationTimeout
+	ctrl.limitsLock.RUnlock()
+	if operationTimeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), operationTimeout)
+}
+
+// SetLimits changes the maximum number of times to retry a failed operation and
+// the maximum duration of an operation, e.g. when the configuration is
+// reloaded. Zero means retry forever and no deadline, respectively. Operations
+// in progress keep their deadlines.
+func (ctrl *ProvisionController) SetLimits(maxRetries int, operationTimeout time.Duration) error {
+	if maxRetries < 0 || operationTimeout < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	ctrl.limitsLock.Lock()
+	defer ctrl.limitsLock.Unlock()
+	ctrl.maxRetries = maxRetries
+	ctrl.operationTimeout = operationTimeout
+	return nil
+}
+
+func (ctrl *ProvisionController) getMaxRetries() int {
+	ctrl.limitsLock.RLock()
+	defer ctrl.limitsLock.RUnlock()
+	return ctrl.maxRetries
+}
+
+func (ctrl *ProvisionController) setOperation(claimKey string, cancel context.CancelFunc) {
+	ctrl.operationsLock.Lock()
+	defer ctrl.operationsLock.Unlock()
+	ctrl.operations[claimKey] = cancel
+}
+
+func (ctrl *ProvisionController) removeOperation(claimKey string) {
+	ctrl.operationsLock.Lock()
+	defer ctrl.operationsLock.Unlock()
+	delete(ctrl.operations, claimKey)
+}
+
+// cancelOperation cancels the operation in progress on the claim with the
+// given key, if any.
+func (ctrl *ProvisionController) cancelOperation(claimKey string) {
+	ctrl.operationsLock.Lock()
+	defer ctrl.operationsLock.Unlock()
+	if cancel, ok := ctrl.operations[claimKey]; ok {
+		glog.Infof("claim %q deleted, canceling provisioning", claimKey)
+		cancel()
+	}
+}
+
+// handleErr handles the result of an operation on the given claim or volume
+// with the given key. If the operation failed, it requeues the key with
+// exponential backoff and records the number of retries and the time of the
+// next attempt on the object. After maxRetries retries it gives up instead,
+// emits an event with the given reason and returns true.
+func (ctrl *ProvisionController) handleErr(queue *rateLimitingQueue, key string, obj runtime.Object, meta v1.ObjectMeta, err error, reason string) bool {
+	if err == nil {
+		if hasAnnotation(meta, annRetries) || hasAnnotation(meta, annNextAttempt) {
+			ctrl.updateRetryAnnotations(obj, 0, "")
+		}
+		queue.Forget(key)
+		return false
+	}
+
+	retries := queue.NumRequeues(key)
+	if maxRetries := ctrl.getMaxRetries(); maxRetries == 0 || retries < maxRetries {
+		delay := queue.AddRateLimited(key)
+		glog.Infof("operation on %q failed, retrying in %v: %v", key, delay, err)
+		ctrl.updateRetryAnnotations(obj, retries+1, time.Now().Add(delay).Format(time.RFC3339))
+		return false
+	}
+
+	strerr := fmt.Sprintf("Giving up after %d retries: %v. Remove annotation %s to retry.", retries, err, annNextAttempt)
+	glog.Errorf("operation on %q failed: %s", key, strerr)
+	ctrl.eventRecorder.Event(obj, v1.EventTypeWarning, reason, strerr)
+	ctrl.updateRetryAnnotations(obj, retries, nextAttemptNever)
+	return true
+}
+
+// hasGivenUp returns whether the latest version of the given claim or volume
+// says the controller has given up retrying work on it.
+func (ctrl *ProvisionController) hasGivenUp(obj runtime.Object) bool {
+	var annotations map[string]string
+	switch obj := obj.(type) {
+	case *v1.PersistentVolumeClaim:
+		claim, err := ctrl.client.Core().PersistentVolumeClaims(obj.Namespace).Get(obj.Name)
+		if err != nil {
+			return false
+		}
+		annotations = claim.Annotations
+	case *v1.PersistentVolume:
+		volume, err := ctrl.client.Core().PersistentVolumes().Get(obj.Name)
+		if err != nil {
+			return false
+		}
+		annotations = volume.Annotations
+	}
+	return annotations[annNextAttempt] == nextAttemptNever
+}
+
+// updateRetryAnnotations sets annRetries and annNextAttempt on the given claim
+// or volume to the given values, or removes them if retries is zero. In a dry
+// run it does nothing.
+func (ctrl *ProvisionController) updateRetryAnnotations(obj runtime.Object, retries int, nextAttempt string) {
+	if ctrl.dryRun {
+		return
+	}
+	switch obj := obj.(type) {
+	case *v1.PersistentVolumeClaim:
+		claim, err := ctrl.client.Core().PersistentVolumeClaims(obj.Namespace).Get(obj.Name)
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				glog.Errorf("Error getting claim %q to annotate it with retries: %v", claimToClaimKey(obj), err)
+			}
+			return
+		}
+		if claim.UID != obj.UID || !setRetryAnnotations(&claim.ObjectMeta, retries, nextAttempt) {
+			return
+		}
+		if _, err = ctrl.client.Core().PersistentVolumeClaims(obj.Namespace).Update(claim); err != nil {
+			glog.Errorf("Error annotating claim %q with retries: %v", claimToClaimKey(obj), err)
+		}
+	case *v1.PersistentVolume:
+		volume, err := ctrl.client.Core().PersistentVolumes().Get(obj.Name)
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				glog.Errorf("Error getting volume %q to annotate it with retries: %v", obj.Name, err)
+			}
+			return
+		}
+		if volume.UID != obj.UID || !setRetryAnnotations(&volume.ObjectMeta, retries, nextAttempt) {
+			return
+		}
+		if _, err = ctrl.client.Core().PersistentVolumes().Update(volume); err != nil {
+			glog.Errorf("Error annotating volume %q with retries: %v", obj.Name, err)
+		}
 	}
 }
 
@@ -254,10 +822,7 @@ func (ctrl *ProvisionController) shouldProvision(claim *v1.PersistentVolumeClaim
 
 	// Kubernetes 1.5 provisioning with annDynamicallyProvisioned
 	if provisioner, found := claim.Annotations[annDynamicallyProvisioned]; found {
-		if provisioner == ctrl.provisionerName {
-			return true
-		}
-		return false
+		return ctrl.accepts(provisioner, claim)
 	}
 
 	// Kubernetes 1.4 provisioning, evaluating class.Provisioner
@@ -277,10 +842,19 @@ func (ctrl *ProvisionController) shouldProvision(claim *v1.PersistentVolumeClaim
 		return false
 	}
 
-	if class.Provisioner != ctrl.provisionerName {
+	return ctrl.accepts(class.Provisioner, claim)
+}
+
+// accepts returns whether the named provisioner is one of this controller's
+// and, if it's a Qualifier, accepts the given claim.
+func (ctrl *ProvisionController) accepts(provisionerName string, claim *v1.PersistentVolumeClaim) bool {
+	provisioner, ok := ctrl.provisioners[provisionerName]
+	if !ok {
 		return false
 	}
-
+	if qualifier, ok := provisioner.(Qualifier); ok {
+		return qualifier.ShouldProvision(claim)
+	}
 	return true
 }
 
@@ -305,16 +879,47 @@ func (ctrl *ProvisionController) shouldDelete(volume *v1.PersistentVolume) bool
 		return false
 	}
 
-	if ann := volume.Annotations[annDynamicallyProvisioned]; ann != ctrl.provisionerName {
+	if _, ok := ctrl.provisioners[volume.Annotations[annDynamicallyProvisioned]]; !ok {
+		return false
+	}
+
+	return true
+}
+
+// shouldRecycle returns whether the given volume is a released volume this
+// controller provisioned with the Recycle reclaim policy.
+func (ctrl *ProvisionController) shouldRecycle(volume *v1.PersistentVolume) bool {
+	if volume.Status.Phase != v1.VolumeReleased {
+		return false
+	}
+
+	// A recycled volume has its ClaimRef cleared before the PV controller
+	// makes it Available again
+	if volume.Spec.ClaimRef == nil {
+		return false
+	}
+
+	if volume.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
+		return false
+	}
+
+	if ann := volume.Annotations[annReclaimPolicy]; ann != string(v1.PersistentVolumeReclaimRecycle) {
+		return false
+	}
+
+	if _, ok := ctrl.provisioners[volume.Annotations[annDynamicallyProvisioned]]; !ok {
 		return false
 	}
 
 	return true
 }
 
-func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVolumeClaim) {
+func (ctrl *ProvisionController) provisionClaimOperation(ctx context.Context, claim *v1.PersistentVolumeClaim) error {
 	// Most code here is identical to that found in controller.go of kube's PV controller...
 	claimClass := getClaimClass(claim)
+	if ctrl.dryRun && ctrl.isPlanned(claim.UID) {
+		return nil
+	}
 	glog.Infof("provisionClaimOperation [%s] started, class: %q", claimToClaimKey(claim), claimClass)
 
 	//  A previous doProvisionClaim may just have finished while we were waiting for
@@ -325,7 +930,8 @@ func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVol
 	if err == nil && volume != nil {
 		// Volume has been already provisioned, nothing to do.
 		glog.Infof("provisionClaimOperation [%s]: volume already exists, skipping", claimToClaimKey(claim))
-		return
+		ctrl.removePendingVolume(claimToClaimKey(claim))
+		return nil
 	}
 
 	// Prepare a claimRef to the claim early (to fail before a volume is
@@ -333,106 +939,239 @@ func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVol
 	claimRef, err := v1.GetReference(claim)
 	if err != nil {
 		glog.Errorf("unexpected error getting claim reference: %v", err)
+		return fmt.Errorf("unexpected error getting claim reference: %v", err)
+	}
+
+	// If other instances with the same name may be racing to provision a
+	// volume for the claim, only proceed while holding the lease on it. Give
+	// up the lease if no volume gets provisioned so that another instance can
+	// try.
+	provisioned := false
+	lostCh := make(chan struct{})
+	if ctrl.leaseDuration != 0 && !ctrl.dryRun {
+		held, err := ctrl.tryAcquireOrRenewLease(claim)
+		if err != nil {
+			glog.Errorf("Error acquiring lease on claim %q: %v", claimToClaimKey(claim), err)
+			return fmt.Errorf("error acquiring lease: %v", err)
+		}
+		if !held {
+			glog.Infof("provisionClaimOperation [%s]: another instance holds the lease on the claim, standing by", claimToClaimKey(claim))
+			return nil
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		stopCh := make(chan struct{})
+		go ctrl.renewLease(claim, stopCh, lostCh, cancel)
+		defer func() {
+			close(stopCh)
+			cancel()
+			if !provisioned {
+				ctrl.releaseLease(claim)
+			}
+		}()
+	}
+
+	// Retry creating the PV object for a volume provisioned by a previous
+	// attempt rather than provision another
+	volume = ctrl.getPendingVolume(claimToClaimKey(claim))
+	if volume != nil && volume.Name != pvName {
+		// The claim was deleted and recreated with the same name
+		ctrl.cleanupPendingVolume(claimToClaimKey(claim))
+		volume = nil
+	}
+	if volume == nil {
+		volume, err = ctrl.provisionVolume(ctx, claim, claimClass, claimRef, pvName)
+		if err != nil {
+			return err
+		}
+		if volume == nil {
+			return nil
+		}
+	}
+	provisioned = true
+
+	if ctrl.dryRun {
+		msg := fmt.Sprintf("Dry run: would provision volume %s with StorageClass %q and create PV object %s", describeVolumeSource(volume), claimClass, volume.Name)
+		glog.Infof("provisionClaimOperation [%s]: %s", claimToClaimKey(claim), msg)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeNormal, "DryRunProvision", msg)
+		ctrl.setPlanned(claim.UID)
+		return nil
+	}
+
+	if err = ctx.Err(); err != nil {
+		select {
+		case <-lostCh:
+			// Another instance holds the lease now and provisions its own
+			// volume for the claim, so this one would never be saved
+			ctrl.deleteVolume(claimToClaimKey(claim), volume)
+			return fmt.Errorf("error provisioning volume: lost lease on claim")
+		default:
+		}
+		// The claim was deleted or the deadline passed while provisioning.
+		// Keep the volume to be saved by the next attempt, or deleted if the
+		// claim is gone.
+		ctrl.setPendingVolume(claimToClaimKey(claim), volume)
+		return fmt.Errorf("error provisioning volume: %v", err)
+	}
+
+	glog.Infof("provisionClaimOperation [%s]: trying to save volume %s", claimToClaimKey(claim), volume.Name)
+	if _, err = ctrl.client.Core().PersistentVolumes().Create(volume); err != nil {
+		// Save failed. Now we have a storage asset outside of Kubernetes,
+		// but we don't have appropriate PV object for it. Keep it around so
+		// the next attempt tries to save it again, and delete it if the
+		// controller gives up.
+		ctrl.setPendingVolume(claimToClaimKey(claim), volume)
+		strerr := fmt.Sprintf("Error creating provisioned PV object for claim %s: %v", claimToClaimKey(claim), err)
+		glog.Info(strerr)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		return fmt.Errorf("error creating provisioned PV object: %v", err)
+	}
+	ctrl.removePendingVolume(claimToClaimKey(claim))
+	ctrl.moveMountOptions(volume)
+
+	glog.Infof("volume %q provisioned for claim %q", volume.Name, claimToClaimKey(claim))
+	return nil
+}
+
+// moveMountOptions moves the mount options of the given created PV from its
+// annMountOptions annotation to its spec.mountOptions field, in one patch, if
+// the cluster has the field. If the patch fails, the options stay in the
+// annotation, which the kubelet still honors.
+func (ctrl *ProvisionController) moveMountOptions(volume *v1.PersistentVolume) {
+	options, ok := volume.Annotations[annMountOptions]
+	if !ctrl.hasMountOptionsField || !ok {
+		return
+	}
+	mountOptions := []string{}
+	for _, option := range strings.Split(options, ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			mountOptions = append(mountOptions, option)
+		}
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{annMountOptions: nil},
+		},
+		"spec": map[string]interface{}{
+			"mountOptions": mountOptions,
+		},
+	})
+	if err != nil {
+		glog.Errorf("Error marshalling mount options patch of volume %q: %v", volume.Name, err)
 		return
 	}
+	if _, err := ctrl.client.Core().PersistentVolumes().Patch(volume.Name, api.MergePatchType, patch); err != nil {
+		glog.Errorf("Error moving mount options of volume %q to spec.mountOptions, leaving them in annotation %s: %v", volume.Name, annMountOptions, err)
+	}
+}
 
+// provisionVolume provisions a volume for the given claim using the
+// provisioner and returns the PV object to create for it, or nil if the claim
+// turns out not to be for this provisioner.
+func (ctrl *ProvisionController) provisionVolume(ctx context.Context, claim *v1.PersistentVolumeClaim, claimClass string, claimRef *v1.ObjectReference, pvName string) (*v1.PersistentVolume, error) {
 	classObj, found, err := ctrl.classes.GetByKey(claimClass)
 	if err != nil {
 		glog.Errorf("Error getting StorageClass %q: %v", claimClass, err)
-		return
+		return nil, fmt.Errorf("error getting StorageClass %q: %v", claimClass, err)
 	}
 	if !found {
-		glog.Errorf("StorageClass %q not found", claimClass)
 		// 3. It tries to find a StorageClass instance referenced by annotation
 		//    `claim.Annotations["volume.beta.kubernetes.io/storage-class"]`. If not
 		//    found, it SHOULD report an error (by sending an event to the claim) and it
 		//    SHOULD retry periodically with step i.
-		return
+		strerr := fmt.Sprintf("Failed to provision volume: StorageClass %q not found", claimClass)
+		glog.Errorf("Failed to provision volume for claim %q: StorageClass %q not found", claimToClaimKey(claim), claimClass)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		return nil, fmt.Errorf("StorageClass %q not found", claimClass)
 	}
 	storageClass, ok := classObj.(*v1beta1.StorageClass)
 	if !ok {
 		glog.Errorf("Cannot convert object to StorageClass: %+v", classObj)
-		return
+		return nil, fmt.Errorf("cannot convert object to StorageClass: %+v", classObj)
 	}
-	if storageClass.Provisioner != ctrl.provisionerName {
+	provisioner, ok := ctrl.provisioners[storageClass.Provisioner]
+	if !ok {
 		// class.Provisioner has either changed since shouldProvision() or
 		// annDynamicallyProvisioned contains different provisioner than
 		// class.Provisioner.
 		glog.Errorf("Unknown provisioner %q requested in storage class %q", claimClass, storageClass.Provisioner)
-		return
+		return nil, nil
 	}
 
-	options := VolumeOptions{
-		Capacity:    claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
-		AccessModes: claim.Spec.AccessModes,
-		// TODO SHOULD be set to `Delete` unless user manually congiures other reclaim policy.
-		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
-		PVName:     pvName,
-		Parameters: storageClass.Parameters,
+	overrides := claim.Annotations
+	if ctrl.disableParameterOverrides {
+		overrides = nil
 	}
-
-	volume, err = ctrl.provisioner.Provision(options)
+	parameters, err := getParameters(storageClass, overrides)
 	if err != nil {
 		strerr := fmt.Sprintf("Failed to provision volume with StorageClass %q: %v", storageClass.Name, err)
-		glog.Errorf("Failed to provision volume for claim %q with StorageClass %q: %v", claimToClaimKey(claim), claim.Name, err)
+		glog.Errorf("Failed to provision volume for claim %q with StorageClass %q: %v", claimToClaimKey(claim), storageClass.Name, err)
 		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
-		return
+		return nil, err
 	}
 
-	glog.Infof("volume %q for claim %q created", volume.Name, claimToClaimKey(claim))
-
-	// Set ClaimRef and the PV controller will bind and set annBoundByController for us
-	volume.Spec.ClaimRef = claimRef
+	reclaimPolicy, err := ctrl.getReclaimPolicy(storageClass.Provisioner, parameters)
+	if err != nil {
+		strerr := fmt.Sprintf("Failed to provision volume with StorageClass %q: %v", storageClass.Name, err)
+		glog.Errorf("Failed to provision volume for claim %q with StorageClass %q: %v", claimToClaimKey(claim), storageClass.Name, err)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		return nil, err
+	}
+	// The controller recycles volumes itself, see annReclaimPolicy
+	pvReclaimPolicy := reclaimPolicy
+	if reclaimPolicy == v1.PersistentVolumeReclaimRecycle {
+		pvReclaimPolicy = v1.PersistentVolumeReclaimRetain
+	}
 
-	setAnnotation(&volume.ObjectMeta, annDynamicallyProvisioned, ctrl.provisionerName)
-	setAnnotation(&volume.ObjectMeta, annClass, claimClass)
+	options := VolumeOptions{
+		Capacity:                      claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
+		AccessModes:                   claim.Spec.AccessModes,
+		PersistentVolumeReclaimPolicy: pvReclaimPolicy,
+		Recycle:                       reclaimPolicy == v1.PersistentVolumeReclaimRecycle,
+		PVName:                        pvName,
+		Parameters:                    parameters,
+		PVC:                           claim,
+	}
 
-	// Try to create the PV object several times
-	for i := 0; i < ctrl.createProvisionedPVRetryCount; i++ {
-		glog.Infof("provisionClaimOperation [%s]: trying to save volume %s", claimToClaimKey(claim), volume.Name)
-		if _, err = ctrl.client.Core().PersistentVolumes().Create(volume); err == nil {
-			// Save succeeded.
-			glog.Infof("volume %q for claim %q saved", volume.Name, claimToClaimKey(claim))
-			break
+	if validator, ok := provisioner.(Validator); ok {
+		if err := validator.Validate(options); err != nil {
+			strerr := fmt.Sprintf("Failed to provision volume with StorageClass %q: %v", storageClass.Name, err)
+			glog.Errorf("Failed to provision volume for claim %q with StorageClass %q: %v", claimToClaimKey(claim), storageClass.Name, err)
+			ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+			return nil, err
 		}
-		// Save failed, try again after a while.
-		glog.Infof("failed to save volume %q for claim %q: %v", volume.Name, claimToClaimKey(claim), err)
-		time.Sleep(ctrl.createProvisionedPVInterval)
 	}
 
+	var volume *v1.PersistentVolume
+	if ctrl.dryRun {
+		volume, err = dryRunProvision(provisioner, options)
+	} else {
+		volume, err = provisioner.Provision(ctx, options)
+	}
 	if err != nil {
-		// Save failed. Now we have a storage asset outside of Kubernetes,
-		// but we don't have appropriate PV object for it.
-		// Emit some event here and try to delete the storage asset several
-		// times.
-		strerr := fmt.Sprintf("Error creating provisioned PV object for claim %s: %v. Deleting the volume.", claimToClaimKey(claim), err)
-		glog.Info(strerr)
+		strerr := fmt.Sprintf("Failed to provision volume with StorageClass %q: %v", storageClass.Name, err)
+		glog.Errorf("Failed to provision volume for claim %q with StorageClass %q: %v", claimToClaimKey(claim), claim.Name, err)
 		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		return nil, err
+	}
 
-		for i := 0; i < ctrl.createProvisionedPVRetryCount; i++ {
-			if err = ctrl.provisioner.Delete(volume); err == nil {
-				// Delete succeeded
-				glog.Infof("provisionClaimOperation [%s]: cleaning volume %s succeeded", claimToClaimKey(claim), volume.Name)
-				break
-			}
-			// Delete failed, try again after a while.
-			glog.Infof("failed to delete volume %q: %v", volume.Name, err)
-			time.Sleep(ctrl.createProvisionedPVInterval)
-		}
+	if !ctrl.dryRun {
+		glog.Infof("volume %q for claim %q created", volume.Name, claimToClaimKey(claim))
+	}
 
-		if err != nil {
-			// Delete failed several times. There is an orphaned volume and there
-			// is nothing we can do about it.
-			strerr := fmt.Sprintf("Error cleaning provisioned volume for claim %s: %v. Please delete manually.", claimToClaimKey(claim), err)
-			glog.Info(strerr)
-			ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningCleanupFailed", strerr)
-		}
-	} else {
-		glog.Infof("volume %q provisioned for claim %q", volume.Name, claimToClaimKey(claim))
+	// Set ClaimRef and the PV controller will bind and set annBoundByController for us
+	volume.Spec.ClaimRef = claimRef
+
+	setAnnotation(&volume.ObjectMeta, annDynamicallyProvisioned, storageClass.Provisioner)
+	setAnnotation(&volume.ObjectMeta, annClass, claimClass)
+	if reclaimPolicy == v1.PersistentVolumeReclaimRecycle {
+		setAnnotation(&volume.ObjectMeta, annReclaimPolicy, string(reclaimPolicy))
 	}
+
+	return volume, nil
 }
 
-func (ctrl *ProvisionController) deleteVolumeOperation(volume *v1.PersistentVolume) {
+func (ctrl *ProvisionController) deleteVolumeOperation(ctx context.Context, volume *v1.PersistentVolume) error {
 	glog.Infof("deleteVolumeOperation [%s] started", volume.Name)
 
 	// This method may have been waiting for a volume lock for some time.
@@ -441,31 +1180,194 @@ func (ctrl *ProvisionController) deleteVolumeOperation(volume *v1.PersistentVolu
 	// ours to delete
 	newVolume, err := ctrl.client.Core().PersistentVolumes().Get(volume.Name)
 	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
 		glog.Infof("error reading peristent volume %q: %v", volume.Name, err)
-		return
+		return fmt.Errorf("error reading persistent volume: %v", err)
 	}
 	if !ctrl.shouldDelete(newVolume) {
 		glog.Infof("volume %q no longer needs deletion, skipping", volume.Name)
-		return
+		return nil
 	}
 
-	if err := ctrl.provisioner.Delete(volume); err != nil {
+	// shouldDelete has made sure this is one of our provisioners
+	provisioner := ctrl.provisioners[newVolume.Annotations[annDynamicallyProvisioned]]
+	if ctrl.dryRun {
+		return ctrl.dryRunDelete(provisioner, newVolume)
+	}
+	if err := provisioner.Delete(ctx, volume); err != nil {
 		// Delete failed, emit an event.
 		glog.Infof("deletion of volume %q failed: %v", volume.Name, err)
 		ctrl.eventRecorder.Event(volume, v1.EventTypeWarning, "VolumeFailedDelete", err.Error())
-		return
+		return err
 	}
 
 	glog.Infof("deleteVolumeOperation [%s]: success", volume.Name)
 	// Delete the volume
 	if err = ctrl.client.Core().PersistentVolumes().Delete(volume.Name, nil); err != nil {
 		// Oops, could not delete the volume and therefore the controller will
-		// try to delete the volume again on next update.
+		// try to delete the volume again.
 		glog.Infof("failed to delete volume %q from database: %v", volume.Name, err)
-		return
+		return fmt.Errorf("error deleting persistent volume: %v", err)
+	}
+
+	if hook, ok := provisioner.(PostDeleteHook); ok {
+		hook.PostDelete(volume)
+	}
+
+	return nil
+}
+
+func (ctrl *ProvisionController) recycleVolumeOperation(ctx context.Context, volume *v1.PersistentVolume) error {
+	glog.Infof("recycleVolumeOperation [%s] started", volume.Name)
+
+	// As in deleteVolumeOperation, check that the volume still needs recycling
+	// and work on the latest version of it, since we are going to update it
+	newVolume, err := ctrl.client.Core().PersistentVolumes().Get(volume.Name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		glog.Infof("error reading peristent volume %q: %v", volume.Name, err)
+		return fmt.Errorf("error reading persistent volume: %v", err)
+	}
+	if !ctrl.shouldRecycle(newVolume) {
+		glog.Infof("volume %q no longer needs recycling, skipping", volume.Name)
+		return nil
+	}
+
+	provisionerName := newVolume.Annotations[annDynamicallyProvisioned]
+	recycler, ok := ctrl.provisioners[provisionerName].(Recycler)
+	if !ok {
+		strerr := fmt.Sprintf("provisioner %q does not support the Recycle reclaim policy", provisionerName)
+		glog.Infof("recycling of volume %q failed: %s", volume.Name, strerr)
+		ctrl.eventRecorder.Event(newVolume, v1.EventTypeWarning, "VolumeFailedRecycle", strerr)
+		return fmt.Errorf("provisioner %q does not support the Recycle reclaim policy", provisionerName)
+	}
+	if ctrl.dryRun {
+		if !ctrl.isPlanned(newVolume.UID) {
+			msg := fmt.Sprintf("Dry run: would recycle volume %s and make PV object %s available", describeVolumeSource(newVolume), newVolume.Name)
+			glog.Infof("recycleVolumeOperation [%s]: %s", volume.Name, msg)
+			ctrl.eventRecorder.Event(newVolume, v1.EventTypeNormal, "DryRunRecycle", msg)
+			ctrl.setPlanned(newVolume.UID)
+		}
+		return nil
+	}
+	if err := recycler.Recycle(ctx, newVolume); err != nil {
+		// Recycle failed, emit an event.
+		glog.Infof("recycling of volume %q failed: %v", volume.Name, err)
+		ctrl.eventRecorder.Event(newVolume, v1.EventTypeWarning, "VolumeFailedRecycle", err.Error())
+		return err
+	}
+
+	// Clear the ClaimRef so the PV controller makes the volume Available
+	// again, and any record of previous failures to recycle it
+	newVolume.Spec.ClaimRef = nil
+	setRetryAnnotations(&newVolume.ObjectMeta, 0, "")
+	if _, err = ctrl.client.Core().PersistentVolumes().Update(newVolume); err != nil {
+		// Recycling an already recycled volume is harmless, so the controller
+		// will just recycle the volume again.
+		glog.Infof("failed to update recycled volume %q: %v", volume.Name, err)
+		return fmt.Errorf("error updating recycled persistent volume: %v", err)
+	}
+
+	glog.Infof("recycleVolumeOperation [%s]: success", volume.Name)
+	ctrl.eventRecorder.Event(newVolume, v1.EventTypeNormal, "VolumeRecycled", "Volume recycled")
+	return nil
+}
+
+// dryRunProvision returns the PV object the given provisioner would return for
+// the given options, asking it if it's a DryRunner. Otherwise the PV object
+// has no volume source.
+func dryRunProvision(provisioner Provisioner, options VolumeOptions) (*v1.PersistentVolume, error) {
+	if dryRunner, ok := provisioner.(DryRunner); ok {
+		return dryRunner.DryRunProvision(options)
+	}
+	return &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name: options.PVName,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: options.PersistentVolumeReclaimPolicy,
+			AccessModes:                   options.AccessModes,
+			Capacity: v1.ResourceList{
+				v1.ResourceName(v1.ResourceStorage): options.Capacity,
+			},
+		},
+	}, nil
+}
+
+// dryRunDelete reports that the given volume would be deleted, after checking
+// with the given provisioner that it could be if it's a DryRunner.
+func (ctrl *ProvisionController) dryRunDelete(provisioner Provisioner, volume *v1.PersistentVolume) error {
+	if ctrl.isPlanned(volume.UID) {
+		return nil
+	}
+	if dryRunner, ok := provisioner.(DryRunner); ok {
+		if err := dryRunner.DryRunDelete(volume); err != nil {
+			glog.Infof("dry run deletion of volume %q failed: %v", volume.Name, err)
+			ctrl.eventRecorder.Event(volume, v1.EventTypeWarning, "VolumeFailedDelete", err.Error())
+			return err
+		}
 	}
+	msg := fmt.Sprintf("Dry run: would delete volume %s and PV object %s", describeVolumeSource(volume), volume.Name)
+	glog.Infof("deleteVolumeOperation [%s]: %s", volume.Name, msg)
+	ctrl.eventRecorder.Event(volume, v1.EventTypeNormal, "DryRunDelete", msg)
+	ctrl.setPlanned(volume.UID)
+	return nil
+}
+
+func (ctrl *ProvisionController) isPlanned(uid types.UID) bool {
+	ctrl.dryRunPlannedLock.Lock()
+	defer ctrl.dryRunPlannedLock.Unlock()
+	return ctrl.dryRunPlanned.Has(string(uid))
+}
 
-	return
+func (ctrl *ProvisionController) setPlanned(uid types.UID) {
+	ctrl.dryRunPlannedLock.Lock()
+	defer ctrl.dryRunPlannedLock.Unlock()
+	ctrl.dryRunPlanned.Insert(string(uid))
+}
+
+// describeVolumeSource returns a short description of the storage asset
+// backing the given PV, e.g. "nfs server:/path".
+func describeVolumeSource(volume *v1.PersistentVolume) string {
+	if nfs := volume.Spec.NFS; nfs != nil {
+		return fmt.Sprintf("nfs %s:%s", nfs.Server, nfs.Path)
+	}
+	return volume.Name
+}
+
+// getReclaimPolicy removes paramReclaimPolicy from the given parameters and
+// returns the reclaim policy it specifies. The Recycle policy is only valid if
+// recycling isn't disabled and the named provisioner implements Recycler.
+func (ctrl *ProvisionController) getReclaimPolicy(provisionerName string, parameters map[string]string) (v1.PersistentVolumeReclaimPolicy, error) {
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	for k, v := range parameters {
+		if strings.ToLower(k) != strings.ToLower(paramReclaimPolicy) {
+			continue
+		}
+		delete(parameters, k)
+		switch strings.ToLower(v) {
+		case "delete":
+			reclaimPolicy = v1.PersistentVolumeReclaimDelete
+		case "retain":
+			reclaimPolicy = v1.PersistentVolumeReclaimRetain
+		case "recycle":
+			if ctrl.disableRecycle {
+				return "", fmt.Errorf("invalid value for parameter %s: %q is disabled", paramReclaimPolicy, v)
+			}
+			if _, ok := ctrl.provisioners[provisionerName].(Recycler); !ok {
+				return "", fmt.Errorf("invalid value for parameter %s: provisioner %q does not support %q", paramReclaimPolicy, provisionerName, v)
+			}
+			reclaimPolicy = v1.PersistentVolumeReclaimRecycle
+		default:
+			return "", fmt.Errorf("invalid value for parameter %s: %q. valid values are: 'Delete', 'Retain' or 'Recycle'", paramReclaimPolicy, v)
+		}
+	}
+
+	return reclaimPolicy, nil
 }
 
 // getProvisionedVolumeNameForClaim returns PV.Name for the provisioned volume.
@@ -474,19 +1376,101 @@ func (ctrl *ProvisionController) getProvisionedVolumeNameForClaim(claim *v1.Pers
 	return "pvc-" + string(claim.UID)
 }
 
-// scheduleOperation starts given asynchronous operation on given volume. It
-// makes sure the operation is already not running.
-func (ctrl *ProvisionController) scheduleOperation(operationName string, operation func() error) {
-	glog.Infof("scheduleOperation[%s]", operationName)
+// getParameters returns the parameters to provision a volume for the given
+// claim with: the given class's parameters, less those interpreted by the
+// controller, merged with any overrides the claim specifies by annotation. An
+// override of a parameter the class doesn't list as overridable is an error.
+// Parameter names are compared case-insensitively. The claim is given by its
+// annotations, which are nil if overrides are disabled.
+func getParameters(class *v1beta1.StorageClass, claimAnnotations map[string]string) (map[string]string, error) {
+	parameters := make(map[string]string)
+	overridable := make(map[string]bool)
+	for k, v := range class.Parameters {
+		if strings.ToLower(k) == strings.ToLower(paramOverridableParameters) {
+			for _, name := range strings.Split(v, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					overridable[strings.ToLower(name)] = true
+				}
+			}
+			continue
+		}
+		parameters[k] = v
+	}
 
-	err := ctrl.runningOperations.Run(operationName, operation)
-	if err != nil {
-		if goroutinemap.IsAlreadyExists(err) {
-			glog.Infof("operation %q is already running, skipping", operationName)
-		} else {
-			glog.Errorf("error scheduling operaion %q: %v", operationName, err)
+	for ann, v := range claimAnnotations {
+		if !strings.HasPrefix(ann, annParameterOverridePrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(ann, annParameterOverridePrefix)
+		if !overridable[strings.ToLower(name)] {
+			return nil, fmt.Errorf("claim annotation %s overrides parameter %q but StorageClass %q doesn't allow claims to override it", ann, name, class.Name)
+		}
+		for k := range parameters {
+			if strings.ToLower(k) == strings.ToLower(name) {
+				delete(parameters, k)
+			}
 		}
+		parameters[name] = v
 	}
+
+	return parameters, nil
+}
+
+func (ctrl *ProvisionController) getPendingVolume(claimKey string) *v1.PersistentVolume {
+	ctrl.pendingVolumesLock.Lock()
+	defer ctrl.pendingVolumesLock.Unlock()
+	return ctrl.pendingVolumes[claimKey]
+}
+
+func (ctrl *ProvisionController) setPendingVolume(claimKey string, volume *v1.PersistentVolume) {
+	ctrl.pendingVolumesLock.Lock()
+	defer ctrl.pendingVolumesLock.Unlock()
+	ctrl.pendingVolumes[claimKey] = volume
+}
+
+func (ctrl *ProvisionController) removePendingVolume(claimKey string) *v1.PersistentVolume {
+	ctrl.pendingVolumesLock.Lock()
+	defer ctrl.pendingVolumesLock.Unlock()
+	volume := ctrl.pendingVolumes[claimKey]
+	delete(ctrl.pendingVolumes, claimKey)
+	return volume
+}
+
+// cleanupPendingVolume deletes the volume provisioned for the claim with the
+// given key whose PV object could not be created, if any. Now we have a
+// storage asset outside of Kubernetes that nobody will use.
+func (ctrl *ProvisionController) cleanupPendingVolume(claimKey string) {
+	volume := ctrl.removePendingVolume(claimKey)
+	if volume == nil {
+		return
+	}
+
+	// The PV object may have been created after all, e.g. if the create
+	// request timed out, in which case the volume is not ours to delete
+	if _, err := ctrl.client.Core().PersistentVolumes().Get(volume.Name); !errors.IsNotFound(err) {
+		glog.Infof("volume %q for claim %q may exist, not cleaning it: %v", volume.Name, claimKey, err)
+		return
+	}
+
+	ctrl.deleteVolume(claimKey, volume)
+}
+
+// deleteVolume deletes the given volume provisioned for the claim with the
+// given key, whose PV object was not created.
+func (ctrl *ProvisionController) deleteVolume(claimKey string, volume *v1.PersistentVolume) {
+	ctx, cancel := ctrl.newOperationContext()
+	defer cancel()
+	// The volume is annotated with the name of the provisioner that
+	// provisioned it
+	provisioner := ctrl.provisioners[volume.Annotations[annDynamicallyProvisioned]]
+	if err := provisioner.Delete(ctx, volume); err != nil {
+		// There is an orphaned volume and there is nothing we can do about it.
+		strerr := fmt.Sprintf("Error cleaning provisioned volume for claim %s: %v. Please delete manually.", claimKey, err)
+		glog.Info(strerr)
+		ctrl.eventRecorder.Event(volume.Spec.ClaimRef, v1.EventTypeWarning, "ProvisioningCleanupFailed", strerr)
+		return
+	}
+	glog.Infof("cleaning volume %s for claim %s succeeded", volume.Name, claimKey)
 }
 
 func hasAnnotation(obj v1.ObjectMeta, ann string) bool {
@@ -501,6 +1485,27 @@ func setAnnotation(obj *v1.ObjectMeta, ann string, value string) {
 	obj.Annotations[ann] = value
 }
 
+// setRetryAnnotations sets annRetries and annNextAttempt to the given values,
+// or removes them if retries is zero. It returns whether anything changed.
+func setRetryAnnotations(obj *v1.ObjectMeta, retries int, nextAttempt string) bool {
+	if retries == 0 {
+		if !hasAnnotation(*obj, annRetries) && !hasAnnotation(*obj, annNextAttempt) {
+			return false
+		}
+		delete(obj.Annotations, annRetries)
+		delete(obj.Annotations, annNextAttempt)
+		return true
+	}
+
+	value := strconv.Itoa(retries)
+	if obj.Annotations[annRetries] == value && obj.Annotations[annNextAttempt] == nextAttempt {
+		return false
+	}
+	setAnnotation(obj, annRetries, value)
+	setAnnotation(obj, annNextAttempt, nextAttempt)
+	return true
+}
+
 // getClaimClass returns name of class that is requested by given claim.
 // Request for `nil` class is interpreted as request for class "",
 // i.e. for a classless PV.
@@ -17,20 +17,28 @@ limitations under the License.
 package controller
 
 import (
+	"encoding/json"
 	"errors"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"golang.org/x/net/context"
+	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/kubernetes/fake"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/resource"
 	"k8s.io/client-go/1.4/pkg/api/testapi"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 	"k8s.io/client-go/1.4/pkg/apis/storage/v1beta1"
+	"k8s.io/client-go/1.4/pkg/labels"
 	"k8s.io/client-go/1.4/pkg/runtime"
 	"k8s.io/client-go/1.4/pkg/types"
 	testclient "k8s.io/client-go/1.4/testing"
+	"k8s.io/client-go/1.4/tools/record"
 )
 
 func TestController(t *testing.T) {
@@ -39,6 +47,11 @@ func TestController(t *testing.T) {
 		objs            []runtime.Object
 		provisionerName string
 		provisioner     Provisioner
+		// Additional provisioners to serve, by name
+		provisioners    map[string]Provisioner
+		leaseDuration   time.Duration
+		namespaces      []string
+		claimSelector   string
 		verbs           []string
 		reaction        testclient.ReactionFunc
 		expectedVolumes []v1.PersistentVolume
@@ -127,7 +140,7 @@ func TestController(t *testing.T) {
 			provisionerName: "foo.bar/baz",
 			provisioner:     newBadTestProvisioner(),
 			expectedVolumes: []v1.PersistentVolume{
-				*newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}),
+				*newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annRetries: "2", annNextAttempt: "never"}),
 			},
 		},
 		{
@@ -144,6 +157,115 @@ func TestController(t *testing.T) {
 			},
 			expectedVolumes: []v1.PersistentVolume(nil),
 		},
+		{
+			name: "provision for claim-1 after failing to save the pv object once",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			verbs:           []string{"create"},
+			reaction:        newFailOnceReaction(),
+			expectedVolumes: []v1.PersistentVolume{
+				*newProvisionedVolume(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", nil)),
+			},
+		},
+		{
+			name: "provision for claim-1 with reclaim policy retain",
+			objs: []runtime.Object{
+				newStorageClassWithParameters("class-1", "foo.bar/baz", map[string]string{"reclaimPolicy": "Retain"}),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			expectedVolumes: []v1.PersistentVolume{
+				*newProvisionedVolume(newStorageClassWithParameters("class-1", "foo.bar/baz", map[string]string{"reclaimPolicy": "Retain"}), newClaim("claim-1", "uid-1-1", "class-1", "", nil)),
+			},
+		},
+		{
+			name: "provision for claim-1 with reclaim policy recycle",
+			objs: []runtime.Object{
+				newStorageClassWithParameters("class-1", "foo.bar/baz", map[string]string{"reclaimPolicy": "Recycle"}),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			expectedVolumes: []v1.PersistentVolume{
+				*newProvisionedVolume(newStorageClassWithParameters("class-1", "foo.bar/baz", map[string]string{"reclaimPolicy": "Recycle"}), newClaim("claim-1", "uid-1-1", "class-1", "", nil)),
+			},
+		},
+		{
+			name: "don't provision for claim-1 because its reclaim policy is invalid",
+			objs: []runtime.Object{
+				newStorageClassWithParameters("class-1", "foo.bar/baz", map[string]string{"reclaimPolicy": "Foo"}),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			expectedVolumes: []v1.PersistentVolume(nil),
+		},
+		{
+			name: "recycle volume-1 but not volume-2",
+			objs: []runtime.Object{
+				newVolumeWithClaimRef(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annReclaimPolicy: "Recycle"})),
+				newVolumeWithClaimRef(newVolume("volume-2", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"})),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			expectedVolumes: []v1.PersistentVolume{
+				*newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annReclaimPolicy: "Recycle"}),
+				*newVolumeWithClaimRef(newVolume("volume-2", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"})),
+			},
+		},
+		{
+			name: "provisioner fails to recycle volume-1: pv is not updated",
+			objs: []runtime.Object{
+				newVolumeWithClaimRef(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annReclaimPolicy: "Recycle"})),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newBadTestProvisioner(),
+			expectedVolumes: []v1.PersistentVolume{
+				*newVolumeWithClaimRef(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annReclaimPolicy: "Recycle", annRetries: "2", annNextAttempt: "never"})),
+			},
+		},
+		{
+			name: "provision for claim-1 after acquiring its lease",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			leaseDuration:   time.Minute,
+			expectedVolumes: []v1.PersistentVolume{
+				*newProvisionedVolume(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", nil)),
+			},
+		},
+		{
+			name: "don't provision for claim-1 because another instance holds its lease",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annLease: newLease("other", time.Now())}),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			leaseDuration:   time.Minute,
+			expectedVolumes: []v1.PersistentVolume(nil),
+		},
+		{
+			name: "provision for claim-1 because another instance's lease on it expired",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annLease: newLease("other", time.Now().Add(-time.Hour))}),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			leaseDuration:   time.Minute,
+			expectedVolumes: []v1.PersistentVolume{
+				*newProvisionedVolume(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annLease: newLease("other", time.Now().Add(-time.Hour))})),
+			},
+		},
 		{
 			name: "try to delete volume-1 but fail to delete the pv object",
 			objs: []runtime.Object{
@@ -156,8 +278,104 @@ func TestController(t *testing.T) {
 				return true, nil, errors.New("fake error")
 			},
 			expectedVolumes: []v1.PersistentVolume{
-				*newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}),
+				*newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annRetries: "2", annNextAttempt: "never"}),
+			},
+		},
+		{
+			name: "provision for claim-1 and claim-2 of classes of different served provisioners but not claim-3",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newStorageClass("class-2", "foo.bar/qux"),
+				newStorageClass("class-3", "abc.def/ghi"),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+				newClaim("claim-2", "uid-1-2", "class-2", "", nil),
+				newClaim("claim-3", "uid-1-3", "class-3", "", nil),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			provisioners:    map[string]Provisioner{"foo.bar/qux": newTestProvisioner()},
+			expectedVolumes: []v1.PersistentVolume{
+				*newProvisionedVolume(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", nil)),
+				*newProvisionedVolume(newStorageClass("class-2", "foo.bar/qux"), newClaim("claim-2", "uid-1-2", "class-2", "", nil)),
+			},
+		},
+		{
+			name: "delete volume-1 and volume-2 of different served provisioners but not volume-3",
+			objs: []runtime.Object{
+				newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}),
+				newVolume("volume-2", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/qux"}),
+				newVolume("volume-3", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "abc.def/ghi"}),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			provisioners:    map[string]Provisioner{"foo.bar/qux": newTestProvisioner()},
+			expectedVolumes: []v1.PersistentVolume{
+				*newVolume("volume-3", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "abc.def/ghi"}),
+			},
+		},
+		{
+			name: "provision for claim-1 in a watched namespace but not claim-2 in another",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+				newClaimWithNamespace(newClaim("claim-2", "uid-1-2", "class-1", "", nil), "other"),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			namespaces:      []string{"default", "another"},
+			expectedVolumes: []v1.PersistentVolume{
+				*newProvisionedVolume(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", nil)),
+			},
+		},
+		{
+			name: "provision for claim-1 matching the selector but not claim-2",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaimWithLabels(newClaim("claim-1", "uid-1-1", "class-1", "", nil), map[string]string{"tenant": "a"}),
+				newClaimWithLabels(newClaim("claim-2", "uid-1-2", "class-1", "", nil), map[string]string{"tenant": "b"}),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			claimSelector:   "tenant=a",
+			expectedVolumes: []v1.PersistentVolume{
+				*newProvisionedVolume(newStorageClass("class-1", "foo.bar/baz"), newClaimWithLabels(newClaim("claim-1", "uid-1-1", "class-1", "", nil), map[string]string{"tenant": "a"})),
+			},
+		},
+		{
+			name: "delete volume-1 of a claim in a watched namespace but not volume-2",
+			objs: []runtime.Object{
+				newVolumeWithClaimRef(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"})),
+				newVolumeWithClaimRefInNamespace(newVolume("volume-2", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}), "other"),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			namespaces:      []string{"default"},
+			expectedVolumes: []v1.PersistentVolume{
+				*newVolumeWithClaimRefInNamespace(newVolume("volume-2", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}), "other"),
+			},
+		},
+		{
+			name: "provision for claim-1 but not claim-2 rejected by qualifier",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+				newClaim("claim-2", "uid-1-2", "class-1", "", nil),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     &hookTestProvisioner{rejectClaim: "claim-2"},
+			expectedVolumes: []v1.PersistentVolume{
+				*newProvisionedVolume(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", nil)),
+			},
+		},
+		{
+			name: "don't provision for claim-1 rejected by validator",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
 			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     &hookTestProvisioner{invalid: true},
+			expectedVolumes: []v1.PersistentVolume(nil),
 		},
 	}
 	for _, test := range tests {
@@ -168,22 +386,43 @@ func TestController(t *testing.T) {
 			}
 		}
 		resyncPeriod := 100 * time.Millisecond
-		ctrl := NewProvisionController(client, "v1.5.0", resyncPeriod, test.provisionerName, test.provisioner)
-
-		ctrl.createProvisionedPVInterval = 10 * time.Millisecond
+		claimSelector, err := labels.Parse(test.claimSelector)
+		if err != nil {
+			t.Fatalf("error parsing selector %q: %v", test.claimSelector, err)
+		}
+		provisioners := map[string]Provisioner{test.provisionerName: test.provisioner}
+		for name, provisioner := range test.provisioners {
+			provisioners[name] = provisioner
+		}
+		ctrl := newTestProvisionController(t, client, provisioners, ProvisionControllerOptions{
+			ServerGitVersion: "v1.5.0",
+			ResyncPeriod:     resyncPeriod,
+			LeaseDuration:    test.leaseDuration,
+			MaxRetries:       2,
+			RetryBaseDelay:   time.Millisecond,
+			RetryMaxDelay:    10 * time.Millisecond,
+			ProvisionWorkers: 2,
+			DeleteWorkers:    2,
+			Namespaces:       test.namespaces,
+			ClaimSelector:    claimSelector,
+		})
 
 		stopCh := make(chan struct{})
-		go ctrl.Run(stopCh)
+		doneCh := make(chan struct{})
+		go func() {
+			ctrl.Run(stopCh)
+			close(doneCh)
+		}()
 
 		time.Sleep(2 * resyncPeriod)
-		ctrl.runningOperations.Wait()
+		close(stopCh)
+		<-doneCh
 
 		pvList, _ := client.Core().PersistentVolumes().List(api.ListOptions{})
 		if !reflect.DeepEqual(test.expectedVolumes, pvList.Items) {
 			t.Logf("test case: %s", test.name)
 			t.Errorf("expected PVs:\n %v\n but got:\n %v\n", test.expectedVolumes, pvList.Items)
 		}
-		close(stopCh)
 	}
 }
 
@@ -246,7 +485,7 @@ func TestShouldProvision(t *testing.T) {
 		client := fake.NewSimpleClientset(test.claim)
 		resyncPeriod := 100 * time.Millisecond
 		provisioner := newTestProvisioner()
-		ctrl := NewProvisionController(client, "v1.5.0", resyncPeriod, test.provisionerName, provisioner)
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{test.provisionerName: provisioner}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: resyncPeriod})
 
 		err := ctrl.classes.Add(test.class)
 		if err != nil {
@@ -317,7 +556,7 @@ func TestShouldDelete(t *testing.T) {
 		client := fake.NewSimpleClientset()
 		resyncPeriod := 100 * time.Millisecond
 		provisioner := newTestProvisioner()
-		ctrl := NewProvisionController(client, test.serverGitVersion, resyncPeriod, test.provisionerName, provisioner)
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{test.provisionerName: provisioner}, ProvisionControllerOptions{ServerGitVersion: test.serverGitVersion, ResyncPeriod: resyncPeriod})
 
 		should := ctrl.shouldDelete(test.volume)
 		if test.expectedShould != should {
@@ -327,6 +566,463 @@ func TestShouldDelete(t *testing.T) {
 	}
 }
 
+func TestShouldRecycle(t *testing.T) {
+	tests := []struct {
+		name            string
+		provisionerName string
+		volume          *v1.PersistentVolume
+		expectedShould  bool
+	}{
+		{
+			name:            "should recycle",
+			provisionerName: "foo.bar/baz",
+			volume:          newVolumeWithClaimRef(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annReclaimPolicy: "Recycle"})),
+			expectedShould:  true,
+		},
+		{
+			name:            "volume still bound",
+			provisionerName: "foo.bar/baz",
+			volume:          newVolumeWithClaimRef(newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimRetain, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annReclaimPolicy: "Recycle"})),
+			expectedShould:  false,
+		},
+		{
+			name:            "already recycled",
+			provisionerName: "foo.bar/baz",
+			volume:          newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annReclaimPolicy: "Recycle"}),
+			expectedShould:  false,
+		},
+		{
+			name:            "retain without recycle annotation",
+			provisionerName: "foo.bar/baz",
+			volume:          newVolumeWithClaimRef(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"})),
+			expectedShould:  false,
+		},
+		{
+			name:            "recycle annotation but delete reclaim policy",
+			provisionerName: "foo.bar/baz",
+			volume:          newVolumeWithClaimRef(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annReclaimPolicy: "Recycle"})),
+			expectedShould:  false,
+		},
+		{
+			name:            "not this provisioner's job",
+			provisionerName: "foo.bar/baz",
+			volume:          newVolumeWithClaimRef(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, map[string]string{annDynamicallyProvisioned: "abc.def/ghi", annReclaimPolicy: "Recycle"})),
+			expectedShould:  false,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		resyncPeriod := 100 * time.Millisecond
+		provisioner := newTestProvisioner()
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{test.provisionerName: provisioner}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: resyncPeriod})
+
+		should := ctrl.shouldRecycle(test.volume)
+		if test.expectedShould != should {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected should recycle %v but got %v\n", test.expectedShould, should)
+		}
+	}
+}
+
+func TestGetReclaimPolicy(t *testing.T) {
+	tests := []struct {
+		name                  string
+		provisioner           Provisioner
+		disableRecycle        bool
+		parameters            map[string]string
+		expectedReclaimPolicy v1.PersistentVolumeReclaimPolicy
+		expectedParameters    map[string]string
+		expectError           bool
+	}{
+		{
+			name:                  "default",
+			provisioner:           newTestProvisioner(),
+			parameters:            map[string]string{"foo": "bar"},
+			expectedReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			expectedParameters:    map[string]string{"foo": "bar"},
+			expectError:           false,
+		},
+		{
+			name:                  "retain",
+			provisioner:           newTestProvisioner(),
+			parameters:            map[string]string{"foo": "bar", "reclaimPolicy": "Retain"},
+			expectedReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			expectedParameters:    map[string]string{"foo": "bar"},
+			expectError:           false,
+		},
+		{
+			name:                  "recycle",
+			provisioner:           newTestProvisioner(),
+			parameters:            map[string]string{"reclaimpolicy": "recycle"},
+			expectedReclaimPolicy: v1.PersistentVolumeReclaimRecycle,
+			expectedParameters:    map[string]string{},
+			expectError:           false,
+		},
+		{
+			name:                  "recycle unsupported by provisioner",
+			provisioner:           &noRecycleTestProvisioner{newTestProvisioner()},
+			parameters:            map[string]string{"reclaimPolicy": "Recycle"},
+			expectedReclaimPolicy: "",
+			expectedParameters:    map[string]string{},
+			expectError:           true,
+		},
+		{
+			name:                  "recycle disabled",
+			provisioner:           newTestProvisioner(),
+			disableRecycle:        true,
+			parameters:            map[string]string{"reclaimPolicy": "Recycle"},
+			expectedReclaimPolicy: "",
+			expectedParameters:    map[string]string{},
+			expectError:           true,
+		},
+		{
+			name:                  "invalid",
+			provisioner:           newTestProvisioner(),
+			parameters:            map[string]string{"reclaimPolicy": "Foo"},
+			expectedReclaimPolicy: "",
+			expectedParameters:    map[string]string{},
+			expectError:           true,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		resyncPeriod := 100 * time.Millisecond
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": test.provisioner}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: resyncPeriod, DisableRecycle: test.disableRecycle})
+
+		reclaimPolicy, err := ctrl.getReclaimPolicy("foo.bar/baz", test.parameters)
+		if test.expectError && err == nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error but got reclaim policy %v", reclaimPolicy)
+		} else if !test.expectError && err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error getting reclaim policy: %v", err)
+		} else if test.expectedReclaimPolicy != reclaimPolicy {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected reclaim policy %v but got %v", test.expectedReclaimPolicy, reclaimPolicy)
+		}
+		if !reflect.DeepEqual(test.expectedParameters, test.parameters) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected parameters %v but got %v", test.expectedParameters, test.parameters)
+		}
+	}
+}
+
+func TestGetParameters(t *testing.T) {
+	tests := []struct {
+		name               string
+		classParameters    map[string]string
+		claimAnnotations   map[string]string
+		expectedParameters map[string]string
+		expectError        bool
+	}{
+		{
+			name:               "no overrides",
+			classParameters:    map[string]string{"gid": "1001"},
+			claimAnnotations:   nil,
+			expectedParameters: map[string]string{"gid": "1001"},
+			expectError:        false,
+		},
+		{
+			name:               "overridable parameters is removed",
+			classParameters:    map[string]string{"gid": "1001", "overridableParameters": "gid"},
+			claimAnnotations:   nil,
+			expectedParameters: map[string]string{"gid": "1001"},
+			expectError:        false,
+		},
+		{
+			name:               "allowed override",
+			classParameters:    map[string]string{"GID": "1001", "foo": "bar", "overridableParameters": "gid, pathPattern"},
+			claimAnnotations:   map[string]string{annParameterOverridePrefix + "gid": "2002"},
+			expectedParameters: map[string]string{"gid": "2002", "foo": "bar"},
+			expectError:        false,
+		},
+		{
+			name:               "allowed override of parameter the class doesn't set",
+			classParameters:    map[string]string{"overridableParameters": "gid"},
+			claimAnnotations:   map[string]string{annParameterOverridePrefix + "gid": "2002"},
+			expectedParameters: map[string]string{"gid": "2002"},
+			expectError:        false,
+		},
+		{
+			name:               "disallowed override",
+			classParameters:    map[string]string{"gid": "1001", "overridableParameters": "pathPattern"},
+			claimAnnotations:   map[string]string{annParameterOverridePrefix + "gid": "2002"},
+			expectedParameters: nil,
+			expectError:        true,
+		},
+		{
+			name:               "unrelated annotation",
+			classParameters:    map[string]string{"gid": "1001"},
+			claimAnnotations:   map[string]string{"gid": "2002"},
+			expectedParameters: map[string]string{"gid": "1001"},
+			expectError:        false,
+		},
+	}
+	for _, test := range tests {
+		class := newStorageClass("class-1", "foo.bar/baz")
+		class.Parameters = test.classParameters
+		claim := newClaim("claim-1", "1-1", "class-1", "", test.claimAnnotations)
+
+		parameters, err := getParameters(class, claim.Annotations)
+		if test.expectError && err == nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error but got parameters %v", parameters)
+		} else if !test.expectError && err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error getting parameters: %v", err)
+		} else if !reflect.DeepEqual(test.expectedParameters, parameters) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected parameters %v but got %v", test.expectedParameters, parameters)
+		}
+	}
+}
+
+func TestCancelProvisioning(t *testing.T) {
+	tests := []struct {
+		name             string
+		operationTimeout time.Duration
+		deleteClaim      bool
+		succeed          bool
+		expectedRequeues int
+		expectedPending  int
+		expectedDeleted  int
+	}{
+		{
+			name:             "claim deleted, provisioner stops",
+			deleteClaim:      true,
+			expectedRequeues: 0,
+			expectedPending:  0,
+			expectedDeleted:  0,
+		},
+		{
+			name:             "claim deleted, provisioner finishes anyway",
+			deleteClaim:      true,
+			succeed:          true,
+			expectedRequeues: 0,
+			expectedPending:  0,
+			expectedDeleted:  1,
+		},
+		{
+			name:             "deadline passed, provisioner stops",
+			operationTimeout: 10 * time.Millisecond,
+			expectedRequeues: 1,
+			expectedPending:  0,
+			expectedDeleted:  0,
+		},
+		{
+			name:             "deadline passed, provisioner finishes anyway",
+			operationTimeout: 10 * time.Millisecond,
+			succeed:          true,
+			expectedRequeues: 1,
+			expectedPending:  1,
+			expectedDeleted:  0,
+		},
+	}
+	for _, test := range tests {
+		class := newStorageClass("class-1", "foo.bar/baz")
+		claim := newClaim("claim-1", "uid-1-1", "class-1", "", nil)
+		client := fake.NewSimpleClientset(class, claim)
+		provisioner := newBlockingTestProvisioner(test.succeed)
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": provisioner}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: 100 * time.Millisecond, MaxRetries: 2, RetryBaseDelay: time.Hour, RetryMaxDelay: time.Hour, ProvisionWorkers: 1, DeleteWorkers: 1, OperationTimeout: test.operationTimeout})
+		ctrl.classes.Add(class)
+		ctrl.claims.Add(claim)
+
+		key := claimToClaimKey(claim)
+		ctrl.claimQueue.Add(key)
+		doneCh := make(chan struct{})
+		go func() {
+			ctrl.processNextClaimWorkItem()
+			close(doneCh)
+		}()
+
+		<-provisioner.started
+		if test.deleteClaim {
+			client.Core().PersistentVolumeClaims(claim.Namespace).Delete(claim.Name, nil)
+			ctrl.claims.Delete(claim)
+			ctrl.deleteClaim(claim)
+		}
+		<-doneCh
+
+		pvList, _ := client.Core().PersistentVolumes().List(api.ListOptions{})
+		if len(pvList.Items) != 0 {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected no PVs but got %v", pvList.Items)
+		}
+		if requeues := ctrl.claimQueue.NumRequeues(key); test.expectedRequeues != requeues {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected %d requeues but got %d", test.expectedRequeues, requeues)
+		}
+		if pending := len(ctrl.pendingVolumes); test.expectedPending != pending {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected %d pending volumes but got %d", test.expectedPending, pending)
+		}
+		if test.expectedDeleted != provisioner.deleted {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected %d volumes deleted but got %d", test.expectedDeleted, provisioner.deleted)
+		}
+	}
+}
+
+func TestAddClass(t *testing.T) {
+	tests := []struct {
+		name         string
+		oldClass     *v1beta1.StorageClass
+		class        *v1beta1.StorageClass
+		claims       []*v1.PersistentVolumeClaim
+		expectedKeys []string
+	}{
+		{
+			name:  "add class, queue its claims that need volumes",
+			class: newStorageClass("class-1", "foo.bar/baz"),
+			claims: []*v1.PersistentVolumeClaim{
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+				newClaim("claim-2", "uid-1-2", "class-2", "", nil),
+				newClaim("claim-3", "uid-1-3", "class-1", "volume-3", nil),
+				newClaim("claim-4", "uid-1-4", "class-1", "", map[string]string{annNextAttempt: nextAttemptNever}),
+			},
+			expectedKeys: []string{"default/claim-1"},
+		},
+		{
+			name:  "add class of another provisioner",
+			class: newStorageClass("class-1", "abc.def/ghi"),
+			claims: []*v1.PersistentVolumeClaim{
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			expectedKeys: []string{},
+		},
+		{
+			name:     "update class",
+			oldClass: newStorageClass("class-1", "abc.def/ghi"),
+			class:    newStorageClassWithResourceVersion("class-1", "foo.bar/baz", "2"),
+			claims: []*v1.PersistentVolumeClaim{
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			expectedKeys: []string{"default/claim-1"},
+		},
+		{
+			name:     "resync class",
+			oldClass: newStorageClass("class-1", "foo.bar/baz"),
+			class:    newStorageClass("class-1", "foo.bar/baz"),
+			claims: []*v1.PersistentVolumeClaim{
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			expectedKeys: []string{},
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": newTestProvisioner()}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: 100 * time.Millisecond})
+		ctrl.classes.Add(test.class)
+		for _, claim := range test.claims {
+			ctrl.claims.Add(claim)
+		}
+
+		if test.oldClass != nil {
+			ctrl.updateClass(test.oldClass, test.class)
+		} else {
+			ctrl.addClass(test.class)
+		}
+
+		keys := []string{}
+		for ctrl.claimQueue.Len() > 0 {
+			key, _ := ctrl.claimQueue.Get()
+			keys = append(keys, key)
+		}
+		if !reflect.DeepEqual(test.expectedKeys, keys) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected queued claims %v but got %v", test.expectedKeys, keys)
+		}
+	}
+}
+
+func TestClassNotFound(t *testing.T) {
+	claim := newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annDynamicallyProvisioned: "foo.bar/baz"})
+	client := fake.NewSimpleClientset(claim)
+	ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": newTestProvisioner()}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: 100 * time.Millisecond})
+	recorder := record.NewFakeRecorder(1)
+	ctrl.eventRecorder = recorder
+
+	if _, err := ctrl.provisionVolume(context.Background(), claim, "class-1", nil, "pvc-uid-1-1"); err == nil {
+		t.Errorf("expected error provisioning volume for claim of missing class")
+	}
+	select {
+	case event := <-recorder.Events:
+		expected := "Warning ProvisioningFailed Failed to provision volume: StorageClass \"class-1\" not found"
+		if event != expected {
+			t.Errorf("expected event %q but got %q", expected, event)
+		}
+	default:
+		t.Errorf("expected event on claim of missing class but got none")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	objs := []runtime.Object{
+		newStorageClass("class-1", "foo.bar/baz"),
+		newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+		newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}),
+	}
+	client := fake.NewSimpleClientset(objs...)
+	provisioner := &dryRunTestProvisioner{}
+	resyncPeriod := 100 * time.Millisecond
+	ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": provisioner}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: resyncPeriod, LeaseDuration: time.Minute, DryRun: true})
+	recorder := record.NewFakeRecorder(10)
+	ctrl.eventRecorder = recorder
+
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		ctrl.Run(stopCh)
+		close(doneCh)
+	}()
+	time.Sleep(3 * resyncPeriod)
+	close(stopCh)
+	<-doneCh
+
+	for _, action := range client.Actions() {
+		switch action.GetVerb() {
+		case "create", "update", "delete":
+			t.Errorf("expected no changes in dry run but got %s %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+	if provisioner.provisioned != 0 || provisioner.deleted != 0 {
+		t.Errorf("expected provisioner to provision and delete nothing but got %d and %d", provisioner.provisioned, provisioner.deleted)
+	}
+	close(recorder.Events)
+	reasons := []string{}
+	for event := range recorder.Events {
+		reasons = append(reasons, strings.Fields(event)[1])
+	}
+	sort.Strings(reasons)
+	if expected := []string{"DryRunDelete", "DryRunProvision"}; !reflect.DeepEqual(expected, reasons) {
+		t.Errorf("expected events with reasons %v but got %v", expected, reasons)
+	}
+}
+
+func TestPostDeleteHook(t *testing.T) {
+	volume := newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"})
+	client := fake.NewSimpleClientset(volume)
+	provisioner := &hookTestProvisioner{}
+	ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": provisioner}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: 100 * time.Millisecond})
+
+	if err := ctrl.deleteVolumeOperation(context.Background(), volume); err != nil {
+		t.Fatalf("unexpected error deleting volume: %v", err)
+	}
+	if expected := []string{"volume-1"}; !reflect.DeepEqual(expected, provisioner.postDeleted) {
+		t.Errorf("expected post-delete hook called for %v but got %v", expected, provisioner.postDeleted)
+	}
+}
+
+// newTestProvisionController creates a controller, failing the test if it
+// can't
+func newTestProvisionController(t *testing.T, client kubernetes.Interface, provisioners map[string]Provisioner, options ProvisionControllerOptions) *ProvisionController {
+	ctrl, err := NewProvisionController(client, provisioners, options)
+	if err != nil {
+		t.Fatalf("error creating controller: %v", err)
+	}
+	return ctrl
+}
+
 func newStorageClass(name, provisioner string) *v1beta1.StorageClass {
 	return &v1beta1.StorageClass{
 		ObjectMeta: v1.ObjectMeta{
@@ -336,6 +1032,25 @@ func newStorageClass(name, provisioner string) *v1beta1.StorageClass {
 	}
 }
 
+// newLease returns the value of annLease for a one-minute lease held by the
+// given holder and last renewed at the given time
+func newLease(holder string, renewTime time.Time) string {
+	value, _ := json.Marshal(leaseRecord{HolderIdentity: holder, LeaseDurationSeconds: 60, AcquireTime: renewTime, RenewTime: renewTime})
+	return string(value)
+}
+
+func newStorageClassWithResourceVersion(name, provisioner, resourceVersion string) *v1beta1.StorageClass {
+	class := newStorageClass(name, provisioner)
+	class.ResourceVersion = resourceVersion
+	return class
+}
+
+func newStorageClassWithParameters(name, provisioner string, parameters map[string]string) *v1beta1.StorageClass {
+	class := newStorageClass(name, provisioner)
+	class.Parameters = parameters
+	return class
+}
+
 func newClaim(name, claimUID, provisioner, volumeName string, annotations map[string]string) *v1.PersistentVolumeClaim {
 	claim := &v1.PersistentVolumeClaim{
 		ObjectMeta: v1.ObjectMeta{
@@ -365,6 +1080,16 @@ func newClaim(name, claimUID, provisioner, volumeName string, annotations map[st
 	return claim
 }
 
+func newClaimWithNamespace(claim *v1.PersistentVolumeClaim, namespace string) *v1.PersistentVolumeClaim {
+	claim.Namespace = namespace
+	return claim
+}
+
+func newClaimWithLabels(claim *v1.PersistentVolumeClaim, labels map[string]string) *v1.PersistentVolumeClaim {
+	claim.Labels = labels
+	return claim
+}
+
 func newVolume(name string, phase v1.PersistentVolumePhase, policy v1.PersistentVolumeReclaimPolicy, annotations map[string]string) *v1.PersistentVolume {
 	pv := &v1.PersistentVolume{
 		ObjectMeta: v1.ObjectMeta{
@@ -393,18 +1118,37 @@ func newVolume(name string, phase v1.PersistentVolumePhase, policy v1.Persistent
 	return pv
 }
 
+// newVolumeWithClaimRef returns the given volume with its ClaimRef set, as it
+// is when the volume is bound or released
+func newVolumeWithClaimRef(volume *v1.PersistentVolume) *v1.PersistentVolume {
+	volume.Spec.ClaimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "default", Name: "claim-1", UID: types.UID("uid-1-1")}
+	return volume
+}
+
+// newVolumeWithClaimRefInNamespace returns the given volume with its ClaimRef
+// set to a claim in the given namespace
+func newVolumeWithClaimRefInNamespace(volume *v1.PersistentVolume, namespace string) *v1.PersistentVolume {
+	volume = newVolumeWithClaimRef(volume)
+	volume.Spec.ClaimRef.Namespace = namespace
+	return volume
+}
+
 // newProvisionedVolume returns the volume the test controller should provision for the
 // given claim with the given class
 func newProvisionedVolume(storageClass *v1beta1.StorageClass, claim *v1.PersistentVolumeClaim) *v1.PersistentVolume {
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	if storageClass.Parameters["reclaimPolicy"] == "Retain" || storageClass.Parameters["reclaimPolicy"] == "Recycle" {
+		reclaimPolicy = v1.PersistentVolumeReclaimRetain
+	}
 	// pv.Spec MUST be set to match requirements in claim.Spec, especially access mode and PV size. The provisioned volume size MUST NOT be smaller than size requested in the claim, however it MAY be larger.
 	options := VolumeOptions{
 		Capacity:                      claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
 		AccessModes:                   claim.Spec.AccessModes,
-		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PersistentVolumeReclaimPolicy: reclaimPolicy,
 		PVName:     "pvc-" + string(claim.ObjectMeta.UID),
 		Parameters: storageClass.Parameters,
 	}
-	volume, _ := newTestProvisioner().Provision(options)
+	volume, _ := newTestProvisioner().Provision(context.Background(), options)
 
 	// pv.Spec.ClaimRef MUST point to the claim that led to its creation (including the claim UID).
 	volume.Spec.ClaimRef, _ = v1.GetReference(claim)
@@ -412,6 +1156,9 @@ func newProvisionedVolume(storageClass *v1beta1.StorageClass, claim *v1.Persiste
 	// pv.Annotations["pv.kubernetes.io/provisioned-by"] MUST be set to name of the external provisioner. This provisioner will be used to delete the volume.
 	// pv.Annotations["volume.beta.kubernetes.io/storage-class"] MUST be set to name of the storage class requested by the claim.
 	volume.Annotations = map[string]string{annDynamicallyProvisioned: storageClass.Provisioner, annClass: storageClass.Name}
+	if storageClass.Parameters["reclaimPolicy"] == "Recycle" {
+		volume.Annotations[annReclaimPolicy] = "Recycle"
+	}
 
 	// TODO implement options.ProvisionerSelector parsing
 	// pv.Labels MUST be set to match claim.spec.selector. The provisioner MAY add additional labels.
@@ -419,6 +1166,65 @@ func newProvisionedVolume(storageClass *v1beta1.StorageClass, claim *v1.Persiste
 	return volume
 }
 
+// newFailOnceReaction returns a reaction that fails the first action it is
+// called for and lets the rest through
+func TestMoveMountOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		serverVersion string
+		annotations   map[string]string
+		expectedPatch string
+	}{
+		{
+			name:          "field supported",
+			serverVersion: "v1.8.0",
+			annotations:   map[string]string{annMountOptions: "nfsvers=4.1,hard"},
+			expectedPatch: `{"metadata":{"annotations":{"volume.beta.kubernetes.io/mount-options":null}},"spec":{"mountOptions":["nfsvers=4.1","hard"]}}`,
+		},
+		{
+			name:          "field not supported",
+			serverVersion: "v1.7.0",
+			annotations:   map[string]string{annMountOptions: "nfsvers=4.1,hard"},
+			expectedPatch: "",
+		},
+		{
+			name:          "no mount options",
+			serverVersion: "v1.8.0",
+			annotations:   nil,
+			expectedPatch: "",
+		},
+	}
+	for _, test := range tests {
+		volume := newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, test.annotations)
+		client := fake.NewSimpleClientset(volume)
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": newTestProvisioner()}, ProvisionControllerOptions{ServerGitVersion: test.serverVersion, ResyncPeriod: 100 * time.Millisecond})
+
+		ctrl.moveMountOptions(volume)
+
+		patch := ""
+		for _, action := range client.Actions() {
+			if patchAction, ok := action.(testclient.PatchActionImpl); ok {
+				patch = string(patchAction.GetPatch())
+			}
+		}
+		if test.expectedPatch != patch {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected patch %q but got %q", test.expectedPatch, patch)
+		}
+	}
+}
+
+func newFailOnceReaction() testclient.ReactionFunc {
+	failed := false
+	return func(action testclient.Action) (handled bool, ret runtime.Object, err error) {
+		if failed {
+			return false, nil, nil
+		}
+		failed = true
+		return true, nil, errors.New("fake error")
+	}
+}
+
 func newTestProvisioner() Provisioner {
 	return &testProvisioner{}
 }
@@ -428,7 +1234,7 @@ type testProvisioner struct {
 
 var _ Provisioner = &testProvisioner{}
 
-func (p *testProvisioner) Provision(options VolumeOptions) (*v1.PersistentVolume, error) {
+func (p *testProvisioner) Provision(ctx context.Context, options VolumeOptions) (*v1.PersistentVolume, error) {
 	pv := &v1.PersistentVolume{
 		ObjectMeta: v1.ObjectMeta{
 			Name: options.PVName,
@@ -452,10 +1258,103 @@ func (p *testProvisioner) Provision(options VolumeOptions) (*v1.PersistentVolume
 	return pv, nil
 }
 
-func (p *testProvisioner) Delete(volume *v1.PersistentVolume) error {
+func (p *testProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
 	return nil
 }
 
+var _ Recycler = &testProvisioner{}
+
+func (p *testProvisioner) Recycle(ctx context.Context, volume *v1.PersistentVolume) error {
+	return nil
+}
+
+type noRecycleTestProvisioner struct {
+	Provisioner
+}
+
+// hookTestProvisioner implements the optional hooks: it rejects the claim named
+// rejectClaim, fails validation if invalid and records the volumes it is told
+// were deleted.
+type hookTestProvisioner struct {
+	testProvisioner
+	rejectClaim string
+	invalid     bool
+
+	mutex       sync.Mutex
+	postDeleted []string
+}
+
+var _ Qualifier = &hookTestProvisioner{}
+var _ Validator = &hookTestProvisioner{}
+var _ PostDeleteHook = &hookTestProvisioner{}
+
+func (p *hookTestProvisioner) ShouldProvision(claim *v1.PersistentVolumeClaim) bool {
+	return claim.Name != p.rejectClaim
+}
+
+func (p *hookTestProvisioner) Validate(options VolumeOptions) error {
+	if p.invalid {
+		return errors.New("fake error")
+	}
+	return nil
+}
+
+func (p *hookTestProvisioner) PostDelete(volume *v1.PersistentVolume) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.postDeleted = append(p.postDeleted, volume.Name)
+}
+
+// dryRunTestProvisioner is a DryRunner that counts the volumes it actually
+// provisions and deletes.
+type dryRunTestProvisioner struct {
+	testProvisioner
+
+	mutex       sync.Mutex
+	provisioned int
+	deleted     int
+}
+
+var _ DryRunner = &dryRunTestProvisioner{}
+
+func (p *dryRunTestProvisioner) Provision(ctx context.Context, options VolumeOptions) (*v1.PersistentVolume, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.provisioned++
+	return p.testProvisioner.Provision(ctx, options)
+}
+
+func (p *dryRunTestProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deleted++
+	return nil
+}
+
+func (p *dryRunTestProvisioner) DryRunProvision(options VolumeOptions) (*v1.PersistentVolume, error) {
+	return p.testProvisioner.Provision(context.Background(), options)
+}
+
+func (p *dryRunTestProvisioner) DryRunDelete(volume *v1.PersistentVolume) error {
+	return nil
+}
+
+// inspectTestProvisioner is an Inspector that fails to inspect the volume
+// named badVolume.
+type inspectTestProvisioner struct {
+	testProvisioner
+	badVolume string
+}
+
+var _ Inspector = &inspectTestProvisioner{}
+
+func (p *inspectTestProvisioner) Inspect(volume *v1.PersistentVolume) (*VolumeInfo, error) {
+	if volume.Name == p.badVolume {
+		return nil, errors.New("fake error")
+	}
+	return &VolumeInfo{ExportId: "1", Path: "/export/" + volume.Name, UsedBytes: 10, ExportBlock: "block of " + volume.Name}, nil
+}
+
 func newBadTestProvisioner() Provisioner {
 	return &badTestProvisioner{}
 }
@@ -465,10 +1364,49 @@ type badTestProvisioner struct {
 
 var _ Provisioner = &badTestProvisioner{}
 
-func (p *badTestProvisioner) Provision(options VolumeOptions) (*v1.PersistentVolume, error) {
+func (p *badTestProvisioner) Provision(ctx context.Context, options VolumeOptions) (*v1.PersistentVolume, error) {
 	return nil, errors.New("fake error")
 }
 
-func (p *badTestProvisioner) Delete(volume *v1.PersistentVolume) error {
+func (p *badTestProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
+	return errors.New("fake error")
+}
+
+var _ Recycler = &badTestProvisioner{}
+
+func (p *badTestProvisioner) Recycle(ctx context.Context, volume *v1.PersistentVolume) error {
 	return errors.New("fake error")
 }
+
+func newBlockingTestProvisioner(succeed bool) *blockingTestProvisioner {
+	return &blockingTestProvisioner{started: make(chan struct{}), succeed: succeed}
+}
+
+// blockingTestProvisioner blocks provisioning until its context is done. Then
+// it either fails or, like a provisioner that can't stop in time, succeeds.
+type blockingTestProvisioner struct {
+	testProvisioner
+	started chan struct{}
+	succeed bool
+
+	mutex   sync.Mutex
+	deleted int
+}
+
+var _ Provisioner = &blockingTestProvisioner{}
+
+func (p *blockingTestProvisioner) Provision(ctx context.Context, options VolumeOptions) (*v1.PersistentVolume, error) {
+	close(p.started)
+	<-ctx.Done()
+	if !p.succeed {
+		return nil, ctx.Err()
+	}
+	return p.testProvisioner.Provision(ctx, options)
+}
+
+func (p *blockingTestProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deleted++
+	return nil
+}
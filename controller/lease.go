@@ -0,0 +1,152 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// annLease annotation records which instance of the provisioner holds the
+// lease on a claim, i.e. is the one instance among those with the same
+// provisioner name that may provision a volume for the claim. The others stand
+// by until the holder gives up the lease or fails to renew it in time.
+const annLease = "provisioner.alpha.kubernetes.io/lease"
+
+// leaseRecord is the value of annLease.
+type leaseRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+}
+
+// expired returns whether the lease has expired as of now.
+func (r *leaseRecord) expired(now time.Time) bool {
+	return r.RenewTime.Add(time.Duration(r.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+// getLeaseRecord returns the lease recorded on the given claim, or nil if
+// there is none or it can't be parsed.
+func getLeaseRecord(claim *v1.PersistentVolumeClaim) *leaseRecord {
+	ann, ok := claim.Annotations[annLease]
+	if !ok {
+		return nil
+	}
+	record := &leaseRecord{}
+	if err := json.Unmarshal([]byte(ann), record); err != nil {
+		glog.Errorf("Error parsing lease %q of claim %q, considering it expired: %v", ann, claimToClaimKey(claim), err)
+		return nil
+	}
+	return record
+}
+
+// tryAcquireOrRenewLease tries to acquire the lease on the given claim for
+// this instance, or renew it if this instance already holds it. It returns
+// whether this instance holds the lease afterwards. Conflicting updates of the
+// claim mean another instance may have acquired the lease first, so they are
+// not errors: the lease is just not acquired.
+func (ctrl *ProvisionController) tryAcquireOrRenewLease(claim *v1.PersistentVolumeClaim) (bool, error) {
+	newClaim, err := ctrl.client.Core().PersistentVolumeClaims(claim.Namespace).Get(claim.Name)
+	if err != nil {
+		return false, fmt.Errorf("error getting claim: %v", err)
+	}
+	if newClaim.UID != claim.UID {
+		return false, fmt.Errorf("claim was deleted and recreated")
+	}
+
+	now := time.Now()
+	record := getLeaseRecord(newClaim)
+	if record != nil && record.HolderIdentity != ctrl.identity && !record.expired(now) {
+		return false, nil
+	}
+
+	newRecord := leaseRecord{
+		HolderIdentity:       ctrl.identity,
+		LeaseDurationSeconds: int(ctrl.leaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+	if record != nil && record.HolderIdentity == ctrl.identity {
+		newRecord.AcquireTime = record.AcquireTime
+	}
+	value, err := json.Marshal(newRecord)
+	if err != nil {
+		return false, fmt.Errorf("error marshalling lease: %v", err)
+	}
+	setAnnotation(&newClaim.ObjectMeta, annLease, string(value))
+
+	if _, err := ctrl.client.Core().PersistentVolumeClaims(claim.Namespace).Update(newClaim); err != nil {
+		if errors.IsConflict(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error updating claim: %v", err)
+	}
+
+	return true, nil
+}
+
+// renewLease renews the lease on the given claim periodically until stopCh is
+// closed, so that it doesn't expire while an operation on the claim takes
+// longer than leaseDuration. If another instance has acquired the lease in the
+// meantime, it closes lostCh and calls cancel to stop the operation, since the
+// other instance may now provision a volume for the claim too.
+func (ctrl *ProvisionController) renewLease(claim *v1.PersistentVolumeClaim, stopCh <-chan struct{}, lostCh chan<- struct{}, cancel context.CancelFunc) {
+	ticker := time.NewTicker(ctrl.leaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			held, err := ctrl.tryAcquireOrRenewLease(claim)
+			if err != nil {
+				glog.Errorf("Error renewing lease on claim %q: %v", claimToClaimKey(claim), err)
+			} else if !held {
+				glog.Errorf("Lost lease on claim %q to another instance, cancelling the operation", claimToClaimKey(claim))
+				close(lostCh)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// releaseLease gives up the lease on the given claim if this instance holds
+// it, so that another instance can try to provision a volume for the claim
+// without waiting for the lease to expire.
+func (ctrl *ProvisionController) releaseLease(claim *v1.PersistentVolumeClaim) {
+	newClaim, err := ctrl.client.Core().PersistentVolumeClaims(claim.Namespace).Get(claim.Name)
+	if err != nil {
+		glog.Errorf("Error releasing lease on claim %q: error getting claim: %v", claimToClaimKey(claim), err)
+		return
+	}
+	record := getLeaseRecord(newClaim)
+	if record == nil || record.HolderIdentity != ctrl.identity {
+		return
+	}
+	delete(newClaim.Annotations, annLease)
+	if _, err := ctrl.client.Core().PersistentVolumeClaims(claim.Namespace).Update(newClaim); err != nil {
+		glog.Errorf("Error releasing lease on claim %q: error updating claim: %v", claimToClaimKey(claim), err)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func TestTryAcquireOrRenewLease(t *testing.T) {
+	hourAgo := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name            string
+		claim           *v1.PersistentVolumeClaim
+		expectedHeld    bool
+		expectedHolder  string
+		expectedAcquire *time.Time
+	}{
+		{
+			name:           "no lease",
+			claim:          newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			expectedHeld:   true,
+			expectedHolder: "self",
+		},
+		{
+			name:           "unparseable lease",
+			claim:          newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annLease: "foo"}),
+			expectedHeld:   true,
+			expectedHolder: "self",
+		},
+		{
+			name:           "held by other",
+			claim:          newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annLease: newLease("other", time.Now())}),
+			expectedHeld:   false,
+			expectedHolder: "other",
+		},
+		{
+			name:           "expired, held by other",
+			claim:          newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annLease: newLease("other", hourAgo)}),
+			expectedHeld:   true,
+			expectedHolder: "self",
+		},
+		{
+			name:            "renew",
+			claim:           newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annLease: newLease("self", hourAgo)}),
+			expectedHeld:    true,
+			expectedHolder:  "self",
+			expectedAcquire: &hourAgo,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset(test.claim)
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": newTestProvisioner()}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: 100 * time.Millisecond, LeaseDuration: time.Minute})
+		ctrl.identity = "self"
+
+		held, err := ctrl.tryAcquireOrRenewLease(test.claim)
+		if err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error acquiring lease: %v", err)
+			continue
+		}
+		if test.expectedHeld != held {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected held %v but got %v", test.expectedHeld, held)
+		}
+
+		claim, _ := client.Core().PersistentVolumeClaims("default").Get("claim-1")
+		record := getLeaseRecord(claim)
+		if record == nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected lease on claim but got none")
+			continue
+		}
+		if test.expectedHolder != record.HolderIdentity {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected holder %v but got %v", test.expectedHolder, record.HolderIdentity)
+		}
+		if test.expectedAcquire != nil && !test.expectedAcquire.Equal(record.AcquireTime) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected acquire time %v but got %v", *test.expectedAcquire, record.AcquireTime)
+		}
+		if held && record.expired(time.Now()) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected renewed lease but it has expired: %+v", record)
+		}
+	}
+}
+
+func TestReleaseLease(t *testing.T) {
+	tests := []struct {
+		name          string
+		claim         *v1.PersistentVolumeClaim
+		expectedLease bool
+	}{
+		{
+			name:          "held by self",
+			claim:         newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annLease: newLease("self", time.Now())}),
+			expectedLease: false,
+		},
+		{
+			name:          "held by other",
+			claim:         newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annLease: newLease("other", time.Now())}),
+			expectedLease: true,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset(test.claim)
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": newTestProvisioner()}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: 100 * time.Millisecond, LeaseDuration: time.Minute})
+		ctrl.identity = "self"
+
+		ctrl.releaseLease(test.claim)
+
+		claim, _ := client.Core().PersistentVolumeClaims("default").Get("claim-1")
+		if _, lease := claim.Annotations[annLease]; test.expectedLease != lease {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected lease %v but got %v", test.expectedLease, lease)
+		}
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	tests := []struct {
+		name         string
+		claim        *v1.PersistentVolumeClaim
+		expectedLost bool
+	}{
+		{
+			name:         "held by self",
+			claim:        newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annLease: newLease("self", time.Now())}),
+			expectedLost: false,
+		},
+		{
+			name:         "lost to other",
+			claim:        newClaim("claim-1", "uid-1-1", "class-1", "", map[string]string{annLease: newLease("other", time.Now())}),
+			expectedLost: true,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset(test.claim)
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": newTestProvisioner()}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: 100 * time.Millisecond, LeaseDuration: time.Minute})
+		ctrl.identity = "self"
+		ctrl.leaseDuration = 30 * time.Millisecond
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stopCh := make(chan struct{})
+		lostCh := make(chan struct{})
+		doneCh := make(chan struct{})
+		go func() {
+			ctrl.renewLease(test.claim, stopCh, lostCh, cancel)
+			close(doneCh)
+		}()
+
+		lost := false
+		select {
+		case <-lostCh:
+			lost = true
+		case <-time.After(200 * time.Millisecond):
+		}
+		if test.expectedLost != lost {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected lost %v but got %v", test.expectedLost, lost)
+		}
+		if canceled := ctx.Err() != nil; test.expectedLost != canceled {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected operation canceled %v but got %v", test.expectedLost, canceled)
+		}
+
+		close(stopCh)
+		select {
+		case <-doneCh:
+		case <-time.After(time.Second):
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected renewal to stop")
+		}
+		cancel()
+	}
+}
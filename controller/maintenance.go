@@ -0,0 +1,143 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/storage/v1beta1"
+	"k8s.io/client-go/1.4/pkg/types"
+)
+
+// annPaused annotation on a StorageClass pauses work on the claims and volumes
+// of the class, e.g. during maintenance of the storage backing it, without
+// touching existing volumes or their exports. Its value is a comma-separated
+// list of the operations to pause: pausedProvisioning, pausedDeletion or both.
+// Removing the annotation resumes them.
+const annPaused = "provisioner.alpha.kubernetes.io/paused"
+
+const (
+	pausedProvisioning = "provisioning"
+	pausedDeletion     = "deletion"
+)
+
+// getPausedOperations returns whether the given class's annPaused annotation
+// pauses provisioning and deletion. An unknown operation pauses provisioning,
+// so that a typo doesn't let provisioning go on during maintenance.
+func getPausedOperations(class *v1beta1.StorageClass) (provisioning, deletion bool) {
+	value, ok := class.Annotations[annPaused]
+	if !ok {
+		return false, false
+	}
+	for _, operation := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(operation)) {
+		case pausedProvisioning:
+			provisioning = true
+		case pausedDeletion:
+			deletion = true
+		case "":
+		default:
+			glog.Errorf("Unknown operation %q in annotation %s of StorageClass %q, pausing provisioning", operation, annPaused, class.Name)
+			provisioning = true
+		}
+	}
+	return provisioning, deletion
+}
+
+// getClassPausedOperations is getPausedOperations of the class with the given
+// name, which pauses nothing if it isn't in the cache.
+func (ctrl *ProvisionController) getClassPausedOperations(className string) (provisioning, deletion bool) {
+	obj, found, err := ctrl.classes.GetByKey(className)
+	if err != nil || !found {
+		return false, false
+	}
+	class, ok := obj.(*v1beta1.StorageClass)
+	if !ok {
+		return false, false
+	}
+	return getPausedOperations(class)
+}
+
+// provisioningPausedReason returns why provisioning a volume for the given
+// claim is paused, or "" if it isn't.
+func (ctrl *ProvisionController) provisioningPausedReason(claim *v1.PersistentVolumeClaim) string {
+	if ctrl.ProvisioningPaused() {
+		return "Provisioning is paused for maintenance of the provisioner"
+	}
+	claimClass := getClaimClass(claim)
+	if provisioning, _ := ctrl.getClassPausedOperations(claimClass); provisioning {
+		return fmt.Sprintf("Provisioning with StorageClass %q is paused for maintenance by its %s annotation", claimClass, annPaused)
+	}
+	return ""
+}
+
+// deletionPaused returns whether deleting and recycling the given volume is
+// paused.
+func (ctrl *ProvisionController) deletionPaused(volume *v1.PersistentVolume) bool {
+	if ctrl.DeletionsPaused() {
+		return true
+	}
+	_, deletion := ctrl.getClassPausedOperations(volume.Annotations[annClass])
+	return deletion
+}
+
+// notifyPaused emits a Normal event with the given message on the given claim,
+// once per claim until provisioning for it is no longer paused, so that
+// resyncs don't repeat it.
+func (ctrl *ProvisionController) notifyPaused(claim *v1.PersistentVolumeClaim, message string) {
+	ctrl.pausedClaimsLock.Lock()
+	notified := ctrl.pausedClaims.Has(string(claim.UID))
+	ctrl.pausedClaims.Insert(string(claim.UID))
+	ctrl.pausedClaimsLock.Unlock()
+	if notified {
+		return
+	}
+	glog.Infof("provisioning for claim %q paused: %s", claimToClaimKey(claim), message)
+	ctrl.eventRecorder.Event(claim, v1.EventTypeNormal, "ProvisioningPaused", message)
+}
+
+// clearPaused forgets that the claim with the given UID was notified of a
+// pause, so that it's notified again if provisioning is paused again.
+func (ctrl *ProvisionController) clearPaused(uid types.UID) {
+	ctrl.pausedClaimsLock.Lock()
+	defer ctrl.pausedClaimsLock.Unlock()
+	ctrl.pausedClaims.Delete(string(uid))
+}
+
+// queueClassVolumes makes the controller work right away on the volumes of
+// the class with the given name that need deleting or recycling, e.g. once
+// deletion is no longer paused for the class.
+func (ctrl *ProvisionController) queueClassVolumes(className string) {
+	if ctrl.DeletionsPaused() {
+		return
+	}
+	for _, obj := range ctrl.volumes.List() {
+		volume, ok := obj.(*v1.PersistentVolume)
+		if !ok || volume.Annotations[annClass] != className || !ctrl.watchesNamespaceOf(volume) {
+			continue
+		}
+		if volume.Annotations[annNextAttempt] == nextAttemptNever {
+			continue
+		}
+		if ctrl.shouldDelete(volume) || ctrl.shouldRecycle(volume) {
+			ctrl.volumeQueue.AddAfter(volume.Name, 0)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/storage/v1beta1"
+	"k8s.io/client-go/1.4/tools/record"
+)
+
+func TestGetPausedOperations(t *testing.T) {
+	tests := []struct {
+		name                 string
+		annotations          map[string]string
+		expectedProvisioning bool
+		expectedDeletion     bool
+	}{
+		{
+			name:                 "no annotation",
+			annotations:          nil,
+			expectedProvisioning: false,
+			expectedDeletion:     false,
+		},
+		{
+			name:                 "provisioning",
+			annotations:          map[string]string{annPaused: "provisioning"},
+			expectedProvisioning: true,
+			expectedDeletion:     false,
+		},
+		{
+			name:                 "deletion",
+			annotations:          map[string]string{annPaused: "Deletion"},
+			expectedProvisioning: false,
+			expectedDeletion:     true,
+		},
+		{
+			name:                 "both",
+			annotations:          map[string]string{annPaused: "provisioning, deletion"},
+			expectedProvisioning: true,
+			expectedDeletion:     true,
+		},
+		{
+			name:                 "unknown operation",
+			annotations:          map[string]string{annPaused: "true"},
+			expectedProvisioning: true,
+			expectedDeletion:     false,
+		},
+		{
+			name:                 "empty",
+			annotations:          map[string]string{annPaused: ""},
+			expectedProvisioning: false,
+			expectedDeletion:     false,
+		},
+	}
+	for _, test := range tests {
+		class := newStorageClass("class-1", "foo.bar/baz")
+		class.Annotations = test.annotations
+		provisioning, deletion := getPausedOperations(class)
+		if provisioning != test.expectedProvisioning || deletion != test.expectedDeletion {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected provisioning, deletion paused %v, %v but got %v, %v", test.expectedProvisioning, test.expectedDeletion, provisioning, deletion)
+		}
+	}
+}
+
+func TestPauseProvisioning(t *testing.T) {
+	tests := []struct {
+		name  string
+		class *v1beta1.StorageClass
+		// Whether to pause provisioning with PauseProvisioning rather than
+		// with the class's annotation
+		pauseController bool
+	}{
+		{
+			name:            "paused by admin API",
+			class:           newStorageClass("class-1", "foo.bar/baz"),
+			pauseController: true,
+		},
+		{
+			name:            "paused by class annotation",
+			class:           newStorageClassWithPaused("class-1", "foo.bar/baz", "provisioning"),
+			pauseController: false,
+		},
+	}
+	for _, test := range tests {
+		claim := newClaim("claim-1", "uid-1-1", "class-1", "", nil)
+		client := fake.NewSimpleClientset(claim)
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": newTestProvisioner()}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: 100 * time.Millisecond})
+		recorder := record.NewFakeRecorder(10)
+		ctrl.eventRecorder = recorder
+		ctrl.classes.Add(test.class)
+		ctrl.claims.Add(claim)
+		if test.pauseController {
+			ctrl.PauseProvisioning(true)
+		}
+
+		// Process the claim twice, as if resynced, to check it's notified once
+		for i := 0; i < 2; i++ {
+			ctrl.claimQueue.Add("default/claim-1")
+			ctrl.processNextClaimWorkItem()
+		}
+		if _, err := client.Core().PersistentVolumes().Get("pvc-uid-1-1"); err == nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected no volume provisioned while provisioning is paused")
+		}
+		if n := ctrl.claimQueue.Len(); n != 0 {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected claim dropped from the queue but the queue has %d keys", n)
+		}
+		if n := len(recorder.Events); n != 1 {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected 1 event but got %d", n)
+		} else if event := <-recorder.Events; !strings.HasPrefix(event, "Normal ProvisioningPaused ") {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected Normal ProvisioningPaused event but got %q", event)
+		}
+
+		if test.pauseController {
+			ctrl.PauseProvisioning(false)
+		} else {
+			resumed := newStorageClassWithResourceVersion("class-1", "foo.bar/baz", "2")
+			ctrl.classes.Update(resumed)
+			ctrl.updateClass(test.class, resumed)
+		}
+		if n := ctrl.claimQueue.Len(); n != 1 {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected claim queued again on resume but the queue has %d keys", n)
+			continue
+		}
+		ctrl.processNextClaimWorkItem()
+		if _, err := client.Core().PersistentVolumes().Get("pvc-uid-1-1"); err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected volume provisioned on resume but got error: %v", err)
+		}
+	}
+}
+
+func TestPauseClassDeletion(t *testing.T) {
+	class := newStorageClassWithPaused("class-1", "foo.bar/baz", "deletion")
+	volume := newVolumeWithClaimRef(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annClass: "class-1"}))
+	client := fake.NewSimpleClientset(volume)
+	ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": newTestProvisioner()}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: 100 * time.Millisecond})
+	ctrl.classes.Add(class)
+	ctrl.volumes.Add(volume)
+
+	ctrl.volumeQueue.Add("volume-1")
+	ctrl.processNextVolumeWorkItem()
+	if _, err := client.Core().PersistentVolumes().Get("volume-1"); err != nil {
+		t.Errorf("expected volume kept while deletion is paused but got error: %v", err)
+	}
+
+	resumed := newStorageClassWithResourceVersion("class-1", "foo.bar/baz", "2")
+	ctrl.classes.Update(resumed)
+	ctrl.updateClass(class, resumed)
+	if n := ctrl.volumeQueue.Len(); n != 1 {
+		t.Fatalf("expected volume queued again on resume but the queue has %d keys", n)
+	}
+	ctrl.processNextVolumeWorkItem()
+	if _, err := client.Core().PersistentVolumes().Get("volume-1"); err == nil {
+		t.Errorf("expected volume deleted on resume")
+	}
+}
+
+func newStorageClassWithPaused(name, provisioner, paused string) *v1beta1.StorageClass {
+	class := newStorageClass(name, provisioner)
+	class.Annotations = map[string]string{annPaused: paused}
+	return class
+}
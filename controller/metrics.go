@@ -0,0 +1,78 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// MetricsHandler returns a handler that serves metrics about the controller's
+// work queues in the Prometheus text format.
+func (ctrl *ProvisionController) MetricsHandler() http.Handler {
+	return http.HandlerFunc(ctrl.serveMetrics)
+}
+
+func (ctrl *ProvisionController) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	ctrl.writeMetrics(w)
+}
+
+// writeMetrics writes a gauge for each statistic of each work queue, labelled
+// with the queue's name: "claim" for claimQueue or "volume" for volumeQueue.
+func (ctrl *ProvisionController) writeMetrics(w io.Writer) {
+	queues := []struct {
+		name    string
+		queue   *rateLimitingQueue
+		workers int
+	}{
+		{"claim", ctrl.claimQueue, ctrl.provisionWorkers},
+		{"volume", ctrl.volumeQueue, ctrl.deleteWorkers},
+	}
+	ready := make([]int, len(queues))
+	waiting := make([]int, len(queues))
+	processing := make([]int, len(queues))
+	for i, q := range queues {
+		ready[i], waiting[i], processing[i] = q.queue.Stats()
+	}
+
+	gauges := []struct {
+		name   string
+		help   string
+		values func(int) int
+	}{
+		{"nfs_provisioner_queue_depth", "Number of keys ready to be worked on.", func(i int) int { return ready[i] }},
+		{"nfs_provisioner_queue_retries_waiting", "Number of keys waiting to be retried after their work failed.", func(i int) int { return waiting[i] }},
+		{"nfs_provisioner_queue_in_progress", "Number of keys being worked on.", func(i int) int { return processing[i] }},
+		{"nfs_provisioner_queue_workers", "Number of workers working on keys from the queue.", func(i int) int { return queues[i].workers }},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+		for i, q := range queues {
+			fmt.Fprintf(w, "%s{queue=%q} %d\n", g.name, q.name, g.values(i))
+		}
+	}
+
+	ctrl.pendingVolumesLock.Lock()
+	pending := len(ctrl.pendingVolumes)
+	ctrl.pendingVolumesLock.Unlock()
+	fmt.Fprintf(w, "# HELP nfs_provisioner_pending_volumes Number of provisioned volumes whose PV objects have yet to be created.\n")
+	fmt.Fprintf(w, "# TYPE nfs_provisioner_pending_volumes gauge\n")
+	fmt.Fprintf(w, "nfs_provisioner_pending_volumes %d\n", pending)
+}
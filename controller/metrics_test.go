@@ -0,0 +1,59 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.4/kubernetes/fake"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": newTestProvisioner()}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", ResyncPeriod: 100 * time.Millisecond, ProvisionWorkers: 3, DeleteWorkers: 2})
+
+	ctrl.claimQueue.Add("default/claim-1")
+	ctrl.claimQueue.Add("default/claim-2")
+	ctrl.claimQueue.Add("default/claim-3")
+	key, _ := ctrl.claimQueue.Get()
+	ctrl.claimQueue.AddRateLimited(key)
+	ctrl.volumeQueue.Add("volume-1")
+
+	buf := &bytes.Buffer{}
+	ctrl.writeMetrics(buf)
+	metrics := buf.String()
+
+	expectedLines := []string{
+		"# TYPE nfs_provisioner_queue_depth gauge",
+		`nfs_provisioner_queue_depth{queue="claim"} 2`,
+		`nfs_provisioner_queue_depth{queue="volume"} 1`,
+		`nfs_provisioner_queue_retries_waiting{queue="claim"} 1`,
+		`nfs_provisioner_queue_in_progress{queue="claim"} 1`,
+		`nfs_provisioner_queue_in_progress{queue="volume"} 0`,
+		`nfs_provisioner_queue_workers{queue="claim"} 3`,
+		`nfs_provisioner_queue_workers{queue="volume"} 2`,
+		"nfs_provisioner_pending_volumes 0",
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("expected line %q in metrics but got:\n%s", line, metrics)
+		}
+	}
+}
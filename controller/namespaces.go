@@ -0,0 +1,160 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	"github.com/wongma7/nfs-provisioner/framework"
+	"k8s.io/client-go/1.4/tools/cache"
+)
+
+// namespacedStore is a cache.Store of namespaced objects made up of one store
+// per namespace, e.g. the stores of informers that each watch one namespace.
+// It only holds objects of the namespaces it was created with.
+type namespacedStore struct {
+	stores map[string]cache.Store
+}
+
+var _ cache.Store = &namespacedStore{}
+
+func newNamespacedStore(stores map[string]cache.Store) *namespacedStore {
+	return &namespacedStore{stores: stores}
+}
+
+// storeForKey returns the store of the namespace of the object with the given
+// key.
+func (s *namespacedStore) storeForKey(key string) (cache.Store, error) {
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, err
+	}
+	store, ok := s.stores[namespace]
+	if !ok {
+		return nil, fmt.Errorf("namespace %q of object %q is not in the store", namespace, key)
+	}
+	return store, nil
+}
+
+// storeFor returns the store of the namespace of the given object.
+func (s *namespacedStore) storeFor(obj interface{}) (cache.Store, error) {
+	key, err := framework.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return nil, err
+	}
+	return s.storeForKey(key)
+}
+
+func (s *namespacedStore) Add(obj interface{}) error {
+	store, err := s.storeFor(obj)
+	if err != nil {
+		return err
+	}
+	return store.Add(obj)
+}
+
+func (s *namespacedStore) Update(obj interface{}) error {
+	store, err := s.storeFor(obj)
+	if err != nil {
+		return err
+	}
+	return store.Update(obj)
+}
+
+func (s *namespacedStore) Delete(obj interface{}) error {
+	store, err := s.storeFor(obj)
+	if err != nil {
+		return err
+	}
+	return store.Delete(obj)
+}
+
+func (s *namespacedStore) List() []interface{} {
+	list := []interface{}{}
+	for _, store := range s.stores {
+		list = append(list, store.List()...)
+	}
+	return list
+}
+
+func (s *namespacedStore) ListKeys() []string {
+	keys := []string{}
+	for _, store := range s.stores {
+		keys = append(keys, store.ListKeys()...)
+	}
+	return keys
+}
+
+func (s *namespacedStore) Get(obj interface{}) (interface{}, bool, error) {
+	key, err := framework.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return nil, false, err
+	}
+	return s.GetByKey(key)
+}
+
+// GetByKey returns the object with the given key. An object of a namespace
+// that is not in the store doesn't exist.
+func (s *namespacedStore) GetByKey(key string) (interface{}, bool, error) {
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	store, ok := s.stores[namespace]
+	if !ok {
+		return nil, false, nil
+	}
+	return store.GetByKey(key)
+}
+
+// Replace replaces the contents of the store of each namespace with the objects
+// of the namespace in the given list.
+func (s *namespacedStore) Replace(list []interface{}, resourceVersion string) error {
+	lists := make(map[string][]interface{})
+	for namespace := range s.stores {
+		lists[namespace] = []interface{}{}
+	}
+	for _, obj := range list {
+		key, err := framework.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return err
+		}
+		namespace, _, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			return err
+		}
+		if _, ok := lists[namespace]; !ok {
+			return fmt.Errorf("namespace %q of object %q is not in the store", namespace, key)
+		}
+		lists[namespace] = append(lists[namespace], obj)
+	}
+	for namespace, store := range s.stores {
+		if err := store.Replace(lists[namespace], resourceVersion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *namespacedStore) Resync() error {
+	for _, store := range s.stores {
+		if err := store.Resync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
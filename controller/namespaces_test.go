@@ -0,0 +1,71 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wongma7/nfs-provisioner/framework"
+	"k8s.io/client-go/1.4/pkg/util/sets"
+	"k8s.io/client-go/1.4/tools/cache"
+)
+
+func TestNamespacedStore(t *testing.T) {
+	store := newNamespacedStore(map[string]cache.Store{
+		"default": cache.NewStore(framework.DeletionHandlingMetaNamespaceKeyFunc),
+		"other":   cache.NewStore(framework.DeletionHandlingMetaNamespaceKeyFunc),
+	})
+
+	claim1 := newClaim("claim-1", "uid-1-1", "class-1", "", nil)
+	claim2 := newClaimWithNamespace(newClaim("claim-2", "uid-1-2", "class-1", "", nil), "other")
+	claim3 := newClaimWithNamespace(newClaim("claim-3", "uid-1-3", "class-1", "", nil), "unknown")
+	for _, claim := range []interface{}{claim1, claim2} {
+		if err := store.Add(claim); err != nil {
+			t.Errorf("unexpected error adding claim: %v", err)
+		}
+	}
+	if err := store.Add(claim3); err == nil {
+		t.Errorf("expected error adding claim of unknown namespace")
+	}
+
+	expectedKeys := sets.NewString("default/claim-1", "other/claim-2")
+	if keys := sets.NewString(store.ListKeys()...); !expectedKeys.Equal(keys) {
+		t.Errorf("expected keys %v but got %v", expectedKeys.List(), keys.List())
+	}
+	if obj, exists, _ := store.GetByKey("other/claim-2"); !exists || !reflect.DeepEqual(claim2, obj) {
+		t.Errorf("expected to get claim-2 but got %v", obj)
+	}
+	if _, exists, err := store.GetByKey("unknown/claim-3"); exists || err != nil {
+		t.Errorf("expected claim-3 not to exist but got exists %v, error %v", exists, err)
+	}
+
+	if err := store.Replace([]interface{}{claim2}, "2"); err != nil {
+		t.Errorf("unexpected error replacing claims: %v", err)
+	}
+	expectedKeys = sets.NewString("other/claim-2")
+	if keys := sets.NewString(store.ListKeys()...); !expectedKeys.Equal(keys) {
+		t.Errorf("expected keys %v after replace but got %v", expectedKeys.List(), keys.List())
+	}
+
+	if err := store.Delete(cache.DeletedFinalStateUnknown{Key: "other/claim-2", Obj: claim2}); err != nil {
+		t.Errorf("unexpected error deleting claim: %v", err)
+	}
+	if len(store.List()) != 0 {
+		t.Errorf("expected empty store but got %v", store.List())
+	}
+}
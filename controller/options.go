@@ -0,0 +1,154 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+const (
+	// DefaultResyncPeriod is the default period at which the controller
+	// re-examines every claim and volume.
+	DefaultResyncPeriod = 15 * time.Second
+	// DefaultRetryBaseDelay is the default delay before the first retry of a
+	// failed operation.
+	DefaultRetryBaseDelay = 1 * time.Second
+	// DefaultRetryMaxDelay is the default maximum delay between retries of a
+	// failed operation.
+	DefaultRetryMaxDelay = 5 * time.Minute
+	// DefaultWorkers is the default number of provision workers and of delete
+	// workers.
+	DefaultWorkers = 4
+)
+
+// ProvisionControllerOptions are the options of a ProvisionController. A field
+// left at its zero value takes its default, unless its comment says otherwise.
+type ProvisionControllerOptions struct {
+	// ResyncPeriod is the period at which the controller re-examines every
+	// claim and volume. Default DefaultResyncPeriod.
+	ResyncPeriod time.Duration
+
+	// ServerGitVersion is the git version of the API server, e.g. "v1.5.0". In
+	// a server older than 1.5, out-of-tree dynamic provisioning is not
+	// officially supported and the controller deletes Failed volumes as well as
+	// Released ones. Default the version the server reports.
+	ServerGitVersion string
+
+	// Identity is the identity of this instance of the controller among those
+	// serving the same provisioner names, for holding leases on claims.
+	// Default the hostname or, failing that, a random UUID.
+	Identity string
+
+	// EventSource is the component that events are reported from. Default the
+	// provisioner names, comma-separated, and the hostname, if any, e.g.
+	// "example.com/nfs-myhost".
+	EventSource string
+
+	// LeaseDuration is the duration of the lease the controller takes on a
+	// claim before provisioning a volume for it. If zero, the controller
+	// doesn't take leases. Otherwise, it must be at least a second, the
+	// granularity leases are recorded with.
+	LeaseDuration time.Duration
+
+	// MaxRetries is the maximum number of times to retry a failed operation.
+	// If zero, the controller retries forever.
+	MaxRetries int
+
+	// RetryBaseDelay is the delay before the first retry of a failed
+	// operation. Every further retry doubles it, up to RetryMaxDelay. Default
+	// DefaultRetryBaseDelay and DefaultRetryMaxDelay, respectively.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// ProvisionWorkers and DeleteWorkers are the maximum numbers of volumes to
+	// provision and to delete or recycle at once. Default DefaultWorkers.
+	ProvisionWorkers int
+	DeleteWorkers    int
+
+	// OperationTimeout is the maximum duration of an attempt to provision,
+	// delete or recycle a volume. If zero, operations have no deadline.
+	OperationTimeout time.Duration
+
+	// Namespaces are the namespaces of the claims to provision volumes for,
+	// and of the claims of the volumes to delete. Default all namespaces.
+	Namespaces []string
+
+	// ClaimSelector selects the claims to provision volumes for by their
+	// labels. Default all claims.
+	ClaimSelector labels.Selector
+
+	// DisableRecycle makes the controller reject the Recycle reclaim policy
+	// even for provisioners that implement Recycler.
+	DisableRecycle bool
+
+	// DisableParameterOverrides makes the controller ignore claims'
+	// overrides of StorageClass parameters.
+	DisableParameterOverrides bool
+
+	// DryRun makes the controller only log, and report in Normal events, the
+	// volumes it would provision, delete and recycle. It creates, updates and
+	// deletes nothing but events, and provisioners take part only if they
+	// implement DryRunner.
+	DryRun bool
+}
+
+// setDefaults sets the fields left at their zero values that have defaults,
+// except ServerGitVersion, Identity and EventSource, which depend on the
+// environment.
+func (o *ProvisionControllerOptions) setDefaults() {
+	if o.ResyncPeriod == 0 {
+		o.ResyncPeriod = DefaultResyncPeriod
+	}
+	if o.RetryBaseDelay == 0 {
+		o.RetryBaseDelay = DefaultRetryBaseDelay
+	}
+	if o.RetryMaxDelay == 0 {
+		o.RetryMaxDelay = DefaultRetryMaxDelay
+	}
+	if o.ProvisionWorkers == 0 {
+		o.ProvisionWorkers = DefaultWorkers
+	}
+	if o.DeleteWorkers == 0 {
+		o.DeleteWorkers = DefaultWorkers
+	}
+	if o.ClaimSelector == nil {
+		o.ClaimSelector = labels.Everything()
+	}
+}
+
+// validate returns an error if any of the options is invalid.
+func (o *ProvisionControllerOptions) validate() error {
+	if o.ResyncPeriod < 0 || o.LeaseDuration < 0 || o.RetryBaseDelay < 0 || o.RetryMaxDelay < 0 || o.OperationTimeout < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	if o.LeaseDuration != 0 && o.LeaseDuration < time.Second {
+		return fmt.Errorf("LeaseDuration must be 0 or at least 1s")
+	}
+	if o.MaxRetries < 0 {
+		return fmt.Errorf("MaxRetries must not be negative")
+	}
+	if o.ProvisionWorkers < 0 || o.DeleteWorkers < 0 {
+		return fmt.Errorf("ProvisionWorkers and DeleteWorkers must not be negative")
+	}
+	if o.RetryBaseDelay > o.RetryMaxDelay {
+		return fmt.Errorf("RetryBaseDelay must not be greater than RetryMaxDelay")
+	}
+	return nil
+}
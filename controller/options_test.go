@@ -0,0 +1,189 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.4/kubernetes/fake"
+)
+
+func TestOptions(t *testing.T) {
+	tests := []struct {
+		name              string
+		options           ProvisionControllerOptions
+		expectedBaseDelay time.Duration
+		expectedMaxDelay  time.Duration
+		expectedWorkers   int
+		expectedIdentity  string
+		expectError       bool
+	}{
+		{
+			name:              "defaults",
+			options:           ProvisionControllerOptions{ServerGitVersion: "v1.5.0"},
+			expectedBaseDelay: DefaultRetryBaseDelay,
+			expectedMaxDelay:  DefaultRetryMaxDelay,
+			expectedWorkers:   DefaultWorkers,
+			expectError:       false,
+		},
+		{
+			name: "set",
+			options: ProvisionControllerOptions{
+				ServerGitVersion: "v1.5.0",
+				ResyncPeriod:     time.Minute,
+				Identity:         "foo",
+				RetryBaseDelay:   time.Second,
+				RetryMaxDelay:    time.Second,
+				ProvisionWorkers: 1,
+				DeleteWorkers:    1,
+			},
+			expectedBaseDelay: time.Second,
+			expectedMaxDelay:  time.Second,
+			expectedWorkers:   1,
+			expectedIdentity:  "foo",
+			expectError:       false,
+		},
+		{
+			name:        "negative duration",
+			options:     ProvisionControllerOptions{ServerGitVersion: "v1.5.0", LeaseDuration: -time.Second},
+			expectError: true,
+		},
+		{
+			name:        "sub-second lease duration",
+			options:     ProvisionControllerOptions{ServerGitVersion: "v1.5.0", LeaseDuration: 500 * time.Millisecond},
+			expectError: true,
+		},
+		{
+			name:        "negative retries",
+			options:     ProvisionControllerOptions{ServerGitVersion: "v1.5.0", MaxRetries: -1},
+			expectError: true,
+		},
+		{
+			name:        "negative workers",
+			options:     ProvisionControllerOptions{ServerGitVersion: "v1.5.0", DeleteWorkers: -1},
+			expectError: true,
+		},
+		{
+			name:        "base delay greater than max delay",
+			options:     ProvisionControllerOptions{ServerGitVersion: "v1.5.0", RetryBaseDelay: time.Hour},
+			expectError: true,
+		},
+		{
+			name:        "unparseable server version",
+			options:     ProvisionControllerOptions{ServerGitVersion: "foo"},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		ctrl, err := NewProvisionController(client, map[string]Provisioner{"foo.bar/baz": newTestProvisioner()}, test.options)
+		if test.expectError {
+			if err == nil {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected error but got none")
+			}
+			continue
+		}
+		if err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error creating controller: %v", err)
+			continue
+		}
+		if test.expectedBaseDelay != ctrl.claimQueue.baseDelay || test.expectedMaxDelay != ctrl.claimQueue.maxDelay {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected retry delays %v, %v but got %v, %v", test.expectedBaseDelay, test.expectedMaxDelay, ctrl.claimQueue.baseDelay, ctrl.claimQueue.maxDelay)
+		}
+		if test.expectedWorkers != ctrl.provisionWorkers || test.expectedWorkers != ctrl.deleteWorkers {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected %v workers but got %v provision and %v delete workers", test.expectedWorkers, ctrl.provisionWorkers, ctrl.deleteWorkers)
+		}
+		if test.expectedIdentity != "" && test.expectedIdentity != ctrl.identity {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected identity %q but got %q", test.expectedIdentity, ctrl.identity)
+		} else if ctrl.identity == "" {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected an identity but got none")
+		}
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxRetries       int
+		operationTimeout time.Duration
+		expectError      bool
+	}{
+		{
+			name:             "set",
+			maxRetries:       3,
+			operationTimeout: time.Minute,
+			expectError:      false,
+		},
+		{
+			name:             "unlimited",
+			maxRetries:       0,
+			operationTimeout: 0,
+			expectError:      false,
+		},
+		{
+			name:             "negative retries",
+			maxRetries:       -1,
+			operationTimeout: time.Minute,
+			expectError:      true,
+		},
+		{
+			name:             "negative timeout",
+			maxRetries:       3,
+			operationTimeout: -time.Minute,
+			expectError:      true,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		ctrl := newTestProvisionController(t, client, map[string]Provisioner{"foo.bar/baz": newTestProvisioner()}, ProvisionControllerOptions{ServerGitVersion: "v1.5.0", MaxRetries: 15, OperationTimeout: time.Hour})
+
+		err := ctrl.SetLimits(test.maxRetries, test.operationTimeout)
+		if test.expectError {
+			if err == nil {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected error but got none")
+			}
+			if ctrl.getMaxRetries() != 15 || ctrl.operationTimeout != time.Hour {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected limits unchanged but got %v, %v", ctrl.getMaxRetries(), ctrl.operationTimeout)
+			}
+			continue
+		}
+		if err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error setting limits: %v", err)
+			continue
+		}
+		if test.maxRetries != ctrl.getMaxRetries() || test.operationTimeout != ctrl.operationTimeout {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected limits %v, %v but got %v, %v", test.maxRetries, test.operationTimeout, ctrl.getMaxRetries(), ctrl.operationTimeout)
+		}
+		ctx, cancel := ctrl.newOperationContext()
+		if _, hasDeadline := ctx.Deadline(); hasDeadline != (test.operationTimeout != 0) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected operation deadline %v but got %v", test.operationTimeout != 0, hasDeadline)
+		}
+		cancel()
+	}
+}
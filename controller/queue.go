@@ -0,0 +1,234 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/1.4/pkg/util/sets"
+)
+
+// rateLimitingQueue is a queue of keys of objects to work on, e.g. claims to
+// provision volumes for, modeled on the work queues of newer client-go
+// versions. A key is in the queue at most once and is never handed to more
+// than one worker at a time. A key whose work failed can be requeued after a
+// delay that grows exponentially with the number of times it has failed.
+type rateLimitingQueue struct {
+	// The delay before the first retry of a key. Every further retry doubles
+	// it, up to maxDelay.
+	baseDelay time.Duration
+	maxDelay  time.Duration
+
+	cond *sync.Cond
+
+	// Keys ready to be handed to workers, in order.
+	queue []string
+	// Keys that need work, whether queued or being worked on.
+	dirty sets.String
+	// Keys being worked on.
+	processing sets.String
+	// Keys that will be added once the given time has come.
+	waiting map[string]time.Time
+	// Number of times each key has been requeued by AddRateLimited.
+	failures map[string]int
+
+	shuttingDown bool
+}
+
+func newRateLimitingQueue(baseDelay, maxDelay time.Duration) *rateLimitingQueue {
+	return &rateLimitingQueue{
+		baseDelay:  baseDelay,
+		maxDelay:   maxDelay,
+		cond:       sync.NewCond(&sync.Mutex{}),
+		dirty:      sets.NewString(),
+		processing: sets.NewString(),
+		waiting:    make(map[string]time.Time),
+		failures:   make(map[string]int),
+	}
+}
+
+// Add marks the given key as needing work. If the key is waiting to be retried
+// after a failure, Add does nothing so that the many updates of an object,
+// e.g. resyncs, don't cut its backoff short.
+func (q *rateLimitingQueue) Add(key string) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.shuttingDown {
+		return
+	}
+	if _, waiting := q.waiting[key]; waiting {
+		return
+	}
+	q.add(key)
+}
+
+// add must be called with the lock held.
+func (q *rateLimitingQueue) add(key string) {
+	if q.dirty.Has(key) {
+		return
+	}
+	q.dirty.Insert(key)
+	if q.processing.Has(key) {
+		// Done will queue it again
+		return
+	}
+	q.queue = append(q.queue, key)
+	q.cond.Signal()
+}
+
+// AddAfter adds the given key once the given duration has passed. If the key
+// is already waiting to be added, the earlier of the two times wins.
+func (q *rateLimitingQueue) AddAfter(key string, duration time.Duration) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.addAfter(key, duration)
+}
+
+// addAfter must be called with the lock held.
+func (q *rateLimitingQueue) addAfter(key string, duration time.Duration) {
+	if q.shuttingDown {
+		return
+	}
+	if duration <= 0 {
+		delete(q.waiting, key)
+		q.add(key)
+		return
+	}
+	readyAt := time.Now().Add(duration)
+	if at, waiting := q.waiting[key]; waiting && !at.After(readyAt) {
+		return
+	}
+	q.waiting[key] = readyAt
+	time.AfterFunc(duration, func() {
+		q.cond.L.Lock()
+		defer q.cond.L.Unlock()
+		// Do nothing if the key has since been scheduled for an earlier time
+		if at, waiting := q.waiting[key]; !waiting || !at.Equal(readyAt) {
+			return
+		}
+		delete(q.waiting, key)
+		if !q.shuttingDown {
+			q.add(key)
+		}
+	})
+}
+
+// AddRateLimited adds the given key after a delay that depends on how many
+// times it has been requeued by AddRateLimited since it was last forgotten,
+// and returns the delay.
+func (q *rateLimitingQueue) AddRateLimited(key string) time.Duration {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.failures[key]++
+	delay := q.when(q.failures[key])
+	q.addAfter(key, delay)
+	return delay
+}
+
+// when returns the delay before retry number n, n >= 1.
+func (q *rateLimitingQueue) when(n int) time.Duration {
+	delay := q.baseDelay
+	for i := 1; i < n && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.maxDelay {
+		delay = q.maxDelay
+	}
+	return delay
+}
+
+// Forget resets the number of times the given key has been requeued, e.g.
+// because its work succeeded or it no longer needs any.
+func (q *rateLimitingQueue) Forget(key string) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	delete(q.failures, key)
+}
+
+// NumRequeues returns the number of times the given key has been requeued by
+// AddRateLimited since it was last forgotten.
+func (q *rateLimitingQueue) NumRequeues(key string) int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.failures[key]
+}
+
+// SetRequeues raises the number of times the given key is considered to have
+// been requeued to the given number, e.g. to carry on backing off from where a
+// previous instance of the controller left off.
+func (q *rateLimitingQueue) SetRequeues(key string, requeues int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.failures[key] < requeues {
+		q.failures[key] = requeues
+	}
+}
+
+// Get blocks until a key is ready to be worked on and returns it. The caller
+// must call Done with the key when it is finished with it. If the queue is shut
+// down and empty, Get returns shutdown true.
+func (q *rateLimitingQueue) Get() (key string, shutdown bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for len(q.queue) == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if len(q.queue) == 0 {
+		return "", true
+	}
+	key, q.queue = q.queue[0], q.queue[1:]
+	q.processing.Insert(key)
+	q.dirty.Delete(key)
+	return key, false
+}
+
+// Done marks the given key as no longer being worked on. If it was added again
+// in the meantime, it is queued again.
+func (q *rateLimitingQueue) Done(key string) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.processing.Delete(key)
+	if q.dirty.Has(key) {
+		q.queue = append(q.queue, key)
+		q.cond.Signal()
+	}
+}
+
+// ShutDown makes the queue ignore further additions, including those still
+// waiting, and Get return shutdown true once the queued keys are handed out.
+func (q *rateLimitingQueue) ShutDown() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+// Stats returns the number of keys ready to be worked on, waiting to be
+// retried and being worked on.
+func (q *rateLimitingQueue) Stats() (ready, waiting, processing int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return len(q.queue), len(q.waiting), q.processing.Len()
+}
+
+// Len returns the number of keys ready to be worked on.
+func (q *rateLimitingQueue) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return len(q.queue)
+}
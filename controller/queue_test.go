@@ -0,0 +1,113 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddRateLimited(t *testing.T) {
+	q := newRateLimitingQueue(10*time.Millisecond, 40*time.Millisecond)
+	tests := []struct {
+		name             string
+		expectedDelay    time.Duration
+		expectedRequeues int
+	}{
+		{
+			name:             "first retry",
+			expectedDelay:    10 * time.Millisecond,
+			expectedRequeues: 1,
+		},
+		{
+			name:             "second retry",
+			expectedDelay:    20 * time.Millisecond,
+			expectedRequeues: 2,
+		},
+		{
+			name:             "third retry",
+			expectedDelay:    40 * time.Millisecond,
+			expectedRequeues: 3,
+		},
+		{
+			name:             "fourth retry: max delay",
+			expectedDelay:    40 * time.Millisecond,
+			expectedRequeues: 4,
+		},
+	}
+	for _, test := range tests {
+		delay := q.AddRateLimited("foo")
+		if test.expectedDelay != delay {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected delay %v but got %v", test.expectedDelay, delay)
+		}
+		if requeues := q.NumRequeues("foo"); test.expectedRequeues != requeues {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected requeues %v but got %v", test.expectedRequeues, requeues)
+		}
+	}
+
+	q.Forget("foo")
+	if requeues := q.NumRequeues("foo"); requeues != 0 {
+		t.Errorf("expected requeues 0 after forgetting but got %v", requeues)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	q := newRateLimitingQueue(20*time.Millisecond, 20*time.Millisecond)
+
+	// A key is queued at most once
+	q.Add("foo")
+	q.Add("foo")
+	if l := q.Len(); l != 1 {
+		t.Errorf("expected 1 key queued but got %v", l)
+	}
+
+	// A key added while being worked on is queued again once done
+	key, _ := q.Get()
+	q.Add("foo")
+	if l := q.Len(); l != 0 {
+		t.Errorf("expected 0 keys queued while working on %q but got %v", key, l)
+	}
+	q.Done(key)
+	if l := q.Len(); l != 1 {
+		t.Errorf("expected 1 key queued after done with %q but got %v", key, l)
+	}
+	key, _ = q.Get()
+	q.Done(key)
+
+	// A key waiting to be retried is not added until its backoff is over
+	q.AddRateLimited("foo")
+	q.Add("foo")
+	if l := q.Len(); l != 0 {
+		t.Errorf("expected 0 keys queued while backing off but got %v", l)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if l := q.Len(); l != 1 {
+		t.Errorf("expected 1 key queued after backing off but got %v", l)
+	}
+
+	// The remaining keys are handed out after shutting down
+	q.AddAfter("bar", time.Hour)
+	q.ShutDown()
+	if key, shutdown := q.Get(); shutdown || key != "foo" {
+		t.Errorf("expected key %q after shutting down but got %q, shutdown %v", "foo", key, shutdown)
+	}
+	if _, shutdown := q.Get(); !shutdown {
+		t.Errorf("expected shutdown")
+	}
+}
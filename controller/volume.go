@@ -17,6 +17,7 @@ limitations under the License.
 package controller
 
 import (
+	"golang.org/x/net/context"
 	"k8s.io/client-go/1.4/pkg/api/resource"
 	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
@@ -26,13 +27,88 @@ import (
 // and can create the volume as a new resource in the infrastructure provider.
 // It can also remove the volume it created from the underlying storage
 // provider.
+//
+// Every operation is given a context that is done when the operation's deadline
+// passes or, for Provision, when the claim is deleted. An operation should stop
+// as soon as it can after that and return the context's error.
 type Provisioner interface {
 	// Provision creates a volume i.e. the storage asset and returns a PV object
-	// for the volume
-	Provision(VolumeOptions) (*v1.PersistentVolume, error)
+	// for the volume. If it stops early, it must remove whatever part of the
+	// storage asset it has created.
+	Provision(context.Context, VolumeOptions) (*v1.PersistentVolume, error)
 	// Delete removes the storage asset that was created by Provision backing the
-	// given PV. Does not delete the PV object itself.
-	Delete(*v1.PersistentVolume) error
+	// given PV. Does not delete the PV object itself. If it stops early,
+	// calling it again must finish the job.
+	Delete(context.Context, *v1.PersistentVolume) error
+}
+
+// Recycler is an optional interface a Provisioner can implement to support
+// the Recycle reclaim policy.
+type Recycler interface {
+	// Recycle removes the contents of the storage asset backing the given PV,
+	// leaving the asset itself in place so that the PV can be bound again. If
+	// it stops early, calling it again must finish the job.
+	Recycle(context.Context, *v1.PersistentVolume) error
+}
+
+// Qualifier is an optional interface a Provisioner can implement to reject
+// claims before the controller does any work for them, e.g. takes a lease on
+// them.
+type Qualifier interface {
+	// ShouldProvision returns whether the provisioner should provision a
+	// volume for the given claim.
+	ShouldProvision(*v1.PersistentVolumeClaim) bool
+}
+
+// Validator is an optional interface a Provisioner can implement to check the
+// options for a volume before the controller calls Provision.
+type Validator interface {
+	// Validate returns an error if the provisioner can't provision a volume
+	// with the given options. The controller reports the error on the claim
+	// and retries like it would if Provision failed.
+	Validate(VolumeOptions) error
+}
+
+// PostDeleteHook is an optional interface a Provisioner can implement to be
+// told when the controller has deleted the PV object of a volume it deleted.
+type PostDeleteHook interface {
+	// PostDelete is called with the PV whose storage asset Delete removed,
+	// once the PV object is gone too.
+	PostDelete(*v1.PersistentVolume)
+}
+
+// DryRunner is an optional interface a Provisioner can implement to take part
+// in dry runs of the controller, in which nothing may be changed. In a dry run
+// the controller calls DryRunProvision and DryRunDelete instead of Provision
+// and Delete, and calls neither on provisioners that don't implement DryRunner.
+type DryRunner interface {
+	// DryRunProvision does what Provision would short of creating anything,
+	// e.g. validates the options, and returns the PV object Provision would.
+	DryRunProvision(VolumeOptions) (*v1.PersistentVolume, error)
+	// DryRunDelete returns an error if Delete would fail to remove the storage
+	// asset backing the given PV, without removing anything.
+	DryRunDelete(*v1.PersistentVolume) error
+}
+
+// Inspector is an optional interface a Provisioner can implement to describe
+// the volumes it provisioned in the controller's admin API.
+type Inspector interface {
+	// Inspect returns what the provisioner knows about the storage asset
+	// backing the given PV.
+	Inspect(*v1.PersistentVolume) (*VolumeInfo, error)
+}
+
+// VolumeInfo describes the storage asset backing a PV.
+type VolumeInfo struct {
+	// ExportId is the ID of the volume's export on the NFS server.
+	ExportId string `json:"exportId,omitempty"`
+	// Path is the path of the volume's directory on the NFS server.
+	Path string `json:"path,omitempty"`
+	// UsedBytes is the size of the files in the volume.
+	UsedBytes int64 `json:"usedBytes"`
+	// ExportBlock is the block exporting the volume in the NFS server's
+	// config file.
+	ExportBlock string `json:"exportBlock,omitempty"`
 }
 
 // VolumeOptions contains option information about a volume
@@ -44,6 +120,9 @@ type VolumeOptions struct {
 	AccessModes []v1.PersistentVolumeAccessMode
 	// Reclamation policy for a persistent volume
 	PersistentVolumeReclaimPolicy v1.PersistentVolumeReclaimPolicy
+	// Whether the volume is recycled once released, in which case
+	// PersistentVolumeReclaimPolicy is Retain since the controller recycles it
+	Recycle bool
 	// PV.Name of the appropriate PersistentVolume. Used to generate cloud
 	// volume name.
 	PVName string
@@ -51,4 +130,6 @@ type VolumeOptions struct {
 	Parameters map[string]string
 	// Volume selector from PersistentVolumeClaim
 	Selector *unversioned.LabelSelector
+	// PVC is the claim that led to the provisioning of the volume
+	PVC *v1.PersistentVolumeClaim
 }
@@ -17,6 +17,7 @@ limitations under the License.
 package framework
 
 import (
+	"hash/fnv"
 	"sync"
 	"time"
 
@@ -56,6 +57,13 @@ type Config struct {
 	//       the object completely if desired. Pass the object in
 	//       question to this interface as a parameter.
 	RetryOnError bool
+
+	// Number of workers that call Process in parallel. Every object is
+	// always processed by the same worker, so the same object is never
+	// processed more than once at a time and its changes are processed in
+	// order. If less than two, objects are processed one at a time as they
+	// are popped from Queue.
+	Workers int
 }
 
 // ProcessFunc processes a single object.
@@ -66,6 +74,12 @@ type Controller struct {
 	config         Config
 	reflector      *cache.Reflector
 	reflectorMutex sync.RWMutex
+
+	// Channels of the objects for each worker to process, if there are
+	// multiple workers.
+	workerQueues []chan interface{}
+	// Closed once Run is told to stop, when the workers stop taking objects.
+	stopCh <-chan struct{}
 }
 
 // TODO make the "Controller" private, and convert all references to use ControllerInterface instead
@@ -100,6 +114,15 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 
 	r.RunUntil(stopCh)
 
+	c.stopCh = stopCh
+	if c.config.Workers > 1 {
+		c.workerQueues = make([]chan interface{}, c.config.Workers)
+		for i := range c.workerQueues {
+			c.workerQueues[i] = make(chan interface{})
+			go c.worker(c.workerQueues[i], stopCh)
+		}
+	}
+
 	wait.Until(c.processLoop, time.Second, stopCh)
 }
 
@@ -118,13 +141,15 @@ func (c *Controller) Requeue(obj interface{}) error {
 	})
 }
 
-// processLoop drains the work queue.
-// TODO: Consider doing the processing in parallel. This will require a little thought
-// to make sure that we don't end up processing the same object multiple times
-// concurrently.
+// processLoop drains the work queue. If there are multiple workers, it hands
+// each object to the worker for its key instead of processing it.
 func (c *Controller) processLoop() {
+	process := c.config.Process
+	if len(c.workerQueues) != 0 {
+		process = c.dispatch
+	}
 	for {
-		obj, err := c.config.Queue.Pop(cache.PopProcessFunc(c.config.Process))
+		obj, err := c.config.Queue.Pop(cache.PopProcessFunc(process))
 		if err != nil {
 			if c.config.RetryOnError {
 				// This is the safe way to re-enqueue.
@@ -134,6 +159,52 @@ func (c *Controller) processLoop() {
 	}
 }
 
+// dispatch hands the given object to the worker for its key. The queue is
+// locked while it waits for the worker to take the object, so a busy worker
+// slows the others down rather than let objects pile up in memory. It gives up
+// on the object once the controller is stopped, since the worker won't take it.
+func (c *Controller) dispatch(obj interface{}) error {
+	key, err := objectKey(obj)
+	if err != nil {
+		// Without a key there's no telling which worker may be processing
+		// the object, so process it here
+		return c.config.Process(obj)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	select {
+	case c.workerQueues[h.Sum32()%uint32(len(c.workerQueues))] <- obj:
+	case <-c.stopCh:
+	}
+	return nil
+}
+
+// worker processes the objects dispatched to it until stopCh is closed.
+func (c *Controller) worker(queue <-chan interface{}, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	for {
+		select {
+		case obj := <-queue:
+			if err := c.config.Process(obj); err != nil && c.config.RetryOnError {
+				c.config.Queue.AddIfNotPresent(obj)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// objectKey returns the key of the given object popped from a cache.FIFO or a
+// cache.DeltaFIFO.
+func objectKey(obj interface{}) (string, error) {
+	if deltas, ok := obj.(cache.Deltas); ok {
+		if newest := deltas.Newest(); newest != nil {
+			obj = newest.Object
+		}
+	}
+	return DeletionHandlingMetaNamespaceKeyFunc(obj)
+}
+
 // ResourceEventHandler can handle notifications for events that happen to a
 // resource.  The events are informational only, so you can't return an
 // error.
@@ -214,6 +285,19 @@ func NewInformer(
 	objType runtime.Object,
 	resyncPeriod time.Duration,
 	h ResourceEventHandler,
+) (cache.Store, *Controller) {
+	return NewParallelInformer(lw, objType, resyncPeriod, h, 1)
+}
+
+// NewParallelInformer is like NewInformer but calls h from the given number of
+// workers in parallel. Notifications about the same object are never sent
+// concurrently and arrive in order.
+func NewParallelInformer(
+	lw cache.ListerWatcher,
+	objType runtime.Object,
+	resyncPeriod time.Duration,
+	h ResourceEventHandler,
+	workers int,
 ) (cache.Store, *Controller) {
 	// This will hold the client state, as we know it.
 	clientState := cache.NewStore(DeletionHandlingMetaNamespaceKeyFunc)
@@ -229,6 +313,7 @@ func NewInformer(
 		ObjectType:       objType,
 		FullResyncPeriod: resyncPeriod,
 		RetryOnError:     false,
+		Workers:          workers,
 
 		Process: func(obj interface{}) error {
 			// from oldest to newest
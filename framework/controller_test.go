@@ -0,0 +1,49 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package framework
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/wait"
+)
+
+func TestDispatchWhenStopped(t *testing.T) {
+	stopCh := make(chan struct{})
+	c := New(&Config{Workers: 2})
+	c.stopCh = stopCh
+	// Nothing takes objects from the workers' channels, as if the workers are
+	// busy
+	c.workerQueues = []chan interface{}{make(chan interface{}), make(chan interface{})}
+
+	done := make(chan error)
+	go func() {
+		done <- c.dispatch(&v1.Pod{ObjectMeta: v1.ObjectMeta{Name: "foo", Namespace: "default"}})
+	}()
+	close(stopCh)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected no error dispatching when stopped but got: %v", err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Errorf("expected dispatch to return once stopped but it's still waiting for a worker")
+	}
+}
@@ -17,15 +17,26 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/wongma7/nfs-provisioner/cli"
+	"github.com/wongma7/nfs-provisioner/config"
 	"github.com/wongma7/nfs-provisioner/controller"
 	"github.com/wongma7/nfs-provisioner/server"
 	vol "github.com/wongma7/nfs-provisioner/volume"
 	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/labels"
+	"k8s.io/client-go/1.4/pkg/util/sets"
 	"k8s.io/client-go/1.4/pkg/util/validation"
 	"k8s.io/client-go/1.4/pkg/util/validation/field"
 	"k8s.io/client-go/1.4/pkg/util/wait"
@@ -34,66 +45,368 @@ import (
 )
 
 var (
-	provisioner = flag.String("provisioner", "matthew/nfs", "Name of the provisioner. The provisioner will only provision volumes for claims that request a StorageClass with a provisioner field set equal to this name.")
-	master      = flag.String("master", "", "Master URL to build a client config from. Either this or kubeconfig needs to be set if the provisioner is being run out of cluster.")
-	kubeconfig  = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Either this or master needs to be set if the provisioner is being run out of cluster.")
-	runServer   = flag.Bool("run-server", true, "If the provisioner is responsible for running the NFS server, i.e. starting and stopping NFS Ganesha. Default true.")
-	useGanesha  = flag.Bool("use-ganesha", true, "If the provisioner will create volumes using NFS Ganesha (D-Bus method calls) as opposed to using the kernel NFS server ('exportfs'). If run-server is true, this must be true. Default true.")
+	provisioner       = flag.String("provisioner", "matthew/nfs", "Name of the provisioner. The provisioner will only provision volumes for claims that request a StorageClass with a provisioner field set equal to this name.")
+	master            = flag.String("master", "", "Master URL to build a client config from. Either this or kubeconfig needs to be set if the provisioner is being run out of cluster.")
+	kubeconfig        = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Either this or master needs to be set if the provisioner is being run out of cluster.")
+	runServer         = flag.Bool("run-server", true, "If the provisioner is responsible for running the NFS server, i.e. starting and stopping NFS Ganesha. Default true.")
+	useGanesha        = flag.Bool("use-ganesha", true, "If the provisioner will create volumes using NFS Ganesha (D-Bus method calls) as opposed to using the kernel NFS server ('exportfs'). Ignored if exporter is set. If run-server is true, this must be true. Default true.")
+	exporter          = flag.String("exporter", "", "Name of the exporter the provisioner will export volumes with: 'ganesha' for NFS Ganesha, 'kernel' for the kernel NFS server or the name of another exporter compiled in. If empty, what use-ganesha says. If run-server is true, this must be 'ganesha'. Default empty.")
+	leaseDuration     = flag.Duration("claim-lease-duration", 0, "Duration of the lease an instance of the provisioner takes on a claim before provisioning a volume for it, so that when multiple instances have the same name only one at a time tries to. If 0, leases are not used. Default 0.")
+	maxRetries        = flag.Int("max-retries", 15, "Maximum number of times to retry provisioning a volume for a claim, or deleting or recycling a volume, after the first attempt fails. Retries back off exponentially. If 0, retry forever. Default 15.")
+	provisionWorkers  = flag.Int("provision-workers", 4, "Maximum number of volumes to provision at once. Default 4.")
+	deleteWorkers     = flag.Int("delete-workers", 4, "Maximum number of volumes to delete or recycle at once. Default 4.")
+	operationTimeout  = flag.Duration("operation-timeout", 5*time.Minute, "Maximum duration of an attempt to provision, delete or recycle a volume. An attempt that takes longer is stopped and retried. If 0, attempts have no deadline. Default 5m.")
+	namespaces        = flag.String("namespaces", "", "Comma-separated list of the namespaces of the claims to provision volumes for. The provisioner only watches claims in these namespaces and only deletes volumes whose claims were in them. If empty, all namespaces. Default empty.")
+	claimSelector     = flag.String("claim-selector", "", "Label selector of the claims to provision volumes for, e.g. 'tenant=a'. If empty, all claims. Default empty.")
+	dryRun            = flag.Bool("dry-run", false, "If the provisioner will only log, and report in Normal events, the volumes it would provision, delete and recycle, without creating or removing any directories, exports or PersistentVolumes. The NFS server is not started even if run-server is true. Default false.")
+	metricsAddress    = flag.String("metrics-address", "", "Address to serve metrics about the provisioner's work queues on, in the Prometheus text format at /metrics, e.g. ':9090'. If empty, metrics are not served. Default empty.")
+	healthAddress     = flag.String("health-address", "", "Address to serve a health check on at /healthz, e.g. ':8080'. May be the same as metrics-address. If empty, the health check is not served. Default empty.")
+	manageService     = flag.Bool("manage-service", false, "If the provisioner will create the Service named by the SERVICE_NAME env in the POD_NAMESPACE namespace, or adopt it if it exists, and keep its Endpoints pointing at the pod IP on the NFS ports, so that provisioned PVs get its stable cluster IP. An adopted Service gets any NFS ports it lacks and loses its selector. Only one pod may manage a given Service. Default false.")
+	serverAddress     = flag.String("server-address", "", "NFS server address to put in provisioned PVs, e.g. an external hostname, if server-address-strategy is 'auto' or 'fixed'. If empty, the provisioner's Service cluster IP, node name or pod IP is looked up from the environment. Default empty.")
+	addressStrategy   = flag.String("server-address-strategy", vol.ServerAuto, "How to choose the NFS server address to put in the PVs of StorageClasses that don't choose one with the serverAddressStrategy parameter: 'auto' for server-address if set, else the Service cluster IP, node name or pod IP; 'fixed' for server-address; 'service-dns' for the Service's DNS name; 'load-balancer' for the Service's load balancer ingress IP; 'pod-dns' for the pod's DNS name under a headless Service, as in a StatefulSet; or 'node-external-ip' for the node's ExternalIP, with hostNetwork or hostPort. The Service is the one named by the SERVICE_NAME env and the node the one named by NODE_NAME. Default auto.")
+	ipFamily          = flag.String("ip-family", "", "Family of the IPs to put in provisioned PVs and the managed Service's Endpoints in a dual-stack cluster, 'ipv4' or 'ipv6'. The pod's IPs are read from the POD_IPS env, then the POD_IP env, then `hostname -i`. If empty, the first IP found. Default empty.")
+	clusterDomain     = flag.String("cluster-domain", vol.DefaultClusterDomain, "DNS domain of the cluster, for the service-dns and pod-dns server address strategies. Default cluster.local.")
+	adminAddress      = flag.String("admin-address", "", "Address to serve the admin API on, for inspecting and operating the provisioner, e.g. '127.0.0.1:8081'. Requests must carry the token in admin-token-file as a bearer token. If empty, the admin API is not served. Default empty.")
+	adminTokenFile    = flag.String("admin-token-file", "", "Path of the file holding the token requests to the admin API must carry. Required if admin-address is set. Default empty.")
+	allowEphemeral    = flag.Bool("allow-ephemeral", false, "If the provisioner may run with an export directory on storage that doesn't outlive the pod, like tmpfs, the container's overlay root filesystem or an emptyDir, in which case its PVs are labeled provisioner.alpha.kubernetes.io/ephemeral=true. Otherwise the provisioner refuses to start with such an export directory. Default false.")
+	configFile        = flag.String("config", "", "Path of a YAML config file whose settings override the flags'. It is checked for changes every config-check-period: changes to the log level, limits and default parameters apply without a restart, and changes to other settings are logged as needing one. If empty, only the flags are used. Default empty.")
+	configCheckPeriod = flag.Duration("config-check-period", 10*time.Second, "Period at which the config file is checked for changes. Default 10s.")
 )
 
-const ganeshaConfig = "/export/vfs.conf"
+var extraProvisioners provisionerSpecs
+
+func init() {
+	flag.Var(&extraProvisioners, "extra-provisioner", "An additional provisioner name to serve from the same process and NFS server, with its own export directory, exporter and default StorageClass parameters, as semicolon-separated key=value pairs, e.g. 'name=example.com/nfs-b;export-dir=/export-b;exporter=kernel;gid=1000'. name and export-dir are required. exporter is the name of an exporter like the exporter flag's and defaults to the exporter flag's. Every other key is the default value of a StorageClass parameter. May be given multiple times.")
+}
 
 func main() {
 	flag.Set("logtostderr", "true")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\nWithout a command, runs the provisioner.\n\n", os.Args[0])
+		cli.Usage(os.Stderr)
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if errs := validateProvisioner(*provisioner, field.NewPath("provisioner")); len(errs) != 0 {
 		glog.Fatalf("Invalid provisioner specified: %v", errs)
 	}
-	glog.Infof("Provisioner %s specified", *provisioner)
 
-	if *runServer && !*useGanesha {
-		glog.Fatalf("Invalid flags specified: if run-server is true, use-ganesha must also be true.")
+	base := flagConfig()
+	cfg := &base
+	if *configFile != "" {
+		var err error
+		cfg, err = config.Load(*configFile, base)
+		if err != nil {
+			glog.Fatalf("Error loading config: %v", err)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		if *configFile != "" {
+			glog.Fatalf("Invalid config file %s: %v", *configFile, err)
+		}
+		glog.Fatalf("Invalid flags specified: %v", err)
+	}
+	flag.Set("v", strconv.Itoa(cfg.LogLevel))
+	for _, p := range cfg.Provisioners {
+		glog.Infof("Provisioner %s specified", p.Name)
+	}
+
+	selector, err := labels.Parse(cfg.ClaimSelector)
+	if err != nil {
+		glog.Fatalf("Invalid claim selector: %v", err)
 	}
 
-	if *runServer {
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(cfg, flag.Args()))
+	}
+
+	// The NFS server only starts once the preflight checks pass, but they
+	// check its config file
+	if cfg.Server.Run && !cfg.DryRun {
+		if err := server.WriteDefaultConfig(cfg.Server.GaneshaConfig); err != nil {
+			glog.Fatalf("Error writing NFS server config: %v", err)
+		}
+	}
+
+	clientset, err := newClient()
+	if err != nil {
+		glog.Fatalf("Failed to create client: %v", err)
+	}
+
+	// Create the provisioners: they implement the Provisioner interface expected
+	// by the controller. The service is only managed once the preflight checks
+	// pass, so they mustn't expect it to exist.
+	serverAddress := newServerAddress(cfg)
+	serverAddress.ManagedService = cfg.Server.ManageService && !cfg.DryRun
+	provisioners := map[string]controller.Provisioner{}
+	for _, p := range cfg.Provisioners {
+		provisioner, err := vol.NewNFSProvisioner(p.ExportDir, clientset, newExporter(cfg, p), serverAddress, cfg.AllowEphemeral, p.DefaultParameters)
+		if err != nil {
+			glog.Fatalf("Error creating provisioner %s: %v", p.Name, err)
+		}
+		provisioners[p.Name] = provisioner
+	}
+
+	// Check the environment of the provisioners before starting anything or
+	// serving any claims. An NFS server this process starts can only be checked
+	// once it has.
+	startServer := cfg.Server.Run && !cfg.DryRun
+	fatal := false
+	for _, p := range cfg.Provisioners {
+		checks := []vol.Check{}
+		if preflighter, ok := provisioners[p.Name].(vol.Preflighter); ok {
+			checks = append(checks, preflighter.Preflight()...)
+		}
+		if preflighter, ok := provisioners[p.Name].(vol.ServerPreflighter); ok && !startServer {
+			checks = append(checks, preflighter.PreflightServer()...)
+		}
+		cli.WritePreflightReport(os.Stderr, p.Name, checks)
+		fatal = fatal || vol.Fatal(checks)
+	}
+	if fatal && cfg.DryRun {
+		glog.Warningf("Preflight checks failed, continuing because of dry run")
+	} else if fatal {
+		glog.Fatalf("Preflight checks failed, not starting")
+	}
+
+	if cfg.Server.Run && cfg.DryRun {
+		glog.Infof("Dry run, not starting NFS server")
+	} else if startServer {
 		glog.Infof("Starting NFS server!")
-		err := server.Start(ganeshaConfig)
+		err := server.Start(cfg.Server.GaneshaConfig)
 		if err != nil {
 			glog.Fatalf("Error starting NFS server: %v", err)
 		}
+		for _, p := range cfg.Provisioners {
+			preflighter, ok := provisioners[p.Name].(vol.ServerPreflighter)
+			if !ok {
+				continue
+			}
+			checks := preflighter.PreflightServer()
+			cli.WritePreflightReport(os.Stderr, p.Name, checks)
+			fatal = fatal || vol.Fatal(checks)
+		}
+		if fatal {
+			glog.Fatalf("Preflight checks of the NFS server failed, not starting")
+		}
+	}
+
+	if cfg.Server.ManageService && cfg.DryRun {
+		glog.Infof("Dry run, not managing service")
+	} else if cfg.Server.ManageService {
+		// Endpoints only need fixing if someone else changes them, so check
+		// them rarely
+		if err := vol.ManageService(clientset, cfg.Server.IPFamily, time.Minute, wait.NeverStop); err != nil {
+			glog.Fatalf("Error managing service: %v", err)
+		}
+	}
+
+	// Start the provision controller which will dynamically provision NFS PVs
+	pc, err := controller.NewProvisionController(clientset, provisioners, controller.ProvisionControllerOptions{
+		LeaseDuration:    cfg.LeaseDuration.Duration,
+		MaxRetries:       cfg.Limits.MaxRetries,
+		ProvisionWorkers: cfg.Workers.Provision,
+		DeleteWorkers:    cfg.Workers.Delete,
+		OperationTimeout: cfg.Limits.OperationTimeout.Duration,
+		Namespaces:       cfg.Namespaces,
+		ClaimSelector:    selector,
+		DryRun:           cfg.DryRun,
+	})
+	if err != nil {
+		glog.Fatalf("Error creating provision controller: %v", err)
+	}
+
+	if cfg.MetricsAddress != "" {
+		http.Handle("/metrics", pc.MetricsHandler())
+	}
+	if cfg.HealthAddress != "" {
+		http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		})
+	}
+	addresses := sets.NewString(cfg.MetricsAddress, cfg.HealthAddress)
+	addresses.Delete("")
+	for _, address := range addresses.List() {
+		go func(address string) {
+			glog.Fatalf("Error serving on %s: %v", address, http.ListenAndServe(address, nil))
+		}(address)
+	}
+
+	if cfg.AdminAddress != "" {
+		token, err := ioutil.ReadFile(cfg.AdminTokenFile)
+		if err != nil {
+			glog.Fatalf("Error reading admin token file: %v", err)
+		}
+		if len(bytes.TrimSpace(token)) == 0 {
+			glog.Fatalf("Admin token file %s is empty", cfg.AdminTokenFile)
+		}
+		go func() {
+			glog.Fatalf("Error serving admin API on %s: %v", cfg.AdminAddress, http.ListenAndServe(cfg.AdminAddress, pc.AdminHandler(string(bytes.TrimSpace(token)))))
+		}()
 	}
 
-	// Create the client according to whether we are running in or out-of-cluster
-	var config *rest.Config
+	if *configFile != "" {
+		running := cfg
+		go config.Watch(*configFile, base, *configCheckPeriod, wait.NeverStop, func(new *config.Config) {
+			if reloadConfig(running, new, pc, provisioners) {
+				running = new
+			}
+		})
+	}
+
+	pc.Run(wait.NeverStop)
+}
+
+// newClient creates a client according to whether we are running in or
+// out-of-cluster.
+func newClient() (*kubernetes.Clientset, error) {
+	var restConfig *rest.Config
 	var err error
 	if *master != "" || *kubeconfig != "" {
-		config, err = clientcmd.BuildConfigFromFlags(*master, *kubeconfig)
+		restConfig, err = clientcmd.BuildConfigFromFlags(*master, *kubeconfig)
 	} else {
-		config, err = rest.InClusterConfig()
+		restConfig, err = rest.InClusterConfig()
 	}
 	if err != nil {
-		glog.Fatalf("Failed to create config: %v", err)
+		return nil, err
 	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		glog.Fatalf("Failed to create client: %v", err)
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// runCommand runs the subcommand given by the arguments against the export
+// directories and exporters' config files of the given configuration, and the
+// API server if there is one to reach, and returns the exit code.
+func runCommand(cfg *config.Config, args []string) int {
+	if !cli.IsCommand(args[0]) {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+		cli.Usage(os.Stderr)
+		return 2
 	}
 
-	// The controller needs to know what version what the server version is
-	// because out-of-tree provisioners aren't officially supported until 1.5
-	serverVersion, err := clientset.Discovery().ServerVersion()
+	env := &cli.Env{
+		Managers:       make(map[string]*vol.ExportManager),
+		Server:         newServerAddress(cfg),
+		AllowEphemeral: cfg.AllowEphemeral,
+		Out:            os.Stdout,
+	}
+	for _, p := range cfg.Provisioners {
+		env.Managers[p.Name] = vol.NewExportManager(p.ExportDir, newExporter(cfg, p))
+	}
+	clientset, err := newClient()
 	if err != nil {
-		glog.Fatalf("Error getting server version: %v", err)
+		if *master != "" || *kubeconfig != "" {
+			fmt.Fprintf(os.Stderr, "Error creating client: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Not in a cluster and neither master nor kubeconfig is set, working offline\n")
+	} else {
+		env.Client = clientset
 	}
 
-	// Create the provisioner: it implements the Provisioner interface expected by
-	// the controller
-	nfsProvisioner := vol.NewNFSProvisioner("/export/", clientset, *useGanesha, ganeshaConfig)
+	if err := cli.Run(env, args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
 
-	// Start the provision controller which will dynamically provision NFS PVs
-	pc := controller.NewProvisionController(clientset, serverVersion.GitVersion, 15*time.Second, *provisioner, nfsProvisioner)
-	pc.Run(wait.NeverStop)
+// flagConfig returns the configuration the flags give.
+func flagConfig() config.Config {
+	exporterName := *exporter
+	if exporterName == "" {
+		exporterName = "kernel"
+		if *useGanesha {
+			exporterName = "ganesha"
+		}
+	}
+
+	provisioners := []config.Provisioner{{Name: *provisioner, ExportDir: "/export/"}}
+	for _, spec := range extraProvisioners {
+		provisioners = append(provisioners, config.Provisioner{
+			Name:              spec.name,
+			ExportDir:         spec.exportDir,
+			Exporter:          spec.exporter,
+			DefaultParameters: spec.defaultParameters,
+		})
+	}
+
+	var namespaceList []string
+	if *namespaces != "" {
+		namespaceList = strings.Split(*namespaces, ",")
+	}
+
+	logLevel := 0
+	if v := flag.Lookup("v"); v != nil {
+		logLevel, _ = strconv.Atoi(v.Value.String())
+	}
+
+	return config.Config{
+		Provisioners: provisioners,
+		Exporter:     exporterName,
+		Server: config.Server{
+			Run:             *runServer,
+			GaneshaConfig:   vol.DefaultGaneshaConfig,
+			Address:         *serverAddress,
+			AddressStrategy: *addressStrategy,
+			ClusterDomain:   *clusterDomain,
+			IPFamily:        *ipFamily,
+			ManageService:   *manageService,
+		},
+		Workers: config.Workers{
+			Provision: *provisionWorkers,
+			Delete:    *deleteWorkers,
+		},
+		Limits: config.Limits{
+			MaxRetries:       *maxRetries,
+			OperationTimeout: unversioned.Duration{Duration: *operationTimeout},
+		},
+		LeaseDuration:  unversioned.Duration{Duration: *leaseDuration},
+		Namespaces:     namespaceList,
+		ClaimSelector:  *claimSelector,
+		MetricsAddress: *metricsAddress,
+		HealthAddress:  *healthAddress,
+		AdminAddress:   *adminAddress,
+		AdminTokenFile: *adminTokenFile,
+		LogLevel:       logLevel,
+		DryRun:         *dryRun,
+		AllowEphemeral: *allowEphemeral,
+	}
+}
+
+// reloadConfig applies the settings of the new configuration that can change
+// without a restart, i.e. the log level, the limits and the default parameters
+// of the provisioners, and warns about the others that differ from the running
+// configuration's. It returns whether all the settings were applied, in which
+// case the new configuration becomes the running one.
+func reloadConfig(running, new *config.Config, pc *controller.ProvisionController, provisioners map[string]controller.Provisioner) bool {
+	applied := true
+	flag.Set("v", strconv.Itoa(new.LogLevel))
+	if err := pc.SetLimits(new.Limits.MaxRetries, new.Limits.OperationTimeout.Duration); err != nil {
+		glog.Errorf("Error applying limits: %v", err)
+		applied = false
+	}
+	for _, p := range new.Provisioners {
+		provisioner, ok := provisioners[p.Name].(defaultParametersSetter)
+		if !ok {
+			continue
+		}
+		if err := provisioner.SetDefaultParameters(p.DefaultParameters); err != nil {
+			glog.Errorf("Error applying default parameters of provisioner %s: %v", p.Name, err)
+			applied = false
+		}
+	}
+	for _, setting := range config.RestartRequired(running, new) {
+		glog.Warningf("Config setting %s changed but only takes effect on a restart", setting)
+	}
+	return applied
+}
+
+// defaultParametersSetter is a provisioner whose default parameters can change
+// while it runs.
+type defaultParametersSetter interface {
+	SetDefaultParameters(map[string]string) error
 }
 
 // validateProvisioner tests if provisioner is a valid qualified name.
@@ -110,3 +423,85 @@ func validateProvisioner(provisioner string, fldPath *field.Path) field.ErrorLis
 	}
 	return allErrs
 }
+
+// newExporter creates the exporter of the given provisioner. Ganesha exporters
+// use the configured Ganesha config file and others their default config file.
+func newExporter(cfg *config.Config, p config.Provisioner) vol.Exporter {
+	name := cfg.ExporterOf(p)
+	exporterConfig := ""
+	if name == "ganesha" {
+		exporterConfig = cfg.Server.GaneshaConfig
+	}
+	e, err := vol.NewExporter(name, exporterConfig)
+	if err != nil {
+		glog.Fatalf("Error creating exporter %s: %v", name, err)
+	}
+	return e
+}
+
+// newServerAddress returns how the provisioners choose the NFS server address
+// to put in PVs.
+func newServerAddress(cfg *config.Config) vol.ServerAddress {
+	return vol.ServerAddress{
+		Strategy:      cfg.Server.AddressStrategy,
+		Address:       cfg.Server.Address,
+		ClusterDomain: cfg.Server.ClusterDomain,
+		IPFamily:      cfg.Server.IPFamily,
+	}
+}
+
+// provisionerSpec is the value of an extra-provisioner flag.
+type provisionerSpec struct {
+	name      string
+	exportDir string
+	// The name of a registered exporter or empty for the exporter flag's
+	exporter          string
+	defaultParameters map[string]string
+}
+
+// provisionerSpecs is a flag.Value of all the extra-provisioner flags given.
+type provisionerSpecs []provisionerSpec
+
+func (s *provisionerSpecs) String() string {
+	names := []string{}
+	for _, spec := range *s {
+		names = append(names, spec.name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (s *provisionerSpecs) Set(value string) error {
+	spec := provisionerSpec{defaultParameters: map[string]string{}}
+	for _, pair := range strings.Split(value, ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%q is not a key=value pair", pair)
+		}
+		switch kv[0] {
+		case "name":
+			spec.name = kv[1]
+		case "export-dir":
+			spec.exportDir = kv[1]
+		case "exporter":
+			if !config.IsExporter(kv[1]) {
+				return fmt.Errorf("unknown exporter %q. valid values are: %s", kv[1], strings.Join(vol.ExporterNames(), ", "))
+			}
+			spec.exporter = kv[1]
+		default:
+			spec.defaultParameters[kv[0]] = kv[1]
+		}
+	}
+	if spec.name == "" || spec.exportDir == "" {
+		return fmt.Errorf("name and export-dir are required")
+	}
+	if !strings.HasSuffix(spec.exportDir, "/") {
+		spec.exportDir = spec.exportDir + "/"
+	}
+	for _, other := range *s {
+		if other.name == spec.name {
+			return fmt.Errorf("name %s is given more than once", spec.name)
+		}
+	}
+	*s = append(*s, spec)
+	return nil
+}
@@ -47,7 +47,22 @@ func Start(ganeshaConfig string) error {
 		return fmt.Errorf("dbus-daemon failed with error: %v, output: %s", err, out)
 	}
 
-	// Copy the default ganesha config to the export directory if one isn't there
+	if err := WriteDefaultConfig(ganeshaConfig); err != nil {
+		return err
+	}
+	// Start ganesha.nfsd
+	cmd = exec.Command("ganesha.nfsd", "-L", "/var/log/ganesha.log", "-f", ganeshaConfig)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ganesha.nfsd failed with error: %v, output: %s", err, out)
+	}
+
+	return nil
+}
+
+// WriteDefaultConfig copies the default ganesha config to the given path, in
+// the export directory, if one isn't there, so that it can be checked before
+// the NFS server is started.
+func WriteDefaultConfig(ganeshaConfig string) error {
 	if _, err := os.Stat(ganeshaConfig); os.IsNotExist(err) {
 		read, err := ioutil.ReadFile(defaultGaneshaConfig)
 		if err != nil {
@@ -58,12 +73,6 @@ func Start(ganeshaConfig string) error {
 			return fmt.Errorf("error writing ganesha config: %v", err)
 		}
 	}
-	// Start ganesha.nfsd
-	cmd = exec.Command("ganesha.nfsd", "-L", "/var/log/ganesha.log", "-f", ganeshaConfig)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("ganesha.nfsd failed with error: %v, output: %s", err, out)
-	}
-
 	return nil
 }
 
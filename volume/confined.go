@@ -0,0 +1,272 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/context"
+)
+
+// Volume directories are created, scrubbed and removed in exportDir, which
+// claims can write to through their exports. So that a claim can't make the
+// provisioner act outside exportDir by planting a symlink, or by swapping one
+// in while a directory is being deleted, directories are resolved one
+// component at a time relative to already open directories, never following
+// symlinks and never crossing onto another filesystem.
+
+// atRemoveDir makes unlinkat remove a directory instead of a file. It is
+// AT_REMOVEDIR from <linux/fcntl.h>, which the syscall package doesn't export.
+const atRemoveDir = 0x200
+
+// confinedDir is an open directory in exportDir, or exportDir itself.
+type confinedDir struct {
+	file *os.File
+	// The device exportDir is on
+	dev uint64
+}
+
+// fd returns the file descriptor of the directory.
+func (d *confinedDir) fd() int {
+	return int(d.file.Fd())
+}
+
+// Close closes the directory.
+func (d *confinedDir) Close() error {
+	return d.file.Close()
+}
+
+// splitDirectory splits the given directory, relative to exportDir, into its
+// path components, checking that none of them could lead out of exportDir.
+func splitDirectory(directory string) ([]string, error) {
+	if filepath.IsAbs(directory) {
+		return nil, fmt.Errorf("directory %q must be relative to the export directory", directory)
+	}
+	components := strings.Split(directory, "/")
+	for _, component := range components {
+		if component == "" || component == "." || component == ".." || strings.Contains(component, "\x00") {
+			return nil, fmt.Errorf("directory %q has an empty, '.', '..' or NUL path component", directory)
+		}
+	}
+	return components, nil
+}
+
+// openExportDir opens the given exportDir so that directories can be resolved
+// relative to it. exportDir itself is trusted and may be a symlink.
+func openExportDir(exportDir string) (*confinedDir, error) {
+	fd, err := syscall.Open(exportDir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: exportDir, Err: err}
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		syscall.Close(fd)
+		return nil, &os.PathError{Op: "stat", Path: exportDir, Err: err}
+	}
+	return &confinedDir{file: os.NewFile(uintptr(fd), exportDir), dev: uint64(stat.Dev)}, nil
+}
+
+// openAt opens the directory with the given name in d. It fails if the name is
+// a symlink, is not a directory or is on another filesystem than exportDir.
+func (d *confinedDir) openAt(name string) (*confinedDir, error) {
+	path := filepath.Join(d.file.Name(), name)
+	fd, err := syscall.Openat(d.fd(), name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err == syscall.ELOOP || err == syscall.ENOTDIR {
+		return nil, fmt.Errorf("%s is a symlink or not a directory", path)
+	} else if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: path, Err: err}
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		syscall.Close(fd)
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if uint64(stat.Dev) != d.dev {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("%s is on another filesystem than the export directory", path)
+	}
+	return &confinedDir{file: os.NewFile(uintptr(fd), path), dev: d.dev}, nil
+}
+
+// openDirectory opens the given directory, relative to exportDir.
+func openDirectory(exportDir, directory string) (*confinedDir, error) {
+	components, err := splitDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := openExportDir(exportDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, component := range components {
+		child, err := dir.openAt(component)
+		dir.Close()
+		if err != nil {
+			return nil, err
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+// openParent opens the parent of the given directory, relative to exportDir,
+// and returns it along with the directory's name in it. If create is true, any
+// missing parents are created with permissions that only let others traverse
+// them.
+func openParent(exportDir, directory string, create bool) (*confinedDir, string, error) {
+	components, err := splitDirectory(directory)
+	if err != nil {
+		return nil, "", err
+	}
+	dir, err := openExportDir(exportDir)
+	if err != nil {
+		return nil, "", err
+	}
+	last := len(components) - 1
+	for _, component := range components[:last] {
+		if create {
+			if err := syscall.Mkdirat(dir.fd(), component, 0755); err != nil && err != syscall.EEXIST {
+				dir.Close()
+				return nil, "", &os.PathError{Op: "mkdirat", Path: filepath.Join(dir.file.Name(), component), Err: err}
+			}
+		}
+		child, err := dir.openAt(component)
+		dir.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		dir = child
+	}
+	return dir, components[last], nil
+}
+
+// directoryExists returns whether anything, including a symlink, exists at the
+// given directory, relative to exportDir.
+func directoryExists(exportDir, directory string) (bool, error) {
+	parent, name, err := openParent(exportDir, directory, false)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer parent.Close()
+
+	fd, err := syscall.Openat(parent.fd(), name, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	switch err {
+	case nil:
+		syscall.Close(fd)
+		return true, nil
+	case syscall.ELOOP:
+		return true, nil
+	case syscall.ENOENT:
+		return false, nil
+	}
+	return false, &os.PathError{Op: "openat", Path: filepath.Join(parent.file.Name(), name), Err: err}
+}
+
+// removeAt removes the file or directory with the given name in d, along with
+// anything it contains. Symlinks are removed, not followed, and it doesn't
+// descend onto another filesystem than exportDir's. If ctx is done before it
+// finishes, it stops and returns the context's error.
+func (d *confinedDir) removeAt(ctx context.Context, name string) error {
+	err := syscall.Unlinkat(d.fd(), name)
+	if err == nil || err == syscall.ENOENT {
+		return nil
+	}
+	if err != syscall.EISDIR && err != syscall.EPERM {
+		return &os.PathError{Op: "unlinkat", Path: filepath.Join(d.file.Name(), name), Err: err}
+	}
+
+	child, err := d.openAt(name)
+	if err != nil {
+		// The directory may have been swapped for a symlink or file since it
+		// was found to be one, in which case that is removed instead
+		if err := syscall.Unlinkat(d.fd(), name); err == nil || err == syscall.ENOENT {
+			return nil
+		}
+		return err
+	}
+	err = child.removeContents(ctx)
+	child.Close()
+	if err != nil {
+		return err
+	}
+	return d.rmdirAt(name)
+}
+
+// removeContents removes everything in d, stopping if ctx is done.
+func (d *confinedDir) removeContents(ctx context.Context) error {
+	names, err := d.file.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := d.removeAt(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rmdirAt removes the empty directory with the given name in d.
+func (d *confinedDir) rmdirAt(name string) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(d.fd()), uintptr(unsafe.Pointer(p)), atRemoveDir)
+	if errno != 0 {
+		return &os.PathError{Op: "rmdir", Path: filepath.Join(d.file.Name(), name), Err: errno}
+	}
+	return nil
+}
+
+// usage returns the total size of the regular files in d and its
+// subdirectories.
+func (d *confinedDir) usage() (int64, error) {
+	infos, err := d.file.Readdir(-1)
+	if err != nil {
+		return 0, err
+	}
+	var usedBytes int64
+	for _, info := range infos {
+		switch {
+		case info.Mode().IsRegular():
+			usedBytes += info.Size()
+		case info.IsDir():
+			child, err := d.openAt(info.Name())
+			if err != nil {
+				return 0, err
+			}
+			childBytes, err := child.usage()
+			child.Close()
+			if err != nil {
+				return 0, err
+			}
+			usedBytes += childBytes
+		}
+	}
+	return usedBytes, nil
+}
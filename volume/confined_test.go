@@ -0,0 +1,297 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+func TestOpenDirectory(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exportDir := tmpDir + "/export/"
+	outside := tmpDir + "/outside"
+	for _, dir := range []string{exportDir + "team-a/pvc-1", outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("error creating %s: %v", dir, err)
+		}
+	}
+	if err := os.Symlink(outside, exportDir+"link"); err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+	if err := ioutil.WriteFile(exportDir+"file", []byte("foo"), 0644); err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		directory   string
+		expectError bool
+	}{
+		{
+			name:        "nested",
+			directory:   "team-a/pvc-1",
+			expectError: false,
+		},
+		{
+			name:        "parent dir",
+			directory:   "../outside",
+			expectError: true,
+		},
+		{
+			name:        "parent dir in the middle",
+			directory:   "team-a/../../outside",
+			expectError: true,
+		},
+		{
+			name:        "absolute",
+			directory:   outside,
+			expectError: true,
+		},
+		{
+			name:        "empty",
+			directory:   "",
+			expectError: true,
+		},
+		{
+			name:        "empty component",
+			directory:   "team-a//pvc-1",
+			expectError: true,
+		},
+		{
+			name:        "NUL",
+			directory:   "team-a\x00/pvc-1",
+			expectError: true,
+		},
+		{
+			name:        "symlink",
+			directory:   "link",
+			expectError: true,
+		},
+		{
+			name:        "symlink parent",
+			directory:   "link/pvc-1",
+			expectError: true,
+		},
+		{
+			name:        "file",
+			directory:   "file",
+			expectError: true,
+		},
+		{
+			name:        "doesn't exist",
+			directory:   "team-b",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		dir, err := openDirectory(exportDir, test.directory)
+		if err == nil {
+			dir.Close()
+		}
+
+		evaluate(t, test.name, test.expectError, err, nil, nil, "error")
+	}
+}
+
+func TestOpenDirectoryOtherFilesystem(t *testing.T) {
+	var root, proc syscall.Stat_t
+	if err := syscall.Stat("/", &root); err != nil {
+		t.Skipf("error getting device of /: %v", err)
+	}
+	if err := syscall.Stat("/proc", &proc); err != nil || root.Dev == proc.Dev {
+		t.Skipf("/proc is not mounted on another filesystem than /")
+	}
+
+	dir, err := openDirectory("/", "proc")
+	if err == nil {
+		dir.Close()
+		t.Errorf("expected error opening directory on another filesystem")
+	}
+}
+
+func TestCreateDirectorySymlinkParent(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exportDir := tmpDir + "/export/"
+	outside := tmpDir + "/outside"
+	for _, dir := range []string{exportDir, outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("error creating %s: %v", dir, err)
+		}
+	}
+	if err := os.Symlink(outside, exportDir+"team-a"); err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(exportDir, client, &testExporter{})
+
+	if err := p.createDirectory("team-a/pvc-1", "none"); err == nil {
+		t.Errorf("expected error creating directory under a symlink")
+	}
+	if _, err := os.Stat(outside + "/pvc-1"); !os.IsNotExist(err) {
+		t.Errorf("expected %s not to be created", outside+"/pvc-1")
+	}
+}
+
+// swapContext calls swap the swapAt'th time its Err is called, which happens
+// before each entry of a directory is removed.
+type swapContext struct {
+	context.Context
+	calls  int
+	swapAt int
+	swap   func() error
+	err    error
+}
+
+func (c *swapContext) Err() error {
+	c.calls++
+	if c.calls == c.swapAt {
+		c.err = c.swap()
+	}
+	return c.Context.Err()
+}
+
+func TestDeleteDirectorySymlinks(t *testing.T) {
+	tests := []struct {
+		name string
+		// Which directory to swap for a symlink to outside, and when
+		swapDirectory string
+		swapAt        int
+		expectError   bool
+	}{
+		{
+			name:        "planted symlink",
+			expectError: false,
+		},
+		{
+			name:          "swapped before being opened",
+			swapDirectory: "a",
+			swapAt:        1,
+			expectError:   false,
+		},
+		{
+			name:          "swapped after being opened",
+			swapDirectory: "a",
+			swapAt:        2,
+			expectError:   true,
+		},
+		{
+			name:          "nested swapped after being opened",
+			swapDirectory: "a/b",
+			swapAt:        3,
+			expectError:   true,
+		},
+	}
+	for _, test := range tests {
+		tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+		defer os.RemoveAll(tmpDir)
+
+		exportDir := tmpDir + "/export/"
+		outside := tmpDir + "/outside"
+		volumeDir := exportDir + "pvc-1/"
+		for _, dir := range []string{volumeDir + "a/b", outside} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("error creating %s: %v", dir, err)
+			}
+		}
+		for _, file := range []string{volumeDir + "a/b/foo", outside + "/secret"} {
+			if err := ioutil.WriteFile(file, []byte("foo"), 0644); err != nil {
+				t.Fatalf("error creating %s: %v", file, err)
+			}
+		}
+		if err := os.Symlink(outside, volumeDir+"a/b/link"); err != nil {
+			t.Fatalf("error creating symlink: %v", err)
+		}
+
+		client := fake.NewSimpleClientset()
+		p := newNFSProvisionerInternal(exportDir, client, &testExporter{})
+
+		ctx := &swapContext{
+			Context: context.Background(),
+			swapAt:  test.swapAt,
+			swap: func() error {
+				path := volumeDir + test.swapDirectory
+				if err := os.Rename(path, tmpDir+"/moved"); err != nil {
+					return err
+				}
+				return os.Symlink(outside, path)
+			},
+		}
+
+		err := p.deleteDirectory(ctx, newVolume("pvc-1", exportDir+"pvc-1"))
+
+		if ctx.err != nil {
+			t.Fatalf("error swapping in symlink: %v", ctx.err)
+		}
+		if test.swapAt != 0 && ctx.calls < test.swapAt {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected symlink to be swapped in but delete only checked the context %d times", ctx.calls)
+		}
+		evaluate(t, test.name, test.expectError, err, nil, nil, "error")
+		if _, err := os.Stat(outside + "/secret"); err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected file outside the export directory to be kept but stat failed with error: %v", err)
+		}
+		if !test.expectError {
+			if _, err := os.Lstat(volumeDir); !os.IsNotExist(err) {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected %s to be removed", volumeDir)
+			}
+		}
+	}
+}
+
+func TestInspectSymlink(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exportDir := tmpDir + "/export/"
+	outside := tmpDir + "/outside"
+	for _, dir := range []string{exportDir + "pvc-1", outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("error creating %s: %v", dir, err)
+		}
+	}
+	if err := ioutil.WriteFile(outside+"/secret", []byte("foo"), 0644); err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	if err := os.Symlink(outside, exportDir+"pvc-1/link"); err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(exportDir, client, &testExporter{})
+
+	info, err := p.Inspect(newVolume("pvc-1", exportDir+"pvc-1"))
+	if err != nil {
+		t.Fatalf("unexpected error inspecting volume: %v", err)
+	}
+	if info.UsedBytes != 0 {
+		t.Errorf("expected symlinked files not to count towards usage but got %d used bytes", info.UsedBytes)
+	}
+}
@@ -19,17 +19,18 @@ package volume
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"strconv"
 
-	"github.com/guelfey/go.dbus"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 )
 
 // Delete removes the directory that was created by Provision backing the given
-// PV.
-func (p *nfsProvisioner) Delete(volume *v1.PersistentVolume) error {
-	err := p.deleteDirectory(volume)
+// PV. If ctx is done while the directory's contents are being removed, it stops
+// and returns the context's error; calling it again picks up where it left off.
+func (p *nfsProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
+	err := p.deleteDirectory(ctx, volume)
 	if err != nil {
 		return fmt.Errorf("error deleting volume's backing path: %v", err)
 	}
@@ -42,68 +43,99 @@ func (p *nfsProvisioner) Delete(volume *v1.PersistentVolume) error {
 	return nil
 }
 
-func (p *nfsProvisioner) deleteDirectory(volume *v1.PersistentVolume) error {
-	path := fmt.Sprintf(p.exportDir+"%s", volume.ObjectMeta.Name)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+// DryRunDelete checks that Delete could find the directory and export block of
+// the given PV, and only logs what it would remove.
+func (p *nfsProvisioner) DryRunDelete(volume *v1.PersistentVolume) error {
+	directory, err := p.getVolumeDirectory(volume)
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf(p.exportDir+"%s", directory)
+	dir, err := openDirectory(p.exportDir, directory)
+	if os.IsNotExist(err) {
 		return fmt.Errorf("Delete called on a volume that doesn't exist, presumably because this provisioner never created it")
+	} else if err != nil {
+		return fmt.Errorf("error opening backing path: %v", err)
 	}
-	if err := os.RemoveAll(path); err != nil {
-		return fmt.Errorf("error deleting backing path: %v", err)
+	dir.Close()
+	block, ok := volume.Annotations[annBlock]
+	if !ok {
+		return fmt.Errorf("PV doesn't have an annotation %s, can't remove the export from the config file %s", annBlock, p.exporter.GetConfig())
 	}
+	glog.Infof("dry run: would remove directory %s and export block from %s: %s", path, p.exporter.GetConfig(), block)
 
 	return nil
 }
 
-func (p *nfsProvisioner) deleteExport(volume *v1.PersistentVolume) error {
-	if ann, ok := volume.Annotations[annExportId]; ok {
-		// If PV doesn't have this annotation it's no big deal for knfs
-		exportId, _ := strconv.ParseUint(ann, 10, 16)
-		p.deleteExportId(uint16(exportId))
+// Recycle removes the contents of the directory that was created by Provision
+// backing the given PV, leaving the directory and its export in place. If ctx is
+// done before it finishes, it stops and returns the context's error.
+func (p *nfsProvisioner) Recycle(ctx context.Context, volume *v1.PersistentVolume) error {
+	directory, err := p.getVolumeDirectory(volume)
+	if err != nil {
+		return err
 	}
 
-	block, ok := volume.Annotations[annBlock]
-	if !ok {
-		return fmt.Errorf("PV doesn't have an annotation %s, can't remove the export from the config file %s ", p.exporter.GetConfig(), annBlock)
-	}
-	if err := p.removeFromFile(p.exporter.GetConfig(), block); err != nil {
-		return fmt.Errorf("error removing the export from the config file %s: %v", p.exporter.GetConfig(), err)
-	}
+	return scrubDirectory(ctx, p.exportDir, directory)
+}
 
-	err := p.exporter.Unexport(volume)
+// scrubDirectory removes the contents of the given directory, relative to
+// exportDir, one entry at a time, stopping if ctx is done. Symlinks in it are
+// removed, not followed, even if swapped in while it is being scrubbed.
+func scrubDirectory(ctx context.Context, exportDir, directory string) error {
+	dir, err := openDirectory(exportDir, directory)
 	if err != nil {
-		return fmt.Errorf("removed export from the config file %s but error unexporting it: %v", p.exporter.GetConfig(), err)
+		return fmt.Errorf("error opening backing path: %v", err)
+	}
+	defer dir.Close()
+	if err := dir.removeContents(ctx); err != nil {
+		return fmt.Errorf("error scrubbing backing path: %v", err)
 	}
 
 	return nil
 }
 
-func (e *ganeshaExporter) Unexport(volume *v1.PersistentVolume) error {
-	ann, ok := volume.Annotations[annExportId]
-	if !ok {
-		return fmt.Errorf("PV doesn't have an annotation %s, can't remove the export from the server", annExportId)
+func (p *nfsProvisioner) deleteDirectory(ctx context.Context, volume *v1.PersistentVolume) error {
+	directory, err := p.getVolumeDirectory(volume)
+	if err != nil {
+		return err
 	}
-	exportId, _ := strconv.ParseUint(ann, 10, 16)
 
-	// Call RemoveExport using dbus
-	conn, err := dbus.SystemBus()
+	exists, err := directoryExists(p.exportDir, directory)
 	if err != nil {
-		return fmt.Errorf("error getting dbus session bus: %v", err)
+		return fmt.Errorf("error opening backing path: %v", err)
+	} else if !exists {
+		return fmt.Errorf("Delete called on a volume that doesn't exist, presumably because this provisioner never created it")
 	}
-	obj := conn.Object("org.ganesha.nfsd", "/org/ganesha/nfsd/ExportMgr")
-	call := obj.Call("org.ganesha.nfsd.exportmgr.RemoveExport", 0, uint16(exportId))
-	if call.Err != nil {
-		return fmt.Errorf("error calling org.ganesha.nfsd.exportmgr.RemoveExport: %v", call.Err)
+	if err := scrubDirectory(ctx, p.exportDir, directory); err != nil {
+		return err
+	}
+	if err := p.removeDirectory(directory); err != nil {
+		return fmt.Errorf("error deleting backing path: %v", err)
 	}
 
 	return nil
 }
 
-func (e *kernelExporter) Unexport(volume *v1.PersistentVolume) error {
-	// Execute exportfs
-	cmd := exec.Command("exportfs", "-r")
-	out, err := cmd.CombinedOutput()
+func (p *nfsProvisioner) deleteExport(volume *v1.PersistentVolume) error {
+	if ann, ok := volume.Annotations[annExportId]; ok {
+		// If PV doesn't have this annotation it's no big deal for knfs
+		exportId, _ := strconv.ParseUint(ann, 10, 16)
+		p.deleteExportId(uint16(exportId))
+	}
+
+	block, ok := volume.Annotations[annBlock]
+	if !ok {
+		return fmt.Errorf("PV doesn't have an annotation %s, can't remove the export from the config file %s ", p.exporter.GetConfig(), annBlock)
+	}
+	if err := p.removeFromFile(p.exporter.GetConfig(), block); err != nil {
+		return fmt.Errorf("error removing the export from the config file %s: %v", p.exporter.GetConfig(), err)
+	}
+
+	err := p.exporter.Unexport(volume)
 	if err != nil {
-		return fmt.Errorf("exportfs -r failed with error: %v, output: %s", err, out)
+		return fmt.Errorf("removed export from the config file %s but error unexporting it: %v", p.exporter.GetConfig(), err)
 	}
 
 	return nil
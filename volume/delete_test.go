@@ -0,0 +1,196 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+func TestDeleteDirectory(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
+
+	for _, directory := range []string{"team-a/db-pvc-1", "team-a/db-pvc-2", "team-b/db-pvc-3"} {
+		if err := p.createDirectory(directory, "none"); err != nil {
+			t.Fatalf("error creating directory %s: %v", directory, err)
+		}
+	}
+
+	tests := []struct {
+		name            string
+		path            string
+		expectedRemoved []string
+		expectedKept    []string
+		expectError     bool
+	}{
+		{
+			name:            "parent still in use",
+			path:            tmpDir + "/team-a/db-pvc-1",
+			expectedRemoved: []string{"team-a/db-pvc-1"},
+			expectedKept:    []string{"team-a", "team-a/db-pvc-2", "team-b/db-pvc-3"},
+			expectError:     false,
+		},
+		{
+			name:            "parent left empty",
+			path:            tmpDir + "/team-b/db-pvc-3",
+			expectedRemoved: []string{"team-b/db-pvc-3", "team-b"},
+			expectedKept:    []string{"team-a/db-pvc-2"},
+			expectError:     false,
+		},
+		{
+			name:            "doesn't exist",
+			path:            tmpDir + "/team-b/db-pvc-3",
+			expectedRemoved: []string{},
+			expectedKept:    []string{"team-a/db-pvc-2"},
+			expectError:     true,
+		},
+	}
+	for _, test := range tests {
+		volume := newVolume("pvc-1", test.path)
+
+		err := p.deleteDirectory(context.Background(), volume)
+
+		if !test.expectError && err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error deleting directory: %v", err)
+		} else if test.expectError && err == nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error deleting directory")
+		}
+		for _, directory := range test.expectedRemoved {
+			if _, err := os.Stat(p.exportDir + directory); !os.IsNotExist(err) {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected %s to be removed", directory)
+			}
+		}
+		for _, directory := range test.expectedKept {
+			if _, err := os.Stat(p.exportDir + directory); err != nil {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected %s to be kept but stat failed with error: %v", directory, err)
+			}
+		}
+	}
+}
+
+func TestRecycle(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
+
+	if err := p.createDirectory("pvc-1", "none"); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	path := tmpDir + "/pvc-1"
+	if err := os.MkdirAll(path+"/foo/bar", 0755); err != nil {
+		t.Fatalf("error creating contents: %v", err)
+	}
+	if err := ioutil.WriteFile(path+"/baz", []byte("baz"), 0644); err != nil {
+		t.Fatalf("error creating contents: %v", err)
+	}
+
+	if err := p.Recycle(context.Background(), newVolume("pvc-1", path)); err != nil {
+		t.Errorf("unexpected error recycling: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("expected %s to be kept but stat failed with error: %v", path, err)
+	}
+	if fi.Mode().Perm() != os.FileMode(0777) {
+		t.Errorf("expected permission bits %v but got %v", os.FileMode(0777), fi.Mode().Perm())
+	}
+	names, _ := ioutil.ReadDir(path)
+	if len(names) != 0 {
+		t.Errorf("expected %s to be empty but it contains %v", path, names)
+	}
+}
+
+func TestDryRunDelete(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
+	if err := p.createDirectory("pvc-1", "none"); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		volume      *v1.PersistentVolume
+		expectError bool
+	}{
+		{
+			name:        "would delete",
+			volume:      newVolumeWithBlock(newVolume("pvc-1", tmpDir+"/pvc-1")),
+			expectError: false,
+		},
+		{
+			name:        "no export block",
+			volume:      newVolume("pvc-1", tmpDir+"/pvc-1"),
+			expectError: true,
+		},
+		{
+			name:        "doesn't exist",
+			volume:      newVolumeWithBlock(newVolume("pvc-2", tmpDir+"/pvc-2")),
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		err := p.DryRunDelete(test.volume)
+
+		if !test.expectError && err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error in dry run delete: %v", err)
+		} else if test.expectError && err == nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error in dry run delete")
+		}
+		if _, err := os.Stat(tmpDir + "/pvc-1"); err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected dry run to keep directory but stat failed with error: %v", err)
+		}
+	}
+}
+
+func newVolume(name, path string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{Path: path},
+			},
+		},
+	}
+}
+
+func newVolumeWithBlock(volume *v1.PersistentVolume) *v1.PersistentVolume {
+	volume.Annotations = map[string]string{annBlock: "\nExport_Id = 1;\n"}
+	return volume
+}
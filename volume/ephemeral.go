@@ -0,0 +1,146 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// LabelEphemeral is the label put on PVs provisioned from an export directory
+// whose storage doesn't outlive the provisioner pod, e.g. an emptyDir, so that
+// they and the workloads using them can be told apart.
+const LabelEphemeral = "provisioner.alpha.kubernetes.io/ephemeral"
+
+// mountInfoFile lists the mounts seen by the provisioner. It's a var so that
+// tests can point it at their own.
+var mountInfoFile = "/proc/self/mountinfo"
+
+// ephemeralFilesystems are the types of filesystems whose contents are lost
+// when the pod goes away: memory-backed ones and the container's own
+// copy-on-write root filesystem.
+var ephemeralFilesystems = map[string]bool{
+	"tmpfs":   true,
+	"ramfs":   true,
+	"overlay": true,
+	"aufs":    true,
+}
+
+// emptyDirMarker is in the path, relative to its filesystem, of every emptyDir
+// volume the kubelet sets up on disk.
+const emptyDirMarker = "/volumes/kubernetes.io~empty-dir/"
+
+// mountInfo is a line of a mountinfo file.
+type mountInfo struct {
+	// The path of the mounted directory within its filesystem
+	root string
+	// Where it is mounted
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+// parseMountInfo parses the lines of a mountinfo file, see proc(5), skipping
+// malformed ones.
+func parseMountInfo(data string) []mountInfo {
+	mounts := []mountInfo{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		// The optional fields end with a "-" separator
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 6 || separator == -1 || separator+2 >= len(fields) {
+			continue
+		}
+		mounts = append(mounts, mountInfo{
+			root:       unescapeMountPath(fields[3]),
+			mountPoint: unescapeMountPath(fields[4]),
+			fsType:     fields[separator+1],
+			source:     fields[separator+2],
+		})
+	}
+	return mounts
+}
+
+// unescapeMountPath undoes the octal escaping of spaces, tabs, newlines and
+// backslashes in the paths in a mountinfo file.
+func unescapeMountPath(path string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(path)
+}
+
+// findMount returns the mount the given absolute, symlink-free directory is
+// on: the one with the longest mount point containing it, the last one listed
+// if several are mounted at the same point.
+func findMount(mounts []mountInfo, dir string) (mountInfo, bool) {
+	found := false
+	var mount mountInfo
+	for _, m := range mounts {
+		if !pathContains(m.mountPoint, dir) {
+			continue
+		}
+		if !found || len(m.mountPoint) >= len(mount.mountPoint) {
+			mount = m
+			found = true
+		}
+	}
+	return mount, found
+}
+
+// pathContains returns whether the given path is the given parent or under
+// it.
+func pathContains(parent, path string) bool {
+	if parent == "/" || parent == path {
+		return true
+	}
+	return strings.HasPrefix(path, parent+"/")
+}
+
+// ephemeralStorage returns why the storage of the given directory, according
+// to the given mountinfo file, doesn't outlive the pod, e.g. "tmpfs", or ""
+// if it does.
+func ephemeralStorage(mountInfoPath, dir string) (string, error) {
+	data, err := ioutil.ReadFile(mountInfoPath)
+	if err != nil {
+		return "", fmt.Errorf("error reading mounts: %v", err)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("error resolving %s: %v", dir, err)
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return "", fmt.Errorf("error resolving %s: %v", dir, err)
+	}
+	mount, found := findMount(parseMountInfo(string(data)), resolved)
+	if !found {
+		return "", fmt.Errorf("no mount found for %s in %s", resolved, mountInfoPath)
+	}
+	if ephemeralFilesystems[mount.fsType] {
+		return fmt.Sprintf("%s mounted at %s", mount.fsType, mount.mountPoint), nil
+	}
+	if strings.Contains(mount.root+"/", emptyDirMarker) {
+		return fmt.Sprintf("emptyDir volume mounted at %s", mount.mountPoint), nil
+	}
+	return "", nil
+}
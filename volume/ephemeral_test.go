@@ -0,0 +1,137 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+func TestEphemeralStorage(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+	exportDir, _ := filepath.EvalSymlinks(tmpDir)
+	if err := os.Symlink(exportDir, tmpDir+"/link"); err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+	root := "1 0 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n"
+	overlayRoot := "1 0 0:50 / / rw,relatime - overlay overlay rw,lowerdir=/a,upperdir=/b,workdir=/c\n"
+
+	tests := []struct {
+		name              string
+		mountInfo         string
+		dir               string
+		expectedEphemeral string
+		expectError       bool
+	}{
+		{
+			name:              "persistent root",
+			mountInfo:         root,
+			dir:               exportDir,
+			expectedEphemeral: "",
+			expectError:       false,
+		},
+		{
+			name:              "overlay root",
+			mountInfo:         overlayRoot,
+			dir:               exportDir,
+			expectedEphemeral: "overlay mounted at /",
+			expectError:       false,
+		},
+		{
+			name:              "persistent volume on overlay root",
+			mountInfo:         overlayRoot + "2 1 8:16 / " + exportDir + " rw - ext4 /dev/sdb rw\n",
+			dir:               exportDir,
+			expectedEphemeral: "",
+			expectError:       false,
+		},
+		{
+			name:              "tmpfs, through symlink",
+			mountInfo:         root + "2 1 0:2 / " + exportDir + " rw shared:1 master:2 - tmpfs tmpfs rw\n",
+			dir:               tmpDir + "/link/",
+			expectedEphemeral: "tmpfs mounted at " + exportDir,
+			expectError:       false,
+		},
+		{
+			name:              "emptyDir on disk",
+			mountInfo:         overlayRoot + "2 1 8:1 /var/lib/kubelet/pods/1234/volumes/kubernetes.io~empty-dir/export " + exportDir + " rw - ext4 /dev/sda1 rw\n",
+			dir:               exportDir,
+			expectedEphemeral: "emptyDir volume mounted at " + exportDir,
+			expectError:       false,
+		},
+		{
+			name:              "mount shadowed by later one",
+			mountInfo:         root + "2 1 0:2 / " + exportDir + " rw - tmpfs tmpfs rw\n3 1 8:16 / " + exportDir + " rw - xfs /dev/sdb rw\n",
+			dir:               exportDir,
+			expectedEphemeral: "",
+			expectError:       false,
+		},
+		{
+			name:              "sibling mount with common prefix",
+			mountInfo:         root + "2 1 0:2 / " + exportDir + "-other rw - tmpfs tmpfs rw\n",
+			dir:               exportDir,
+			expectedEphemeral: "",
+			expectError:       false,
+		},
+		{
+			name:              "no mount",
+			mountInfo:         "malformed line\n",
+			dir:               exportDir,
+			expectedEphemeral: "",
+			expectError:       true,
+		},
+		{
+			name:              "missing dir",
+			mountInfo:         root,
+			dir:               exportDir + "/missing",
+			expectedEphemeral: "",
+			expectError:       true,
+		},
+	}
+	for _, test := range tests {
+		mountInfo := tmpDir + "/mountinfo"
+		if err := ioutil.WriteFile(mountInfo, []byte(test.mountInfo), 0600); err != nil {
+			t.Fatalf("error writing mountinfo: %v", err)
+		}
+
+		ephemeral, err := ephemeralStorage(mountInfo, test.dir)
+
+		evaluate(t, test.name, test.expectError, err, test.expectedEphemeral, ephemeral, "ephemeral storage")
+	}
+}
+
+func TestParseMountInfoEscapes(t *testing.T) {
+	mounts := parseMountInfo(`2 1 8:1 / /export\040dir rw - ext4 /dev/sda1 rw`)
+	if len(mounts) != 1 || mounts[0].mountPoint != "/export dir" {
+		t.Errorf("expected mount point %q but got %+v", "/export dir", mounts)
+	}
+}
+
+func TestEphemeralLabel(t *testing.T) {
+	options := controller.VolumeOptions{PVName: "pvc-1"}
+	if pv := newPersistentVolume(options, volume{ephemeral: true}); pv.Labels[LabelEphemeral] != "true" {
+		t.Errorf("expected label %s on PV of ephemeral volume but got labels %v", LabelEphemeral, pv.Labels)
+	}
+	if pv := newPersistentVolume(options, volume{}); len(pv.Labels) != 0 {
+		t.Errorf("expected no labels on PV of persistent volume but got %v", pv.Labels)
+	}
+}
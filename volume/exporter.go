@@ -0,0 +1,331 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/guelfey/go.dbus"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+const (
+	// DefaultGaneshaConfig is the config file the ganesha exporter adds export
+	// blocks to if it isn't given one.
+	DefaultGaneshaConfig = "/export/vfs.conf"
+
+	// defaultKernelConfig is the config file the kernel exporter adds export
+	// blocks to if it isn't given one.
+	defaultKernelConfig = "/etc/exports"
+)
+
+// Exporter exports the directories of volumes over NFS. It adds a block per
+// export to a config file, which the provisioner writes, then makes the NFS
+// server pick it up. Provisioners whose exporters have the same config file
+// share exportIds, so they must be exporting through the same NFS server.
+type Exporter interface {
+	// GetConfig returns the path of the config file to add export blocks to.
+	GetConfig() string
+	// GetConfigExportIds returns the exportIds already used in the config file.
+	GetConfigExportIds() (map[uint16]bool, error)
+	// CreateBlock returns the block to add to the config file to export the
+	// given path with the given exportId, read-only if the bool is true, to
+	// the given clients, IPv4 or IPv6 addresses or CIDRs, or to every client
+	// if there are none.
+	CreateBlock(string, string, bool, []string) string
+	// Export makes the NFS server export the given path, whose block has been
+	// added to the config file.
+	Export(string) error
+	// Unexport makes the NFS server stop exporting the given PV's directory,
+	// whose block has been removed from the config file.
+	Unexport(*v1.PersistentVolume) error
+	// Capabilities returns what the exporter supports.
+	Capabilities() ExporterCapabilities
+}
+
+// ExporterCapabilities are the optional features an Exporter supports. The
+// provisioner rejects StorageClass parameters and claims that need a feature
+// its exporter lacks.
+type ExporterCapabilities struct {
+	// LiveUpdate is whether the exporter adds and removes exports one at a time
+	// without disturbing the others, as opposed to reloading all of them.
+	LiveUpdate bool
+	// ReadOnly is whether the exporter can export volumes read-only, which
+	// claims that only request ReadOnlyMany get.
+	ReadOnly bool
+	// Kerberos is whether the exporter's exports accept Kerberos security
+	// flavors, which a mountOptions parameter may ask for with sec=krb5,
+	// sec=krb5i or sec=krb5p.
+	Kerberos bool
+	// Statistics is whether the NFS server keeps statistics per export.
+	Statistics bool
+}
+
+// ExporterFactory creates an exporter that adds export blocks to the given
+// config file, or to its default config file if the given one is empty.
+type ExporterFactory func(config string) (Exporter, error)
+
+var (
+	exporterFactories      = make(map[string]ExporterFactory)
+	exporterFactoriesMutex = &sync.Mutex{}
+)
+
+func init() {
+	RegisterExporter("ganesha", newGaneshaExporter)
+	RegisterExporter("kernel", newKernelExporter)
+}
+
+// RegisterExporter makes an exporter available by the given name, e.g. to be
+// chosen by flag. It is meant to be called from the init function of the
+// package that implements the exporter and panics if the name is already
+// taken.
+func RegisterExporter(name string, factory ExporterFactory) {
+	exporterFactoriesMutex.Lock()
+	defer exporterFactoriesMutex.Unlock()
+	if factory == nil {
+		panic("volume: RegisterExporter factory is nil")
+	}
+	if _, dup := exporterFactories[name]; dup {
+		panic("volume: RegisterExporter called twice for exporter " + name)
+	}
+	exporterFactories[name] = factory
+}
+
+// NewExporter creates an exporter of the given registered name that adds
+// export blocks to the given config file, or to its default one if empty.
+func NewExporter(name, config string) (Exporter, error) {
+	exporterFactoriesMutex.Lock()
+	factory, ok := exporterFactories[name]
+	exporterFactoriesMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown exporter %q. valid values are: %s", name, strings.Join(ExporterNames(), ", "))
+	}
+	return factory(config)
+}
+
+// ExporterNames returns the sorted names of the registered exporters.
+func ExporterNames() []string {
+	exporterFactoriesMutex.Lock()
+	defer exporterFactoriesMutex.Unlock()
+	names := []string{}
+	for name := range exporterFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type ganeshaExporter struct {
+	ganeshaConfig string
+}
+
+var _ Exporter = &ganeshaExporter{}
+
+func newGaneshaExporter(config string) (Exporter, error) {
+	if config == "" {
+		config = DefaultGaneshaConfig
+	}
+	return &ganeshaExporter{ganeshaConfig: config}, nil
+}
+
+func (e *ganeshaExporter) GetConfig() string {
+	return e.ganeshaConfig
+}
+
+func (e *ganeshaExporter) GetConfigExportIds() (map[uint16]bool, error) {
+	return getConfigExportIds(e.GetConfig(), regexp.MustCompile("Export_Id = ([0-9]+);"))
+}
+
+// CreateBlock creates the text block to add to the ganesha config file.
+func (e *ganeshaExporter) CreateBlock(exportId, path string, readOnly bool, clients []string) string {
+	accessType := "RW"
+	if readOnly {
+		accessType = "RO"
+	}
+	// Only the clients in the CLIENT block get access if there is one
+	access := "\tAccess_Type = " + accessType + ";\n"
+	if len(clients) != 0 {
+		access = "\tAccess_Type = None;\n" +
+			"\tCLIENT {\n\t\tClients = " + strings.Join(clients, ", ") + ";\n\t\tAccess_Type = " + accessType + ";\n\t}\n"
+	}
+	return "\nEXPORT\n{\n" +
+		"\tExport_Id = " + exportId + ";\n" +
+		"\tPath = " + path + ";\n" +
+		"\tPseudo = " + path + ";\n" +
+		access +
+		"\tSquash = root_id_squash;\n" +
+		"\tSecType = sys;\n" +
+		"\tFilesystem_id = " + exportId + "." + exportId + ";\n" +
+		"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n"
+}
+
+// Export exports the given directory using NFS Ganesha, assuming it is running
+// and can be connected to using D-Bus.
+func (e *ganeshaExporter) Export(path string) error {
+	// Call AddExport using dbus
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return fmt.Errorf("error getting dbus session bus: %v", err)
+	}
+	obj := conn.Object("org.ganesha.nfsd", "/org/ganesha/nfsd/ExportMgr")
+	call := obj.Call("org.ganesha.nfsd.exportmgr.AddExport", 0, e.ganeshaConfig, fmt.Sprintf("export(path = %s)", path))
+	if call.Err != nil {
+		return fmt.Errorf("error calling org.ganesha.nfsd.exportmgr.AddExport: %v", call.Err)
+	}
+
+	return nil
+}
+
+func (e *ganeshaExporter) Unexport(volume *v1.PersistentVolume) error {
+	ann, ok := volume.Annotations[annExportId]
+	if !ok {
+		return fmt.Errorf("PV doesn't have an annotation %s, can't remove the export from the server", annExportId)
+	}
+	exportId, _ := strconv.ParseUint(ann, 10, 16)
+
+	// Call RemoveExport using dbus
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return fmt.Errorf("error getting dbus session bus: %v", err)
+	}
+	obj := conn.Object("org.ganesha.nfsd", "/org/ganesha/nfsd/ExportMgr")
+	call := obj.Call("org.ganesha.nfsd.exportmgr.RemoveExport", 0, uint16(exportId))
+	if call.Err != nil {
+		return fmt.Errorf("error calling org.ganesha.nfsd.exportmgr.RemoveExport: %v", call.Err)
+	}
+
+	return nil
+}
+
+// Capabilities of NFS Ganesha: exports are added and removed over D-Bus, which
+// also serves per-export statistics. Exports are created with SecType = sys.
+func (e *ganeshaExporter) Capabilities() ExporterCapabilities {
+	return ExporterCapabilities{
+		LiveUpdate: true,
+		ReadOnly:   true,
+		Kerberos:   false,
+		Statistics: true,
+	}
+}
+
+type kernelExporter struct {
+	config string
+}
+
+var _ Exporter = &kernelExporter{}
+
+func newKernelExporter(config string) (Exporter, error) {
+	if config == "" {
+		config = defaultKernelConfig
+	}
+	return &kernelExporter{config: config}, nil
+}
+
+func (e *kernelExporter) GetConfig() string {
+	if e.config == "" {
+		return defaultKernelConfig
+	}
+	return e.config
+}
+
+func (e *kernelExporter) GetConfigExportIds() (map[uint16]bool, error) {
+	return getConfigExportIds(e.GetConfig(), regexp.MustCompile("fsid=([0-9]+)"))
+}
+
+// CreateBlock creates the text block to add to the /etc/exports file.
+func (e *kernelExporter) CreateBlock(exportId, path string, readOnly bool, clients []string) string {
+	access := "rw"
+	if readOnly {
+		access = "ro"
+	}
+	if len(clients) == 0 {
+		clients = []string{"*"}
+	}
+	line := path
+	for _, client := range clients {
+		line += " " + client + "(" + access + ",insecure,root_squash,fsid=" + exportId + ")"
+	}
+	return "\n" + line + "\n"
+}
+
+// Export exports all directories listed in /etc/exports
+func (e *kernelExporter) Export(_ string) error {
+	// Execute exportfs
+	cmd := exec.Command("exportfs", "-r")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exportfs -r failed with error: %v, output: %s", err, out)
+	}
+
+	return nil
+}
+
+func (e *kernelExporter) Unexport(volume *v1.PersistentVolume) error {
+	// Execute exportfs
+	cmd := exec.Command("exportfs", "-r")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exportfs -r failed with error: %v, output: %s", err, out)
+	}
+
+	return nil
+}
+
+// Capabilities of the kernel NFS server: every export and unexport re-exports
+// everything with exportfs -r. Exports are created with the default sec=sys.
+func (e *kernelExporter) Capabilities() ExporterCapabilities {
+	return ExporterCapabilities{
+		LiveUpdate: false,
+		ReadOnly:   true,
+		Kerberos:   false,
+		Statistics: false,
+	}
+}
+
+// getConfigExportIds populates the exportIds map with pre-existing exportIds
+// found in the given config file. Takes as argument the regex it should use to
+// find each exportId in the file i.e. Export_Id or fsid.
+func getConfigExportIds(config string, re *regexp.Regexp) (map[uint16]bool, error) {
+	exportIds := map[uint16]bool{}
+
+	digitsRe := "([0-9]+)"
+	if !strings.Contains(re.String(), digitsRe) {
+		return exportIds, fmt.Errorf("regexp %s doesn't contain digits submatch %s", re.String(), digitsRe)
+	}
+
+	read, err := ioutil.ReadFile(config)
+	if err != nil {
+		return exportIds, err
+	}
+
+	allMatches := re.FindAllSubmatch(read, -1)
+	for _, match := range allMatches {
+		digits := match[1]
+		if id, err := strconv.ParseUint(string(digits), 10, 16); err == nil {
+			exportIds[uint16(id)] = true
+		}
+	}
+
+	return exportIds, nil
+}
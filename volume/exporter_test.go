@@ -0,0 +1,212 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+func TestExporterRegistry(t *testing.T) {
+	RegisterExporter("test", func(config string) (Exporter, error) {
+		return &testExporter{config: config}, nil
+	})
+	defer func() {
+		exporterFactoriesMutex.Lock()
+		delete(exporterFactories, "test")
+		exporterFactoriesMutex.Unlock()
+	}()
+
+	tests := []struct {
+		name           string
+		exporter       string
+		config         string
+		expectedConfig string
+		expectError    bool
+	}{
+		{
+			name:           "ganesha default config",
+			exporter:       "ganesha",
+			config:         "",
+			expectedConfig: DefaultGaneshaConfig,
+			expectError:    false,
+		},
+		{
+			name:           "kernel default config",
+			exporter:       "kernel",
+			config:         "",
+			expectedConfig: "/etc/exports",
+			expectError:    false,
+		},
+		{
+			name:           "registered exporter",
+			exporter:       "test",
+			config:         "/foo",
+			expectedConfig: "/foo",
+			expectError:    false,
+		},
+		{
+			name:           "unknown exporter",
+			exporter:       "foo",
+			config:         "",
+			expectedConfig: "",
+			expectError:    true,
+		},
+	}
+	for _, test := range tests {
+		config := ""
+		exporter, err := NewExporter(test.exporter, test.config)
+		if err == nil {
+			config = exporter.GetConfig()
+		}
+
+		evaluate(t, test.name, test.expectError, err, test.expectedConfig, config, "config")
+	}
+
+	if names := ExporterNames(); !reflect.DeepEqual([]string{"ganesha", "kernel", "test"}, names) {
+		t.Errorf("expected exporter names %v but got %v", []string{"ganesha", "kernel", "test"}, names)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic registering exporter name twice")
+		}
+	}()
+	RegisterExporter("kernel", newKernelExporter)
+}
+
+func TestCreateBlock(t *testing.T) {
+	tests := []struct {
+		name             string
+		exporter         Exporter
+		readOnly         bool
+		clients          []string
+		expectedContains string
+	}{
+		{
+			name:             "ganesha read-write",
+			exporter:         &ganeshaExporter{},
+			readOnly:         false,
+			expectedContains: "\tAccess_Type = RW;\n",
+		},
+		{
+			name:             "ganesha read-only",
+			exporter:         &ganeshaExporter{},
+			readOnly:         true,
+			expectedContains: "\tAccess_Type = RO;\n",
+		},
+		{
+			name:             "kernel read-write",
+			exporter:         &kernelExporter{},
+			readOnly:         false,
+			expectedContains: "/export/pvc-1 *(rw,",
+		},
+		{
+			name:             "kernel read-only",
+			exporter:         &kernelExporter{},
+			readOnly:         true,
+			expectedContains: "/export/pvc-1 *(ro,",
+		},
+		{
+			name:             "ganesha clients",
+			exporter:         &ganeshaExporter{},
+			readOnly:         false,
+			clients:          []string{"10.0.0.0/8", "fd00::/64"},
+			expectedContains: "\tAccess_Type = None;\n\tCLIENT {\n\t\tClients = 10.0.0.0/8, fd00::/64;\n\t\tAccess_Type = RW;\n\t}\n",
+		},
+		{
+			name:             "kernel clients",
+			exporter:         &kernelExporter{},
+			readOnly:         true,
+			clients:          []string{"10.0.0.0/8", "fd00::/64"},
+			expectedContains: "/export/pvc-1 10.0.0.0/8(ro,insecure,root_squash,fsid=1) fd00::/64(ro,insecure,root_squash,fsid=1)\n",
+		},
+	}
+	for _, test := range tests {
+		block := test.exporter.CreateBlock("1", "/export/pvc-1", test.readOnly, test.clients)
+
+		if !strings.Contains(block, test.expectedContains) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected block to contain %q but got %q", test.expectedContains, block)
+		}
+	}
+}
+
+func TestGetConfigExportIds(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name              string
+		useGanesha        bool
+		configContents    string
+		re                *regexp.Regexp
+		expectedExportIds map[uint16]bool
+		expectError       bool
+	}{
+		{
+			name: "ganesha exports 1, 3",
+			configContents: "\nEXPORT\n{\n" +
+				"\tExport_Id = 1;\n" +
+				"\tFilesystem_id = 1.1;\n" +
+				"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n" +
+				"\nEXPORT\n{\n" +
+				"\tExport_Id = 3;\n" +
+				"\tFilesystem_id = 1.1;\n" +
+				"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n",
+			re:                regexp.MustCompile("Export_Id = ([0-9]+);"),
+			expectedExportIds: map[uint16]bool{1: true, 3: true},
+			expectError:       false,
+		},
+		{
+			name: "kernel exports 1, 3",
+			configContents: "\n foo *(rw,insecure,root_squash,fsid=1)\n" +
+				"\n bar *(rw,insecure,root_squash,fsid=3)\n",
+			re:                regexp.MustCompile("fsid=([0-9]+)"),
+			expectedExportIds: map[uint16]bool{1: true, 3: true},
+			expectError:       false,
+		},
+		{
+			name: "bad regex",
+			configContents: "\nEXPORT\n{\n" +
+				"\tExport_Id = 1;\n" +
+				"\tFilesystem_id = 1.1;\n" +
+				"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n",
+			re:                regexp.MustCompile("Export_Id = [0-9]+;"),
+			expectedExportIds: map[uint16]bool{},
+			expectError:       true,
+		},
+	}
+	for i, test := range tests {
+		conf := tmpDir + "/test" + "-" + strconv.Itoa(i)
+		err := ioutil.WriteFile(conf, []byte(test.configContents), 0755)
+		if err != nil {
+			t.Errorf("Error writing file %s: %v", conf, err)
+		}
+
+		exportIds, err := getConfigExportIds(conf, test.re)
+
+		evaluate(t, test.name, test.expectError, err, test.expectedExportIds, exportIds, "export ids")
+	}
+}
@@ -0,0 +1,374 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/guelfey/go.dbus"
+	"github.com/wongma7/nfs-provisioner/controller"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Export is an export block found in an exporter's config file.
+type Export struct {
+	ExportId uint16
+	Path     string
+	// Block is the text of the block, without surrounding whitespace.
+	Block string
+
+	// The offsets of the block in the config file, including the newlines
+	// around it.
+	start, end int
+}
+
+// ExportParser is an optional interface an Exporter can implement to let
+// offline tools find the export blocks in its config file.
+type ExportParser interface {
+	// ParseExports returns the export blocks in the given contents of the
+	// exporter's config file, in order.
+	ParseExports(config string) []Export
+}
+
+// LiveExporter is an optional interface an Exporter can implement to let
+// offline tools see what the NFS server is actually exporting.
+type LiveExporter interface {
+	// LiveExports returns the paths the NFS server is exporting by exportId.
+	LiveExports() (map[uint16]string, error)
+}
+
+var (
+	ganeshaStartRe    = regexp.MustCompile(`(?m)^[ \t]*EXPORT\s*\{`)
+	ganeshaExportIdRe = regexp.MustCompile(`(?i)Export_Id\s*=\s*([0-9]+)\s*;`)
+	ganeshaPathRe     = regexp.MustCompile(`(?i)\bPath\s*=\s*"?([^";]+)"?\s*;`)
+	kernelLineRe      = regexp.MustCompile(`(?m)^[ \t]*(/\S*)[ \t]+[^\n]*?fsid=([0-9]+)[^\n]*$`)
+)
+
+var _ ExportParser = &ganeshaExporter{}
+
+// ParseExports finds EXPORT blocks by matching their braces.
+func (e *ganeshaExporter) ParseExports(config string) []Export {
+	exports := []Export{}
+	for _, loc := range ganeshaStartRe.FindAllStringIndex(config, -1) {
+		depth := 0
+		end := -1
+		for i := loc[1] - 1; i < len(config); i++ {
+			if config[i] == '{' {
+				depth++
+			} else if config[i] == '}' {
+				depth--
+				if depth == 0 {
+					end = i + 1
+					break
+				}
+			}
+		}
+		if end == -1 {
+			continue
+		}
+		block := strings.TrimSpace(config[loc[0]:end])
+		export := Export{Block: block}
+		if match := ganeshaExportIdRe.FindStringSubmatch(block); match != nil {
+			id, _ := strconv.ParseUint(match[1], 10, 16)
+			export.ExportId = uint16(id)
+		}
+		if match := ganeshaPathRe.FindStringSubmatch(block); match != nil {
+			export.Path = strings.TrimSpace(match[1])
+		}
+		export.start, export.end = withNewlines(config, loc[0], end)
+		exports = append(exports, export)
+	}
+	return exports
+}
+
+var _ ExportParser = &kernelExporter{}
+
+// ParseExports finds the lines of /etc/exports that have an fsid, which the
+// provisioner's do.
+func (e *kernelExporter) ParseExports(config string) []Export {
+	exports := []Export{}
+	for _, loc := range kernelLineRe.FindAllStringSubmatchIndex(config, -1) {
+		id, _ := strconv.ParseUint(config[loc[4]:loc[5]], 10, 16)
+		export := Export{
+			ExportId: uint16(id),
+			Path:     config[loc[2]:loc[3]],
+			Block:    strings.TrimSpace(config[loc[0]:loc[1]]),
+		}
+		export.start, export.end = withNewlines(config, loc[0], loc[1])
+		exports = append(exports, export)
+	}
+	return exports
+}
+
+// withNewlines widens the given span of text to take in the newline before and
+// the newline after it, if any, like the blocks CreateBlock returns.
+func withNewlines(text string, start, end int) (int, int) {
+	if start > 0 && text[start-1] == '\n' {
+		start--
+	}
+	if end < len(text) && text[end] == '\n' {
+		end++
+	}
+	return start, end
+}
+
+var _ LiveExporter = &ganeshaExporter{}
+
+// LiveExports calls ShowExports using dbus.
+func (e *ganeshaExporter) LiveExports() (map[uint16]string, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("error getting dbus session bus: %v", err)
+	}
+	obj := conn.Object("org.ganesha.nfsd", "/org/ganesha/nfsd/ExportMgr")
+	call := obj.Call("org.ganesha.nfsd.exportmgr.ShowExports", 0)
+	if call.Err != nil {
+		return nil, fmt.Errorf("error calling org.ganesha.nfsd.exportmgr.ShowExports: %v", call.Err)
+	}
+	// The reply is the time and an array of structs starting with the
+	// exportId and the path of each export
+	if len(call.Body) < 2 {
+		return nil, fmt.Errorf("unexpected reply from org.ganesha.nfsd.exportmgr.ShowExports: %v", call.Body)
+	}
+	structs, ok := call.Body[1].([][]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply from org.ganesha.nfsd.exportmgr.ShowExports: %v", call.Body)
+	}
+	exports := make(map[uint16]string)
+	for _, s := range structs {
+		if len(s) < 2 {
+			continue
+		}
+		id, idOk := s[0].(uint16)
+		path, pathOk := s[1].(string)
+		if idOk && pathOk {
+			exports[id] = path
+		}
+	}
+	return exports, nil
+}
+
+// ExportManager inspects and repairs the exports of the volumes in an export
+// directory without a running controller, e.g. for command-line tools. It
+// changes the exporter's config file under the same lock as the provisioners of
+// the process, but not of other processes.
+type ExportManager struct {
+	p *nfsProvisioner
+}
+
+// NewExportManager creates a manager of the exports of the volumes in the given
+// exportDir, exported by the given exporter.
+func NewExportManager(exportDir string, exporter Exporter) *ExportManager {
+	state := getExportState(exporter)
+	return &ExportManager{
+		p: &nfsProvisioner{
+			exportDir:              exportDir,
+			exporter:               exporter,
+			exportIds:              state.exportIds,
+			mapMutex:               state.mapMutex,
+			fileMutex:              state.fileMutex,
+			dirMutex:               &sync.Mutex{},
+			defaultParametersMutex: &sync.Mutex{},
+		},
+	}
+}
+
+// ExportDir returns the manager's export directory.
+func (m *ExportManager) ExportDir() string {
+	return m.p.exportDir
+}
+
+// InExportDir returns whether the given path is in the manager's export
+// directory.
+func (m *ExportManager) InExportDir(path string) bool {
+	return inExportDir(m.p.exportDir, path)
+}
+
+// Config returns the path of the exporter's config file.
+func (m *ExportManager) Config() string {
+	return m.p.exporter.GetConfig()
+}
+
+// Exports returns the export blocks in the exporter's config file whose paths
+// are in the export directory.
+func (m *ExportManager) Exports() ([]Export, error) {
+	parser, ok := m.p.exporter.(ExportParser)
+	if !ok {
+		return nil, fmt.Errorf("exporter doesn't support parsing its config file %s", m.Config())
+	}
+	read, err := ioutil.ReadFile(m.Config())
+	if err != nil {
+		return nil, err
+	}
+	exports := []Export{}
+	for _, export := range parser.ParseExports(string(read)) {
+		if inExportDir(m.p.exportDir, export.Path) {
+			exports = append(exports, export)
+		}
+	}
+	return exports, nil
+}
+
+// LiveExports returns the paths the NFS server is exporting by exportId, or
+// false if the exporter can't tell.
+func (m *ExportManager) LiveExports() (map[uint16]string, bool, error) {
+	live, ok := m.p.exporter.(LiveExporter)
+	if !ok {
+		return nil, false, nil
+	}
+	exports, err := live.LiveExports()
+	return exports, true, err
+}
+
+// Inspect returns the export ID, path, usage and export block of the given PV.
+func (m *ExportManager) Inspect(volume *v1.PersistentVolume) (*controller.VolumeInfo, error) {
+	return m.p.Inspect(volume)
+}
+
+// RemoveExport removes the given export block from the config file and makes
+// the NFS server stop exporting it. It leaves the exported directory alone.
+func (m *ExportManager) RemoveExport(export Export) error {
+	config := m.Config()
+	read, err := ioutil.ReadFile(config)
+	if err != nil {
+		return err
+	}
+	block := ""
+	for _, candidate := range []string{"\n" + export.Block + "\n", export.Block + "\n", export.Block} {
+		if strings.Contains(string(read), candidate) {
+			block = candidate
+			break
+		}
+	}
+	if block == "" {
+		return fmt.Errorf("export block of %s not found in config file %s", export.Path, config)
+	}
+	if err := m.p.removeFromFile(config, block); err != nil {
+		return fmt.Errorf("error removing the export from the config file %s: %v", config, err)
+	}
+	m.p.deleteExportId(export.ExportId)
+
+	// Unexport needs only what Provision records on a PV
+	volume := &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{annExportId: strconv.FormatUint(uint64(export.ExportId), 10)},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{Path: export.Path},
+			},
+		},
+	}
+	if err := m.p.exporter.Unexport(volume); err != nil {
+		return fmt.Errorf("removed export from the config file %s but error unexporting it: %v", config, err)
+	}
+	return nil
+}
+
+// DirectoryExists returns whether the given path in the export directory is a
+// directory. Like the provisioner, it doesn't follow symlinks or cross onto
+// another filesystem on the way.
+func (m *ExportManager) DirectoryExists(path string) bool {
+	directory, err := relativeDirectory(m.p.exportDir, path)
+	if err != nil {
+		return false
+	}
+	dir, err := openDirectory(m.p.exportDir, directory)
+	if err != nil {
+		return false
+	}
+	dir.Close()
+	return true
+}
+
+// RemoveDirectory removes the directory at the given path in the export
+// directory and then any of its parents left empty, like Delete does. Symlinks
+// are removed, not followed.
+func (m *ExportManager) RemoveDirectory(path string) error {
+	directory, err := relativeDirectory(m.p.exportDir, path)
+	if err != nil {
+		return err
+	}
+	return m.p.removeDirectory(directory)
+}
+
+// RebuildConfig returns the given contents of the config file as they should
+// be according to the given PVs: without the export blocks of paths in the
+// export directory, followed by the export blocks recorded on those of the PVs
+// whose paths are in it, in order of exportId.
+func (m *ExportManager) RebuildConfig(config string, volumes []*v1.PersistentVolume) (string, error) {
+	parser, ok := m.p.exporter.(ExportParser)
+	if !ok {
+		return "", fmt.Errorf("exporter doesn't support parsing its config file %s", m.Config())
+	}
+
+	rebuilt := ""
+	last := 0
+	for _, export := range parser.ParseExports(config) {
+		if !inExportDir(m.p.exportDir, export.Path) {
+			continue
+		}
+		rebuilt += config[last:export.start]
+		last = export.end
+	}
+	rebuilt += config[last:]
+
+	blocks := []exportBlock{}
+	for _, volume := range volumes {
+		if volume.Spec.NFS == nil || !inExportDir(m.p.exportDir, volume.Spec.NFS.Path) {
+			continue
+		}
+		text, ok := volume.Annotations[annBlock]
+		if !ok {
+			continue
+		}
+		exportId, _ := strconv.ParseUint(volume.Annotations[annExportId], 10, 16)
+		blocks = append(blocks, exportBlock{exportId, text})
+	}
+	sort.Sort(byExportId(blocks))
+	for _, b := range blocks {
+		rebuilt += b.text
+	}
+	return rebuilt, nil
+}
+
+type exportBlock struct {
+	exportId uint64
+	text     string
+}
+
+type byExportId []exportBlock
+
+func (b byExportId) Len() int           { return len(b) }
+func (b byExportId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byExportId) Less(i, j int) bool { return b[i].exportId < b[j].exportId }
+
+// ExportOf returns the export recorded on the given PV by Provision, if any.
+func ExportOf(volume *v1.PersistentVolume) (Export, bool) {
+	block, ok := volume.Annotations[annBlock]
+	if !ok || volume.Spec.NFS == nil {
+		return Export{}, false
+	}
+	exportId, _ := strconv.ParseUint(volume.Annotations[annExportId], 10, 16)
+	return Export{ExportId: uint16(exportId), Path: volume.Spec.NFS.Path, Block: strings.TrimSpace(block)}, true
+}
@@ -0,0 +1,334 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+func TestParseExports(t *testing.T) {
+	ganesha := &ganeshaExporter{}
+	kernel := &kernelExporter{}
+	tests := []struct {
+		name            string
+		parser          ExportParser
+		config          string
+		expectedExports []Export
+	}{
+		{
+			name:   "ganesha",
+			parser: ganesha,
+			config: "NFS_Core_Param {\n\tMNT_Port = 20048;\n}\n" +
+				ganesha.CreateBlock("1", "/export/pvc-1", false, nil) +
+				ganesha.CreateBlock("2", "/export/team-a/pvc-2", true, nil) +
+				ganesha.CreateBlock("3", "/export/pvc-3", false, []string{"fd00::/64"}),
+			expectedExports: []Export{
+				{ExportId: 1, Path: "/export/pvc-1", Block: trim(ganesha.CreateBlock("1", "/export/pvc-1", false, nil))},
+				{ExportId: 2, Path: "/export/team-a/pvc-2", Block: trim(ganesha.CreateBlock("2", "/export/team-a/pvc-2", true, nil))},
+				{ExportId: 3, Path: "/export/pvc-3", Block: trim(ganesha.CreateBlock("3", "/export/pvc-3", false, []string{"fd00::/64"}))},
+			},
+		},
+		{
+			name:   "ganesha, hand-written",
+			parser: ganesha,
+			config: "EXPORT {\n  Export_Id = 3;\n  Path = \"/export/pvc-3\";\n  FSAL { Name = VFS; }\n}",
+			expectedExports: []Export{
+				{ExportId: 3, Path: "/export/pvc-3", Block: "EXPORT {\n  Export_Id = 3;\n  Path = \"/export/pvc-3\";\n  FSAL { Name = VFS; }\n}"},
+			},
+		},
+		{
+			name:            "ganesha, unterminated",
+			parser:          ganesha,
+			config:          "EXPORT {\n  Export_Id = 3;\n",
+			expectedExports: []Export{},
+		},
+		{
+			name:   "kernel",
+			parser: kernel,
+			config: "# exports\n/srv *(rw)\n" +
+				kernel.CreateBlock("1", "/export/pvc-1", false, nil) +
+				kernel.CreateBlock("2", "/export/pvc-2", true, nil) +
+				kernel.CreateBlock("3", "/export/pvc-3", false, []string{"10.0.0.0/8", "fd00::1"}),
+			expectedExports: []Export{
+				{ExportId: 1, Path: "/export/pvc-1", Block: trim(kernel.CreateBlock("1", "/export/pvc-1", false, nil))},
+				{ExportId: 2, Path: "/export/pvc-2", Block: trim(kernel.CreateBlock("2", "/export/pvc-2", true, nil))},
+				{ExportId: 3, Path: "/export/pvc-3", Block: trim(kernel.CreateBlock("3", "/export/pvc-3", false, []string{"10.0.0.0/8", "fd00::1"}))},
+			},
+		},
+	}
+	for _, test := range tests {
+		exports := test.parser.ParseExports(test.config)
+		for i := range exports {
+			exports[i].start, exports[i].end = 0, 0
+		}
+		if !reflect.DeepEqual(test.expectedExports, exports) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected exports %+v but got %+v", test.expectedExports, exports)
+		}
+	}
+}
+
+func TestExportsSiblingExportDirs(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	kernel := &kernelExporter{}
+	config := tmpDir + "/exports"
+	own := kernel.CreateBlock("1", "/export/pvc-1", false, nil)
+	sibling := kernel.CreateBlock("2", "/export2/pvc-2", false, nil)
+	itself := kernel.CreateBlock("3", "/export", false, nil)
+	if err := ioutil.WriteFile(config, []byte(own+sibling+itself), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	volumes := []*v1.PersistentVolume{
+		newVolumeWithExport(newVolume("pvc-1", "/export/pvc-1"), "1", own),
+		newVolumeWithExport(newVolume("pvc-2", "/export2/pvc-2"), "2", sibling),
+	}
+
+	tests := []struct {
+		name            string
+		exportDir       string
+		expectedPaths   []string
+		expectedRebuilt string
+	}{
+		{
+			name:            "trailing slash",
+			exportDir:       "/export/",
+			expectedPaths:   []string{"/export/pvc-1"},
+			expectedRebuilt: sibling + itself + own,
+		},
+		{
+			name:            "no trailing slash",
+			exportDir:       "/export",
+			expectedPaths:   []string{"/export/pvc-1"},
+			expectedRebuilt: sibling + itself + own,
+		},
+		{
+			name:            "sibling",
+			exportDir:       "/export2/",
+			expectedPaths:   []string{"/export2/pvc-2"},
+			expectedRebuilt: own + itself + sibling,
+		},
+	}
+	for _, test := range tests {
+		m := NewExportManager(test.exportDir, &parsingTestExporter{testExporter{config: config}})
+
+		exports, err := m.Exports()
+		if err != nil {
+			t.Fatalf("unexpected error getting exports: %v", err)
+		}
+		paths := []string{}
+		for _, export := range exports {
+			paths = append(paths, export.Path)
+		}
+		if !reflect.DeepEqual(test.expectedPaths, paths) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected exports of paths %v but got %v", test.expectedPaths, paths)
+		}
+
+		rebuilt, err := m.RebuildConfig(own+sibling+itself, volumes)
+		if err != nil {
+			t.Fatalf("unexpected error rebuilding config: %v", err)
+		}
+		if test.expectedRebuilt != rebuilt {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected config:\n%s\nbut got:\n%s", test.expectedRebuilt, rebuilt)
+		}
+	}
+}
+
+func TestRebuildConfig(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+	ganesha := &ganeshaExporter{ganeshaConfig: tmpDir + "/vfs.conf"}
+	if err := ioutil.WriteFile(ganesha.ganeshaConfig, []byte{}, 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	m := NewExportManager("/export/", ganesha)
+
+	header := "NFS_Core_Param {\n\tMNT_Port = 20048;\n}\n"
+	orphan := ganesha.CreateBlock("1", "/export/pvc-1", false, nil)
+	other := ganesha.CreateBlock("4", "/export-b/pvc-4", false, nil)
+	kept := ganesha.CreateBlock("2", "/export/pvc-2", false, nil)
+	missing := ganesha.CreateBlock("3", "/export/pvc-3", false, nil)
+
+	volumes := []*v1.PersistentVolume{
+		newVolumeWithExport(newVolume("pvc-3", "/export/pvc-3"), "3", missing),
+		newVolumeWithExport(newVolume("pvc-2", "/export/pvc-2"), "2", kept),
+		newVolume("pvc-5", "/export/pvc-5"),
+		newVolumeWithExport(newVolume("pvc-6", "/export-b/pvc-6"), "6", ganesha.CreateBlock("6", "/export-b/pvc-6", false, nil)),
+	}
+
+	rebuilt, err := m.RebuildConfig(header+orphan+other+kept, volumes)
+	if err != nil {
+		t.Fatalf("unexpected error rebuilding config: %v", err)
+	}
+	expected := header + other + kept + missing
+	if expected != rebuilt {
+		t.Errorf("expected config:\n%s\nbut got:\n%s", expected, rebuilt)
+	}
+}
+
+func TestRemoveExport(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	kernel := &kernelExporter{}
+	config := tmpDir + "/exports"
+	first := kernel.CreateBlock("1", tmpDir+"/pvc-1", false, nil)
+	second := kernel.CreateBlock("2", tmpDir+"/pvc-2", false, nil)
+	if err := ioutil.WriteFile(config, []byte(first+second), 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	m := NewExportManager(tmpDir+"/", &parsingTestExporter{testExporter{config: config}})
+
+	exports, err := m.Exports()
+	if err != nil || len(exports) != 2 {
+		t.Fatalf("expected 2 exports but got %+v, %v", exports, err)
+	}
+	if err := m.RemoveExport(exports[0]); err != nil {
+		t.Fatalf("unexpected error removing export: %v", err)
+	}
+	read, _ := ioutil.ReadFile(config)
+	if string(read) != second {
+		t.Errorf("expected config %q but got %q", second, string(read))
+	}
+	if err := m.RemoveExport(exports[0]); err == nil {
+		t.Errorf("expected error removing export again but got none")
+	}
+}
+
+func TestExportManagerRemoveDirectory(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exportDir := tmpDir + "/export/"
+	outside := tmpDir + "/outside"
+	for _, dir := range []string{exportDir + "team-a/pvc-1", exportDir + "pvc-2", outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("error creating %s: %v", dir, err)
+		}
+	}
+	if err := ioutil.WriteFile(outside+"/secret", []byte("foo"), 0644); err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	for _, link := range []string{exportDir + "pvc-2/link", exportDir + "pvc-3"} {
+		if err := os.Symlink(outside, link); err != nil {
+			t.Fatalf("error creating symlink: %v", err)
+		}
+	}
+	m := NewExportManager(exportDir, &parsingTestExporter{testExporter{config: tmpDir + "/exports"}})
+
+	tests := []struct {
+		name            string
+		path            string
+		expectedExists  bool
+		expectedRemoved []string
+		expectError     bool
+	}{
+		{
+			name:            "nested",
+			path:            exportDir + "team-a/pvc-1",
+			expectedExists:  true,
+			expectedRemoved: []string{"team-a/pvc-1", "team-a"},
+			expectError:     false,
+		},
+		{
+			name:            "symlink in directory",
+			path:            exportDir + "pvc-2",
+			expectedExists:  true,
+			expectedRemoved: []string{"pvc-2"},
+			expectError:     false,
+		},
+		{
+			name:            "symlink",
+			path:            exportDir + "pvc-3",
+			expectedExists:  false,
+			expectedRemoved: []string{"pvc-3"},
+			expectError:     false,
+		},
+		{
+			name:            "outside export directory",
+			path:            outside,
+			expectedExists:  false,
+			expectedRemoved: []string{},
+			expectError:     true,
+		},
+		{
+			name:            "parent dir",
+			path:            exportDir + "../outside",
+			expectedExists:  false,
+			expectedRemoved: []string{},
+			expectError:     true,
+		},
+		{
+			name:            "export directory",
+			path:            exportDir,
+			expectedExists:  false,
+			expectedRemoved: []string{},
+			expectError:     true,
+		},
+	}
+	for _, test := range tests {
+		exists := m.DirectoryExists(test.path)
+		if exists != test.expectedExists {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected directory exists %v but got %v", test.expectedExists, exists)
+		}
+
+		err := m.RemoveDirectory(test.path)
+
+		evaluate(t, test.name, test.expectError, err, nil, nil, "error")
+		for _, directory := range test.expectedRemoved {
+			if _, err := os.Lstat(exportDir + directory); !os.IsNotExist(err) {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected %s to be removed", directory)
+			}
+		}
+		if _, err := os.Stat(outside + "/secret"); err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected file outside the export directory to be kept but stat failed with error: %v", err)
+		}
+	}
+}
+
+func trim(block string) string {
+	return block[1 : len(block)-1]
+}
+
+func newVolumeWithExport(volume *v1.PersistentVolume, exportId, block string) *v1.PersistentVolume {
+	volume.Annotations = map[string]string{annExportId: exportId, annBlock: block}
+	return volume
+}
+
+// parsingTestExporter is a testExporter whose config file is in the format of
+// /etc/exports.
+type parsingTestExporter struct {
+	testExporter
+}
+
+var _ ExportParser = &parsingTestExporter{}
+
+func (e *parsingTestExporter) ParseExports(config string) []Export {
+	return (&kernelExporter{}).ParseExports(config)
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+var _ controller.Inspector = &nfsProvisioner{}
+
+// Inspect returns the export ID, path, usage and export block of the given PV,
+// as recorded in its annotations and found in its directory.
+func (p *nfsProvisioner) Inspect(volume *v1.PersistentVolume) (*controller.VolumeInfo, error) {
+	directory, err := p.getVolumeDirectory(volume)
+	if err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf(p.exportDir+"%s", directory)
+	dir, err := openDirectory(p.exportDir, directory)
+	if err != nil {
+		return nil, fmt.Errorf("error getting usage of backing path: %v", err)
+	}
+	usedBytes, err := dir.usage()
+	dir.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error getting usage of backing path: %v", err)
+	}
+
+	return &controller.VolumeInfo{
+		ExportId:    volume.Annotations[annExportId],
+		Path:        path,
+		UsedBytes:   usedBytes,
+		ExportBlock: volume.Annotations[annBlock],
+	}, nil
+}
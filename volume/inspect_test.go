@@ -0,0 +1,104 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+func TestInspect(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
+	for _, directory := range []string{"pvc-1", "pvc-1/sub", "pvc-2"} {
+		if err := os.Mkdir(tmpDir+"/"+directory, 0777); err != nil {
+			t.Fatalf("error creating directory %s: %v", directory, err)
+		}
+	}
+	for file, size := range map[string]int{"pvc-1/a": 100, "pvc-1/sub/b": 24} {
+		if err := ioutil.WriteFile(tmpDir+"/"+file, make([]byte, size), 0666); err != nil {
+			t.Fatalf("error writing file %s: %v", file, err)
+		}
+	}
+
+	withExportId := newVolumeWithBlock(newVolume("pvc-1", tmpDir+"/pvc-1"))
+	withExportId.Annotations[annExportId] = "1"
+
+	tests := []struct {
+		name         string
+		volume       *v1.PersistentVolume
+		expectedInfo *controller.VolumeInfo
+		expectError  bool
+	}{
+		{
+			name:   "files",
+			volume: withExportId,
+			expectedInfo: &controller.VolumeInfo{
+				ExportId:    "1",
+				Path:        tmpDir + "/pvc-1",
+				UsedBytes:   124,
+				ExportBlock: "\nExport_Id = 1;\n",
+			},
+			expectError: false,
+		},
+		{
+			name:         "empty",
+			volume:       newVolume("pvc-2", tmpDir+"/pvc-2"),
+			expectedInfo: &controller.VolumeInfo{Path: tmpDir + "/pvc-2"},
+			expectError:  false,
+		},
+		{
+			name:        "doesn't exist",
+			volume:      newVolume("pvc-3", tmpDir+"/pvc-3"),
+			expectError: true,
+		},
+		{
+			name:        "outside export directory",
+			volume:      newVolume("pvc-1", "/foo/pvc-1"),
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		info, err := p.Inspect(test.volume)
+		if test.expectError {
+			if err == nil {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected error but got info %+v", info)
+			}
+			continue
+		}
+		if err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error inspecting volume: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(test.expectedInfo, info) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected info %+v but got %+v", test.expectedInfo, info)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The IP families a provisioner can prefer in a dual-stack cluster.
+const (
+	IPv4 = "ipv4"
+	IPv6 = "ipv6"
+)
+
+// podIPsEnv is the env holding the pod's IPs, comma-separated, from the
+// downward API's status.podIPs in dual-stack clusters.
+const podIPsEnv = "POD_IPS"
+
+// parseIPs parses the IPs separated by whitespace or commas in the given text,
+// e.g. the output of `hostname -i`, skipping link-local and unparseable ones.
+func parseIPs(text string) []net.IP {
+	ips := []net.IP{}
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+		ip := net.ParseIP(field)
+		if ip == nil || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// isFamily returns whether the given IP is of the given family, which any IP
+// is if it's empty.
+func isFamily(ip net.IP, family string) bool {
+	switch family {
+	case IPv4:
+		return ip.To4() != nil
+	case IPv6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// pickIP returns the first of the given IPs of the given family.
+func pickIP(ips []net.IP, family string) (net.IP, error) {
+	for _, ip := range ips {
+		if isFamily(ip, family) {
+			return ip, nil
+		}
+	}
+	if family == "" {
+		return nil, fmt.Errorf("no IP found")
+	}
+	return nil, fmt.Errorf("no %s IP found among %v", family, ips)
+}
+
+// getPodIPs gets the pod's IPs from podIPsEnv or the given env or, if neither
+// is set, from `hostname -i`.
+func getPodIPs(podIPEnv string) ([]net.IP, error) {
+	for _, env := range []string{podIPsEnv, podIPEnv} {
+		if value := os.Getenv(env); value != "" {
+			ips := parseIPs(value)
+			if len(ips) == 0 {
+				return nil, fmt.Errorf("env %s=%s holds no valid IP", env, value)
+			}
+			return ips, nil
+		}
+	}
+	out, err := exec.Command("hostname", "-i").Output()
+	if err != nil {
+		return nil, fmt.Errorf("hostname -i failed with error: %v, output: %s", err, out)
+	}
+	ips := parseIPs(string(out))
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("hostname -i output holds no valid IP: %s", out)
+	}
+	return ips, nil
+}
+
+// getPodIP gets the pod's IP of the given family, or its first IP if the
+// family is empty.
+func getPodIP(podIPEnv, family string) (string, error) {
+	ips, err := getPodIPs(podIPEnv)
+	if err != nil {
+		return "", err
+	}
+	ip, err := pickIP(ips, family)
+	if err != nil {
+		return "", fmt.Errorf("error getting pod IP: %v", err)
+	}
+	return ip.String(), nil
+}
+
+// containsIP returns whether the given IPs contain the given one, in any form.
+func containsIP(ips []net.IP, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeAddress returns the given server address in canonical form if it's
+// an IP, e.g. with IPv6 zeros compressed, or else as it is.
+func normalizeAddress(address string) string {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return address
+}
+
+// parseClients parses the given comma-separated list of the clients an export
+// is restricted to, each an IPv4 or IPv6 address or CIDR, and returns them in
+// canonical form.
+func parseClients(value string) ([]string, error) {
+	clients := []string{}
+	for _, client := range strings.Split(value, ",") {
+		client = strings.TrimSpace(client)
+		if client == "" {
+			continue
+		}
+		if ip := net.ParseIP(client); ip != nil {
+			clients = append(clients, ip.String())
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(client); err == nil {
+			clients = append(clients, ipNet.String())
+			continue
+		}
+		return nil, fmt.Errorf("%q is not an IP address or CIDR", client)
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no clients given")
+	}
+	return clients, nil
+}
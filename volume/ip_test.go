@@ -0,0 +1,135 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseIPs(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		expectedIPs []net.IP
+	}{
+		{
+			name:        "single",
+			text:        "10.0.0.1\n",
+			expectedIPs: []net.IP{net.ParseIP("10.0.0.1")},
+		},
+		{
+			name:        "hostname -i in dual-stack pod",
+			text:        "10.0.0.1 fd00::1 fe80::1 \n",
+			expectedIPs: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+		},
+		{
+			name:        "comma-separated",
+			text:        "fd00::1,10.0.0.1",
+			expectedIPs: []net.IP{net.ParseIP("fd00::1"), net.ParseIP("10.0.0.1")},
+		},
+		{
+			name:        "garbage",
+			text:        "foo",
+			expectedIPs: []net.IP{},
+		},
+	}
+	for _, test := range tests {
+		ips := parseIPs(test.text)
+		evaluate(t, test.name, false, nil, test.expectedIPs, ips, "IPs")
+	}
+}
+
+func TestPickIP(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}
+	tests := []struct {
+		name        string
+		ips         []net.IP
+		family      string
+		expectedIP  string
+		expectError bool
+	}{
+		{
+			name:        "any",
+			ips:         ips,
+			family:      "",
+			expectedIP:  "10.0.0.1",
+			expectError: false,
+		},
+		{
+			name:        "IPv4",
+			ips:         ips,
+			family:      IPv4,
+			expectedIP:  "10.0.0.1",
+			expectError: false,
+		},
+		{
+			name:        "IPv6",
+			ips:         ips,
+			family:      IPv6,
+			expectedIP:  "fd00::1",
+			expectError: false,
+		},
+		{
+			name:        "no IP of family",
+			ips:         ips[:1],
+			family:      IPv6,
+			expectedIP:  "",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		ip, err := pickIP(test.ips, test.family)
+		got := ""
+		if ip != nil {
+			got = ip.String()
+		}
+		evaluate(t, test.name, test.expectError, err, test.expectedIP, got, "IP")
+	}
+}
+
+func TestParseClients(t *testing.T) {
+	tests := []struct {
+		name            string
+		value           string
+		expectedClients []string
+		expectError     bool
+	}{
+		{
+			name:            "IPs and CIDRs",
+			value:           "10.0.0.1, 10.1.2.3/16,fd00:0::1,fd00::1:2/64",
+			expectedClients: []string{"10.0.0.1", "10.1.0.0/16", "fd00::1", "fd00::/64"},
+			expectError:     false,
+		},
+		{
+			name:            "hostname",
+			value:           "10.0.0.1,nfs.example.com",
+			expectedClients: []string(nil),
+			expectError:     true,
+		},
+		{
+			name:            "empty",
+			value:           " , ",
+			expectedClients: []string(nil),
+			expectError:     true,
+		},
+	}
+	for _, test := range tests {
+		clients, err := parseClients(test.value)
+		evaluate(t, test.name, test.expectError, err, test.expectedClients, clients, "clients")
+	}
+}
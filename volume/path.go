@@ -0,0 +1,183 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+const (
+	// The pathPattern used if the StorageClass doesn't specify one: every
+	// volume gets its own directory directly under exportDir, named after its
+	// PV.
+	defaultPathPattern = "${pvName}"
+
+	varNamespace   = "namespace"
+	varPVCName     = "pvcName"
+	varPVName      = "pvName"
+	varAnnotations = "annotations."
+)
+
+var patternVarRe = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// pathComponentRe matches the path components a pathPattern may expand to. The
+// directory ends up in the exporter's config file, e.g. in a Ganesha EXPORT
+// block or an /etc/exports line, where whitespace, quotes or characters like
+// ';', '{' or '(' could end the path and add options or exports of a claim's
+// choosing, since claims control their names and annotations and may override
+// the pathPattern.
+var pathComponentRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// getDirectory renders the given pathPattern for the volume described by
+// options and returns the resulting directory, relative to exportDir. Every
+// variable must expand to a single, non-empty path component so that a claim
+// can't use its name or annotations to escape exportDir, and every component
+// may only contain letters, digits, '.', '_' and '-'.
+func getDirectory(pattern string, options controller.VolumeOptions) (string, error) {
+	if !strings.Contains(pattern, "${"+varPVName+"}") {
+		return "", fmt.Errorf("pathPattern %q must contain ${%s} so that every volume gets a unique directory", pattern, varPVName)
+	}
+
+	var expandErr error
+	expanded := patternVarRe.ReplaceAllStringFunc(pattern, func(match string) string {
+		name := patternVarRe.FindStringSubmatch(match)[1]
+		value, err := getPatternVar(name, options)
+		if err == nil {
+			err = validatePathComponent(value)
+		}
+		if err != nil {
+			if expandErr == nil {
+				expandErr = fmt.Errorf("error expanding %s in pathPattern %q: %v", match, pattern, err)
+			}
+			return ""
+		}
+		return value
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	if strings.Contains(expanded, "${") {
+		return "", fmt.Errorf("pathPattern %q contains an unterminated variable", pattern)
+	}
+
+	if path.IsAbs(expanded) {
+		return "", fmt.Errorf("pathPattern %q must be relative to the export directory", pattern)
+	}
+	for _, component := range strings.Split(expanded, "/") {
+		if component == "" || component == "." || component == ".." {
+			return "", fmt.Errorf("pathPattern %q expands to %q which has an empty, '.' or '..' path component", pattern, expanded)
+		}
+		if !pathComponentRe.MatchString(component) {
+			return "", fmt.Errorf("pathPattern %q expands to %q which has characters other than letters, digits, '.', '_' and '-'", pattern, expanded)
+		}
+	}
+
+	return expanded, nil
+}
+
+// getPatternVar returns the value of the pathPattern variable with the given
+// name for the volume described by options.
+func getPatternVar(name string, options controller.VolumeOptions) (string, error) {
+	if name == varPVName {
+		return options.PVName, nil
+	}
+
+	claim := options.PVC
+	if claim == nil {
+		return "", fmt.Errorf("no claim to get the value of ${%s} from", name)
+	}
+	switch {
+	case name == varNamespace:
+		return claim.Namespace, nil
+	case name == varPVCName:
+		return claim.Name, nil
+	case strings.HasPrefix(name, varAnnotations):
+		key := strings.TrimPrefix(name, varAnnotations)
+		value, ok := claim.Annotations[key]
+		if !ok {
+			return "", fmt.Errorf("claim has no annotation %q", key)
+		}
+		return value, nil
+	}
+
+	return "", fmt.Errorf("unknown variable. valid variables are: ${%s}, ${%s}, ${%s} and ${%s<key>}", varNamespace, varPVCName, varPVName, varAnnotations)
+}
+
+// validatePathComponent checks that the given variable value can be used as a
+// single component of a path.
+func validatePathComponent(value string) error {
+	if value == "" {
+		return fmt.Errorf("value is empty")
+	}
+	if value == "." || value == ".." {
+		return fmt.Errorf("value %q is not allowed", value)
+	}
+	if !pathComponentRe.MatchString(value) {
+		return fmt.Errorf("value %q may only contain letters, digits, '.', '_' and '-'", value)
+	}
+	return nil
+}
+
+// getVolumeDirectory returns the directory, relative to exportDir, backing the
+// given PV. Provision stored it in the PV's NFS path, which may be nested
+// according to the pathPattern it was provisioned with.
+func (p *nfsProvisioner) getVolumeDirectory(volume *v1.PersistentVolume) (string, error) {
+	if volume.Spec.NFS == nil {
+		return "", fmt.Errorf("volume %s is not an NFS volume", volume.Name)
+	}
+	path := volume.Spec.NFS.Path
+	if !strings.HasPrefix(path, p.exportDir) {
+		return "", fmt.Errorf("volume path %s is not in export directory %s", path, p.exportDir)
+	}
+	directory := strings.TrimPrefix(path, p.exportDir)
+	for _, component := range strings.Split(directory, "/") {
+		if component == "" || component == "." || component == ".." {
+			return "", fmt.Errorf("volume path %s has an empty, '.' or '..' path component", path)
+		}
+	}
+
+	return directory, nil
+}
+
+// inExportDir returns whether the given path is somewhere under exportDir. It
+// doesn't match exportDir itself or its siblings that exportDir is a prefix of,
+// like /export2 for /export, whose exports may share the config file.
+func inExportDir(exportDir, path string) bool {
+	dir := filepath.Clean(exportDir)
+	prefix := dir
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	path = filepath.Clean(path)
+	return path != dir && strings.HasPrefix(path, prefix)
+}
+
+// relativeDirectory returns the given path, which must be in exportDir,
+// relative to exportDir.
+func relativeDirectory(exportDir, path string) (string, error) {
+	if !inExportDir(exportDir, path) {
+		return "", fmt.Errorf("path %s is not in export directory %s", path, exportDir)
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(filepath.Clean(path), filepath.Clean(exportDir)), "/"), nil
+}
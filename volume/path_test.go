@@ -0,0 +1,268 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+func TestGetDirectory(t *testing.T) {
+	claim := newClaim("db-data", "team-a")
+	claim.Annotations["example.com/tier"] = "gold"
+	claim.Annotations["example.com/evil"] = "../../etc"
+	claim.Annotations["example.com/dots"] = ".."
+	claim.Annotations["example.com/block"] = "x\";\n}\nEXPORT {\n\tPath = \"/\""
+
+	tests := []struct {
+		name              string
+		pattern           string
+		pvc               *v1.PersistentVolumeClaim
+		expectedDirectory string
+		expectError       bool
+	}{
+		{
+			name:              "default pattern",
+			pattern:           defaultPathPattern,
+			pvc:               claim,
+			expectedDirectory: "pvc-1",
+			expectError:       false,
+		},
+		{
+			name:              "default pattern without claim",
+			pattern:           defaultPathPattern,
+			pvc:               nil,
+			expectedDirectory: "pvc-1",
+			expectError:       false,
+		},
+		{
+			name:              "nested pattern",
+			pattern:           "${namespace}/${pvcName}-${pvName}",
+			pvc:               claim,
+			expectedDirectory: "team-a/db-data-pvc-1",
+			expectError:       false,
+		},
+		{
+			name:              "annotation",
+			pattern:           "${annotations.example.com/tier}/${pvName}",
+			pvc:               claim,
+			expectedDirectory: "gold/pvc-1",
+			expectError:       false,
+		},
+		{
+			name:              "no pvName",
+			pattern:           "${namespace}/${pvcName}",
+			pvc:               claim,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "claim variable without claim",
+			pattern:           "${namespace}/${pvName}",
+			pvc:               nil,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "missing annotation",
+			pattern:           "${annotations.example.com/missing}/${pvName}",
+			pvc:               claim,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "annotation with slashes",
+			pattern:           "${annotations.example.com/evil}/${pvName}",
+			pvc:               claim,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "annotation is dot-dot",
+			pattern:           "${annotations.example.com/dots}/${pvName}",
+			pvc:               claim,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "annotation closing an export block",
+			pattern:           "${annotations.example.com/block}/${pvName}",
+			pvc:               claim,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "pattern with export options",
+			pattern:           "a *(rw,no_root_squash)/${pvName}",
+			pvc:               claim,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "unknown variable",
+			pattern:           "${foo}/${pvName}",
+			pvc:               claim,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "absolute",
+			pattern:           "/etc/${pvName}",
+			pvc:               claim,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "traversal",
+			pattern:           "a/../../${pvName}",
+			pvc:               claim,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "empty component",
+			pattern:           "a//${pvName}",
+			pvc:               claim,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "unterminated variable",
+			pattern:           "${pvName}/${namespace",
+			pvc:               claim,
+			expectedDirectory: "",
+			expectError:       true,
+		},
+	}
+	for _, test := range tests {
+		options := controller.VolumeOptions{PVName: "pvc-1", PVC: test.pvc}
+
+		directory, err := getDirectory(test.pattern, options)
+
+		evaluate(t, test.name, test.expectError, err, test.expectedDirectory, directory, "directory")
+	}
+}
+
+func TestHostilePathPatternValues(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	values := []string{
+		"a\nb",
+		"a b",
+		"a;b",
+		"a{b",
+		"a}b",
+		"a(b)",
+		"a#b",
+		"a\"b",
+		"a'b",
+		"a*b",
+		"a,b",
+		"a=b",
+		"a\tb",
+		"a\x7fb",
+		"x\";\n}\nEXPORT {\n\tExport_Id = 9;\n\tPath = \"/\";\n\tSquash = \"no_root_squash\";\n}\n#",
+		"x *(rw,no_root_squash)\n/ *(rw,no_root_squash)\n#",
+	}
+	exporters := map[string]Exporter{
+		"ganesha": &ganeshaExporter{ganeshaConfig: tmpDir + "/vfs.conf"},
+		"kernel":  &kernelExporter{},
+	}
+	for exporterName, exporter := range exporters {
+		client := fake.NewSimpleClientset()
+		p := newNFSProvisionerInternal(tmpDir+"/", client, exporter)
+		for _, value := range append(values, "gold") {
+			claim := newClaim("db-data", "team-a")
+			claim.Annotations["example.com/team"] = value
+			options := controller.VolumeOptions{
+				PVName:     "pvc-1",
+				PVC:        claim,
+				Parameters: map[string]string{"pathPattern": "${annotations.example.com/team}/${pvName}"},
+				Capacity:   resource.MustParse("1Ki"),
+			}
+
+			config, err := p.validateOptions(options)
+
+			expectError := value != "gold"
+			expectedDirectory := ""
+			if !expectError {
+				expectedDirectory = "gold/pvc-1"
+			}
+			evaluate(t, exporterName+" "+strconv.Quote(value), expectError, err, expectedDirectory, config.directory, "directory")
+		}
+	}
+}
+
+func TestGetVolumeDirectory(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name              string
+		path              string
+		expectedDirectory string
+		expectError       bool
+	}{
+		{
+			name:              "flat",
+			path:              tmpDir + "/pvc-1",
+			expectedDirectory: "pvc-1",
+			expectError:       false,
+		},
+		{
+			name:              "nested",
+			path:              tmpDir + "/team-a/db-data-pvc-1",
+			expectedDirectory: "team-a/db-data-pvc-1",
+			expectError:       false,
+		},
+		{
+			name:              "outside export dir",
+			path:              "/etc/pvc-1",
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "traversal",
+			path:              tmpDir + "/../pvc-1",
+			expectedDirectory: "",
+			expectError:       true,
+		},
+		{
+			name:              "export dir itself",
+			path:              tmpDir + "/",
+			expectedDirectory: "",
+			expectError:       true,
+		},
+	}
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
+
+	for _, test := range tests {
+		directory, err := p.getVolumeDirectory(newVolume("pvc-1", test.path))
+
+		evaluate(t, test.name, test.expectError, err, test.expectedDirectory, directory, "directory")
+	}
+}
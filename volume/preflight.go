@@ -0,0 +1,314 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/1.4/kubernetes"
+)
+
+// CheckStatus is the outcome of a preflight check.
+type CheckStatus string
+
+const (
+	// CheckOK means the check passed.
+	CheckOK CheckStatus = "ok"
+	// CheckWarning means the provisioner can run but may not work as
+	// expected.
+	CheckWarning CheckStatus = "warning"
+	// CheckFatal means the provisioner would fail to provision or delete
+	// volumes, so it must not start.
+	CheckFatal CheckStatus = "fatal"
+)
+
+// Check is the result of a preflight check.
+type Check struct {
+	Name    string
+	Status  CheckStatus
+	Message string
+}
+
+// Preflighter is an optional interface a provisioner or an Exporter can
+// implement to check its environment before it serves any claims.
+type Preflighter interface {
+	// Preflight checks the environment and returns the results.
+	Preflight() []Check
+}
+
+// ServerPreflighter is an optional interface a provisioner or an Exporter can
+// implement for the checks that need the NFS server running. They are left out
+// of Preflight so that a provisioner that starts the server itself can run them
+// once it has.
+type ServerPreflighter interface {
+	// PreflightServer checks the running NFS server and returns the results.
+	PreflightServer() []Check
+}
+
+// Fatal returns whether any of the given checks is fatal.
+func Fatal(checks []Check) bool {
+	for _, check := range checks {
+		if check.Status == CheckFatal {
+			return true
+		}
+	}
+	return false
+}
+
+func newCheck(name string, status CheckStatus, format string, a ...interface{}) Check {
+	return Check{Name: name, Status: status, Message: fmt.Sprintf(format, a...)}
+}
+
+var _ Preflighter = &nfsProvisioner{}
+var _ ServerPreflighter = &nfsProvisioner{}
+
+// Preflight checks that the export directory and the exporter's config file are
+// writable, that the export directory outlives the pod unless that's allowed,
+// the exporter's own checks, and that the NFS server to put in PVs can be found
+// the way getServer finds it. The exporter's checks of the running NFS server
+// are left to PreflightServer.
+func (p *nfsProvisioner) Preflight() []Check {
+	checks := []Check{p.checkExportDir()}
+	if checks[0].Status != CheckFatal {
+		checks = append(checks, p.checkExportStorage())
+	}
+	checks = append(checks, p.checkConfig())
+	if preflighter, ok := p.exporter.(Preflighter); ok {
+		checks = append(checks, preflighter.Preflight()...)
+	}
+	return append(checks, p.checkServer()...)
+}
+
+// PreflightServer runs the exporter's checks of the running NFS server, if it
+// has any.
+func (p *nfsProvisioner) PreflightServer() []Check {
+	if preflighter, ok := p.exporter.(ServerPreflighter); ok {
+		return preflighter.PreflightServer()
+	}
+	return []Check{}
+}
+
+func (p *nfsProvisioner) checkExportDir() Check {
+	const name = "export directory"
+	info, err := os.Stat(p.exportDir)
+	if err != nil {
+		return newCheck(name, CheckFatal, "%v", err)
+	}
+	if !info.IsDir() {
+		return newCheck(name, CheckFatal, "%s is not a directory", p.exportDir)
+	}
+	file, err := ioutil.TempFile(p.exportDir, ".preflight")
+	if err != nil {
+		return newCheck(name, CheckFatal, "%s is not writable: %v", p.exportDir, err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return newCheck(name, CheckOK, "%s is writable", p.exportDir)
+}
+
+// checkExportStorage checks that the export directory isn't on storage that is
+// lost with the pod, like tmpfs, the container's overlay root filesystem or an
+// emptyDir, which would take every PV's data with it, unless allowEphemeral.
+func (p *nfsProvisioner) checkExportStorage() Check {
+	const name = "export storage"
+	ephemeral, err := ephemeralStorage(p.mountInfo, p.exportDir)
+	if err != nil {
+		return newCheck(name, CheckWarning, "can't tell whether %s outlives the pod: %v", p.exportDir, err)
+	}
+	if ephemeral == "" {
+		return newCheck(name, CheckOK, "%s is not on ephemeral storage", p.exportDir)
+	}
+	if p.allowEphemeral {
+		return newCheck(name, CheckWarning, "%s is on %s, PVs will be lost with the pod and are labeled %s", p.exportDir, ephemeral, LabelEphemeral)
+	}
+	return newCheck(name, CheckFatal, "%s is on %s, PVs would be lost with the pod; mount persistent storage there or set allow-ephemeral", p.exportDir, ephemeral)
+}
+
+func (p *nfsProvisioner) checkConfig() Check {
+	const name = "exporter config"
+	config := p.exporter.GetConfig()
+	if _, err := ioutil.ReadFile(config); err != nil {
+		return newCheck(name, CheckFatal, "%v", err)
+	}
+	// Open it the way addToFile does, without writing anything
+	file, err := os.OpenFile(config, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return newCheck(name, CheckFatal, "%s is not writable: %v", config, err)
+	}
+	file.Close()
+	if _, err := p.exporter.GetConfigExportIds(); err != nil {
+		return newCheck(name, CheckFatal, "error reading export IDs from %s: %v", config, err)
+	}
+	return newCheck(name, CheckOK, "%s is writable", config)
+}
+
+// checkServer checks that getServer succeeds by the provisioner's strategy. For
+// the auto strategy, it checks what getServer relies on: if the service env is
+// set, that the namespace env is too and the service has the NFS ports. It
+// warns if the server it returns is not stable. A managed service is only
+// created once the provisioner has started, so for the strategies that would
+// use it, it checks what ManageService needs instead.
+func (p *nfsProvisioner) checkServer() []Check {
+	const name = "server address"
+	strategy := p.server.Strategy
+	auto := strategy == "" || strategy == ServerAuto
+	if p.server.ManagedService && (strategy == ServerServiceDNS || auto && p.server.Address == "") {
+		return []Check{p.checkManagedService()}
+	}
+	if !auto {
+		server, err := p.getServer()
+		if err != nil {
+			return []Check{newCheck(name, CheckFatal, "%v", err)}
+		}
+		return []Check{newCheck(name, CheckOK, "using %s by strategy %s", server, strategy)}
+	}
+	if p.server.Address != "" {
+		return []Check{newCheck(name, CheckOK, "using %s", p.server.Address)}
+	}
+
+	serviceName := os.Getenv(p.serviceEnv)
+	if serviceName == "" {
+		server, err := p.getServer()
+		if err != nil {
+			return []Check{newCheck(name, CheckFatal, "%v", err)}
+		}
+		server = strings.TrimSpace(server)
+		if os.Getenv(p.nodeEnv) != "" {
+			return []Check{newCheck(name, CheckWarning, "using node name %s, which only works if the pod uses hostPort or hostNetwork", server)}
+		}
+		return []Check{newCheck(name, CheckWarning, "using pod IP %s, which changes if the pod is recreated; set %s to the name of a service for the pod", server, p.serviceEnv)}
+	}
+
+	namespace := os.Getenv(p.namespaceEnv)
+	if namespace == "" {
+		return []Check{newCheck(name, CheckFatal, "%s is set but %s isn't", p.serviceEnv, p.namespaceEnv)}
+	}
+	if p.client == nil {
+		return []Check{newCheck(name, CheckWarning, "can't check service %s/%s without the API server", namespace, serviceName)}
+	}
+	service, err := p.client.Core().Services(namespace).Get(serviceName)
+	if err != nil {
+		return []Check{newCheck(name, CheckFatal, "error getting service %s/%s: %v", namespace, serviceName, err)}
+	}
+	if missing := missingPorts(service); len(missing) != 0 {
+		ports := []string{}
+		for _, port := range missing {
+			ports = append(ports, fmt.Sprintf("%d/%s", port.Port, port.Protocol))
+		}
+		return []Check{newCheck(name, CheckFatal, "service %s/%s lacks ports %s", namespace, serviceName, strings.Join(ports, ", "))}
+	}
+	server, err := p.getServer()
+	if err != nil {
+		return []Check{newCheck(name, CheckFatal, "%v", err)}
+	}
+	return []Check{newCheck(name, CheckOK, "using cluster IP %s of service %s/%s", server, namespace, serviceName)}
+}
+
+func (p *nfsProvisioner) checkManagedService() Check {
+	const name = "server address"
+	serviceName := os.Getenv(p.serviceEnv)
+	namespace := os.Getenv(p.namespaceEnv)
+	if serviceName == "" || namespace == "" {
+		return newCheck(name, CheckFatal, "service env %s and namespace env %s must be set to manage a service", p.serviceEnv, p.namespaceEnv)
+	}
+	podIP, err := getPodIP(p.podIPEnv, p.server.IPFamily)
+	if err != nil {
+		return newCheck(name, CheckFatal, "%v", err)
+	}
+	return newCheck(name, CheckOK, "using service %s/%s, managed with endpoint %s once started", namespace, serviceName, podIP)
+}
+
+const (
+	// ganeshaDbusPolicy is where NFS Ganesha's D-Bus policy, which lets the
+	// provisioner call it, is installed.
+	ganeshaDbusPolicy = "/etc/dbus-1/system.d/org.ganesha.nfsd.conf"
+	// ganeshaDbusCheck is the name of the checks of calls to NFS Ganesha
+	ganeshaDbusCheck = "ganesha dbus"
+	// minGaneshaMajor and minGaneshaMinor are the oldest version of NFS
+	// Ganesha whose D-Bus export manager the ganesha exporter works with.
+	minGaneshaMajor = 2
+	minGaneshaMinor = 2
+)
+
+var ganeshaVersionRe = regexp.MustCompile(`V?([0-9]+)\.([0-9]+)`)
+
+var _ Preflighter = &ganeshaExporter{}
+var _ ServerPreflighter = &ganeshaExporter{}
+
+// Preflight checks that NFS Ganesha is new enough and that the D-Bus policy
+// allowing calls to it is installed.
+func (e *ganeshaExporter) Preflight() []Check {
+	checks := []Check{}
+
+	const version = "ganesha version"
+	out, err := exec.Command("ganesha.nfsd", "-v").CombinedOutput()
+	if err != nil {
+		checks = append(checks, newCheck(version, CheckWarning, "can't run ganesha.nfsd -v, NFS Ganesha may be running elsewhere: %v", err))
+	} else if match := ganeshaVersionRe.FindStringSubmatch(string(out)); match == nil {
+		checks = append(checks, newCheck(version, CheckWarning, "can't find a version in the output of ganesha.nfsd -v: %s", strings.TrimSpace(string(out))))
+	} else {
+		major, _ := strconv.Atoi(match[1])
+		minor, _ := strconv.Atoi(match[2])
+		if major < minGaneshaMajor || (major == minGaneshaMajor && minor < minGaneshaMinor) {
+			checks = append(checks, newCheck(version, CheckFatal, "%s.%s is older than %d.%d", match[1], match[2], minGaneshaMajor, minGaneshaMinor))
+		} else {
+			checks = append(checks, newCheck(version, CheckOK, "%s.%s", match[1], match[2]))
+		}
+	}
+
+	if _, err := os.Stat(ganeshaDbusPolicy); err != nil {
+		checks = append(checks, newCheck(ganeshaDbusCheck, CheckWarning, "policy %s not found, calls to NFS Ganesha may be denied", ganeshaDbusPolicy))
+	}
+
+	return checks
+}
+
+// PreflightServer checks that the export manager of the running NFS Ganesha can
+// be called over D-Bus.
+func (e *ganeshaExporter) PreflightServer() []Check {
+	if _, err := e.LiveExports(); err != nil {
+		return []Check{newCheck(ganeshaDbusCheck, CheckFatal, "%v", err)}
+	}
+	return []Check{newCheck(ganeshaDbusCheck, CheckOK, "export manager is reachable")}
+}
+
+var _ Preflighter = &kernelExporter{}
+
+// Preflight checks that exportfs is installed.
+func (e *kernelExporter) Preflight() []Check {
+	if _, err := exec.LookPath("exportfs"); err != nil {
+		return []Check{newCheck("exportfs", CheckFatal, "%v", err)}
+	}
+	return []Check{newCheck("exportfs", CheckOK, "found")}
+}
+
+// Preflight runs the preflight checks of a provisioner of the manager's export
+// directory and exporter, with the given client, which may be nil, way of
+// choosing the NFS server address and whether ephemeral storage is allowed,
+// including its checks of the running NFS server.
+func (m *ExportManager) Preflight(client kubernetes.Interface, server ServerAddress, allowEphemeral bool) []Check {
+	p := newNFSProvisionerInternal(m.p.exportDir, client, m.p.exporter)
+	p.server = server
+	p.allowEphemeral = allowEphemeral
+	return append(p.Preflight(), p.PreflightServer()...)
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+func TestPreflight(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+	config := tmpDir + "/exports"
+	if err := ioutil.WriteFile(config, []byte{}, 0600); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	if err := ioutil.WriteFile(tmpDir+"/file", []byte{}, 0600); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	mountsDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(mountsDir)
+	persistent := writeMountInfo(t, mountsDir+"/persistent", "/", "ext4")
+	ephemeral := writeMountInfo(t, mountsDir+"/ephemeral", tmpDir, "tmpfs")
+
+	nfsPorts := []v1.ServicePort{{Port: 2049}, {Port: 20048}, {Port: 111}, {Port: 111, Protocol: v1.ProtocolUDP}}
+	tests := []struct {
+		name             string
+		exportDir        string
+		config           string
+		mountInfo        string
+		allowEphemeral   bool
+		serverAddress    string
+		strategy         string
+		managedService   bool
+		objs             []runtime.Object
+		podIP            string
+		service          string
+		namespace        string
+		expectedStatuses []CheckStatus
+	}{
+		{
+			name:             "fixed server address",
+			exportDir:        tmpDir + "/",
+			config:           config,
+			serverAddress:    "nfs.example.com",
+			expectedStatuses: []CheckStatus{CheckOK, CheckOK, CheckOK, CheckOK},
+		},
+		{
+			name:             "ephemeral export dir",
+			exportDir:        tmpDir + "/",
+			config:           config,
+			mountInfo:        ephemeral,
+			serverAddress:    "nfs.example.com",
+			expectedStatuses: []CheckStatus{CheckOK, CheckFatal, CheckOK, CheckOK},
+		},
+		{
+			name:             "ephemeral export dir allowed",
+			exportDir:        tmpDir + "/",
+			config:           config,
+			mountInfo:        ephemeral,
+			allowEphemeral:   true,
+			serverAddress:    "nfs.example.com",
+			expectedStatuses: []CheckStatus{CheckOK, CheckWarning, CheckOK, CheckOK},
+		},
+		{
+			name:             "missing export dir",
+			exportDir:        tmpDir + "/missing/",
+			config:           config,
+			serverAddress:    "nfs.example.com",
+			expectedStatuses: []CheckStatus{CheckFatal, CheckOK, CheckOK},
+		},
+		{
+			name:             "export dir is a file",
+			exportDir:        tmpDir + "/file",
+			config:           config,
+			serverAddress:    "nfs.example.com",
+			expectedStatuses: []CheckStatus{CheckFatal, CheckOK, CheckOK},
+		},
+		{
+			name:             "missing config",
+			exportDir:        tmpDir + "/",
+			config:           tmpDir + "/missing",
+			serverAddress:    "nfs.example.com",
+			expectedStatuses: []CheckStatus{CheckOK, CheckOK, CheckFatal, CheckOK},
+		},
+		{
+			name:             "pod IP",
+			exportDir:        tmpDir + "/",
+			config:           config,
+			podIP:            "2.2.2.2",
+			expectedStatuses: []CheckStatus{CheckOK, CheckOK, CheckOK, CheckWarning},
+		},
+		{
+			name:      "valid service",
+			exportDir: tmpDir + "/",
+			config:    config,
+			objs: []runtime.Object{
+				newServiceWithPorts("foo", "1.1.1.1", nfsPorts),
+				newEndpoints("foo", []string{"2.2.2.2"}, []endpointPort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:            "2.2.2.2",
+			service:          "foo",
+			namespace:        "default",
+			expectedStatuses: []CheckStatus{CheckOK, CheckOK, CheckOK, CheckOK},
+		},
+		{
+			name:      "service lacks ports",
+			exportDir: tmpDir + "/",
+			config:    config,
+			objs: []runtime.Object{
+				newServiceWithPorts("foo", "1.1.1.1", nfsPorts[:3]),
+				newEndpoints("foo", []string{"2.2.2.2"}, []endpointPort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:            "2.2.2.2",
+			service:          "foo",
+			namespace:        "default",
+			expectedStatuses: []CheckStatus{CheckOK, CheckOK, CheckOK, CheckFatal},
+		},
+		{
+			name:             "service missing",
+			exportDir:        tmpDir + "/",
+			config:           config,
+			podIP:            "2.2.2.2",
+			service:          "foo",
+			namespace:        "default",
+			expectedStatuses: []CheckStatus{CheckOK, CheckOK, CheckOK, CheckFatal},
+		},
+		{
+			name:             "service without namespace",
+			exportDir:        tmpDir + "/",
+			config:           config,
+			podIP:            "2.2.2.2",
+			service:          "foo",
+			expectedStatuses: []CheckStatus{CheckOK, CheckOK, CheckOK, CheckFatal},
+		},
+		{
+			name:             "managed service missing",
+			exportDir:        tmpDir + "/",
+			config:           config,
+			managedService:   true,
+			podIP:            "2.2.2.2",
+			service:          "foo",
+			namespace:        "default",
+			expectedStatuses: []CheckStatus{CheckOK, CheckOK, CheckOK, CheckOK},
+		},
+		{
+			name:             "managed service missing by service-dns",
+			exportDir:        tmpDir + "/",
+			config:           config,
+			strategy:         ServerServiceDNS,
+			managedService:   true,
+			podIP:            "2.2.2.2",
+			service:          "foo",
+			namespace:        "default",
+			expectedStatuses: []CheckStatus{CheckOK, CheckOK, CheckOK, CheckOK},
+		},
+		{
+			name:             "managed service without namespace",
+			exportDir:        tmpDir + "/",
+			config:           config,
+			managedService:   true,
+			podIP:            "2.2.2.2",
+			service:          "foo",
+			expectedStatuses: []CheckStatus{CheckOK, CheckOK, CheckOK, CheckFatal},
+		},
+	}
+	for _, test := range tests {
+		if test.podIP != "" {
+			os.Setenv(podIPEnv, test.podIP)
+		}
+		if test.service != "" {
+			os.Setenv(serviceEnv, test.service)
+		}
+		if test.namespace != "" {
+			os.Setenv(namespaceEnv, test.namespace)
+		}
+
+		client := fake.NewSimpleClientset(test.objs...)
+		p := newNFSProvisionerInternal(test.exportDir, client, &testExporter{config: test.config})
+		p.server = ServerAddress{Strategy: test.strategy, Address: test.serverAddress, ManagedService: test.managedService}
+		p.mountInfo = persistent
+		if test.mountInfo != "" {
+			p.mountInfo = test.mountInfo
+		}
+		p.allowEphemeral = test.allowEphemeral
+
+		checks := p.Preflight()
+		statuses := []CheckStatus{}
+		for _, check := range checks {
+			statuses = append(statuses, check.Status)
+		}
+		if !reflect.DeepEqual(test.expectedStatuses, statuses) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected statuses %v but got %+v", test.expectedStatuses, checks)
+		}
+		os.Unsetenv(podIPEnv)
+		os.Unsetenv(serviceEnv)
+		os.Unsetenv(namespaceEnv)
+	}
+
+	if files, _ := ioutil.ReadDir(tmpDir); len(files) != 2 {
+		t.Errorf("expected preflight checks to leave only the config and file in the export dir but got %d files", len(files))
+	}
+}
+
+func newServiceWithPorts(name, clusterIP string, ports []v1.ServicePort) *v1.Service {
+	service := newService(name, clusterIP)
+	service.Spec.Ports = ports
+	return service
+}
+
+// writeMountInfo writes a mountinfo file to the given path in which the given
+// directory is mounted with the given filesystem type on top of an ext4 root,
+// and returns the path.
+func writeMountInfo(t *testing.T, path, dir, fsType string) string {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("error resolving %s: %v", dir, err)
+	}
+	data := "1 0 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n" +
+		"2 1 0:2 / " + resolved + " rw,relatime shared:1 - " + fsType + " none rw\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("error writing mountinfo: %v", err)
+	}
+	return path
+}
+
+func TestPreflightServer(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter, err := newGaneshaExporter(tmpDir + "/vfs.conf")
+	if err != nil {
+		t.Fatalf("error creating ganesha exporter: %v", err)
+	}
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir, client, exporter)
+
+	// Whether NFS Ganesha is reachable depends on where the test runs, only
+	// check which of the checks call it
+	for _, check := range p.Preflight() {
+		if check.Name == ganeshaDbusCheck && check.Status != CheckWarning {
+			t.Errorf("expected Preflight to leave calling NFS Ganesha to PreflightServer but got %+v", check)
+		}
+	}
+	checks := p.PreflightServer()
+	if len(checks) != 1 || checks[0].Name != ganeshaDbusCheck {
+		t.Errorf("expected PreflightServer to call NFS Ganesha but got %+v", checks)
+	}
+
+	p = newNFSProvisionerInternal(tmpDir, client, &testExporter{})
+	if checks := p.PreflightServer(); len(checks) != 0 {
+		t.Errorf("expected no server checks for an exporter without any but got %+v", checks)
+	}
+}
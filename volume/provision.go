@@ -20,18 +20,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"reflect"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 
 	"github.com/golang/glog"
-	"github.com/guelfey/go.dbus"
 	"github.com/wongma7/nfs-provisioner/controller"
+	"golang.org/x/net/context"
 	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 )
@@ -54,50 +54,124 @@ const (
 	annCreatedBy = "kubernetes.io/createdby"
 	createdBy    = "nfs-dynamic-provisioner"
 
+	// A PV annotation for the options the kubelet should mount the volume
+	// with. The vendored API types have no pv.Spec.MountOptions, so the options
+	// go here and the controller moves them to the field on 1.8 and later
+	// clusters.
+	annMountOptions = "volume.beta.kubernetes.io/mount-options"
+
 	podIPEnv     = "POD_IP"
 	serviceEnv   = "SERVICE_NAME"
 	namespaceEnv = "POD_NAMESPACE"
 	nodeEnv      = "NODE_NAME"
 )
 
-func NewNFSProvisioner(exportDir string, client kubernetes.Interface, useGanesha bool, ganeshaConfig string) controller.Provisioner {
-	var exporter exporter
-	if useGanesha {
-		exporter = &ganeshaExporter{ganeshaConfig: ganeshaConfig}
-	} else {
-		exporter = &kernelExporter{}
+// NewNFSProvisioner creates a provisioner of volumes in the given exportDir,
+// exported by the given exporter, e.g. one created by NewExporter. The given
+// server says how to choose the NFS server put in provisioned PVs whose
+// StorageClasses don't choose one. If allowEphemeral is true, the exportDir
+// may be on storage that doesn't outlive the pod, and PVs provisioned from it
+// are labeled LabelEphemeral. The given default parameters
+// apply to every volume whose StorageClass doesn't set them. Provisioners whose
+// exporters have the same config file share exportIds, so one process can serve
+// several provisioners from the same NFS server. It returns an error if the
+// default parameters are invalid or if the exportDir is on ephemeral storage
+// and that isn't allowed.
+func NewNFSProvisioner(exportDir string, client kubernetes.Interface, exporter Exporter, server ServerAddress, allowEphemeral bool, defaultParameters map[string]string) (controller.Provisioner, error) {
+	provisioner := newNFSProvisionerInternal(exportDir, client, exporter)
+	provisioner.server = server
+	provisioner.allowEphemeral = allowEphemeral
+	ephemeral, err := ephemeralStorage(provisioner.mountInfo, exportDir)
+	if err != nil {
+		glog.Errorf("Error checking whether exportDir %s is ephemeral: %v", exportDir, err)
+	} else if ephemeral != "" && !allowEphemeral {
+		return nil, fmt.Errorf("exportDir %s is on %s, its volumes would be lost with the pod; mount persistent storage there or set allow-ephemeral", exportDir, ephemeral)
+	} else if ephemeral != "" {
+		glog.Warningf("exportDir %s is on %s, its volumes will be lost with the pod", exportDir, ephemeral)
+		provisioner.ephemeral = true
 	}
-	return newNFSProvisionerInternal(exportDir, client, exporter)
+	if err := provisioner.SetDefaultParameters(defaultParameters); err != nil {
+		return nil, fmt.Errorf("invalid default parameters for exportDir %s: %v", exportDir, err)
+	}
+	return provisioner, nil
 }
 
-func newNFSProvisionerInternal(exportDir string, client kubernetes.Interface, exporter exporter) *nfsProvisioner {
-	if _, err := os.Stat(exportDir); os.IsNotExist(err) {
-		glog.Fatalf("exportDir %s does not exist!", exportDir)
+// SetDefaultParameters replaces the parameters that apply to every volume whose
+// StorageClass doesn't set them, e.g. when the configuration is reloaded, if
+// they are valid.
+func (p *nfsProvisioner) SetDefaultParameters(defaultParameters map[string]string) error {
+	params, err := parseParameters(defaultParameters)
+	if err != nil {
+		return err
+	}
+	if err := validateCapabilities(p.exporter.Capabilities(), params.mountOptions, false); err != nil {
+		return err
 	}
+	p.defaultParametersMutex.Lock()
+	defer p.defaultParametersMutex.Unlock()
+	p.defaultParameters = defaultParameters
+	return nil
+}
+
+func newNFSProvisionerInternal(exportDir string, client kubernetes.Interface, exporter Exporter) *nfsProvisioner {
 	if !strings.HasSuffix(exportDir, "/") {
 		exportDir = exportDir + "/"
 	}
+	state := getExportState(exporter)
 	provisioner := &nfsProvisioner{
-		exportDir:    exportDir,
-		client:       client,
-		exporter:     exporter,
-		mapMutex:     &sync.Mutex{},
-		fileMutex:    &sync.Mutex{},
-		podIPEnv:     podIPEnv,
-		serviceEnv:   serviceEnv,
-		namespaceEnv: namespaceEnv,
-		nodeEnv:      nodeEnv,
-	}
-
-	var err error
-	provisioner.exportIds, err = provisioner.exporter.GetConfigExportIds()
-	if err != nil {
-		glog.Errorf("error while populating exportIds map, there may be errors exporting later if exportIds are reused: %v", err)
+		exportDir:              exportDir,
+		client:                 client,
+		exporter:               exporter,
+		exportIds:              state.exportIds,
+		mapMutex:               state.mapMutex,
+		fileMutex:              state.fileMutex,
+		dirMutex:               &sync.Mutex{},
+		defaultParametersMutex: &sync.Mutex{},
+		mountInfo:              mountInfoFile,
+		podIPEnv:               podIPEnv,
+		serviceEnv:             serviceEnv,
+		namespaceEnv:           namespaceEnv,
+		nodeEnv:                nodeEnv,
 	}
 
 	return provisioner
 }
 
+// exportState is the state shared by all the provisioners whose exporters
+// export through the same config file, i.e. the same NFS server.
+type exportState struct {
+	exportIds map[uint16]bool
+	mapMutex  *sync.Mutex
+	fileMutex *sync.Mutex
+}
+
+var (
+	exportStates      = make(map[string]*exportState)
+	exportStatesMutex = &sync.Mutex{}
+)
+
+// getExportState returns the state of the config file of the given exporter,
+// populating its exportIds from the file the first time.
+func getExportState(exporter Exporter) *exportState {
+	exportStatesMutex.Lock()
+	defer exportStatesMutex.Unlock()
+
+	if state, ok := exportStates[exporter.GetConfig()]; ok {
+		return state
+	}
+	exportIds, err := exporter.GetConfigExportIds()
+	if err != nil {
+		glog.Errorf("error while populating exportIds map, there may be errors exporting later if exportIds are reused: %v", err)
+	}
+	state := &exportState{
+		exportIds: exportIds,
+		mapMutex:  &sync.Mutex{},
+		fileMutex: &sync.Mutex{},
+	}
+	exportStates[exporter.GetConfig()] = state
+	return state
+}
+
 type nfsProvisioner struct {
 	// The directory to create PV-backing directories in
 	exportDir string
@@ -107,19 +181,40 @@ type nfsProvisioner struct {
 	client kubernetes.Interface
 
 	// The exporter to use for exporting NFS shares
-	exporter exporter
+	exporter Exporter
 
 	// Map to track used exportIds. Each ganesha export needs a unique Export_Id,
 	// and both ganesha and kernel exports need a unique fsid. So we simply assign
-	// each export an exportId and use it as both Export_id and fsid.
+	// each export an exportId and use it as both Export_id and fsid. Shared with
+	// the other provisioners that use the same config file.
 	exportIds map[uint16]bool
 
 	// Lock for accessing exportIds
 	mapMutex *sync.Mutex
 
-	// Lock for writing to the ganesha config or /etc/exports file
+	// Lock for writing to the ganesha config or /etc/exports file, shared like
+	// exportIds
 	fileMutex *sync.Mutex
 
+	// Lock for creating and removing the parents of PV-backing directories
+	dirMutex *sync.Mutex
+
+	// Parameters that apply to every volume whose StorageClass doesn't set
+	// them, and the lock for replacing them
+	defaultParameters      map[string]string
+	defaultParametersMutex *sync.Mutex
+
+	// How to choose the NFS server to put in the PVs of StorageClasses that
+	// don't choose
+	server ServerAddress
+
+	// The mountinfo file to look up the storage of exportDir in, whether
+	// exportDir may be on storage that doesn't outlive the pod, and whether it
+	// is, in which case provisioned PVs are labeled LabelEphemeral
+	mountInfo      string
+	allowEphemeral bool
+	ephemeral      bool
+
 	// Environment variables the provisioner pod needs valid values for in order to
 	// put a service cluster IP as the server of provisioned NFS PVs, passed in
 	// via downward API. If serviceEnv is set, namespaceEnv must be too.
@@ -130,27 +225,80 @@ type nfsProvisioner struct {
 }
 
 var _ controller.Provisioner = &nfsProvisioner{}
+var _ controller.Recycler = &nfsProvisioner{}
+var _ controller.DryRunner = &nfsProvisioner{}
 
 // Provision creates a volume i.e. the storage asset and returns a PV object for
 // the volume.
-func (p *nfsProvisioner) Provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
-	server, path, supGroup, block, exportId, err := p.createVolume(options)
+func (p *nfsProvisioner) Provision(ctx context.Context, options controller.VolumeOptions) (*v1.PersistentVolume, error) {
+	volume, err := p.createVolume(ctx, options)
 	if err != nil {
 		return nil, err
 	}
 
+	return newPersistentVolume(options, volume), nil
+}
+
+// DryRunProvision validates the options for a volume and renders its export
+// block like Provision would, but only logs the directory and export it would
+// create. It returns the PV object Provision would.
+func (p *nfsProvisioner) DryRunProvision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
+	config, err := p.validateOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("error validating options for volume: %v", err)
+	}
+
+	server, err := p.getServerWith(config.serverAddressStrategy, config.serverAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error getting NFS server IP for volume: %v", err)
+	}
+
+	path := fmt.Sprintf(p.exportDir+"%s", config.directory)
+	exists, err := directoryExists(p.exportDir, config.directory)
+	if err != nil {
+		return nil, fmt.Errorf("error creating directory for volume: %v", err)
+	} else if exists {
+		return nil, fmt.Errorf("error creating directory for volume: the path already exists")
+	}
+
+	exportId := p.nextExportId()
+	block := p.exporter.CreateBlock(strconv.FormatUint(uint64(exportId), 10), path, config.readOnly, config.clients)
+	glog.Infof("dry run: would create directory %s with gid %s and add export block to %s: %s", path, config.gid, p.exporter.GetConfig(), block)
+
+	return newPersistentVolume(options, volume{
+		server:       server,
+		path:         path,
+		supGroup:     0,
+		block:        block,
+		exportId:     exportId,
+		mountOptions: config.mountOptions,
+		readOnly:     config.readOnly,
+		ephemeral:    p.ephemeral,
+	}), nil
+}
+
+// newPersistentVolume returns the PV object for the given created volume.
+func newPersistentVolume(options controller.VolumeOptions, volume volume) *v1.PersistentVolume {
 	annotations := make(map[string]string)
 	annotations[annCreatedBy] = createdBy
-	annotations[annExportId] = strconv.FormatUint(uint64(exportId), 10)
-	annotations[annBlock] = block
-	if supGroup != 0 {
-		annotations[VolumeGidAnnotationKey] = strconv.FormatUint(supGroup, 10)
+	annotations[annExportId] = strconv.FormatUint(uint64(volume.exportId), 10)
+	annotations[annBlock] = volume.block
+	if volume.supGroup != 0 {
+		annotations[VolumeGidAnnotationKey] = strconv.FormatUint(volume.supGroup, 10)
+	}
+	if volume.mountOptions != "" {
+		annotations[annMountOptions] = volume.mountOptions
+	}
+
+	labels := map[string]string{}
+	if volume.ephemeral {
+		labels[LabelEphemeral] = "true"
 	}
 
 	pv := &v1.PersistentVolume{
 		ObjectMeta: v1.ObjectMeta{
 			Name:        options.PVName,
-			Labels:      map[string]string{},
+			Labels:      labels,
 			Annotations: annotations,
 		},
 		Spec: v1.PersistentVolumeSpec{
@@ -161,98 +309,390 @@ func (p *nfsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
 				NFS: &v1.NFSVolumeSource{
-					Server:   server,
-					Path:     path,
-					ReadOnly: false,
+					Server:   volume.server,
+					Path:     volume.path,
+					ReadOnly: volume.readOnly,
 				},
 			},
 		},
 	}
 
-	return pv, nil
+	return pv
+}
+
+// volume is the result of creating a volume i.e. the storage asset, everything
+// Provision needs to know to create a PV object for it.
+type volume struct {
+	// The server IP to put in the PV
+	server string
+	// The path of the volume's directory
+	path string
+	// A zero/non-zero supplemental group
+	supGroup uint64
+	// The block added to either the ganesha config or /etc/exports
+	block string
+	// The exportId of the volume's export
+	exportId uint16
+	// The mount options to put in the PV, if any
+	mountOptions string
+	// Whether the volume is exported read-only
+	readOnly bool
+	// Whether the volume is lost with the pod, see LabelEphemeral
+	ephemeral bool
 }
 
 // createVolume creates a volume i.e. the storage asset. It creates a unique
-// directory under /export and exports it. Returns the server IP, the path, a
-// zero/non-zero supplemental group, the block it added to either the ganesha
-// config or /etc/exports, and the exportId
-func (p *nfsProvisioner) createVolume(options controller.VolumeOptions) (string, string, uint64, string, uint16, error) {
-	gid, err := p.validateOptions(options)
+// directory under /export and exports it. If ctx is done before the volume is
+// exported, it removes the directory it may have created and returns the
+// context's error.
+func (p *nfsProvisioner) createVolume(ctx context.Context, options controller.VolumeOptions) (volume, error) {
+	config, err := p.validateOptions(options)
 	if err != nil {
-		return "", "", 0, "", 0, fmt.Errorf("error validating options for volume: %v", err)
+		return volume{}, fmt.Errorf("error validating options for volume: %v", err)
 	}
 
-	server, err := p.getServer()
+	server, err := p.getServerWith(config.serverAddressStrategy, config.serverAddress)
 	if err != nil {
-		return "", "", 0, "", 0, fmt.Errorf("error getting NFS server IP for volume: %v", err)
+		return volume{}, fmt.Errorf("error getting NFS server IP for volume: %v", err)
 	}
 
-	path := fmt.Sprintf(p.exportDir+"%s", options.PVName)
+	path := fmt.Sprintf(p.exportDir+"%s", config.directory)
 
-	err = p.createDirectory(options.PVName, gid)
+	if err = ctx.Err(); err != nil {
+		return volume{}, fmt.Errorf("error creating directory for volume: %v", err)
+	}
+	err = p.createDirectory(config.directory, config.gid)
 	if err != nil {
-		return "", "", 0, "", 0, fmt.Errorf("error creating directory for volume: %v", err)
+		return volume{}, fmt.Errorf("error creating directory for volume: %v", err)
 	}
 
-	block, exportId, err := p.createExport(options.PVName)
-	if err != nil {
-		os.RemoveAll(path)
-		return "", "", 0, "", 0, fmt.Errorf("error creating export for volume: %v", err)
+	if err = ctx.Err(); err != nil {
+		p.removeDirectory(config.directory)
+		return volume{}, fmt.Errorf("error creating export for volume: %v", err)
 	}
 
-	return server, path, 0, block, exportId, nil
+	block, exportId, err := p.createExport(config.directory, config.readOnly, config.clients)
+	if err != nil {
+		p.removeDirectory(config.directory)
+		return volume{}, fmt.Errorf("error creating export for volume: %v", err)
+	}
+
+	return volume{
+		server:       server,
+		path:         path,
+		supGroup:     0,
+		block:        block,
+		exportId:     exportId,
+		mountOptions: config.mountOptions,
+		readOnly:     config.readOnly,
+		ephemeral:    p.ephemeral,
+	}, nil
 }
 
-func (p *nfsProvisioner) validateOptions(options controller.VolumeOptions) (string, error) {
-	gid := "none"
-	for k, v := range options.Parameters {
-		switch strings.ToLower(k) {
-		case "gid":
-			if strings.ToLower(v) == "none" {
-				gid = "none"
-			} else if i, err := strconv.ParseUint(v, 10, 64); err == nil && i != 0 {
-				gid = v
-			} else {
-				return "", fmt.Errorf("invalid value for parameter gid: %v. valid values are: 'none' or a non-zero integer", v)
-			}
-		default:
-			return "", fmt.Errorf("invalid parameter: %q", k)
-		}
+// volumeConfig is the result of validating the options for a volume.
+type volumeConfig struct {
+	// The supplemental group to own the volume's directory, or "none"
+	gid string
+	// The volume's directory, relative to exportDir
+	directory string
+	// The comma-separated mount options to put in the PV
+	mountOptions string
+	// Whether to export the volume read-only, according to the access modes
+	readOnly bool
+	// The strategy and fixed address for choosing the server to put in the
+	// PV, or empty for the provisioner's
+	serverAddressStrategy string
+	serverAddress         string
+	// The clients to restrict the export to, or empty for every client
+	clients []string
+}
+
+func (p *nfsProvisioner) validateOptions(options controller.VolumeOptions) (volumeConfig, error) {
+	params, err := parseParameters(p.withDefaults(options.Parameters))
+	if err != nil {
+		return volumeConfig{}, err
+	}
+
+	directory, err := getDirectory(params.pathPattern, options)
+	if err != nil {
+		return volumeConfig{}, fmt.Errorf("invalid value for parameter pathPattern: %v", err)
+	}
+	// A recycled volume is bound to other claims but would keep the directory
+	// named after the first
+	if options.Recycle && params.pathPattern != defaultPathPattern {
+		return volumeConfig{}, fmt.Errorf("invalid value for parameter pathPattern: volumes with the Recycle reclaim policy must use the default %q", defaultPathPattern)
 	}
 
 	// TODO implement options.ProvisionerSelector parsing
 	// pv.Labels MUST be set to match claim.spec.selector
 	// gid selector? with or without pv annotation?
 	if options.Selector != nil {
-		return "", fmt.Errorf("claim.Spec.Selector is not supported")
+		return volumeConfig{}, fmt.Errorf("claim.Spec.Selector is not supported")
 	}
 
 	var stat syscall.Statfs_t
 	if err := syscall.Statfs(p.exportDir, &stat); err != nil {
-		return "", fmt.Errorf("error calling statfs on %v: %v", p.exportDir, err)
+		return volumeConfig{}, fmt.Errorf("error calling statfs on %v: %v", p.exportDir, err)
 	}
 	capacity := options.Capacity.Value()
 	available := int64(stat.Bavail) * stat.Bsize
 	if capacity > available {
-		return "", fmt.Errorf("insufficient available space %v bytes to satisfy claim for %v bytes", available, capacity)
+		return volumeConfig{}, fmt.Errorf("insufficient available space %v bytes to satisfy claim for %v bytes", available, capacity)
+	}
+
+	readOnly := isReadOnly(options.AccessModes)
+	if err := validateCapabilities(p.exporter.Capabilities(), params.mountOptions, readOnly); err != nil {
+		return volumeConfig{}, err
 	}
 
-	return gid, nil
+	return volumeConfig{
+		gid:                   params.gid,
+		directory:             directory,
+		mountOptions:          params.mountOptions,
+		readOnly:              readOnly,
+		serverAddressStrategy: params.serverAddressStrategy,
+		serverAddress:         params.serverAddress,
+		clients:               params.clients,
+	}, nil
 }
 
-// getServer gets the server IP to put in a provisioned PV's spec.
-func (p *nfsProvisioner) getServer() (string, error) {
-	// Use either `hostname -i` or podIPEnv as the fallback server
-	var fallbackServer string
-	podIP := os.Getenv(p.podIPEnv)
-	if podIP == "" {
-		out, err := exec.Command("hostname", "-i").Output()
-		if err != nil {
-			return "", fmt.Errorf("hostname -i failed with error: %v, output: %s", err, out)
+// validateCapabilities checks that an exporter with the given capabilities can
+// export a volume with the given mount options, read-only if readOnly is true.
+func validateCapabilities(capabilities ExporterCapabilities, mountOptions string, readOnly bool) error {
+	if readOnly && !capabilities.ReadOnly {
+		return fmt.Errorf("the exporter can't export volumes read-only, which claims that only request ReadOnlyMany need")
+	}
+	for _, option := range strings.Split(mountOptions, ",") {
+		if strings.HasPrefix(option, "sec=krb5") && !capabilities.Kerberos {
+			return fmt.Errorf("invalid value for parameter mountOptions: the exporter doesn't support %s", option)
+		}
+	}
+	return nil
+}
+
+// parameters are the parsed StorageClass parameters of a volume.
+type parameters struct {
+	gid                   string
+	pathPattern           string
+	mountOptions          string
+	serverAddressStrategy string
+	serverAddress         string
+	clients               []string
+}
+
+// parseParameters parses the given StorageClass parameters.
+func parseParameters(params map[string]string) (parameters, error) {
+	parsed := parameters{gid: "none", pathPattern: defaultPathPattern}
+	for k, v := range params {
+		switch strings.ToLower(k) {
+		case "gid":
+			if strings.ToLower(v) == "none" {
+				parsed.gid = "none"
+			} else if i, err := strconv.ParseUint(v, 10, 64); err == nil && i != 0 {
+				parsed.gid = v
+			} else {
+				return parameters{}, fmt.Errorf("invalid value for parameter gid: %v. valid values are: 'none' or a non-zero integer", v)
+			}
+		case "pathpattern":
+			parsed.pathPattern = v
+		case "mountoptions":
+			mountOptions, err := validateMountOptions(v)
+			if err != nil {
+				return parameters{}, fmt.Errorf("invalid value for parameter mountOptions: %v", err)
+			}
+			parsed.mountOptions = mountOptions
+		case "serveraddressstrategy":
+			if !isServerStrategy(v) {
+				return parameters{}, fmt.Errorf("invalid value for parameter serverAddressStrategy: %v. valid values are: %s", v, strings.Join(ServerStrategies(), ", "))
+			}
+			parsed.serverAddressStrategy = v
+		case "serveraddress":
+			parsed.serverAddress = v
+		case "clients":
+			clients, err := parseClients(v)
+			if err != nil {
+				return parameters{}, fmt.Errorf("invalid value for parameter clients: %v", err)
+			}
+			parsed.clients = clients
+		default:
+			return parameters{}, fmt.Errorf("invalid parameter: %q", k)
+		}
+	}
+	// An address alone means a fixed one
+	if parsed.serverAddress != "" {
+		if parsed.serverAddressStrategy == "" {
+			parsed.serverAddressStrategy = ServerFixed
+		} else if parsed.serverAddressStrategy != ServerFixed {
+			return parameters{}, fmt.Errorf("invalid parameter serverAddress: only valid with serverAddressStrategy %s", ServerFixed)
+		}
+	}
+	return parsed, nil
+}
+
+// withDefaults returns the given parameters plus the default parameters they
+// don't set. Parameter names are case-insensitive.
+func (p *nfsProvisioner) withDefaults(parameters map[string]string) map[string]string {
+	p.defaultParametersMutex.Lock()
+	defer p.defaultParametersMutex.Unlock()
+	merged := make(map[string]string)
+	for k, v := range p.defaultParameters {
+		merged[k] = v
+	}
+	for k, v := range parameters {
+		for d := range p.defaultParameters {
+			if strings.EqualFold(d, k) {
+				delete(merged, d)
+			}
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// isReadOnly returns whether a volume with the given access modes should be
+// exported read-only: only if every mode is ReadOnlyMany. If any mode lets a
+// node mount the volume read-write, the export must be read-write too and it's
+// up to pods to mount it read-only where they should.
+func isReadOnly(accessModes []v1.PersistentVolumeAccessMode) bool {
+	if len(accessModes) == 0 {
+		return false
+	}
+	for _, mode := range accessModes {
+		if mode != v1.ReadOnlyMany {
+			return false
+		}
+	}
+	return true
+}
+
+// mountOptionKind is the kind of value an NFS client mount option takes.
+type mountOptionKind int
+
+const (
+	// The option takes no value, like hard
+	noValueOption mountOptionKind = iota
+	// The option takes a non-negative integer, like timeo=600
+	integerOption
+	// The option takes one of a list of values, like proto=tcp
+	enumOption
+)
+
+// mountOption describes the value an NFS client mount option takes.
+type mountOption struct {
+	kind mountOptionKind
+	// The valid values of an enumOption
+	values []string
+}
+
+var (
+	noValue      = mountOption{kind: noValueOption}
+	integerValue = mountOption{kind: integerOption}
+)
+
+// oneOf returns a mountOption that takes one of the given values.
+func oneOf(values ...string) mountOption {
+	return mountOption{kind: enumOption, values: values}
+}
+
+// nfsMountOptions maps the names of the NFS client mount options a
+// mountOptions parameter may contain to the values they take.
+var nfsMountOptions = map[string]mountOption{
+	"nfsvers":      oneOf("3", "4", "4.0", "4.1", "4.2"),
+	"vers":         oneOf("3", "4", "4.0", "4.1", "4.2"),
+	"minorversion": integerValue,
+	"hard":         noValue,
+	"soft":         noValue,
+	"intr":         noValue,
+	"nointr":       noValue,
+	"timeo":        integerValue,
+	"retrans":      integerValue,
+	"retry":        integerValue,
+	"rsize":        integerValue,
+	"wsize":        integerValue,
+	"proto":        oneOf("tcp", "udp", "tcp6", "udp6", "rdma"),
+	"port":         integerValue,
+	"ac":           noValue,
+	"noac":         noValue,
+	"actimeo":      integerValue,
+	"acregmin":     integerValue,
+	"acregmax":     integerValue,
+	"acdirmin":     integerValue,
+	"acdirmax":     integerValue,
+	"cto":          noValue,
+	"nocto":        noValue,
+	"lookupcache":  oneOf("all", "none", "pos", "positive"),
+	"sec":          oneOf("sys", "none", "krb5", "krb5i", "krb5p"),
+	"lock":         noValue,
+	"nolock":       noValue,
+	"local_lock":   oneOf("all", "flock", "posix", "none"),
+	"sharecache":   noValue,
+	"nosharecache": noValue,
+	"resvport":     noValue,
+	"noresvport":   noValue,
+	"rdirplus":     noValue,
+	"nordirplus":   noValue,
+	"fsc":          noValue,
+	"nofsc":        noValue,
+	"atime":        noValue,
+	"noatime":      noValue,
+	"diratime":     noValue,
+	"nodiratime":   noValue,
+	"relatime":     noValue,
+	"norelatime":   noValue,
+}
+
+// validateMountOptions checks that the given comma-separated list of mount
+// options only contains known NFS client options with valid values. It returns
+// the list with whitespace around each option trimmed.
+func validateMountOptions(options string) (string, error) {
+	valid := []string{}
+	for _, option := range strings.Split(options, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		name, value, hasValue := option, "", false
+		if i := strings.Index(option, "="); i != -1 {
+			name, value, hasValue = option[:i], option[i+1:], true
+		}
+		known, ok := nfsMountOptions[name]
+		if !ok {
+			return "", fmt.Errorf("unknown NFS mount option %q", name)
 		}
-		fallbackServer = string(out)
-	} else {
-		fallbackServer = podIP
+		switch {
+		case known.kind == noValueOption && hasValue:
+			return "", fmt.Errorf("NFS mount option %q doesn't take a value", name)
+		case known.kind != noValueOption && !hasValue:
+			return "", fmt.Errorf("NFS mount option %q requires a value", name)
+		case known.kind == integerOption:
+			if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+				return "", fmt.Errorf("invalid value %q for NFS mount option %q: must be a non-negative integer", value, name)
+			}
+		case known.kind == enumOption:
+			found := false
+			for _, v := range known.values {
+				if value == v {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return "", fmt.Errorf("invalid value %q for NFS mount option %q: valid values are %v", value, name, known.values)
+			}
+		}
+		valid = append(valid, option)
+	}
+
+	return strings.Join(valid, ","), nil
+}
+
+// getAutoServer gets the server IP to put in a provisioned PV's spec from the
+// environment: the service's cluster IP, the node name or the pod IP.
+func (p *nfsProvisioner) getAutoServer() (string, error) {
+	// Use either `hostname -i` or podIPEnv as the fallback server
+	fallbackServer, err := getPodIP(p.podIPEnv, p.server.IPFamily)
+	if err != nil {
+		return "", err
 	}
 
 	// Try to use the service's cluster IP as the server if serviceEnv is
@@ -271,13 +711,38 @@ func (p *nfsProvisioner) getServer() (string, error) {
 
 	// From this point forward, rather than fallback & provision non-persistent
 	// where persistent is expected, just return an error.
+	service, err := p.getValidService()
+	if err != nil {
+		return "", err
+	}
+	if service.Spec.ClusterIP == v1.ClusterIPNone {
+		return "", fmt.Errorf("service %s=%s is valid but it doesn't have a cluster IP", p.serviceEnv, serviceName)
+	}
+	if ip := net.ParseIP(service.Spec.ClusterIP); ip == nil || !isFamily(ip, p.server.IPFamily) {
+		return "", fmt.Errorf("service %s=%s is valid but its cluster IP %s is not %s", p.serviceEnv, serviceName, service.Spec.ClusterIP, p.server.IPFamily)
+	}
+
+	return service.Spec.ClusterIP, nil
+}
+
+// getValidService gets the service named by serviceEnv and checks that this
+// pod is its one endpoint for the NFS ports.
+func (p *nfsProvisioner) getValidService() (*v1.Service, error) {
+	serviceName := os.Getenv(p.serviceEnv)
+	if serviceName == "" {
+		return nil, fmt.Errorf("service env %s isn't set", p.serviceEnv)
+	}
 	namespace := os.Getenv(p.namespaceEnv)
 	if namespace == "" {
-		return "", fmt.Errorf("service env %s is set but namespace env %s isn't; no way to get the service cluster IP", p.serviceEnv, p.namespaceEnv)
+		return nil, fmt.Errorf("service env %s is set but namespace env %s isn't; no way to get the service cluster IP", p.serviceEnv, p.namespaceEnv)
+	}
+	podIPs, err := getPodIPs(p.podIPEnv)
+	if err != nil {
+		return nil, err
 	}
 	service, err := p.client.Core().Services(namespace).Get(serviceName)
 	if err != nil {
-		return "", fmt.Errorf("error getting service %s=%s in namespace %s=%s", p.serviceEnv, serviceName, p.namespaceEnv, namespace)
+		return nil, fmt.Errorf("error getting service %s=%s in namespace %s=%s", p.serviceEnv, serviceName, p.namespaceEnv, namespace)
 	}
 
 	// Do some validation of the service before provisioning useless volumes
@@ -293,11 +758,14 @@ func (p *nfsProvisioner) getServer() (string, error) {
 		endpointPort{111, v1.ProtocolTCP}:   true,
 	}
 	endpoints, err := p.client.Core().Endpoints(namespace).Get(serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting endpoints of service %s=%s in namespace %s=%s", p.serviceEnv, serviceName, p.namespaceEnv, namespace)
+	}
 	for _, subset := range endpoints.Subsets {
 		if len(subset.Addresses) != 1 {
 			continue
 		}
-		if subset.Addresses[0].IP != fallbackServer {
+		if !containsIP(podIPs, subset.Addresses[0].IP) {
 			continue
 		}
 		actualPorts := make(map[endpointPort]bool)
@@ -311,63 +779,117 @@ func (p *nfsProvisioner) getServer() (string, error) {
 		break
 	}
 	if !valid {
-		return "", fmt.Errorf("service %s=%s is not valid; check that it has for ports %v one endpoint, this pod's IP %v", p.serviceEnv, serviceName, expectedPorts, fallbackServer)
-	}
-	if service.Spec.ClusterIP == v1.ClusterIPNone {
-		return "", fmt.Errorf("service %s=%s is valid but it doesn't have a cluster IP", p.serviceEnv, serviceName)
+		return nil, fmt.Errorf("service %s=%s is not valid; check that it has for ports %v one endpoint, this pod's IP %v", p.serviceEnv, serviceName, expectedPorts, podIPs)
 	}
 
-	return service.Spec.ClusterIP, nil
+	return service, nil
 }
 
 // createDirectory creates the given directory in exportDir with appropriate
-// permissions and ownership according to the given gid parameter string.
+// permissions and ownership according to the given gid parameter string. Any
+// missing parent directories, as in the case of a nested pathPattern, are
+// created with permissions that only let others traverse them. Neither the
+// directory nor its parents may be symlinks.
 func (p *nfsProvisioner) createDirectory(directory, gid string) error {
 	// TODO quotas
-	path := fmt.Sprintf(p.exportDir+"%s", directory)
-	if _, err := os.Stat(path); err == nil {
-		return fmt.Errorf("error creating volume, the path already exists")
-	}
-
 	perm := os.FileMode(0777)
 	if gid != "none" {
 		// Execute permission is required for stat, which kubelet uses during unmount.
 		perm = os.FileMode(0071)
 	}
-	if err := os.MkdirAll(path, perm); err != nil {
+
+	// Don't let removeDirectory remove the parent dirs, if it finds them
+	// empty, between their creation and the creation of the dir
+	p.dirMutex.Lock()
+	parent, name, err := openParent(p.exportDir, directory, true)
+	if err != nil {
+		p.dirMutex.Unlock()
+		return fmt.Errorf("error creating parent dirs for volume: %v", err)
+	}
+	err = syscall.Mkdirat(parent.fd(), name, uint32(perm))
+	p.dirMutex.Unlock()
+	if err == syscall.EEXIST {
+		parent.Close()
+		return fmt.Errorf("error creating volume, the path already exists")
+	} else if err != nil {
+		parent.Close()
+		p.removeDirectory(directory)
 		return fmt.Errorf("error creating dir for volume: %v", err)
 	}
-	// Due to umask, need to chmod
-	cmd := exec.Command("chmod", strconv.FormatInt(int64(perm), 8), path)
-	out, err := cmd.CombinedOutput()
+	dir, err := parent.openAt(name)
+	parent.Close()
 	if err != nil {
-		os.RemoveAll(path)
-		return fmt.Errorf("chmod failed with error: %v, output: %s", err, out)
+		p.removeDirectory(directory)
+		return fmt.Errorf("error opening dir for volume: %v", err)
+	}
+	defer dir.Close()
+
+	// Due to umask, need to chmod
+	if err := syscall.Fchmod(dir.fd(), uint32(perm)); err != nil {
+		p.removeDirectory(directory)
+		return fmt.Errorf("chmod failed with error: %v", err)
 	}
 
 	if gid != "none" {
-		groupId, _ := strconv.ParseUint(gid, 10, 64)
-		cmd = exec.Command("chgrp", strconv.FormatUint(groupId, 10), path)
-		out, err = cmd.CombinedOutput()
+		groupId, err := strconv.ParseUint(gid, 10, 32)
+		if err == nil {
+			err = syscall.Fchown(dir.fd(), -1, int(groupId))
+		}
+		if err != nil {
+			p.removeDirectory(directory)
+			return fmt.Errorf("chgrp failed with error: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// removeDirectory removes the given directory in exportDir and then any of its
+// parents, up to but excluding exportDir, that are left empty. Symlinks in the
+// directory are removed, not followed.
+func (p *nfsProvisioner) removeDirectory(directory string) error {
+	parent, name, err := openParent(p.exportDir, directory, false)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = parent.removeAt(context.Background(), name)
+	parent.Close()
+	if err != nil {
+		return err
+	}
+
+	p.dirMutex.Lock()
+	for dir := filepath.Dir(directory); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		// rmdir fails on non-empty directories, which are still in use by
+		// other volumes
+		parent, name, err := openParent(p.exportDir, dir, false)
 		if err != nil {
-			os.RemoveAll(path)
-			return fmt.Errorf("chgrp failed with error: %v, output: %s", err, out)
+			break
+		}
+		err = parent.rmdirAt(name)
+		parent.Close()
+		if err != nil {
+			break
 		}
 	}
+	p.dirMutex.Unlock()
 
 	return nil
 }
 
 // createExport creates the export by adding a block to the appropriate config
-// file and exporting it, using the appropriate method.
-func (p *nfsProvisioner) createExport(directory string) (string, uint16, error) {
+// file and exporting it, using the appropriate method. The export is read-only
+// if readOnly is true, and restricted to the given clients if there are any.
+func (p *nfsProvisioner) createExport(directory string, readOnly bool, clients []string) (string, uint16, error) {
 	path := fmt.Sprintf(p.exportDir+"%s", directory)
 
 	exportId := p.generateExportId()
 	exportIdStr := strconv.FormatUint(uint64(exportId), 10)
 
 	config := p.exporter.GetConfig()
-	block := p.exporter.CreateBlock(exportIdStr, path)
+	block := p.exporter.CreateBlock(exportIdStr, path, readOnly, clients)
 
 	// Add the export block to the config file
 	if err := p.addToFile(config, block); err != nil {
@@ -388,14 +910,28 @@ func (p *nfsProvisioner) createExport(directory string) (string, uint16, error)
 // generateExportId generates a unique exportId to assign an export
 func (p *nfsProvisioner) generateExportId() uint16 {
 	p.mapMutex.Lock()
+	id := p.firstFreeExportId()
+	p.exportIds[id] = true
+	p.mapMutex.Unlock()
+	return id
+}
+
+// nextExportId returns the exportId generateExportId would assign next,
+// without reserving it.
+func (p *nfsProvisioner) nextExportId() uint16 {
+	p.mapMutex.Lock()
+	defer p.mapMutex.Unlock()
+	return p.firstFreeExportId()
+}
+
+// firstFreeExportId must be called with mapMutex held.
+func (p *nfsProvisioner) firstFreeExportId() uint16 {
 	id := uint16(1)
 	for ; id <= math.MaxUint16; id++ {
 		if _, ok := p.exportIds[id]; !ok {
 			break
 		}
 	}
-	p.exportIds[id] = true
-	p.mapMutex.Unlock()
 	return id
 }
 
@@ -444,112 +980,3 @@ func (p *nfsProvisioner) removeFromFile(path string, toRemove string) error {
 	p.fileMutex.Unlock()
 	return nil
 }
-
-type exporter interface {
-	GetConfig() string
-	GetConfigExportIds() (map[uint16]bool, error)
-	CreateBlock(string, string) string
-	Export(string) error
-	Unexport(*v1.PersistentVolume) error
-}
-
-type ganeshaExporter struct {
-	ganeshaConfig string
-}
-
-var _ exporter = &ganeshaExporter{}
-
-func (e *ganeshaExporter) GetConfig() string {
-	return e.ganeshaConfig
-}
-
-func (e *ganeshaExporter) GetConfigExportIds() (map[uint16]bool, error) {
-	return getConfigExportIds(e.GetConfig(), regexp.MustCompile("Export_Id = ([0-9]+);"))
-}
-
-// CreateBlock creates the text block to add to the ganesha config file.
-func (e *ganeshaExporter) CreateBlock(exportId, path string) string {
-	return "\nEXPORT\n{\n" +
-		"\tExport_Id = " + exportId + ";\n" +
-		"\tPath = " + path + ";\n" +
-		"\tPseudo = " + path + ";\n" +
-		"\tAccess_Type = RW;\n" +
-		"\tSquash = root_id_squash;\n" +
-		"\tSecType = sys;\n" +
-		"\tFilesystem_id = " + exportId + "." + exportId + ";\n" +
-		"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n"
-}
-
-// Export exports the given directory using NFS Ganesha, assuming it is running
-// and can be connected to using D-Bus.
-func (e *ganeshaExporter) Export(path string) error {
-	// Call AddExport using dbus
-	conn, err := dbus.SystemBus()
-	if err != nil {
-		return fmt.Errorf("error getting dbus session bus: %v", err)
-	}
-	obj := conn.Object("org.ganesha.nfsd", "/org/ganesha/nfsd/ExportMgr")
-	call := obj.Call("org.ganesha.nfsd.exportmgr.AddExport", 0, e.ganeshaConfig, fmt.Sprintf("export(path = %s)", path))
-	if call.Err != nil {
-		return fmt.Errorf("error calling org.ganesha.nfsd.exportmgr.AddExport: %v", call.Err)
-	}
-
-	return nil
-}
-
-type kernelExporter struct {
-}
-
-var _ exporter = &kernelExporter{}
-
-func (e *kernelExporter) GetConfig() string {
-	return "/etc/exports"
-}
-
-func (e *kernelExporter) GetConfigExportIds() (map[uint16]bool, error) {
-	return getConfigExportIds(e.GetConfig(), regexp.MustCompile("fsid=([0-9]+)"))
-}
-
-// CreateBlock creates the text block to add to the /etc/exports file.
-func (e *kernelExporter) CreateBlock(exportId, path string) string {
-	return "\n" + path + " *(rw,insecure,root_squash,fsid=" + exportId + ")\n"
-}
-
-// Export exports all directories listed in /etc/exports
-func (e *kernelExporter) Export(_ string) error {
-	// Execute exportfs
-	cmd := exec.Command("exportfs", "-r")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("exportfs -r failed with error: %v, output: %s", err, out)
-	}
-
-	return nil
-}
-
-// getConfigExportIds populates the exportIds map with pre-existing exportIds
-// found in the given config file. Takes as argument the regex it should use to
-// find each exportId in the file i.e. Export_Id or fsid.
-func getConfigExportIds(config string, re *regexp.Regexp) (map[uint16]bool, error) {
-	exportIds := map[uint16]bool{}
-
-	digitsRe := "([0-9]+)"
-	if !strings.Contains(re.String(), digitsRe) {
-		return exportIds, fmt.Errorf("regexp %s doesn't contain digits submatch %s", re.String(), digitsRe)
-	}
-
-	read, err := ioutil.ReadFile(config)
-	if err != nil {
-		return exportIds, err
-	}
-
-	allMatches := re.FindAllSubmatch(read, -1)
-	for _, match := range allMatches {
-		digits := match[1]
-		if id, err := strconv.ParseUint(string(digits), 10, 16); err == nil {
-			exportIds[uint16(id)] = true
-		}
-	}
-
-	return exportIds, nil
-}
@@ -21,13 +21,13 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
-	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
 	"testing"
 
 	"github.com/wongma7/nfs-provisioner/controller"
+	"golang.org/x/net/context"
 	"k8s.io/client-go/1.4/kubernetes/fake"
 	"k8s.io/client-go/1.4/pkg/api/resource"
 	"k8s.io/client-go/1.4/pkg/api/unversioned"
@@ -44,6 +44,7 @@ func TestCreateVolume(t *testing.T) {
 		name             string
 		options          controller.VolumeOptions
 		envKey           string
+		canceled         bool
 		expectedServer   string
 		expectedPath     string
 		expectedGroup    uint64
@@ -85,6 +86,24 @@ func TestCreateVolume(t *testing.T) {
 			expectedExportId: 2,
 			expectError:      false,
 		},
+		{
+			name: "succeed creating volume with nested pathPattern",
+			options: controller.VolumeOptions{
+				Capacity:                      resource.MustParse("1Ki"),
+				AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany},
+				PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				PVName:     "pvc-5",
+				Parameters: map[string]string{"pathPattern": "${namespace}/${pvcName}-${pvName}"},
+				PVC:        newClaim("claim-1", "team-a"),
+			},
+			envKey:           podIPEnv,
+			expectedServer:   "1.1.1.1",
+			expectedPath:     tmpDir + "/team-a/claim-1-pvc-5",
+			expectedGroup:    0,
+			expectedBlock:    "\nExport_Id = 3;\n",
+			expectedExportId: 3,
+			expectError:      false,
+		},
 		{
 			name: "bad parameter",
 			options: controller.VolumeOptions{
@@ -102,6 +121,24 @@ func TestCreateVolume(t *testing.T) {
 			expectedExportId: 0,
 			expectError:      true,
 		},
+		{
+			name: "canceled",
+			options: controller.VolumeOptions{
+				Capacity:                      resource.MustParse("1Ki"),
+				AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany},
+				PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				PVName:     "pvc-6",
+				Parameters: map[string]string{},
+			},
+			envKey:           podIPEnv,
+			canceled:         true,
+			expectedServer:   "",
+			expectedPath:     "",
+			expectedGroup:    0,
+			expectedBlock:    "",
+			expectedExportId: 0,
+			expectError:      true,
+		},
 		{
 			name: "bad server",
 			options: controller.VolumeOptions{
@@ -166,18 +203,106 @@ func TestCreateVolume(t *testing.T) {
 	for _, test := range tests {
 		os.Setenv(test.envKey, "1.1.1.1")
 
-		server, path, supGroup, block, exportId, err := p.createVolume(test.options)
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.canceled {
+			cancel()
+		}
 
-		evaluate(t, test.name, test.expectError, err, test.expectedServer, server, "server")
-		evaluate(t, test.name, test.expectError, err, test.expectedPath, path, "path")
-		evaluate(t, test.name, test.expectError, err, test.expectedGroup, supGroup, "group")
-		evaluate(t, test.name, test.expectError, err, test.expectedBlock, block, "block")
-		evaluate(t, test.name, test.expectError, err, test.expectedExportId, exportId, "export id")
+		volume, err := p.createVolume(ctx, test.options)
+		cancel()
+
+		evaluate(t, test.name, test.expectError, err, test.expectedServer, volume.server, "server")
+		evaluate(t, test.name, test.expectError, err, test.expectedPath, volume.path, "path")
+		evaluate(t, test.name, test.expectError, err, test.expectedGroup, volume.supGroup, "group")
+		evaluate(t, test.name, test.expectError, err, test.expectedBlock, volume.block, "block")
+		evaluate(t, test.name, test.expectError, err, test.expectedExportId, volume.exportId, "export id")
+		if test.canceled {
+			if _, err := os.Stat(tmpDir + "/" + test.options.PVName); !os.IsNotExist(err) {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected directory of canceled volume to not exist")
+			}
+		}
 
 		os.Unsetenv(test.envKey)
 	}
 }
 
+func TestDryRunProvision(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	if err := ioutil.WriteFile(conf, []byte{}, 0600); err != nil {
+		t.Fatalf("Error creating file %s: %v", conf, err)
+	}
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{config: conf})
+	os.Setenv(podIPEnv, "1.1.1.1")
+	defer os.Unsetenv(podIPEnv)
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{},
+	}
+	pv, err := p.DryRunProvision(options)
+	if err != nil {
+		t.Fatalf("unexpected error in dry run provision: %v", err)
+	}
+	if pv.Spec.NFS == nil || pv.Spec.NFS.Server != "1.1.1.1" || pv.Spec.NFS.Path != tmpDir+"/pvc-1" {
+		t.Errorf("expected PV of nfs 1.1.1.1:%s but got %+v", tmpDir+"/pvc-1", pv.Spec.PersistentVolumeSource)
+	}
+	if expected := "\nExport_Id = 1;\n"; pv.Annotations[annBlock] != expected {
+		t.Errorf("expected export block %q but got %q", expected, pv.Annotations[annBlock])
+	}
+	if _, err := os.Stat(tmpDir + "/pvc-1"); !os.IsNotExist(err) {
+		t.Errorf("expected dry run to not create directory")
+	}
+	if read, _ := ioutil.ReadFile(conf); len(read) != 0 {
+		t.Errorf("expected dry run to not write config but got %q", read)
+	}
+	if len(p.exportIds) != 0 {
+		t.Errorf("expected dry run to not reserve exportIds but got %v", p.exportIds)
+	}
+
+	options.Parameters = map[string]string{"foo": "bar"}
+	if _, err := p.DryRunProvision(options); err == nil {
+		t.Errorf("expected error in dry run provision with invalid parameters")
+	}
+}
+
+func TestSharedExportIds(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	if err := ioutil.WriteFile(conf, []byte{}, 0600); err != nil {
+		t.Fatalf("Error creating file %s: %v", conf, err)
+	}
+	if err := os.Mkdir(tmpDir+"/a", 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if err := os.Mkdir(tmpDir+"/b", 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	client := fake.NewSimpleClientset()
+	a := newNFSProvisionerInternal(tmpDir+"/a/", client, &testExporter{config: conf})
+	b := newNFSProvisionerInternal(tmpDir+"/b/", client, &testExporter{config: conf})
+
+	if id := a.generateExportId(); id != 1 {
+		t.Errorf("expected exportId 1 but got %d", id)
+	}
+	if id := b.generateExportId(); id != 2 {
+		t.Errorf("expected exportId 2 but got %d", id)
+	}
+	a.deleteExportId(1)
+	if id := b.generateExportId(); id != 1 {
+		t.Errorf("expected exportId 1 after it was deleted but got %d", id)
+	}
+}
+
 func TestValidateOptions(t *testing.T) {
 	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
 	defer os.RemoveAll(tmpDir)
@@ -185,27 +310,83 @@ func TestValidateOptions(t *testing.T) {
 	tests := []struct {
 		name        string
 		options     controller.VolumeOptions
+		defaults    map[string]string
 		expectedGid string
 		expectError bool
 	}{
 		{
 			name:        "empty parameters",
-			options:     controller.VolumeOptions{Parameters: map[string]string{}, Capacity: resource.MustParse("1Ki")},
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{}, Capacity: resource.MustParse("1Ki")},
 			expectedGid: "none",
 			expectError: false,
 		},
 		{
 			name:        "gid parameter value 'none'",
-			options:     controller.VolumeOptions{Parameters: map[string]string{"gid": "none"}, Capacity: resource.MustParse("1Ki")},
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"gid": "none"}, Capacity: resource.MustParse("1Ki")},
 			expectedGid: "none",
 			expectError: false,
 		},
 		{
 			name:        "gid parameter value id",
-			options:     controller.VolumeOptions{Parameters: map[string]string{"gid": "1"}, Capacity: resource.MustParse("1Ki")},
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"gid": "1"}, Capacity: resource.MustParse("1Ki")},
 			expectedGid: "1",
 			expectError: false,
 		},
+		{
+			name:        "pathPattern parameter",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"pathPattern": "foo/${pvName}"}, Capacity: resource.MustParse("1Ki")},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name:        "bad pathPattern parameter value",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"pathPattern": "../${pvName}"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "recycled volume",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{}, Recycle: true, Capacity: resource.MustParse("1Ki")},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name:        "pathPattern parameter on recycled volume",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"pathPattern": "foo/${pvName}"}, Recycle: true, Capacity: resource.MustParse("1Ki")},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "default pathPattern on recycled volume",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{}, Recycle: true, Capacity: resource.MustParse("1Ki")},
+			defaults:    map[string]string{"pathPattern": "${namespace}/${pvName}"},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "mountOptions parameter",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"mountOptions": "nfsvers=4.1,hard"}, Capacity: resource.MustParse("1Ki")},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name:        "bad mountOptions parameter value",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"mountOptions": "nfsvers=5"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "clients parameter",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"clients": "10.0.0.0/8, fd00::/64"}, Capacity: resource.MustParse("1Ki")},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name:        "bad clients parameter value",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"clients": "10.0.0.0/8,*"}},
+			expectedGid: "",
+			expectError: true,
+		},
 		{
 			name:        "bad parameter name",
 			options:     controller.VolumeOptions{Parameters: map[string]string{"foo": "bar"}},
@@ -230,6 +411,44 @@ func TestValidateOptions(t *testing.T) {
 			expectedGid: "",
 			expectError: true,
 		},
+		{
+			name:        "default gid parameter",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{}, Capacity: resource.MustParse("1Ki")},
+			defaults:    map[string]string{"gid": "2"},
+			expectedGid: "2",
+			expectError: false,
+		},
+		{
+			name:        "gid parameter overrides default",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"GID": "1"}, Capacity: resource.MustParse("1Ki")},
+			defaults:    map[string]string{"gid": "2"},
+			expectedGid: "1",
+			expectError: false,
+		},
+		{
+			name:        "serverAddress parameter",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"serverAddress": "nfs.example.com"}, Capacity: resource.MustParse("1Ki")},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name:        "serverAddressStrategy parameter",
+			options:     controller.VolumeOptions{PVName: "pvc-1", Parameters: map[string]string{"serverAddressStrategy": "service-dns"}, Capacity: resource.MustParse("1Ki")},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name:        "bad serverAddressStrategy parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"serverAddressStrategy": "foo"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "serverAddress parameter with other strategy",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"serverAddress": "nfs.example.com", "serverAddressStrategy": "pod-dns"}},
+			expectedGid: "",
+			expectError: true,
+		},
 		// TODO implement options.ProvisionerSelector parsing
 		{
 			name:        "non-nil selector",
@@ -249,9 +468,249 @@ func TestValidateOptions(t *testing.T) {
 	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
 
 	for _, test := range tests {
-		gid, err := p.validateOptions(test.options)
+		p.defaultParameters = test.defaults
 
-		evaluate(t, test.name, test.expectError, err, test.expectedGid, gid, "gid")
+		config, err := p.validateOptions(test.options)
+
+		evaluate(t, test.name, test.expectError, err, test.expectedGid, config.gid, "gid")
+	}
+}
+
+func TestNewNFSProvisioner(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	persistent := writeMountInfo(t, tmpDir+"/persistent", "/", "ext4")
+	ephemeral := writeMountInfo(t, tmpDir+"/ephemeral", tmpDir, "tmpfs")
+	defer func(mountInfo string) { mountInfoFile = mountInfo }(mountInfoFile)
+
+	tests := []struct {
+		name           string
+		defaults       map[string]string
+		mountInfo      string
+		allowEphemeral bool
+		expectError    bool
+	}{
+		{
+			name:        "valid defaults",
+			defaults:    map[string]string{"gid": "1000"},
+			mountInfo:   persistent,
+			expectError: false,
+		},
+		{
+			name:        "invalid defaults",
+			defaults:    map[string]string{"gid": "foo"},
+			mountInfo:   persistent,
+			expectError: true,
+		},
+		{
+			name:        "ephemeral export dir",
+			mountInfo:   ephemeral,
+			expectError: true,
+		},
+		{
+			name:           "ephemeral export dir allowed",
+			mountInfo:      ephemeral,
+			allowEphemeral: true,
+			expectError:    false,
+		},
+	}
+	for _, test := range tests {
+		mountInfoFile = test.mountInfo
+		client := fake.NewSimpleClientset()
+		_, err := NewNFSProvisioner(tmpDir+"/", client, &testExporter{}, ServerAddress{}, test.allowEphemeral, test.defaults)
+
+		evaluate(t, test.name, test.expectError, err, nil, nil, "error")
+	}
+}
+
+func TestSetDefaultParameters(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name             string
+		defaults         map[string]string
+		expectedDefaults map[string]string
+		expectError      bool
+	}{
+		{
+			name:             "valid",
+			defaults:         map[string]string{"gid": "1000"},
+			expectedDefaults: map[string]string{"gid": "1000"},
+			expectError:      false,
+		},
+		{
+			name:             "none",
+			defaults:         nil,
+			expectedDefaults: nil,
+			expectError:      false,
+		},
+		{
+			name:             "invalid gid",
+			defaults:         map[string]string{"gid": "foo"},
+			expectedDefaults: map[string]string{"gid": "none"},
+			expectError:      true,
+		},
+		{
+			name:             "invalid parameter",
+			defaults:         map[string]string{"foo": "bar"},
+			expectedDefaults: map[string]string{"gid": "none"},
+			expectError:      true,
+		},
+	}
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
+
+	for _, test := range tests {
+		p.defaultParameters = map[string]string{"gid": "none"}
+
+		err := p.SetDefaultParameters(test.defaults)
+
+		evaluate(t, test.name, test.expectError, err, test.expectedDefaults, p.defaultParameters, "default parameters")
+	}
+}
+
+func TestValidateMountOptions(t *testing.T) {
+	tests := []struct {
+		name                 string
+		mountOptions         string
+		expectedMountOptions string
+		expectError          bool
+	}{
+		{
+			name:                 "empty",
+			mountOptions:         "",
+			expectedMountOptions: "",
+			expectError:          false,
+		},
+		{
+			name:                 "valid options",
+			mountOptions:         "nfsvers=4.1, hard,timeo=600 ,rsize=1048576,proto=tcp,noac",
+			expectedMountOptions: "nfsvers=4.1,hard,timeo=600,rsize=1048576,proto=tcp,noac",
+			expectError:          false,
+		},
+		{
+			name:                 "unknown option",
+			mountOptions:         "hard,foo",
+			expectedMountOptions: "",
+			expectError:          true,
+		},
+		{
+			name:                 "value for option without value",
+			mountOptions:         "hard=1",
+			expectedMountOptions: "",
+			expectError:          true,
+		},
+		{
+			name:                 "no value for option with value",
+			mountOptions:         "timeo",
+			expectedMountOptions: "",
+			expectError:          true,
+		},
+		{
+			name:                 "non-integer value",
+			mountOptions:         "timeo=-1",
+			expectedMountOptions: "",
+			expectError:          true,
+		},
+		{
+			name:                 "invalid enumerated value",
+			mountOptions:         "sec=foo",
+			expectedMountOptions: "",
+			expectError:          true,
+		},
+	}
+	for _, test := range tests {
+		mountOptions, err := validateMountOptions(test.mountOptions)
+
+		evaluate(t, test.name, test.expectError, err, test.expectedMountOptions, mountOptions, "mount options")
+	}
+}
+
+func TestIsReadOnly(t *testing.T) {
+	tests := []struct {
+		name             string
+		accessModes      []v1.PersistentVolumeAccessMode
+		expectedReadOnly bool
+	}{
+		{
+			name:             "no access modes",
+			accessModes:      []v1.PersistentVolumeAccessMode{},
+			expectedReadOnly: false,
+		},
+		{
+			name:             "ROX only",
+			accessModes:      []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany},
+			expectedReadOnly: true,
+		},
+		{
+			name:             "RWO and ROX",
+			accessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany},
+			expectedReadOnly: false,
+		},
+		{
+			name:             "RWX only",
+			accessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			expectedReadOnly: false,
+		},
+	}
+	for _, test := range tests {
+		readOnly := isReadOnly(test.accessModes)
+
+		evaluate(t, test.name, false, nil, test.expectedReadOnly, readOnly, "read-only")
+	}
+}
+
+func TestValidateCapabilities(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities ExporterCapabilities
+		mountOptions string
+		readOnly     bool
+		expectError  bool
+	}{
+		{
+			name:         "read-only",
+			capabilities: ExporterCapabilities{ReadOnly: true},
+			mountOptions: "",
+			readOnly:     true,
+			expectError:  false,
+		},
+		{
+			name:         "read-only unsupported",
+			capabilities: ExporterCapabilities{},
+			mountOptions: "",
+			readOnly:     true,
+			expectError:  true,
+		},
+		{
+			name:         "kerberos",
+			capabilities: ExporterCapabilities{Kerberos: true},
+			mountOptions: "hard,sec=krb5p",
+			readOnly:     false,
+			expectError:  false,
+		},
+		{
+			name:         "kerberos unsupported",
+			capabilities: ExporterCapabilities{},
+			mountOptions: "hard,sec=krb5i",
+			readOnly:     false,
+			expectError:  true,
+		},
+		{
+			name:         "sys security",
+			capabilities: ExporterCapabilities{},
+			mountOptions: "sec=sys",
+			readOnly:     false,
+			expectError:  false,
+		},
+	}
+	for _, test := range tests {
+		err := validateCapabilities(test.capabilities, test.mountOptions, test.readOnly)
+
+		evaluate(t, test.name, test.expectError, err, nil, nil, "error")
 	}
 }
 
@@ -360,64 +819,6 @@ func TestAddToRemoveFromFile(t *testing.T) {
 	}
 }
 
-func TestGetConfigExportIds(t *testing.T) {
-	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
-	defer os.RemoveAll(tmpDir)
-
-	tests := []struct {
-		name              string
-		useGanesha        bool
-		configContents    string
-		re                *regexp.Regexp
-		expectedExportIds map[uint16]bool
-		expectError       bool
-	}{
-		{
-			name: "ganesha exports 1, 3",
-			configContents: "\nEXPORT\n{\n" +
-				"\tExport_Id = 1;\n" +
-				"\tFilesystem_id = 1.1;\n" +
-				"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n" +
-				"\nEXPORT\n{\n" +
-				"\tExport_Id = 3;\n" +
-				"\tFilesystem_id = 1.1;\n" +
-				"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n",
-			re:                regexp.MustCompile("Export_Id = ([0-9]+);"),
-			expectedExportIds: map[uint16]bool{1: true, 3: true},
-			expectError:       false,
-		},
-		{
-			name: "kernel exports 1, 3",
-			configContents: "\n foo *(rw,insecure,root_squash,fsid=1)\n" +
-				"\n bar *(rw,insecure,root_squash,fsid=3)\n",
-			re:                regexp.MustCompile("fsid=([0-9]+)"),
-			expectedExportIds: map[uint16]bool{1: true, 3: true},
-			expectError:       false,
-		},
-		{
-			name: "bad regex",
-			configContents: "\nEXPORT\n{\n" +
-				"\tExport_Id = 1;\n" +
-				"\tFilesystem_id = 1.1;\n" +
-				"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n",
-			re:                regexp.MustCompile("Export_Id = [0-9]+;"),
-			expectedExportIds: map[uint16]bool{},
-			expectError:       true,
-		},
-	}
-	for i, test := range tests {
-		conf := tmpDir + "/test" + "-" + strconv.Itoa(i)
-		err := ioutil.WriteFile(conf, []byte(test.configContents), 0755)
-		if err != nil {
-			t.Errorf("Error writing file %s: %v", conf, err)
-		}
-
-		exportIds, err := getConfigExportIds(conf, test.re)
-
-		evaluate(t, test.name, test.expectError, err, test.expectedExportIds, exportIds, "export ids")
-	}
-}
-
 func TestGetServer(t *testing.T) {
 	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
 	defer os.RemoveAll(tmpDir)
@@ -560,6 +961,16 @@ func TestGetServer(t *testing.T) {
 	}
 }
 
+func newClaim(name, namespace string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Annotations: map[string]string{},
+		},
+	}
+}
+
 func newService(name, clusterIP string) *v1.Service {
 	return &v1.Service{
 		ObjectMeta: v1.ObjectMeta{
@@ -605,7 +1016,7 @@ type testExporter struct {
 	config string
 }
 
-var _ exporter = &testExporter{}
+var _ Exporter = &testExporter{}
 
 func (e *testExporter) GetConfig() string {
 	return e.config
@@ -615,7 +1026,7 @@ func (e *testExporter) GetConfigExportIds() (map[uint16]bool, error) {
 	return map[uint16]bool{}, nil
 }
 
-func (e *testExporter) CreateBlock(exportId, path string) string {
+func (e *testExporter) CreateBlock(exportId, path string, readOnly bool, clients []string) string {
 	return "\nExport_Id = " + exportId + ";\n"
 }
 
@@ -630,6 +1041,10 @@ func (e *testExporter) Unexport(volume *v1.PersistentVolume) error {
 	return nil
 }
 
+func (e *testExporter) Capabilities() ExporterCapabilities {
+	return ExporterCapabilities{LiveUpdate: true, ReadOnly: true, Kerberos: true, Statistics: true}
+}
+
 func evaluate(t *testing.T, name string, expectError bool, err error, expected interface{}, got interface{}, output string) {
 	if !expectError && err != nil {
 		t.Logf("test case: %s", name)
@@ -0,0 +1,200 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// The strategies for choosing the NFS server address to put in provisioned
+// PVs.
+const (
+	// ServerAuto uses the fixed address if there is one, else the cluster IP
+	// of the service named by the service env, else the node name if the
+	// node env is set, else the pod IP.
+	ServerAuto = "auto"
+	// ServerFixed uses the fixed address, e.g. an external hostname.
+	ServerFixed = "fixed"
+	// ServerServiceDNS uses the DNS name of the service named by the service
+	// env.
+	ServerServiceDNS = "service-dns"
+	// ServerLoadBalancer uses the load balancer ingress IP, or hostname, of
+	// the service named by the service env.
+	ServerLoadBalancer = "load-balancer"
+	// ServerPodDNS uses the pod's DNS name under the headless service named
+	// by the service env, as a StatefulSet's pods have.
+	ServerPodDNS = "pod-dns"
+	// ServerNodeExternalIP uses the ExternalIP of the node named by the node
+	// env, for pods using hostNetwork or hostPort.
+	ServerNodeExternalIP = "node-external-ip"
+)
+
+// ServerStrategies returns the names of the strategies for choosing the NFS
+// server address.
+func ServerStrategies() []string {
+	return []string{ServerAuto, ServerFixed, ServerServiceDNS, ServerLoadBalancer, ServerPodDNS, ServerNodeExternalIP}
+}
+
+func isServerStrategy(strategy string) bool {
+	for _, s := range ServerStrategies() {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultClusterDomain is the DNS domain of the cluster if none is given.
+const DefaultClusterDomain = "cluster.local"
+
+// ServerAddress is how a provisioner chooses the NFS server address to put in
+// the PVs of StorageClasses that don't choose one.
+type ServerAddress struct {
+	// Strategy is one of ServerStrategies, or empty for ServerAuto.
+	Strategy string
+	// Address is the fixed address.
+	Address string
+	// ClusterDomain is the DNS domain of the cluster, or empty for
+	// DefaultClusterDomain.
+	ClusterDomain string
+	// IPFamily is the family of the IPs to choose, IPv4 or IPv6, or empty for
+	// the first IP found.
+	IPFamily string
+	// ManagedService is whether the service named by the service env is
+	// created and pointed at the pod by ManageService once the provisioner
+	// has started, so may not exist before.
+	ManagedService bool
+}
+
+// getServer gets the server to put in a provisioned PV's spec by the
+// provisioner's strategy.
+func (p *nfsProvisioner) getServer() (string, error) {
+	return p.getServerWith("", "")
+}
+
+// getServerWith gets the server to put in a provisioned PV's spec by the given
+// strategy and fixed address, either of which defaults to the provisioner's if
+// empty. IPs are returned in canonical form, and IPv6 ones without brackets.
+func (p *nfsProvisioner) getServerWith(strategy, address string) (string, error) {
+	server, err := p.chooseServer(strategy, address)
+	if err != nil {
+		return "", err
+	}
+	return normalizeAddress(server), nil
+}
+
+func (p *nfsProvisioner) chooseServer(strategy, address string) (string, error) {
+	if strategy == "" {
+		strategy = p.server.Strategy
+	}
+	if address == "" {
+		address = p.server.Address
+	}
+	domain := p.server.ClusterDomain
+	if domain == "" {
+		domain = DefaultClusterDomain
+	}
+
+	switch strategy {
+	case "", ServerAuto:
+		if address != "" {
+			return address, nil
+		}
+		return p.getAutoServer()
+	case ServerFixed:
+		if address == "" {
+			return "", fmt.Errorf("server address strategy is %s but no address is set", ServerFixed)
+		}
+		return address, nil
+	case ServerServiceDNS:
+		service, err := p.getValidService()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s.%s.svc.%s", service.Name, service.Namespace, domain), nil
+	case ServerLoadBalancer:
+		service, err := p.getValidService()
+		if err != nil {
+			return "", err
+		}
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ip := net.ParseIP(ingress.IP); ip != nil && isFamily(ip, p.server.IPFamily) {
+				return ingress.IP, nil
+			}
+			if ingress.IP == "" && ingress.Hostname != "" {
+				return ingress.Hostname, nil
+			}
+		}
+		return "", fmt.Errorf("service %s=%s has no load balancer ingress", p.serviceEnv, service.Name)
+	case ServerPodDNS:
+		return p.getPodDNSName(domain)
+	case ServerNodeExternalIP:
+		return p.getNodeExternalIP()
+	}
+	return "", fmt.Errorf("unknown server address strategy %q", strategy)
+}
+
+// getPodDNSName gets the DNS name of the pod under the headless service named
+// by serviceEnv. The pod's hostname and subdomain must be set, as a
+// StatefulSet does for its pods with the name of its pod and service.
+func (p *nfsProvisioner) getPodDNSName(domain string) (string, error) {
+	serviceName := os.Getenv(p.serviceEnv)
+	if serviceName == "" {
+		return "", fmt.Errorf("service env %s isn't set", p.serviceEnv)
+	}
+	namespace := os.Getenv(p.namespaceEnv)
+	if namespace == "" {
+		return "", fmt.Errorf("service env %s is set but namespace env %s isn't", p.serviceEnv, p.namespaceEnv)
+	}
+	service, err := p.client.Core().Services(namespace).Get(serviceName)
+	if err != nil {
+		return "", fmt.Errorf("error getting service %s=%s in namespace %s=%s: %v", p.serviceEnv, serviceName, p.namespaceEnv, namespace, err)
+	}
+	if service.Spec.ClusterIP != v1.ClusterIPNone {
+		return "", fmt.Errorf("service %s=%s isn't headless, so its pods have no DNS names", p.serviceEnv, serviceName)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("error getting hostname: %v", err)
+	}
+	return fmt.Sprintf("%s.%s.%s.svc.%s", hostname, serviceName, namespace, domain), nil
+}
+
+// getNodeExternalIP gets the ExternalIP of the node named by nodeEnv.
+func (p *nfsProvisioner) getNodeExternalIP() (string, error) {
+	nodeName := os.Getenv(p.nodeEnv)
+	if nodeName == "" {
+		return "", fmt.Errorf("node env %s isn't set", p.nodeEnv)
+	}
+	node, err := p.client.Core().Nodes().Get(nodeName)
+	if err != nil {
+		return "", fmt.Errorf("error getting node %s=%s: %v", p.nodeEnv, nodeName, err)
+	}
+	for _, address := range node.Status.Addresses {
+		if ip := net.ParseIP(address.Address); address.Type == v1.NodeExternalIP && ip != nil && isFamily(ip, p.server.IPFamily) {
+			return address.Address, nil
+		}
+	}
+	if p.server.IPFamily != "" {
+		return "", fmt.Errorf("node %s=%s has no %s ExternalIP", p.nodeEnv, nodeName, p.server.IPFamily)
+	}
+	return "", fmt.Errorf("node %s=%s has no ExternalIP", p.nodeEnv, nodeName)
+}
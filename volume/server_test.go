@@ -0,0 +1,229 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"os"
+	"testing"
+
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+func TestGetServerWith(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	hostname, _ := os.Hostname()
+	validEndpoints := newEndpoints("foo", []string{"2.2.2.2"}, []endpointPort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}})
+	loadBalancer := newService("foo", "1.1.1.1")
+	loadBalancer.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "3.3.3.3"}}
+	dualStackLoadBalancer := newService("foo", "1.1.1.1")
+	dualStackLoadBalancer.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "3.3.3.3"}, {IP: "fd00:0::3"}}
+	headless := newService("foo", v1.ClusterIPNone)
+	node := &v1.Node{
+		ObjectMeta: v1.ObjectMeta{Name: "node-1"},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}, {Type: v1.NodeExternalIP, Address: "4.4.4.4"}},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		objs           []runtime.Object
+		podIPs         string
+		server         ServerAddress
+		strategy       string
+		address        string
+		service        string
+		node           string
+		expectedServer string
+		expectError    bool
+	}{
+		{
+			name:           "auto with fixed address",
+			server:         ServerAddress{Address: "nfs.example.com"},
+			expectedServer: "nfs.example.com",
+			expectError:    false,
+		},
+		{
+			name:           "auto with pod IP",
+			expectedServer: "2.2.2.2",
+			expectError:    false,
+		},
+		{
+			name:           "auto with IPv6 fixed address",
+			server:         ServerAddress{Address: "fd00:0:0::1"},
+			expectedServer: "fd00::1",
+			expectError:    false,
+		},
+		{
+			name:           "auto with dual-stack pod IPs",
+			podIPs:         "2.2.2.2,fd00::2",
+			expectedServer: "2.2.2.2",
+			expectError:    false,
+		},
+		{
+			name:           "auto with dual-stack pod IPs, IPv6",
+			podIPs:         "2.2.2.2,fd00::2",
+			server:         ServerAddress{IPFamily: IPv6},
+			expectedServer: "fd00::2",
+			expectError:    false,
+		},
+		{
+			name:           "auto with pod IP not of IP family",
+			server:         ServerAddress{IPFamily: IPv6},
+			expectedServer: "",
+			expectError:    true,
+		},
+		{
+			name:           "fixed from parameter overrides provisioner's",
+			server:         ServerAddress{Strategy: ServerServiceDNS},
+			strategy:       ServerFixed,
+			address:        "nfs.example.com",
+			expectedServer: "nfs.example.com",
+			expectError:    false,
+		},
+		{
+			name:           "fixed without address",
+			server:         ServerAddress{Strategy: ServerFixed},
+			expectedServer: "",
+			expectError:    true,
+		},
+		{
+			name:           "service DNS",
+			objs:           []runtime.Object{newService("foo", "1.1.1.1"), validEndpoints},
+			server:         ServerAddress{Strategy: ServerServiceDNS},
+			service:        "foo",
+			expectedServer: "foo.default.svc.cluster.local",
+			expectError:    false,
+		},
+		{
+			name:           "service DNS with cluster domain",
+			objs:           []runtime.Object{newService("foo", "1.1.1.1"), validEndpoints},
+			server:         ServerAddress{Strategy: ServerServiceDNS, ClusterDomain: "example.org"},
+			service:        "foo",
+			expectedServer: "foo.default.svc.example.org",
+			expectError:    false,
+		},
+		{
+			name:           "service DNS from parameter",
+			objs:           []runtime.Object{newService("foo", "1.1.1.1"), validEndpoints},
+			strategy:       ServerServiceDNS,
+			service:        "foo",
+			expectedServer: "foo.default.svc.cluster.local",
+			expectError:    false,
+		},
+		{
+			name:           "service DNS without service",
+			server:         ServerAddress{Strategy: ServerServiceDNS},
+			expectedServer: "",
+			expectError:    true,
+		},
+		{
+			name:           "load balancer",
+			objs:           []runtime.Object{loadBalancer, validEndpoints},
+			server:         ServerAddress{Strategy: ServerLoadBalancer},
+			service:        "foo",
+			expectedServer: "3.3.3.3",
+			expectError:    false,
+		},
+		{
+			name:           "load balancer, IPv6",
+			objs:           []runtime.Object{dualStackLoadBalancer, validEndpoints},
+			server:         ServerAddress{Strategy: ServerLoadBalancer, IPFamily: IPv6},
+			service:        "foo",
+			expectedServer: "fd00::3",
+			expectError:    false,
+		},
+		{
+			name:           "load balancer without ingress",
+			objs:           []runtime.Object{newService("foo", "1.1.1.1"), validEndpoints},
+			server:         ServerAddress{Strategy: ServerLoadBalancer},
+			service:        "foo",
+			expectedServer: "",
+			expectError:    true,
+		},
+		{
+			name:           "pod DNS",
+			objs:           []runtime.Object{headless},
+			server:         ServerAddress{Strategy: ServerPodDNS},
+			service:        "foo",
+			expectedServer: hostname + ".foo.default.svc.cluster.local",
+			expectError:    false,
+		},
+		{
+			name:           "pod DNS with service that isn't headless",
+			objs:           []runtime.Object{newService("foo", "1.1.1.1")},
+			server:         ServerAddress{Strategy: ServerPodDNS},
+			service:        "foo",
+			expectedServer: "",
+			expectError:    true,
+		},
+		{
+			name:           "node external IP",
+			objs:           []runtime.Object{node},
+			server:         ServerAddress{Strategy: ServerNodeExternalIP},
+			node:           "node-1",
+			expectedServer: "4.4.4.4",
+			expectError:    false,
+		},
+		{
+			name:           "node without external IP",
+			objs:           []runtime.Object{&v1.Node{ObjectMeta: v1.ObjectMeta{Name: "node-2"}}},
+			server:         ServerAddress{Strategy: ServerNodeExternalIP},
+			node:           "node-2",
+			expectedServer: "",
+			expectError:    true,
+		},
+		{
+			name:           "unknown strategy",
+			server:         ServerAddress{Strategy: "foo"},
+			expectedServer: "",
+			expectError:    true,
+		},
+	}
+	os.Setenv(podIPEnv, "2.2.2.2")
+	os.Setenv(namespaceEnv, "default")
+	defer os.Unsetenv(podIPEnv)
+	defer os.Unsetenv(namespaceEnv)
+	for _, test := range tests {
+		if test.service != "" {
+			os.Setenv(serviceEnv, test.service)
+		}
+		if test.node != "" {
+			os.Setenv(nodeEnv, test.node)
+		}
+		if test.podIPs != "" {
+			os.Setenv(podIPsEnv, test.podIPs)
+		}
+
+		client := fake.NewSimpleClientset(test.objs...)
+		p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
+		p.server = test.server
+
+		server, err := p.getServerWith(test.strategy, test.address)
+
+		evaluate(t, test.name, test.expectError, err, test.expectedServer, server, "server")
+
+		os.Unsetenv(serviceEnv)
+		os.Unsetenv(nodeEnv)
+		os.Unsetenv(podIPsEnv)
+	}
+}
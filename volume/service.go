@@ -0,0 +1,215 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/wait"
+)
+
+// nfsServicePorts are the ports the NFS server's service needs: nfsd, mountd
+// and rpcbind.
+var nfsServicePorts = []v1.ServicePort{
+	{Name: "nfs", Port: 2049, Protocol: v1.ProtocolTCP},
+	{Name: "mountd", Port: 20048, Protocol: v1.ProtocolTCP},
+	{Name: "rpcbind", Port: 111, Protocol: v1.ProtocolTCP},
+	{Name: "rpcbind-udp", Port: 111, Protocol: v1.ProtocolUDP},
+}
+
+// isNFSPort returns whether the given service port is one of nfsServicePorts.
+func isNFSPort(port v1.ServicePort) bool {
+	for _, nfsPort := range nfsServicePorts {
+		if port.Port == nfsPort.Port && protocolOf(port) == nfsPort.Protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// missingPorts returns those of nfsServicePorts the given service doesn't
+// have.
+func missingPorts(service *v1.Service) []v1.ServicePort {
+	missing := []v1.ServicePort{}
+	for _, nfsPort := range nfsServicePorts {
+		found := false
+		for _, port := range service.Spec.Ports {
+			if port.Port == nfsPort.Port && protocolOf(port) == nfsPort.Protocol {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, nfsPort)
+		}
+	}
+	return missing
+}
+
+// protocolOf returns the protocol of the given service port, which defaults to
+// TCP.
+func protocolOf(port v1.ServicePort) v1.Protocol {
+	if port.Protocol == "" {
+		return v1.ProtocolTCP
+	}
+	return port.Protocol
+}
+
+// ManageService creates the service named by the service env in the namespace
+// of the namespace env, or adopts it if it exists, and points its endpoints at
+// the pod IP on the NFS ports, so that getServer finds it valid. Then it keeps
+// them that way every period until stopCh is closed. An adopted service gets
+// any NFS ports it lacks and loses its selector, since its endpoints are no
+// longer Kubernetes' to manage. The endpoint is the pod's IP of the given
+// family, or its first IP if the family is empty. Only one pod may manage a
+// given service.
+func ManageService(client kubernetes.Interface, ipFamily string, period time.Duration, stopCh <-chan struct{}) error {
+	name := os.Getenv(serviceEnv)
+	namespace := os.Getenv(namespaceEnv)
+	if name == "" || namespace == "" {
+		return fmt.Errorf("service env %s and namespace env %s must be set to manage a service", serviceEnv, namespaceEnv)
+	}
+	podIP, err := getPodIP(podIPEnv, ipFamily)
+	if err != nil {
+		return err
+	}
+	m := &serviceManager{
+		client:    client,
+		name:      name,
+		namespace: namespace,
+		podIP:     podIP,
+	}
+	if err := m.sync(); err != nil {
+		return err
+	}
+	go wait.Until(func() {
+		if err := m.sync(); err != nil {
+			glog.Errorf("Error syncing service %s/%s: %v", namespace, name, err)
+		}
+	}, period, stopCh)
+	return nil
+}
+
+type serviceManager struct {
+	client    kubernetes.Interface
+	name      string
+	namespace string
+	podIP     string
+}
+
+func (m *serviceManager) sync() error {
+	service, err := m.syncService()
+	if err != nil {
+		return err
+	}
+	return m.syncEndpoints(service)
+}
+
+// syncService creates the service or, if it exists, removes its selector and
+// adds the NFS ports it lacks.
+func (m *serviceManager) syncService() (*v1.Service, error) {
+	services := m.client.Core().Services(m.namespace)
+	service, err := services.Get(m.name)
+	if errors.IsNotFound(err) {
+		glog.Infof("Creating service %s/%s", m.namespace, m.name)
+		service = &v1.Service{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      m.name,
+				Namespace: m.namespace,
+			},
+			Spec: v1.ServiceSpec{
+				Ports: nfsServicePorts,
+			},
+		}
+		if service, err = services.Create(service); err != nil {
+			return nil, fmt.Errorf("error creating service: %v", err)
+		}
+		return service, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting service: %v", err)
+	}
+
+	updated := false
+	if len(service.Spec.Selector) != 0 {
+		glog.Infof("Adopting service %s/%s, removing its selector %v", m.namespace, m.name, service.Spec.Selector)
+		service.Spec.Selector = nil
+		updated = true
+	}
+	if missing := missingPorts(service); len(missing) != 0 {
+		glog.Infof("Adding ports %v to service %s/%s", missing, m.namespace, m.name)
+		service.Spec.Ports = append(service.Spec.Ports, missing...)
+		updated = true
+	}
+	if !updated {
+		return service, nil
+	}
+	if service, err = services.Update(service); err != nil {
+		return nil, fmt.Errorf("error updating service: %v", err)
+	}
+	return service, nil
+}
+
+// syncEndpoints makes the pod IP the only endpoint of the given service's NFS
+// ports.
+func (m *serviceManager) syncEndpoints(service *v1.Service) error {
+	subset := v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{{IP: m.podIP}},
+	}
+	for _, port := range service.Spec.Ports {
+		if isNFSPort(port) {
+			subset.Ports = append(subset.Ports, v1.EndpointPort{Name: port.Name, Port: port.Port, Protocol: protocolOf(port)})
+		}
+	}
+	subsets := []v1.EndpointSubset{subset}
+
+	endpointsClient := m.client.Core().Endpoints(m.namespace)
+	endpoints, err := endpointsClient.Get(m.name)
+	if errors.IsNotFound(err) {
+		glog.Infof("Creating endpoints %s/%s pointing at %s", m.namespace, m.name, m.podIP)
+		endpoints = &v1.Endpoints{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      m.name,
+				Namespace: m.namespace,
+			},
+			Subsets: subsets,
+		}
+		if _, err := endpointsClient.Create(endpoints); err != nil {
+			return fmt.Errorf("error creating endpoints: %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting endpoints: %v", err)
+	}
+	if reflect.DeepEqual(endpoints.Subsets, subsets) {
+		return nil
+	}
+	glog.Infof("Updating endpoints %s/%s to point at %s", m.namespace, m.name, m.podIP)
+	endpoints.Subsets = subsets
+	if _, err := endpointsClient.Update(endpoints); err != nil {
+		return fmt.Errorf("error updating endpoints: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+)
+
+func TestSyncService(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	selectorService := newServiceWithPorts("foo", "1.1.1.1", []v1.ServicePort{{Name: "nfs", Port: 2049, Protocol: v1.ProtocolTCP}, {Name: "metrics", Port: 9090, Protocol: v1.ProtocolTCP}})
+	selectorService.Spec.Selector = map[string]string{"app": "nfs-provisioner"}
+
+	tests := []struct {
+		name          string
+		objs          []runtime.Object
+		expectedPorts []v1.ServicePort
+	}{
+		{
+			name:          "no service",
+			objs:          []runtime.Object{},
+			expectedPorts: nfsServicePorts,
+		},
+		{
+			name: "service with selector and missing ports",
+			objs: []runtime.Object{
+				selectorService,
+				newEndpoints("foo", []string{"3.3.3.3"}, []endpointPort{{2049, v1.ProtocolTCP}, {9090, v1.ProtocolTCP}}),
+			},
+			expectedPorts: append([]v1.ServicePort{{Name: "nfs", Port: 2049, Protocol: v1.ProtocolTCP}, {Name: "metrics", Port: 9090, Protocol: v1.ProtocolTCP}}, nfsServicePorts[1:]...),
+		},
+		{
+			name: "valid service, stale endpoints",
+			objs: []runtime.Object{
+				newServiceWithPorts("foo", "1.1.1.1", nfsServicePorts),
+				newEndpoints("foo", []string{"3.3.3.3"}, []endpointPort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			expectedPorts: nfsServicePorts,
+		},
+	}
+	os.Setenv(podIPEnv, "2.2.2.2")
+	os.Setenv(serviceEnv, "foo")
+	os.Setenv(namespaceEnv, "default")
+	defer os.Unsetenv(podIPEnv)
+	defer os.Unsetenv(serviceEnv)
+	defer os.Unsetenv(namespaceEnv)
+	for _, test := range tests {
+		client := fake.NewSimpleClientset(test.objs...)
+		m := &serviceManager{client: client, name: "foo", namespace: "default", podIP: "2.2.2.2"}
+
+		// Syncing twice must leave the same result
+		for i := 0; i < 2; i++ {
+			if err := m.sync(); err != nil {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("unexpected error syncing service: %v", err)
+			}
+		}
+
+		service, err := client.Core().Services("default").Get("foo")
+		if err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error getting service: %v", err)
+			continue
+		}
+		if len(service.Spec.Selector) != 0 {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected no selector but got %v", service.Spec.Selector)
+		}
+		if !reflect.DeepEqual(test.expectedPorts, service.Spec.Ports) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected ports %v but got %v", test.expectedPorts, service.Spec.Ports)
+		}
+
+		// getServer must find the service valid; the fake client doesn't
+		// assign cluster IPs, so give it one
+		if service.Spec.ClusterIP == "" {
+			service.Spec.ClusterIP = "1.1.1.1"
+			client.Core().Services("default").Update(service)
+		}
+		p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
+		server, err := p.getServer()
+		evaluate(t, test.name, false, err, "1.1.1.1", server, "server")
+	}
+}
+
+func TestManageServiceWithoutEnv(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	if err := ManageService(client, "", 0, nil); err == nil {
+		t.Errorf("expected error managing service without env but got none")
+	}
+}